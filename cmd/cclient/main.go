@@ -2,9 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 
@@ -13,8 +19,41 @@ import (
 	"coinkit/util"
 )
 
+// How long we wait for a single query to the network
+const queryTimeout = 10 * time.Second
+
+// How long we wait for a transaction to clear
+const sendTimeout = time.Minute
+
+var networkName = flag.String("network", network.DefaultProfile,
+	"which network to use: mainnet, testnet, or devnet")
+
+var networkFile = flag.String("network-config", "",
+	"a JSON file with the members, threshold, and addresses of the network, which mainnet and testnet need")
+
+var peers = flag.String("peers", "",
+	"comma-separated host:port addresses of the network's servers, in order, for a network that runs across machines")
+
+// networkConfig returns the config for the network we are using.
+func networkConfig() *network.NetworkConfig {
+	profile, err := network.LookupProfile(*networkName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := profile.LoadNetwork(*networkFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *peers != "" {
+		if err := config.SetAddresses(strings.Split(*peers, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return config
+}
+
 func newClient() *network.Client {
-	config, _ := network.NewLocalNetwork()
+	config := networkConfig()
 	address := config.RandomAddress()
 	c := network.NewClient(address)
 	log.Printf("connecting to %s", address.String())
@@ -22,9 +61,14 @@ func newClient() *network.Client {
 }
 
 // Fetches, displays, and returns the status for a user.
-func status(user string) *currency.Account {
+func status(user util.PublicKey) *currency.Account {
 	client := newClient()
-	account := client.GetAccount(user)
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	account, err := client.GetAccount(ctx, user)
+	if err != nil {
+		log.Fatalf("could not get account data: %s", err)
+	}
 
 	log.Printf("account data for %s:\n%s", user, spew.Sdump(account))
 	return account
@@ -36,6 +80,15 @@ func ourStatus() {
 	status(kp.PublicKey())
 }
 
+// Parses a public key from the command line, exiting if it isn't one.
+func parsePublicKey(s string) util.PublicKey {
+	publicKey, err := util.ParsePublicKey(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return publicKey
+}
+
 // Ask the user for a passphrase to log in.
 func login() *util.KeyPair {
 	log.Printf("please enter your passphrase:")
@@ -47,52 +100,371 @@ func login() *util.KeyPair {
 	return kp
 }
 
-func send(recipient string, amountStr string) {
+func send(recipient string, amountStr string, memoStr string) {
 	amountInt, err := strconv.Atoi(amountStr)
 	if err != nil {
 		log.Fatalf("could not convert %s to a number", amountStr)
 	}
 	amount := uint64(amountInt)
+	var memo uint64
+	if memoStr != "" {
+		memo, err = strconv.ParseUint(memoStr, 10, 64)
+		if err != nil {
+			log.Fatalf("could not convert %s to a memo ID", memoStr)
+		}
+	}
 	kp := login()
 	user := kp.PublicKey()
 	client := newClient()
-	account := client.GetAccount(user)
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
 
-	log.Printf("account data for %s:\n%s", user, spew.Sdump(account))
+	// Send our transaction to the network
+	st, err := client.NewTransaction(kp).To(recipient).Amount(amount).Memo(memo).Submit(ctx)
+	if err != nil {
+		log.Fatalf("could not send the transaction: %s", err)
+	}
+	log.Printf("sending %d to %s", amount, recipient)
 
-	if account.Balance < amount {
-		log.Fatalf("cannot send %d when our account only has %d",
-			amount, account.Balance)
+	// Wait for our transaction to clear
+	if _, err := client.WaitToClear(ctx, user, st.Sequence); err != nil {
+		log.Fatalf("gave up waiting for the transaction to clear: %s", err)
 	}
+	log.Printf("transaction %d cleared", st.Sequence)
+}
 
-	seq := account.Sequence + 1
-	transaction := &currency.Transaction{
-		From:     user,
-		Sequence: seq,
-		To:       recipient,
-		Amount:   amount,
-		Fee:      0,
+// Displays how many slots have been finalized after the one that included a
+// user's transaction.
+func depth(user util.PublicKey, sequenceStr string) {
+	sequence, err := strconv.ParseUint(sequenceStr, 10, 32)
+	if err != nil {
+		log.Fatalf("could not convert %s to a sequence number", sequenceStr)
+	}
+	client := newClient()
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	d, err := client.GetDepth(ctx, user, uint32(sequence))
+	if err != nil {
+		log.Fatalf("could not get the depth: %s", err)
+	}
+	if d < 0 {
+		log.Printf("transaction %d has not been finalized", sequence)
+	} else {
+		log.Printf("transaction %d is %d slots deep", sequence, d)
 	}
+}
 
-	// Send our transaction to the network
-	st := transaction.SignWith(kp)
-	tm := currency.NewTransactionMessage(st)
-	sm := util.NewSignedMessage(kp, tm)
-	client.SendMessage(sm)
-	log.Printf("sending %d to %s", amount, recipient)
+// Displays the metadata that validators have published.
+func validators() {
+	client := newClient()
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	entries, err := client.GetValidators(ctx)
+	if err != nil {
+		log.Fatalf("could not get the validator registry: %s", err)
+	}
+	for _, s := range entries {
+		log.Printf("%s\n%s", s.Validator, spew.Sdump(s.Metadata))
+	}
+	log.Printf("%d validators have published metadata", len(entries))
+}
 
-	// Wait for our transaction to clear
-	client.WaitToClear(user, seq)
-	log.Printf("transaction %d cleared", transaction.Sequence)
+// Displays how one of the network's servers is doing, and how long its
+// recent slots took. It needs the passphrase of an admin on that server.
+func nodeStatus(serverStr string) {
+	config := networkConfig()
+	i, err := strconv.Atoi(serverStr)
+	if err != nil || i < 0 || i >= len(config.Nodes) {
+		log.Fatalf("there is no server %s", serverStr)
+	}
+	kp := login()
+	client := network.NewClient(config.Nodes[i])
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	status, err := client.GetStatus(ctx, kp)
+	if err != nil {
+		log.Fatalf("could not get the node status: %s", err)
+	}
+	log.Printf("working on slot %d", status.I)
+	if status.Metrics != nil {
+		log.Printf("consensus on %s", status.Metrics)
+	}
+	for _, s := range status.Slots {
+		log.Printf("%s", s)
+	}
+}
+
+// Pauses or resumes consensus on one of the network's servers. It needs the
+// passphrase of an admin on that server.
+func pause(serverStr string, resume bool) {
+	config := networkConfig()
+	i, err := strconv.Atoi(serverStr)
+	if err != nil || i < 0 || i >= len(config.Nodes) {
+		log.Fatalf("there is no server %s", serverStr)
+	}
+	kp := login()
+	client := network.NewClient(config.Nodes[i])
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	var status *network.StatusMessage
+	if resume {
+		status, err = client.Resume(ctx, kp)
+	} else {
+		status, err = client.Pause(ctx, kp)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if status.Paused {
+		log.Printf("server %d is paused, working on slot %d", i, status.I)
+	} else {
+		log.Printf("server %d is running, working on slot %d", i, status.I)
+	}
+}
+
+// Displays the recent metrics of one of the network's servers. It needs the
+// passphrase of an admin on that server.
+func metrics(serverStr string) {
+	config := networkConfig()
+	i, err := strconv.Atoi(serverStr)
+	if err != nil || i < 0 || i >= len(config.Nodes) {
+		log.Fatalf("there is no server %s", serverStr)
+	}
+	kp := login()
+	client := network.NewClient(config.Nodes[i])
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	samples, err := client.GetMetrics(ctx, kp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, sample := range samples {
+		log.Printf("%s", sample)
+	}
+	log.Printf("server %d has %d samples", i, len(samples))
+}
+
+// Displays the messages one of the network's servers could not decode. It
+// needs the passphrase of an admin on that server.
+func deadLetters(serverStr string) {
+	config := networkConfig()
+	i, err := strconv.Atoi(serverStr)
+	if err != nil || i < 0 || i >= len(config.Nodes) {
+		log.Fatalf("there is no server %s", serverStr)
+	}
+	kp := login()
+	client := network.NewClient(config.Nodes[i])
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	letters, total, err := client.GetDeadLetters(ctx, kp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, letter := range letters {
+		log.Printf("%s", letter)
+	}
+	log.Printf("server %d could not decode %d messages", i, total)
+}
+
+// Writes a CSV statement of a user's activity over a range of slots to
+// stdout. The history comes from the archive listening on the given port.
+func statement(user util.PublicKey, firstStr string, lastStr string, portStr string) {
+	first, err := strconv.Atoi(firstStr)
+	if err != nil {
+		log.Fatalf("could not convert %s to a slot", firstStr)
+	}
+	last, err := strconv.Atoi(lastStr)
+	if err != nil {
+		log.Fatalf("could not convert %s to a slot", lastStr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		log.Fatalf("could not convert %s to a port", portStr)
+	}
+	client := network.NewClient(&network.Address{
+		Host:    "127.0.0.1",
+		Port:    port,
+		Archive: true,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	s, err := client.GetStatement(ctx, user, first, last)
+	if err != nil {
+		log.Fatalf("could not get the statement: %s", err)
+	}
+	if err := s.WriteCSV(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Reads the non-empty lines of a file.
+func readLines(filename string) []string {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return lines
+}
+
+// Reads JSON from a file into v.
+func readJSON(filename string, v interface{}) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(bytes, v); err != nil {
+		log.Fatalf("could not parse %s: %s", filename, err)
+	}
+}
+
+// Writes v to stdout as JSON.
+func writeJSON(v interface{}) {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(bytes, '\n'))
+}
+
+// The first step of a sweep. Looks up the accounts whose public keys are in
+// keyfile, and writes unsigned transactions that move their money to the
+// cold address to stdout. This needs the network but no secrets.
+func sweepPlan(cold util.PublicKey, feeStr string, budgetStr string, keyfile string) {
+	fee, err := strconv.ParseUint(feeStr, 10, 64)
+	if err != nil {
+		log.Fatalf("could not convert %s to a fee", feeStr)
+	}
+	budget, err := strconv.ParseUint(budgetStr, 10, 64)
+	if err != nil {
+		log.Fatalf("could not convert %s to a fee budget", budgetStr)
+	}
+	client := newClient()
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	accounts := make(map[util.PublicKey]*currency.Account)
+	for _, line := range readLines(keyfile) {
+		key := parsePublicKey(line)
+		account, err := client.GetAccount(ctx, key)
+		if err != nil {
+			log.Fatalf("could not get account data for %s: %s", key, err)
+		}
+		accounts[key] = account
+	}
+	plan := currency.PlanSweep(accounts, cold, fee, budget)
+	log.Printf("sweeping %d of %d accounts", len(plan), len(accounts))
+	writeJSON(plan)
+}
+
+// The second step of a sweep. Signs the transactions in planfile with the
+// keys for the passphrases in phrasefile, and writes them to stdout.
+// This needs the secrets but no network, so it can run offline.
+func sweepSign(planfile string, phrasefile string) {
+	plan := []*currency.Transaction{}
+	readJSON(planfile, &plan)
+	keys := make(map[util.PublicKey]*util.KeyPair)
+	for _, phrase := range readLines(phrasefile) {
+		kp := util.NewKeyPairFromSecretPhrase(phrase)
+		keys[kp.PublicKey()] = kp
+	}
+	signed := []*currency.SignedTransaction{}
+	for _, t := range plan {
+		kp, ok := keys[t.Signer()]
+		if !ok {
+			log.Fatalf("no passphrase for %s", t.Signer())
+		}
+		signed = append(signed, t.SignWith(kp))
+	}
+	writeJSON(signed)
+}
+
+// The last step of a sweep. Sends the signed transactions in signedfile to
+// the network in one batch and waits for them to clear.
+func sweepSend(signedfile string) {
+	signed := []*currency.SignedTransaction{}
+	readJSON(signedfile, &signed)
+	for _, t := range signed {
+		if !t.Verify() {
+			log.Fatalf("bad signature on %s", t.Transaction)
+		}
+	}
+	client := newClient()
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	// Any key can relay transactions that are already signed
+	sm := util.NewSignedMessage(util.NewKeyPair(), currency.NewTransactionMessage(signed...))
+	response, err := client.SendMessage(ctx, sm)
+	if err != nil {
+		log.Fatalf("could not send the sweep: %s", err)
+	}
+	if response != nil {
+		if e, ok := response.Message().(*util.ErrorMessage); ok {
+			log.Fatalf("the sweep was rejected: %s", e)
+		}
+	}
+	for _, t := range signed {
+		if _, err := client.WaitToClear(ctx, t.From, t.Sequence); err != nil {
+			log.Fatalf("gave up waiting for %s to clear: %s", t.Transaction, err)
+		}
+	}
+	log.Printf("swept %d accounts", len(signed))
+}
+
+// Streams the signed transactions in signedfile to the node for bulk import,
+// signing the batches with our key, which needs admin access on the node.
+// The file has one signed transaction per line, so it never has to fit in
+// memory. Turn the output of sweep-sign into that with jq -c '.[]'.
+func importTransactions(signedfile string) {
+	file, err := os.Open(signedfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	kp := login()
+	client := newClient()
+	ctx := context.Background()
+
+	ts := make(chan *currency.SignedTransaction, network.ImportBatchSize)
+	go func() {
+		defer close(ts)
+		decoder := json.NewDecoder(bufio.NewReader(file))
+		for decoder.More() {
+			t := &currency.SignedTransaction{}
+			if err := decoder.Decode(t); err != nil {
+				log.Fatalf("could not read %s: %s", signedfile, err)
+			}
+			ts <- t
+		}
+	}()
+	sent, backlog, err := client.Import(ctx, kp, ts)
+	if err != nil {
+		log.Fatalf("import failed after %d transactions: %s", sent, err)
+	}
+	log.Printf("imported %d transactions, %d still waiting to get into a chunk",
+		sent, backlog)
 }
 
 // cclient runs a client that connects to the coinkit network.
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("Usage: cclient {send,status} ...")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		log.Fatal("Usage: cclient [--network name] [--network-config file] [--peers host:port,...] {dead-letters,depth,import,metrics,node-status,pause,resume,send,statement,status,sweep-plan,sweep-sign,sweep-send,validators} ...")
 	}
-	op := os.Args[1]
-	rest := os.Args[2:]
+	op := args[0]
+	rest := args[1:]
 	switch op {
 	case "status":
 		if len(rest) > 1 {
@@ -101,13 +473,72 @@ func main() {
 		if len(rest) == 0 {
 			ourStatus()
 		} else {
-			status(rest[0])
+			status(parsePublicKey(rest[0]))
 		}
 	case "send":
+		if len(rest) != 2 && len(rest) != 3 {
+			log.Fatal("Usage: cclient send <user> <amount> [memo]")
+		}
+		memo := ""
+		if len(rest) == 3 {
+			memo = rest[2]
+		}
+		send(rest[0], rest[1], memo)
+	case "depth":
+		if len(rest) != 2 {
+			log.Fatal("Usage: cclient depth <user> <sequence>")
+		}
+		depth(parsePublicKey(rest[0]), rest[1])
+	case "import":
+		if len(rest) != 1 {
+			log.Fatal("Usage: cclient import <signedfile>")
+		}
+		importTransactions(rest[0])
+	case "pause", "resume":
+		if len(rest) != 1 {
+			log.Fatalf("Usage: cclient %s <i>", op)
+		}
+		pause(rest[0], op == "resume")
+	case "dead-letters":
+		if len(rest) != 1 {
+			log.Fatal("Usage: cclient dead-letters <i>")
+		}
+		deadLetters(rest[0])
+	case "metrics":
+		if len(rest) != 1 {
+			log.Fatal("Usage: cclient metrics <i>")
+		}
+		metrics(rest[0])
+	case "node-status":
+		if len(rest) != 1 {
+			log.Fatal("Usage: cclient node-status <i>")
+		}
+		nodeStatus(rest[0])
+	case "statement":
+		if len(rest) != 4 {
+			log.Fatal("Usage: cclient statement <user> <first> <last> <archiveport>")
+		}
+		statement(parsePublicKey(rest[0]), rest[1], rest[2], rest[3])
+	case "sweep-plan":
+		if len(rest) != 4 {
+			log.Fatal("Usage: cclient sweep-plan <cold> <fee> <feebudget> <keyfile>")
+		}
+		sweepPlan(parsePublicKey(rest[0]), rest[1], rest[2], rest[3])
+	case "sweep-sign":
 		if len(rest) != 2 {
-			log.Fatal("Usage: cclient send <user> <amount>")
+			log.Fatal("Usage: cclient sweep-sign <planfile> <phrasefile>")
+		}
+		sweepSign(rest[0], rest[1])
+	case "sweep-send":
+		if len(rest) != 1 {
+			log.Fatal("Usage: cclient sweep-send <signedfile>")
+		}
+		sweepSend(rest[0])
+	case "validators":
+		if len(rest) != 0 {
+			log.Fatal("Usage: cclient validators")
 		}
-		send(rest[0], rest[1])
+		validators()
 	default:
 		log.Fatalf("unrecognized operation: %s", op)
 	}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"coinkit/network"
+	"coinkit/util"
+)
+
+// coinkit has utilities for operators and support that don't need a network.
+
+func usage() {
+	log.Fatal("Usage: coinkit keys inspect <publickey>\n" +
+		"   or: coinkit keys convert <publickey>\n" +
+		"   or: coinkit keys derive, which reads a passphrase from stdin\n" +
+		"   or: coinkit keys verify-sig <publickey> <message> <signature>\n" +
+		"   or: coinkit replay <journal>, to replay a journal that cserver recorded\n" +
+		"Public keys can be base64 or strkeys. A message of - is read from stdin.")
+}
+
+func parsePublicKey(s string) util.PublicKey {
+	publicKey, err := util.ParsePublicKey(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return publicKey
+}
+
+func strkey(publicKey util.PublicKey) string {
+	answer, err := util.PublicKeyToStrkey(publicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return answer
+}
+
+// Shows a public key in every form.
+func inspect(s string) {
+	publicKey := parsePublicKey(s)
+	fmt.Printf("base64: %s\n", publicKey)
+	fmt.Printf("strkey: %s\n", strkey(publicKey))
+	fmt.Printf("short:  %s\n", util.Shorten(string(publicKey)))
+}
+
+// Converts a public key from base64 to a strkey, or the other way around.
+func convert(s string) {
+	publicKey := parsePublicKey(s)
+	if string(publicKey) == s {
+		fmt.Println(strkey(publicKey))
+	} else {
+		fmt.Println(publicKey)
+	}
+}
+
+// Reads a passphrase from stdin and shows the public key for it. The
+// passphrase doesn't go on the command line, so it stays out of shell
+// history.
+func derive() {
+	log.Printf("please enter your passphrase:")
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	kp := util.NewKeyPairFromSecretPhrase(scanner.Text())
+	inspect(string(kp.PublicKey()))
+}
+
+// Checks a signature, exiting with an error if it is not valid.
+func verifySig(s string, message string, signature string) {
+	publicKey := parsePublicKey(s)
+	if message == "-" {
+		bytes, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		message = string(bytes)
+	}
+	if !util.Verify(publicKey, message, signature) {
+		log.Fatalf("the signature is not valid for %s", util.Shorten(string(publicKey)))
+	}
+	fmt.Println("the signature is valid")
+}
+
+func keys(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	op := args[0]
+	rest := args[1:]
+	switch op {
+	case "inspect":
+		if len(rest) != 1 {
+			usage()
+		}
+		inspect(rest[0])
+	case "convert":
+		if len(rest) != 1 {
+			usage()
+		}
+		convert(rest[0])
+	case "derive":
+		if len(rest) != 0 {
+			usage()
+		}
+		derive()
+	case "verify-sig":
+		if len(rest) != 3 {
+			usage()
+		}
+		verifySig(rest[0], rest[1], rest[2])
+	default:
+		log.Fatalf("unrecognized keys operation: %s", op)
+	}
+}
+
+// Replays a journal into a fresh node, showing each slot as it is finalized
+// and which journal entry finalized it.
+func replay(filename string) {
+	entries, err := network.ReadJournal(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err := network.NewReplayer(entries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 1; !r.Done(); i++ {
+		slot := r.Node.Slot()
+		entry, err := r.Step()
+		if err != nil {
+			log.Fatalf("journal entry %d: %s", i, err)
+		}
+		for ; slot < r.Node.Slot(); slot++ {
+			fmt.Printf("entry %d at %s: %s\n", i, entry.Time.Format(time.RFC3339Nano),
+				r.Node.History(slot))
+		}
+	}
+	fmt.Printf("replayed %d entries, ending on slot %d\n", len(entries), r.Node.Slot())
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "keys":
+		keys(os.Args[2:])
+	case "replay":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		replay(os.Args[2])
+	default:
+		log.Fatalf("unrecognized command: %s", os.Args[1])
+	}
+}
@@ -1,33 +1,290 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"coinkit/currency"
 	"coinkit/network"
+	"coinkit/util"
 )
 
 // cserver runs a coinkit server.
 
+var networkName = flag.String("network", network.DefaultProfile,
+	"which network to join: mainnet, testnet, or devnet")
+
+var networkFile = flag.String("network-config", "",
+	"a JSON file with the members, threshold, and addresses of the network, which mainnet and testnet need")
+
+var keyFile = flag.String("key", "",
+	"a file with this server's secret phrase, which mainnet and testnet need")
+
+var admin = flag.String("admin", "",
+	"a public key that is allowed to bulk import transactions with cclient import")
+
+var journal = flag.String("journal", "",
+	"a file to record every message and timer tick in, for replaying with coinkit replay")
+
+var metricsFile = flag.String("metrics", "",
+	"a file to keep the last day of metrics in, for cclient metrics")
+
+var verifyWorkers = flag.Int("verify-workers", currency.VerifyWorkers,
+	"how many cores check the signatures on incoming transactions at once")
+
+var bootstrap = flag.String("bootstrap", "",
+	"a host:port to ask where the other servers are, instead of using the addresses in the network config")
+
+var peers = flag.String("peers", "",
+	"comma-separated host:port addresses of the network's servers, in order, for a network that runs across machines")
+
+var bind = flag.String("bind", "",
+	"the host to listen on, like 0.0.0.0 to accept connections from other machines (default 127.0.0.1)")
+
+var advertise = flag.String("advertise", "",
+	"the host:port that other machines can reach this server at, if it isn't its address in --peers")
+
+var keyQuota = flag.String("key-quota", "",
+	"how many expensive queries each signer outside the network can make at once, and how often it gets another, like 20/1s")
+
+var ipQuota = flag.String("ip-quota", "",
+	"like --key-quota, but for each IP address")
+
+var maxMessages = flag.Float64("max-messages", 0,
+	"how many messages each connection and each signer can send per second, or 0 for no limit")
+
+var maxBytes = flag.Float64("max-bytes", 0,
+	"how many bytes each connection and each signer can send per second, or 0 for no limit")
+
+var strikes = flag.Int("strikes", 0,
+	"how many messages a sender can have dropped by --max-messages or --max-bytes before it is banned, or 0 to never ban")
+
+var banDuration = flag.Duration("ban", 10*time.Minute,
+	"how long a sender that runs out of strikes is banned for")
+
+var emptySlots = flag.Int("empty-slots", 0,
+	"how many seconds a slot can go without transactions before it is externalized empty, or 0 to wait for transactions")
+
 func usage() {
-	log.Fatal("Usage: cserver <i> where i is in [0, 1, 2, 3]")
+	log.Fatal("Usage: cserver [--network name] [--network-config file] [--key file] [--journal file] [--metrics file] [--verify-workers n] [--admin publickey] [--empty-slots seconds] [--key-quota n/interval] [--ip-quota n/interval] [--max-messages n] [--max-bytes n] [--strikes n] [--ban duration] [--bootstrap host:port] [--peers host:port,...] [--bind host] [--advertise host:port] <i> [datafile [slicefile]] where i is the server's index in the network\n" +
+		"   or: cserver [--network name] [--journal file] [--metrics file] follow <i> <port> to run a read replica of server i\n" +
+		"Relative datafiles, journals, and metrics files go in the network's data directory.\n" +
+		"Only devnet has built-in keys. Other networks need --network-config, and servers need --key.\n" +
+		"Send SIGHUP to reload the quorum slice from slicefile.")
 }
 
-func main() {
-	if len(os.Args) < 2 {
+func parseServer(s string, netConfig *network.NetworkConfig) int {
+	arg, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if arg < 0 || arg >= len(netConfig.Members) {
 		usage()
 	}
-	arg, err := strconv.Atoi(os.Args[1])
+	return arg
+}
+
+// serverConfig returns the config for server i. Local networks have keys
+// built in, and the others need --key.
+func serverConfig(profile *network.Profile, netConfig *network.NetworkConfig, i int) *network.ServerConfig {
+	if *keyFile == "" {
+		if !profile.Local {
+			log.Fatalf("%s servers need --key", profile.Name)
+		}
+		_, configs := profile.Network()
+		config := configs[i]
+		config.Network = netConfig
+		return config
+	}
+	kp, err := network.LoadKeyPair(*keyFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if arg < 0 || arg > 3 {
+	if kp.PublicKey() != netConfig.Members[i] {
+		log.Fatalf("the key in %s is not the key of server %d", *keyFile, i)
+	}
+	if netConfig.Nodes[i] == nil {
+		log.Fatalf("the network config has no address for server %d", i)
+	}
+	return &network.ServerConfig{
+		Network: netConfig,
+		Port:    netConfig.Nodes[i].Port,
+		KeyPair: kp,
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
 		usage()
 	}
+	profile, err := network.LookupProfile(*networkName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("joining %s", profile.Name)
+	currency.VerifyWorkers = *verifyWorkers
+	netConfig, err := profile.LoadNetwork(*networkFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *peers != "" {
+		if err := netConfig.SetAddresses(strings.Split(*peers, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	journalPath := ""
+	if *journal != "" {
+		journalPath, err = profile.DataPath(*journal)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	metricsPath := ""
+	if *metricsFile != "" {
+		metricsPath, err = profile.DataPath(*metricsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if args[0] == "follow" {
+		if len(args) < 3 {
+			usage()
+		}
+		leader := parseServer(args[1], netConfig)
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		config := &network.ServerConfig{
+			Network: netConfig,
+			Port:    port,
+			KeyPair: util.NewKeyPairFromSecretPhrase(fmt.Sprintf("follower %d", port)),
+			Follow:  netConfig.Nodes[leader],
+			Leader:  netConfig.Members[leader],
+			Journal: journalPath,
+
+			MetricsFile: metricsPath,
+		}
+		setLimits(config)
+		s := network.NewServer(config)
+		s.InitMint()
+		s.ServeForever()
+		return
+	}
 
-	_, configs := network.NewLocalNetwork()
-	s := network.NewServer(configs[arg])
+	i := parseServer(args[0], netConfig)
+	config := serverConfig(profile, netConfig, i)
+	if *bootstrap != "" {
+		address, err := network.ParseAddress(*bootstrap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Forget where everyone else is, and find them through the
+		// bootstrap node instead
+		limited := *netConfig
+		limited.Nodes = make([]*network.Address, len(netConfig.Nodes))
+		limited.Nodes[i] = netConfig.Nodes[i]
+		config.Network = &limited
+		config.Bootstrap = []*network.Address{address}
+	}
+	config.Bind = *bind
+	if *advertise != "" {
+		config.Advertise, err = network.ParseAddress(*advertise)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *peers != "" {
+		config.Advertise = netConfig.Nodes[i]
+	}
+	config.Journal = journalPath
+	config.MetricsFile = metricsPath
+	setLimits(config)
+	// The ballot timer ticks once a second
+	config.EmptySlotTicks = *emptySlots
+	if *admin != "" {
+		key, err := util.ParsePublicKey(*admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Everyone else can still do everything they could before
+		config.Access = &network.AccessPolicy{
+			Keys:    map[util.PublicKey]network.Scope{key: network.AllScopes | network.AdminScope},
+			Default: network.AllScopes,
+		}
+	}
+	if len(args) >= 2 {
+		config.DataFile, err = profile.DataPath(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(args) >= 3 {
+		qs, err := network.LoadQuorumSlice(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.QuorumSlice = qs
+	}
+	s := network.NewServer(config)
 	s.InitMint()
+	if len(args) >= 3 {
+		go reloadQuorumSlice(s, args[2])
+	}
 	s.ServeForever()
 }
+
+// setLimits sets the quotas and rate limits from the flags.
+func setLimits(config *network.ServerConfig) {
+	var err error
+	if *keyQuota != "" {
+		config.KeyQuota, err = network.ParseQuota(*keyQuota)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *ipQuota != "" {
+		config.IPQuota, err = network.ParseQuota(*ipQuota)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *maxMessages > 0 || *maxBytes > 0 {
+		config.RateLimit = &network.RateLimitConfig{
+			MessagesPerSecond: *maxMessages,
+			BytesPerSecond:    *maxBytes,
+			Strikes:           *strikes,
+			BanDuration:       *banDuration,
+		}
+	}
+}
+
+// reloadQuorumSlice changes the server's quorum slice to the contents of
+// slicefile whenever we get a SIGHUP. A bad slice is logged and ignored, so
+// the server keeps running with the one it has.
+func reloadQuorumSlice(s *network.Server, slicefile string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		qs, err := network.LoadQuorumSlice(slicefile)
+		if err == nil {
+			err = s.SetQuorumSlice(*qs)
+		}
+		if err != nil {
+			log.Printf("not changing the quorum slice: %s", err)
+			continue
+		}
+		log.Printf("reloaded the quorum slice from %s", slicefile)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"coinkit/network"
+	"coinkit/util"
+)
+
+// top shows how one of the network's servers is doing, and keeps the
+// display up to date by polling the server's admin queries. It needs the
+// passphrase of an admin on that server.
+
+// How long we wait for a single query to the server
+const queryTimeout = 5 * time.Second
+
+// How many recent errors we show
+const recentErrors = 5
+
+var networkName = flag.String("network", network.DefaultProfile,
+	"which network to use: mainnet, testnet, or devnet")
+
+var networkFile = flag.String("network-config", "",
+	"a JSON file with the members, threshold, and addresses of the network, which mainnet and testnet need")
+
+var peers = flag.String("peers", "",
+	"comma-separated host:port addresses of the network's servers, in order, for a network that runs across machines")
+
+var interval = flag.Duration("interval", 2*time.Second,
+	"how often to refresh the display")
+
+func usage() {
+	log.Fatal("Usage: top [--network name] [--network-config file] [--peers host:port,...] [--interval duration] <i>\n" +
+		"It reads the passphrase of an admin on server i from stdin.")
+}
+
+// networkConfig returns the config for the network we are using.
+func networkConfig() *network.NetworkConfig {
+	profile, err := network.LookupProfile(*networkName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := profile.LoadNetwork(*networkFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *peers != "" {
+		if err := config.SetAddresses(strings.Split(*peers, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return config
+}
+
+// Ask the user for a passphrase to log in.
+func login() *util.KeyPair {
+	log.Printf("please enter your passphrase:")
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	return util.NewKeyPairFromSecretPhrase(scanner.Text())
+}
+
+// A snapshot is everything we know about the server as of one poll.
+type snapshot struct {
+	time    time.Time
+	status  *network.StatusMessage
+	metrics *network.MetricsMessage
+
+	// Errors we got polling the server, oldest first
+	errors []string
+}
+
+// poll asks the server for its status and metrics. Whatever we can't get
+// is left as it was in the previous snapshot, so a server that stops
+// answering still shows what it last said.
+func poll(client *network.Client, kp *util.KeyPair, previous *snapshot) *snapshot {
+	answer := &snapshot{
+		time:    time.Now(),
+		status:  previous.status,
+		metrics: previous.metrics,
+		errors:  previous.errors,
+	}
+	fail := func(err error) {
+		line := fmt.Sprintf("%s %s", answer.time.Format("15:04:05"), err)
+		answer.errors = append(answer.errors, line)
+		if len(answer.errors) > recentErrors {
+			answer.errors = answer.errors[len(answer.errors)-recentErrors:]
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	status, err := client.GetStatus(ctx, kp)
+	if err != nil {
+		fail(err)
+	} else {
+		answer.status = status
+	}
+	metrics, err := client.GetServerMetrics(ctx, kp)
+	if err != nil {
+		fail(err)
+	} else {
+		answer.metrics = metrics
+	}
+	return answer
+}
+
+// render draws a snapshot of server i on the whole terminal.
+func render(i int, address *network.Address, snap *snapshot) string {
+	lines := []string{
+		fmt.Sprintf("server %d at %s, as of %s", i, address, snap.time.Format("15:04:05")),
+		"",
+	}
+
+	if status := snap.status; status == nil {
+		lines = append(lines, "no status yet")
+	} else {
+		state := "running"
+		if status.Paused {
+			state = "paused"
+		}
+		lines = append(lines, fmt.Sprintf("slot %d, %s, %d transactions queued",
+			status.I, state, status.Queue))
+		if m := status.Metrics; m != nil {
+			lines = append(lines, fmt.Sprintf("%s on ballot %d, %d bumps, %d messages, %.1fs in slot",
+				m.Phase, m.BallotNumber, m.BallotBumps, m.MessagesReceived,
+				m.TimeInSlot.Seconds()))
+		} else {
+			lines = append(lines, "following a leader")
+		}
+	}
+
+	if metrics := snap.metrics; metrics != nil {
+		if n := len(metrics.Samples); n > 0 {
+			sample := metrics.Samples[n-1]
+			lines = append(lines, fmt.Sprintf("%.1f tps, %.1fs per slot, as of %s",
+				sample.TPS, sample.SlotTime.Seconds(), sample.Time.Format("15:04:05")))
+		}
+
+		lines = append(lines, "", fmt.Sprintf("%d peers:", len(metrics.Peers)))
+		lines = append(lines, fmt.Sprintf("  %-10s %-5s %-10s %8s %7s %8s %7s %4s",
+			"peer", "link", "for", "failures", "version", "slot", "dropped", "bans"))
+		for _, p := range metrics.Peers {
+			state, since := "down", "-"
+			if p.Connected {
+				state = "up"
+			}
+			if !p.Since.IsZero() {
+				since = snap.time.Sub(p.Since).Round(time.Second).String()
+			}
+			lines = append(lines, fmt.Sprintf("  %-10s %-5s %-10s %8d %7d %8d %7d %4d",
+				util.Shorten(string(p.PublicKey)), state, since, p.Failures,
+				p.Version, p.Slot, p.Dropped, p.Bans))
+		}
+
+		lines = append(lines, "", fmt.Sprintf("%d messages could not be decoded", metrics.Undecodable))
+		letters := metrics.DeadLetters
+		if len(letters) > recentErrors {
+			letters = letters[len(letters)-recentErrors:]
+		}
+		for _, letter := range letters {
+			lines = append(lines, "  "+letter.String())
+		}
+	}
+
+	if len(snap.errors) > 0 {
+		lines = append(lines, "", "errors polling the server:")
+		for _, e := range snap.errors {
+			lines = append(lines, "  "+e)
+		}
+	}
+
+	// Clear the screen and start from the top left
+	return "\033[H\033[2J" + strings.Join(lines, "\n") + "\n"
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 {
+		usage()
+	}
+	config := networkConfig()
+	i, err := strconv.Atoi(args[0])
+	if err != nil || i < 0 || i >= len(config.Nodes) {
+		log.Fatalf("there is no server %s", args[0])
+	}
+	kp := login()
+	client := network.NewClient(config.Nodes[i])
+	defer client.Close()
+
+	snap := &snapshot{}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		snap = poll(client, kp, snap)
+		fmt.Print(render(i, config.Nodes[i], snap))
+		<-ticker.C
+	}
+}
@@ -0,0 +1,489 @@
+package consensus
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"coinkit/util"
+)
+
+// A delivery is one message on its way from one node to another.
+type delivery struct {
+	sender  util.PublicKey
+	target  util.PublicKey
+	message util.Message
+}
+
+// A Strategy is one way for an adversary to interfere with messages.
+// Each delivery goes through every strategy in turn. A strategy returns the
+// deliveries that should continue on, which may be none, or may include
+// ones it held back earlier.
+type Strategy interface {
+	Apply(r *rand.Rand, d *delivery) []*delivery
+}
+
+// Drop loses messages.
+type Drop struct {
+	Chance float64
+}
+
+func (s *Drop) Apply(r *rand.Rand, d *delivery) []*delivery {
+	if r.Float64() < s.Chance {
+		return nil
+	}
+	return []*delivery{d}
+}
+
+// Duplicate delivers messages twice.
+type Duplicate struct {
+	Chance float64
+}
+
+func (s *Duplicate) Apply(r *rand.Rand, d *delivery) []*delivery {
+	if r.Float64() < s.Chance {
+		copy := &delivery{
+			sender:  d.sender,
+			target:  d.target,
+			message: util.EncodeThenDecode(d.message),
+		}
+		return []*delivery{d, copy}
+	}
+	return []*delivery{d}
+}
+
+// Delay holds messages back, and lets them through later alongside other
+// messages, so that they arrive out of date.
+type Delay struct {
+	Chance float64
+	held   []*delivery
+}
+
+func (s *Delay) Apply(r *rand.Rand, d *delivery) []*delivery {
+	answer := []*delivery{}
+	if len(s.held) > 0 && r.Float64() < s.Chance {
+		i := r.Intn(len(s.held))
+		answer = append(answer, s.held[i])
+		s.held = append(s.held[:i], s.held[i+1:]...)
+	}
+	if r.Float64() < s.Chance {
+		s.held = append(s.held, d)
+	} else {
+		answer = append(answer, d)
+	}
+	return answer
+}
+
+// Reorder buffers up to Window messages and lets them through in a random
+// order.
+type Reorder struct {
+	Window int
+	buffer []*delivery
+}
+
+func (s *Reorder) Apply(r *rand.Rand, d *delivery) []*delivery {
+	s.buffer = append(s.buffer, d)
+	if len(s.buffer) <= s.Window {
+		return nil
+	}
+	i := r.Intn(len(s.buffer))
+	answer := s.buffer[i]
+	s.buffer = append(s.buffer[:i], s.buffer[i+1:]...)
+	return []*delivery{answer}
+}
+
+// Partition drops every message between nodes on different sides, until it
+// heals.
+type Partition struct {
+	// The nodes on one side. Everyone else is on the other side
+	Side   map[util.PublicKey]bool
+	Healed bool
+}
+
+func (s *Partition) Apply(r *rand.Rand, d *delivery) []*delivery {
+	if !s.Healed && s.Side[d.sender] != s.Side[d.target] {
+		return nil
+	}
+	return []*delivery{d}
+}
+
+// A Mutator rewrites a message. It returns nil if it doesn't know how to mess
+// with this sort of message.
+type Mutator func(r *rand.Rand, m util.Message) util.Message
+
+// Mutate rewrites messages sent by the nodes in From. Each target gets its
+// own mutation, so the sender can tell different nodes different things.
+type Mutate struct {
+	Chance   float64
+	From     map[util.PublicKey]bool
+	Mutators []Mutator
+}
+
+func (s *Mutate) Apply(r *rand.Rand, d *delivery) []*delivery {
+	if s.From[d.sender] && r.Float64() < s.Chance {
+		mutator := s.Mutators[r.Intn(len(s.Mutators))]
+		if m := mutator(r, d.message); m != nil {
+			d.message = m
+		}
+	}
+	return []*delivery{d}
+}
+
+// The value that lying nodes try to get externalized
+const evilValue = SlotValue("evil")
+
+// forgeValue swaps whatever values a message is about for evilValue.
+func forgeValue(r *rand.Rand, message util.Message) util.Message {
+	switch m := message.(type) {
+	case *NominationMessage:
+		m.Nom = []SlotValue{evilValue}
+		m.Acc = []SlotValue{evilValue}
+	case *PrepareMessage:
+		m.Bx = evilValue
+		if m.Pn > 0 {
+			m.Px = evilValue
+		}
+		if m.Ppx == evilValue {
+			m.Ppn = 0
+			m.Ppx = ""
+		}
+	case *ConfirmMessage:
+		m.X = evilValue
+	case *ExternalizeMessage:
+		m.X = evilValue
+	default:
+		return nil
+	}
+	return message
+}
+
+// inflateBallots claims to be further along in balloting than it is.
+func inflateBallots(r *rand.Rand, message util.Message) util.Message {
+	k := 1 + r.Intn(10)
+	switch m := message.(type) {
+	case *PrepareMessage:
+		m.Bn += k
+		if m.Pn > 0 {
+			m.Pn += k
+		}
+		if m.Hn > 0 {
+			m.Hn += k
+		}
+	case *ConfirmMessage:
+		m.Pn += k
+		m.Hn += k
+	case *ExternalizeMessage:
+		m.Hn += k
+	default:
+		return nil
+	}
+	return message
+}
+
+// maxRange claims a range of ballots large enough to keep a node busy
+// forever, if it tried to handle them one at a time.
+func maxRange(r *rand.Rand, message util.Message) util.Message {
+	switch m := message.(type) {
+	case *PrepareMessage:
+		m.Hn = math.MaxInt32
+	case *ConfirmMessage:
+		m.Hn = math.MaxInt32
+	default:
+		return nil
+	}
+	return message
+}
+
+// skipAhead turns a prepare into a claim that its ballot was externalized.
+func skipAhead(r *rand.Rand, message util.Message) util.Message {
+	m, ok := message.(*PrepareMessage)
+	if !ok {
+		return nil
+	}
+	return &ExternalizeMessage{
+		I:  m.I,
+		X:  m.Bx,
+		Cn: m.Bn,
+		Hn: m.Bn,
+		D:  m.D,
+	}
+}
+
+var allMutators = []Mutator{forgeValue, inflateBallots, maxRange, skipAhead}
+
+// An adversarialNetwork runs a cluster of chains while its strategies
+// interfere with every message. The byzantine nodes run the normal code,
+// but the strategies are free to rewrite what they send.
+type adversarialNetwork struct {
+	chains     []*Chain
+	byzantine  map[util.PublicKey]bool
+	strategies []Strategy
+	rand       *rand.Rand
+}
+
+func (n *adversarialNetwork) chain(name util.PublicKey) *Chain {
+	for _, chain := range n.chains {
+		if chain.publicKey == name {
+			return chain
+		}
+	}
+	return nil
+}
+
+func (n *adversarialNetwork) honest() []*Chain {
+	answer := []*Chain{}
+	for _, chain := range n.chains {
+		if !n.byzantine[chain.publicKey] {
+			answer = append(answer, chain)
+		}
+	}
+	return answer
+}
+
+// apply runs a delivery through the strategies starting at the ith one.
+func (n *adversarialNetwork) apply(i int, d *delivery) []*delivery {
+	if i == len(n.strategies) {
+		return []*delivery{d}
+	}
+	answer := []*delivery{}
+	for _, next := range n.strategies[i].Apply(n.rand, d) {
+		answer = append(answer, n.apply(i+1, next)...)
+	}
+	return answer
+}
+
+// deliver hands a message to its target, and sends any response back
+// through the adversary as well. Strategies can let held messages through
+// along with a response, so responses to those are dropped rather than
+// bouncing around forever.
+func (n *adversarialNetwork) deliver(d *delivery, depth int) {
+	response := n.chain(d.target).Handle(d.sender, d.message)
+	if response == nil || depth > 0 {
+		return
+	}
+	back := &delivery{
+		sender:  d.target,
+		target:  d.sender,
+		message: util.EncodeThenDecode(response),
+	}
+	for _, r := range n.apply(0, back) {
+		n.deliver(r, depth+1)
+	}
+}
+
+// send sends everything source has to say to target.
+func (n *adversarialNetwork) send(source *Chain, target *Chain) {
+	if source == target {
+		return
+	}
+	for _, message := range source.OutgoingMessages() {
+		d := &delivery{
+			sender:  source.publicKey,
+			target:  target.publicKey,
+			message: util.EncodeThenDecode(message),
+		}
+		for _, r := range n.apply(0, d) {
+			n.deliver(r, 0)
+		}
+	}
+}
+
+// checkSafety fails if two honest chains externalized different values for
+// the same slot.
+func (n *adversarialNetwork) checkSafety(seed int64, t *testing.T) {
+	honest := n.honest()
+	for slot := 1; ; slot++ {
+		var value SlotValue
+		var first *Chain
+		for _, chain := range honest {
+			e := chain.Externalized(slot)
+			if e == nil {
+				continue
+			}
+			if first == nil {
+				first, value = chain, e.X
+				continue
+			}
+			if e.X != value {
+				LogChains(n.chains)
+				t.Fatalf("with seed %d, %s externalized %s but %s externalized %s for slot %d",
+					seed, first.publicKey, value, chain.publicKey, e.X, slot)
+			}
+		}
+		if first == nil {
+			return
+		}
+	}
+}
+
+// step sends messages between a random pair of chains. Every so often, it
+// is also a timer tick.
+func (n *adversarialNetwork) step(i int) {
+	j := n.rand.Intn(len(n.chains))
+	k := n.rand.Intn(len(n.chains))
+	n.send(n.chains[j], n.chains[k])
+	if i%len(n.chains) == 0 {
+		for _, chain := range n.chains {
+			chain.HandleTimerTick()
+		}
+	}
+}
+
+// run simulates the network until the honest chains externalize limit
+// blocks or it runs out of steps, checking safety along the way.
+// It returns how many blocks all of the honest chains externalized.
+func (n *adversarialNetwork) run(seed int64, limit int, t *testing.T) int {
+	honest := n.honest()
+	for i := 1; i <= 10000; i++ {
+		n.step(i)
+		if i%100 == 0 {
+			n.checkSafety(seed, t)
+		}
+		if progress(honest) >= limit {
+			break
+		}
+	}
+	n.checkSafety(seed, t)
+	return progress(honest)
+}
+
+// adversarialCluster makes a cluster of chains where the first numByzantine
+// of them are byzantine.
+func adversarialCluster(seed int64, size int, numByzantine int,
+	strategies func(byzantine map[util.PublicKey]bool) []Strategy) *adversarialNetwork {
+	chains := chainCluster(size)
+	byzantine := make(map[util.PublicKey]bool)
+	for i := 0; i < numByzantine; i++ {
+		byzantine[chains[i].publicKey] = true
+	}
+	return &adversarialNetwork{
+		chains:     chains,
+		byzantine:  byzantine,
+		strategies: strategies(byzantine),
+		rand:       rand.New(rand.NewSource(seed ^ 8273648263)),
+	}
+}
+
+// Messages that get lost, repeated, and shuffled around should not stop
+// four honest nodes from agreeing
+func TestAdversarialNetwork(t *testing.T) {
+	var i int64
+	for i = 0; i < util.GetTestLoopLength(10, 2000); i++ {
+		n := adversarialCluster(i, 4, 0, func(byzantine map[util.PublicKey]bool) []Strategy {
+			return []Strategy{
+				&Drop{Chance: 0.1},
+				&Duplicate{Chance: 0.1},
+				&Delay{Chance: 0.2},
+				&Reorder{Window: 5},
+			}
+		})
+		if p := n.run(i, 5, t); p < 5 {
+			LogChains(n.chains)
+			t.Fatalf("with seed %d, we only externalized %d blocks", i, p)
+		}
+	}
+}
+
+// One lying node out of four should not be able to stop the others from
+// agreeing
+func TestOneByzantineNode(t *testing.T) {
+	StrictBallots = false
+	defer func() { StrictBallots = true }()
+
+	var i int64
+	for i = 0; i < util.GetTestLoopLength(10, 2000); i++ {
+		n := adversarialCluster(i, 4, 1, func(byzantine map[util.PublicKey]bool) []Strategy {
+			return []Strategy{
+				&Mutate{Chance: 0.5, From: byzantine, Mutators: allMutators},
+				&Duplicate{Chance: 0.1},
+				&Delay{Chance: 0.1},
+			}
+		})
+		if p := n.run(i, 5, t); p < 5 {
+			LogChains(n.chains)
+			t.Fatalf("with seed %d, we only externalized %d blocks", i, p)
+		}
+	}
+}
+
+// Seven nodes can survive two liars, even when the network is unreliable too
+func TestTwoByzantineNodes(t *testing.T) {
+	StrictBallots = false
+	defer func() { StrictBallots = true }()
+
+	var i int64
+	for i = 0; i < util.GetTestLoopLength(10, 2000); i++ {
+		n := adversarialCluster(i, 7, 2, func(byzantine map[util.PublicKey]bool) []Strategy {
+			return []Strategy{
+				&Mutate{Chance: 0.5, From: byzantine, Mutators: allMutators},
+				&Drop{Chance: 0.1},
+				&Duplicate{Chance: 0.1},
+				&Reorder{Window: 3},
+			}
+		})
+		if p := n.run(i, 5, t); p < 5 {
+			LogChains(n.chains)
+			t.Fatalf("with seed %d, we only externalized %d blocks", i, p)
+		}
+	}
+}
+
+// round has every chain send to every other chain, and then ticks the timers.
+func (n *adversarialNetwork) round() {
+	for _, source := range n.chains {
+		for _, target := range n.chains {
+			n.send(source, target)
+		}
+	}
+	for _, chain := range n.chains {
+		chain.HandleTimerTick()
+	}
+}
+
+// When a partition heals, every chain should notice that it needs to resync,
+// and the cluster should get going again
+func TestResyncAfterPartition(t *testing.T) {
+	partition := &Partition{Healed: true}
+	n := adversarialCluster(0, 4, 0, func(byzantine map[util.PublicKey]bool) []Strategy {
+		return []Strategy{partition}
+	})
+	partition.Side = map[util.PublicKey]bool{
+		n.chains[0].publicKey: true,
+		n.chains[1].publicKey: true,
+	}
+
+	for i := 0; i < 3; i++ {
+		n.round()
+	}
+	partition.Healed = false
+	before := progress(n.chains)
+	for i := 0; i < 2*PartitionTicks; i++ {
+		n.round()
+	}
+	if progress(n.chains) != before {
+		t.Fatal("neither side should make progress during the partition")
+	}
+	for _, chain := range n.chains {
+		if chain.Resync() {
+			t.Fatalf("%s resynced during the partition", chain.publicKey)
+		}
+	}
+
+	partition.Healed = true
+	for i := 0; i < 100 && progress(n.chains) < before+3; i++ {
+		n.round()
+	}
+	n.checkSafety(0, t)
+	if progress(n.chains) < before+3 {
+		LogChains(n.chains)
+		t.Fatal("the cluster never recovered from the partition")
+	}
+	for _, chain := range n.chains {
+		if !chain.Resync() {
+			t.Fatalf("%s never noticed the partition heal", chain.publicKey)
+		}
+		if chain.Resync() {
+			t.Fatal("Resync should reset once it is called")
+		}
+	}
+}
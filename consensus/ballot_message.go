@@ -44,11 +44,19 @@ type BallotMessage interface {
 	// provides information for.
 	RelevantRange(x SlotValue) (int, int)
 
+	// Boundaries returns the ends of the ranges of ballot numbers where the
+	// predicates above hold for x. Between two boundaries, each predicate
+	// gives the same answer for every ballot number.
+	Boundaries(x SlotValue) []int
+
 	// Returns the highest ballot number that this message says anything about.
 	MaxN() int
 
 	// A readable, relatively-short string good for putting in logs.
 	String() string
+
+	// Validate returns an error if the message contradicts itself
+	Validate() error
 }
 
 // Ballot phases
@@ -161,6 +169,28 @@ func (m *PrepareMessage) QuorumSlice() QuorumSlice {
 	return m.D
 }
 
+func (m *PrepareMessage) Validate() error {
+	if m.I < 1 {
+		return invalidf("slot %d", m.I)
+	}
+	if m.Bn < 1 || m.Bx == "" {
+		return invalidf("no ballot")
+	}
+	if m.Pn < 0 || m.Ppn < 0 {
+		return invalidf("negative ballot number")
+	}
+	if (m.Pn > 0) != (m.Px != "") || (m.Ppn > 0) != (m.Ppx != "") {
+		return invalidf("p and p prime need both a number and a value")
+	}
+	if m.Ppn > m.Pn {
+		return invalidf("p prime is above p")
+	}
+	if m.Ppn > 0 && m.Ppx == m.Px {
+		return invalidf("p and p prime are compatible")
+	}
+	return validateRange(m.Cn, m.Hn)
+}
+
 func (m *PrepareMessage) Phase() Phase {
 	return Prepare
 }
@@ -221,6 +251,23 @@ func (m *PrepareMessage) RelevantRange(x SlotValue) (int, int) {
 	return min, max
 }
 
+func (m *PrepareMessage) Boundaries(x SlotValue) []int {
+	answer := []int{}
+	if x == m.Bx {
+		answer = append(answer, m.Bn)
+		if m.Cn != 0 {
+			answer = append(answer, m.Cn, m.Hn)
+		}
+	}
+	if x == m.Px {
+		answer = append(answer, m.Pn)
+	}
+	if x == m.Ppx {
+		answer = append(answer, m.Ppn)
+	}
+	return answer
+}
+
 func (m *PrepareMessage) MaxN() int {
 	ns := []int{m.Bn, m.Cn, m.Hn, m.Pn, m.Ppn}
 	sort.Ints(ns)
@@ -268,6 +315,22 @@ func (m *ConfirmMessage) QuorumSlice() QuorumSlice {
 	return m.D
 }
 
+func (m *ConfirmMessage) Validate() error {
+	if m.I < 1 {
+		return invalidf("slot %d", m.I)
+	}
+	if m.X == "" {
+		return invalidf("no value")
+	}
+	if m.Pn < 0 {
+		return invalidf("negative ballot number")
+	}
+	if m.Hn < 1 {
+		return invalidf("no accepted commit")
+	}
+	return validateRange(m.Cn, m.Hn)
+}
+
 func (m *ConfirmMessage) Phase() Phase {
 	return Confirm
 }
@@ -303,6 +366,13 @@ func (m *ConfirmMessage) RelevantRange(x SlotValue) (int, int) {
 	return 0, 0
 }
 
+func (m *ConfirmMessage) Boundaries(x SlotValue) []int {
+	if x == m.X {
+		return []int{m.Cn, m.Hn}
+	}
+	return nil
+}
+
 func (m *ConfirmMessage) MaxN() int {
 	ns := []int{m.Pn, m.Cn, m.Hn}
 	sort.Ints(ns)
@@ -342,6 +412,19 @@ func (m *ExternalizeMessage) QuorumSlice() QuorumSlice {
 	return m.D
 }
 
+func (m *ExternalizeMessage) Validate() error {
+	if m.I < 1 {
+		return invalidf("slot %d", m.I)
+	}
+	if m.X == "" {
+		return invalidf("no value")
+	}
+	if m.Hn < 1 {
+		return invalidf("no confirmed commit")
+	}
+	return validateRange(m.Cn, m.Hn)
+}
+
 func (m *ExternalizeMessage) Phase() Phase {
 	return Externalize
 }
@@ -377,6 +460,13 @@ func (m *ExternalizeMessage) RelevantRange(x SlotValue) (int, int) {
 	return 0, 0
 }
 
+func (m *ExternalizeMessage) Boundaries(x SlotValue) []int {
+	if x == m.X {
+		return []int{m.Cn}
+	}
+	return nil
+}
+
 func (m *ExternalizeMessage) MaxN() int {
 	return m.Hn
 }
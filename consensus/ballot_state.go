@@ -1,11 +1,19 @@
 package consensus
 
 import (
-	"coinkit/util"
+	"fmt"
 	"log"
+	"math"
 	"sort"
+
+	"coinkit/util"
 )
 
+// StrictBallots makes a broken invariant crash the node, rather than
+// quarantining the message that caused it. Tests turn this on so that bugs
+// don't go unnoticed.
+var StrictBallots = false
+
 // The ballot state for the Stellar Consensus Protocol.
 // See page 23 of
 // https://www.stellar.org/papers/stellar-consensus-protocol.pdf
@@ -51,14 +59,23 @@ type BallotState struct {
 
 	// The latest PrepareMessage, ConfirmMessage, or ExternalizeMessage from
 	// each peer
-	M map[string]BallotMessage
+	M map[util.PublicKey]BallotMessage
+
+	// The ballot timer, in ticks. When it runs out, we go to the next ballot.
+	// It is armed for ballot timerN once a quorum has reached that ballot,
+	// and it is zero when it is not armed.
+	timer  int
+	timerN int
+
+	// How many times we have moved on from a ballot to a higher one
+	bumps int
 
-	// How many duplicate messages we received from each peer
-	// Used like a timer to guess when we should advance rounds
-	stale map[string]int
+	// The first broken invariant we ran into while handling the current
+	// message, if any
+	err error
 
 	// Who we are
-	publicKey string
+	publicKey util.PublicKey
 
 	// Who we listen to for quorum
 	D QuorumSlice
@@ -67,12 +84,11 @@ type BallotState struct {
 	nState *NominationState
 }
 
-func NewBallotState(publicKey string, qs QuorumSlice, nState *NominationState) *BallotState {
+func NewBallotState(publicKey util.PublicKey, qs QuorumSlice, nState *NominationState) *BallotState {
 	return &BallotState{
 		phase:     Prepare,
-		M:         make(map[string]BallotMessage),
+		M:         make(map[util.PublicKey]BallotMessage),
 		publicKey: publicKey,
-	    stale:     make(map[string]int),
 		D:         qs,
 		nState:    nState,
 	}
@@ -103,11 +119,11 @@ func (s *BallotState) Show() {
 	}
 }
 
-func (s *BallotState) PublicKey() string {
+func (s *BallotState) PublicKey() util.PublicKey {
 	return s.publicKey
 }
 
-func (s *BallotState) QuorumSlice(node string) (*QuorumSlice, bool) {
+func (s *BallotState) QuorumSlice(node util.PublicKey) (*QuorumSlice, bool) {
 	if node == s.publicKey {
 		return &s.D, true
 	}
@@ -145,8 +161,8 @@ func (s *BallotState) MaybeAcceptAsPrepared(n int, x SlotValue) bool {
 	// The rules for accepting are, if a quorum has voted or accepted,
 	// we can accept.
 	// Or, if a local blocking set has accepted, we can accept.
-	votedOrAccepted := []string{}
-	accepted := []string{}
+	votedOrAccepted := []util.PublicKey{}
+	accepted := []util.PublicKey{}
 	if s.b != nil && s.b.n >= n && s.b.x == x {
 		// We have voted for this
 		votedOrAccepted = append(votedOrAccepted, s.publicKey)
@@ -180,7 +196,8 @@ func (s *BallotState) MaybeAcceptAsPrepared(n int, x SlotValue) bool {
 		s.p = ballot
 	} else if s.p.x == x {
 		if n <= s.p.n {
-			log.Fatal("should have short circuited already")
+			s.fail("should have short circuited already")
+			return false
 		}
 		s.p = ballot
 	} else if n >= s.p.n {
@@ -252,7 +269,7 @@ func (s *BallotState) MaybeConfirmAsPrepared(n int, x SlotValue) bool {
 	}
 
 	// We confirm when a quorum accepts as prepared
-	accepted := []string{}
+	accepted := []util.PublicKey{}
 	if gtecompat(s.p, ballot) || gtecompat(s.pPrime, ballot) {
 		// We accept as prepared
 		accepted = append(accepted, s.publicKey)
@@ -282,8 +299,8 @@ func (s *BallotState) MaybeConfirmAsPrepared(n int, x SlotValue) bool {
 	}
 
 	if s.cn > 0 && x != s.b.x {
-		s.Show()
-		log.Fatalf("we are voting to commit but must confirm a contradiction")
+		s.fail("we are voting to commit but must confirm a contradiction")
+		return false
 	}
 
 	// This value is now our default for future rounds
@@ -320,8 +337,8 @@ func (s *BallotState) MaybeAcceptAsCommitted(n int, x SlotValue) bool {
 		return false
 	}
 
-	votedOrAccepted := []string{}
-	accepted := []string{}
+	votedOrAccepted := []util.PublicKey{}
+	accepted := []util.PublicKey{}
 
 	if s.phase == Prepare && s.b != nil &&
 		s.b.x == x && s.cn != 0 && s.cn <= n && n <= s.hn {
@@ -377,7 +394,7 @@ func (s *BallotState) MaybeConfirmAsCommitted(n int, x SlotValue) bool {
 		return false
 	}
 
-	accepted := []string{}
+	accepted := []util.PublicKey{}
 	if s.phase == Confirm {
 		if s.cn <= n && n <= s.hn {
 			accepted = append(accepted, s.publicKey)
@@ -426,16 +443,16 @@ func (s *BallotState) GoToNextBallot() bool {
 		b.n = s.b.n + 1
 	}
 	
-	if s.z != nil {
-		b.x = *s.z
-	} else {
-		if !s.nState.HasNomination() {
-			// We don't have a candidate value so we can't go to the next ballot
-			return false
-		}
-		b.x = s.nState.PredictValue()
+	x, ok := s.nextValue()
+	if !ok {
+		// We don't have a candidate value so we can't go to the next ballot
+		return false
 	}
+	b.x = x
 	
+	if s.b != nil {
+		s.bumps++
+	}
 	s.b = b
 	if s.cn == 0 && s.hn >= s.b.n && !s.AcceptedAbort(s.hn, s.b.x) {
 		// With the new ballot, we can immediately vote to commit
@@ -445,6 +462,18 @@ func (s *BallotState) GoToNextBallot() bool {
 	return true
 }
 
+// nextValue returns the value we would use for our next ballot, if we have
+// a candidate value at all.
+func (s *BallotState) nextValue() (SlotValue, bool) {
+	if s.z != nil {
+		return *s.z, true
+	}
+	if !s.nState.HasNomination() {
+		return "", false
+	}
+	return s.nState.PredictValue(), true
+}
+
 // CheckForBlockedBallot returns whether we ended up changing the state.
 // We bump the ballot number if the set of nodes that could never vote
 // for our ballot is blocking, and we have a candidate value.
@@ -452,64 +481,84 @@ func (s *BallotState) CheckForBlockedBallot() bool {
 	if s.b == nil {
 		return false
 	}
+	next, ok := s.nextValue()
+	if !ok {
+		return false
+	}
 
 	// Nodes that could never vote for our ballot
-	blockers := []string{}
+	blockers := []util.PublicKey{}
+
+	// Nodes that could never vote for the value of our next ballot, no
+	// matter how high its number is
+	stuck := []util.PublicKey{}
 
 	for node, m := range s.M {
 		if !m.CouldEverVoteFor(s.b.n, s.b.x) {
 			blockers = append(blockers, node)
 		}
+		if !m.CouldEverVoteFor(math.MaxInt32, next) {
+			stuck = append(stuck, node)
+		}
 	}
 
 	if !s.D.BlockedBy(blockers) {
 		return false
 	}
 
-	return s.GoToNextBallot()
-}
-
-// HandleStaleQuorum returns whether we ended up changing the ballot state.
-// The assumption is that the system is stuck on some ballot, and we should
-// proceed to the next ballot if this could be the stuck one.
-// TODO: could we just use CheckForBlockedBallot here?
-func (s *BallotState) HandleStaleQuorum() bool {
-	if s.b == nil {
+	if s.D.BlockedBy(stuck) {
+		// Going to the next ballot wouldn't unblock us, so it would just
+		// keep going forever
 		return false
 	}
 
-	// Nodes that are behind us in balloting
-	behind := []string{}
+	return s.GoToNextBallot()
+}
+
+// BallotTimeout returns how many ticks we wait on ballot n before giving up
+// on it. Like the SCP paper suggests, the timeout grows with the ballot
+// number, so that eventually it is long enough for the network to converge.
+func BallotTimeout(n int) int {
+	return n
+}
 
+// maybeArmTimer starts the ballot timer once a quorum, including us, has
+// reached our current ballot. Until then, going to a higher ballot would not
+// help anything.
+func (s *BallotState) maybeArmTimer() {
+	if s.b == nil || s.timerN == s.b.n {
+		return
+	}
+	s.timer = 0
+	caughtUp := []util.PublicKey{s.publicKey}
 	for node, m := range s.M {
-		if m.BallotNumber() < s.b.n {
-			behind = append(behind, node)
+		if m.BallotNumber() >= s.b.n {
+			caughtUp = append(caughtUp, node)
 		}
 	}
-
-	if s.D.BlockedBy(behind) {
-		// Our ballot is blocked because other nodes are behind it.
-		// We should wait for them to catch up rather than advancing further.
-		return false
+	if MeetsQuorum(s, caughtUp) {
+		s.timer = BallotTimeout(s.b.n)
+		s.timerN = s.b.n
 	}
-
-	return s.GoToNextBallot()
 }
 
-// CheckIfStale is a heuristic to guess whether the network is blocked.
-// We do rely on this heuristic being neither too aggressive nor too conservative
-// for values to converge.
-func (s *BallotState) CheckIfStale() {
-	stale := []string{s.publicKey}
-	for node, staleCount := range s.stale {
-		if staleCount >= 3 {
-			stale = append(stale, node)
-		}
+// HandleTimerTick should be called at regular intervals. It returns whether
+// the ballot timer fired, which moves us on to the next ballot.
+func (s *BallotState) HandleTimerTick() bool {
+	s.maybeArmTimer()
+	if s.timer == 0 {
+		return false
 	}
-	if MeetsQuorum(s, stale) {
-		s.stale = make(map[string]int)
- 		s.HandleStaleQuorum()
+	s.timer--
+	if s.timer > 0 {
+		return false
+	}
+	if !s.GoToNextBallot() {
+		// We have no candidate value yet, so try again on the next tick
+		s.timer = 1
+		return false
 	}
+	return true
 }
 
 // Update the stage of this ballot as needed
@@ -538,7 +587,7 @@ func (s *BallotState) RelevantRange(x SlotValue) (int, int) {
 
 // Returns the max ballot number that a blocking set of nodes are talking about.
 func (s *BallotState) MaxActionableBallotNumber() int {
-	numberToNodes := make(map[int][]string)
+	numberToNodes := make(map[int][]util.PublicKey)
 
 	for node, message := range s.M {
 		maxN := message.MaxN()
@@ -554,7 +603,7 @@ func (s *BallotState) MaxActionableBallotNumber() int {
 
 	sort.Sort(sort.Reverse(sort.IntSlice(nKeys)))
 
-	nodesAbove := []string{}
+	nodesAbove := []util.PublicKey{}
 
 	for _, n := range nKeys {
 		nodesAbove = append(nodesAbove, numberToNodes[n]...)
@@ -567,6 +616,11 @@ func (s *BallotState) MaxActionableBallotNumber() int {
 }
 
 // InvestigateValue checks if any information can be updated for this value.
+// Any ballot number in the relevant range might have news, but between the
+// boundaries of what we and our peers say about the value, every ballot
+// number looks the same. So we only investigate the ballot numbers at the
+// edges of each stretch, which takes the same time no matter how many
+// ballots a message covers.
 func (s *BallotState) InvestigateValue(x SlotValue) {
 	min, max := s.RelevantRange(x)
 	maxActionable := s.MaxActionableBallotNumber()
@@ -574,16 +628,75 @@ func (s *BallotState) InvestigateValue(x SlotValue) {
 		max = maxActionable
 	}
 
-	i := min
-	for ; i <= max; i++ {
-		s.InvestigateBallot(i, x)
+	for _, n := range s.investigationPoints(x, min, max) {
+		s.InvestigateBallot(n, x)
 	}
 
-	if s.b != nil && i <= s.b.n {
+	next := max + 1
+	if min > max {
+		next = min
+	}
+	if s.b != nil && next <= s.b.n {
 		s.InvestigateBallot(s.b.n, x)
 	}
 }
 
+// investigationPoints returns, in order, the ballot numbers from min to max
+// that InvestigateValue needs to check for x. Investigating them has the same
+// effect as investigating every ballot number in between.
+func (s *BallotState) investigationPoints(x SlotValue, min int, max int) []int {
+	if min < 1 {
+		min = 1
+	}
+	if min > max {
+		return nil
+	}
+	boundaries := map[int]bool{min: true, max: true}
+	add := func(n int) {
+		if min <= n && n <= max {
+			boundaries[n] = true
+		}
+	}
+	for _, m := range s.M {
+		for _, n := range m.Boundaries(x) {
+			add(n)
+		}
+	}
+	if s.b != nil {
+		add(s.b.n)
+	}
+	if s.p != nil {
+		add(s.p.n)
+	}
+	if s.pPrime != nil {
+		add(s.pPrime.n)
+	}
+	add(s.cn)
+	add(s.hn)
+
+	sorted := []int{}
+	for n := range boundaries {
+		sorted = append(sorted, n)
+	}
+	sort.Ints(sorted)
+
+	// Each stretch between two boundaries needs both of its ends checked
+	answer := []int{}
+	for i, n := range sorted {
+		if i > 0 {
+			prev := sorted[i-1]
+			if n-prev > 1 {
+				answer = append(answer, prev+1)
+			}
+			if n-prev > 2 {
+				answer = append(answer, n-1)
+			}
+		}
+		answer = append(answer, n)
+	}
+	return answer
+}
+
 func (s *BallotState) InvestigateValues(values ...SlotValue) {
 	done := []SlotValue{}
 	for _, value := range values {
@@ -606,16 +719,18 @@ func (s *BallotState) SelfInvestigate() {
 	s.InvestigateBallot(s.b.n, s.b.x)
 }
 
-func (s *BallotState) Handle(node string, message BallotMessage) {
+// Handle handles a ballot message from a peer.
+// If the message would break one of our invariants, it is quarantined: the
+// ballot state is left the way it was, as if the message never arrived, and
+// the error is returned.
+func (s *BallotState) Handle(node util.PublicKey, message BallotMessage) error {
 	// If this message isn't new, skip it
 	old, ok := s.M[node]
 	if ok && Compare(old, message) >= 0 {
-		s.stale[node]++
-		s.CheckIfStale()
-		return
+		return nil
 	}
-	s.Logf("got message from %s: %s", util.Shorten(node), message)
-	s.stale[node] = 0
+	s.Logf("got message from %s: %s", util.Shorten(string(node)), message)
+	saved := *s
 	s.M[node] = message
 
 	for {
@@ -628,55 +743,87 @@ func (s *BallotState) Handle(node string, message BallotMessage) {
 		case *ExternalizeMessage:
 			s.InvestigateValue(m.X)
 		}
+		if s.err != nil {
+			break
+		}
 
 		// Step 9 of the processing algorithm
 		if !s.CheckForBlockedBallot() {
 			break
 		}
 	}
+
+	err := s.err
+	if err == nil {
+		err = s.Validate()
+	}
+	if err != nil {
+		if StrictBallots {
+			s.Show()
+			log.Fatalf("%s from %s: %s", message, util.Shorten(string(node)), err)
+		}
+		*s = saved
+		if ok {
+			s.M[node] = old
+		} else {
+			delete(s.M, node)
+		}
+		s.Logf("quarantined %s from %s: %s", message, util.Shorten(string(node)), err)
+		return err
+	}
+
+	if s.b != nil && s.phase == Prepare {
+		s.last = s.b
+	}
+	s.maybeArmTimer()
+	return nil
 }
 
 func (s *BallotState) HasMessage() bool {
 	return s.b != nil
 }
 
-func (s *BallotState) AssertValid() {
+// fail records a broken invariant while handling a message.
+func (s *BallotState) fail(problem string) {
+	if s.err == nil {
+		s.err = fmt.Errorf("%w: %s", ErrBrokenInvariant, problem)
+	}
+}
+
+// Validate checks that the ballot state is consistent.
+func (s *BallotState) Validate() error {
 	if s.cn > s.hn {
-		s.Show()
-		log.Fatalf("c should be <= h")
+		return fmt.Errorf("%w: c should be <= h", ErrBrokenInvariant)
 	}
 
 	if s.p != nil && s.pPrime != nil && s.p.x == s.pPrime.x {
-		s.Logf("p: %+v", s.p)
-		s.Logf("pPrime: %+v", s.pPrime)
-		log.Fatalf("p and p prime should not be compatible")
+		return fmt.Errorf("%w: p and p prime should not be compatible",
+			ErrBrokenInvariant)
 	}
 
 	if s.b != nil && s.phase == Prepare {
 		if s.p != nil && s.b.x != s.p.x && s.cn != 0 && s.hn <= s.p.n {
-			s.Logf("b: %+v", s.b)
-			s.Logf("c: %d", s.cn)
-			s.Logf("h: %d", s.hn)
-			s.Logf("p: %+v", s.p)
-			log.Fatalf("the vote to commit should have been aborted")
+			return fmt.Errorf("%w: the vote to commit should have been aborted",
+				ErrBrokenInvariant)
 		}
 		if s.pPrime != nil && s.b.x != s.pPrime.x && s.cn != 0 && s.hn <= s.pPrime.n {
-			s.Logf("b: %+v", s.b)
-			s.Logf("c: %d", s.cn)
-			s.Logf("h: %d", s.hn)
-			s.Logf("pPrime: %+v", s.pPrime)
-			log.Fatalf("the vote to commit should have been aborted")
+			return fmt.Errorf("%w: the vote to commit should have been aborted",
+				ErrBrokenInvariant)
 		}
-	}
-
-	if s.b != nil && s.phase == Prepare {
 		if s.last != nil && s.b.x != s.last.x && s.last.n > s.b.n {
-			s.Logf("last b: %+v", s.last)
-			s.Logf("curr b: %+v", s.b)
-			log.Fatalf("monotonicity violation")
+			return fmt.Errorf("%w: monotonicity violation", ErrBrokenInvariant)
 		}
+	}
 
-		s.last = s.b
+	return nil
+}
+
+// AssertValid crashes if the ballot state is not consistent. Since Handle
+// quarantines bad messages, this only fails when we break it ourselves.
+func (s *BallotState) AssertValid() {
+	if err := s.Validate(); err != nil {
+		s.Show()
+		log.Fatal(err)
 	}
 }
 
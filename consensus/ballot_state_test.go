@@ -0,0 +1,165 @@
+package consensus
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// investigateEveryBallot is how InvestigateValue used to work, one ballot
+// number at a time.
+func investigateEveryBallot(s *BallotState, x SlotValue) {
+	min, max := s.RelevantRange(x)
+	maxActionable := s.MaxActionableBallotNumber()
+	if max > maxActionable {
+		max = maxActionable
+	}
+	i := min
+	for ; i <= max; i++ {
+		s.InvestigateBallot(i, x)
+	}
+	if s.b != nil && i <= s.b.n {
+		s.InvestigateBallot(s.b.n, x)
+	}
+}
+
+func randomBallotMessage(r *rand.Rand, values []SlotValue) BallotMessage {
+	value := func() SlotValue {
+		return values[r.Intn(len(values))]
+	}
+	n := func(limit int) int {
+		if limit < 1 {
+			return 0
+		}
+		return r.Intn(limit + 1)
+	}
+	var m BallotMessage
+	switch r.Intn(3) {
+	case 0:
+		p := &PrepareMessage{I: 1, Bn: 1 + r.Intn(20), Bx: value()}
+		p.Pn = n(p.Bn)
+		if p.Pn > 0 {
+			p.Px = value()
+			p.Ppn = n(p.Pn - 1)
+			if p.Ppn > 0 {
+				p.Ppx = value()
+			}
+		}
+		p.Hn = n(p.Bn)
+		p.Cn = n(p.Hn)
+		m = p
+	case 1:
+		c := &ConfirmMessage{I: 1, X: value(), Hn: 1 + r.Intn(20)}
+		c.Cn = 1 + n(c.Hn-1)
+		c.Pn = n(c.Hn)
+		m = c
+	default:
+		e := &ExternalizeMessage{I: 1, X: value(), Hn: 1 + r.Intn(20)}
+		e.Cn = 1 + n(e.Hn-1)
+		m = e
+	}
+	if m.Validate() != nil {
+		return nil
+	}
+	return m
+}
+
+// randomBallotState makes a ballot state with random messages from its
+// peers. The same seed always makes the same state.
+func randomBallotState(seed int64) (*BallotState, []SlotValue) {
+	r := rand.New(rand.NewSource(seed))
+	qs, names := MakeTestQuorumSlice(4)
+	values := []SlotValue{"x", "y"}
+	nState := NewNominationState(names[0], qs, 1, NewTestValueStore(0))
+	s := NewBallotState(names[0], qs, nState)
+	for _, name := range names[1:] {
+		if m := randomBallotMessage(r, values); m != nil {
+			s.M[name] = m
+		}
+	}
+	if r.Intn(2) == 0 {
+		s.b = &Ballot{n: 1 + r.Intn(20), x: values[r.Intn(2)]}
+		if r.Intn(2) == 0 {
+			s.p = &Ballot{n: 1 + r.Intn(s.b.n), x: s.b.x}
+		}
+		s.hn = r.Intn(s.b.n + 1)
+		if s.hn > 0 {
+			s.cn = 1 + r.Intn(s.hn)
+		}
+	}
+	return s, values
+}
+
+func TestInvestigateValueMatchesEveryBallot(t *testing.T) {
+	for seed := int64(0); seed < 2000; seed++ {
+		fast, values := randomBallotState(seed)
+		slow, _ := randomBallotState(seed)
+		for _, x := range values {
+			fast.InvestigateValue(x)
+			investigateEveryBallot(slow, x)
+		}
+		got := fmt.Sprintf("%s b=%v p=%v p'=%v c=%d h=%d err=%v",
+			fast.phase, fast.b, fast.p, fast.pPrime, fast.cn, fast.hn, fast.err)
+		want := fmt.Sprintf("%s b=%v p=%v p'=%v c=%d h=%d err=%v",
+			slow.phase, slow.b, slow.p, slow.pPrime, slow.cn, slow.hn, slow.err)
+		if got != want {
+			t.Fatalf("seed %d: investigating by value got\n%s\nbut every ballot got\n%s",
+				seed, got, want)
+		}
+	}
+}
+
+func TestInvestigateHugeRange(t *testing.T) {
+	qs, names := MakeTestQuorumSlice(4)
+	nState := NewNominationState(names[0], qs, 1, NewTestValueStore(0))
+	s := NewBallotState(names[0], qs, nState)
+	start := time.Now()
+	for _, name := range names[1:] {
+		err := s.Handle(name, &ConfirmMessage{
+			I:  1,
+			X:  "x",
+			Pn: math.MaxInt32,
+			Cn: 1,
+			Hn: math.MaxInt32,
+			D:  qs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.phase != Externalize || s.cn != 1 {
+		t.Fatalf("expected to externalize, but got %s c=%d h=%d", s.phase, s.cn, s.hn)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("handling a huge range took %s", time.Since(start))
+	}
+}
+
+func TestNominationWaitsForUnknownValues(t *testing.T) {
+	qs, names := MakeTestQuorumSlice(4)
+	vs := NewTestValueStore(0)
+	vs.Unknown = true
+	s := NewNominationState(names[0], qs, 1, vs)
+	for i, name := range names[1:] {
+		s.Handle(name, &NominationMessage{
+			I:   1,
+			Nom: []SlotValue{"mystery"},
+			Acc: []SlotValue{"mystery"},
+			C:   i + 1,
+			D:   qs,
+		})
+	}
+	if HasSlotValue(s.Y, "mystery") || len(s.Z) != 0 {
+		t.Fatal("we should not accept a value that we can't validate")
+	}
+
+	vs.Learn()
+	if !s.RevalidatePending() {
+		t.Fatal("learning the value should change something")
+	}
+	if !HasSlotValue(s.Y, "mystery") || !HasSlotValue(s.Z, "mystery") {
+		t.Fatal("once we know the value, we should confirm it")
+	}
+}
@@ -2,6 +2,7 @@ package consensus
 
 import (
 	"log"
+	"time"
 
 	"coinkit/util"
 )
@@ -31,24 +32,82 @@ type Block struct {
 	D QuorumSlice
 
 	// Who we are
-	publicKey string
+	publicKey util.PublicKey
+
+	// What we measure time with
+	clock Clock
+
+	// When we started working on this block
+	start time.Time
+
+	// When we started balloting, and when the block externalized. Zero
+	// until they happen
+	ballotStart time.Time
+	end         time.Time
+
+	// How many messages we have received for this block
+	received int
+
+	// The peers whose ballot messages we quarantined for this block
+	quarantined map[util.PublicKey]bool
+
+	// How many quorum slices away from us each reachable node is.
+	// This is nil when a slice has changed and it needs to be worked out again.
+	reach map[util.PublicKey]int
+
+	// When we last heard from each peer, as a count of messages received
+	heard map[util.PublicKey]int
 }
 
+// We keep messages from at most this many peers for each block, so that a
+// node with many keys can't use up all our memory.
+// Once we have this many, a new peer only gets in by replacing one that is
+// farther from us, so that a node listing many keys in its slice can't crowd
+// out the members of our own slice.
+const MaxPeersPerBlock = 1000
+
 func NewBlock(
-	publicKey string, qs QuorumSlice, slot int, vs ValueStore) *Block {
-	nState := NewNominationState(publicKey, qs, vs)
+	publicKey util.PublicKey, qs QuorumSlice, slot int, vs ValueStore, clock Clock) *Block {
+	nState := NewNominationState(publicKey, qs, slot, vs)
 	nState.MaybeNominateNewValue()
 	block := &Block{
-		slot:      slot,
-		nState:    nState,
-		bState:    NewBallotState(publicKey, qs, nState),
-		values:    vs,
-		D:         qs,
-		publicKey: publicKey,
+		slot:        slot,
+		nState:      nState,
+		bState:      NewBallotState(publicKey, qs, nState),
+		values:      vs,
+		D:           qs,
+		publicKey:   publicKey,
+		clock:       clock,
+		start:       clock.Now(),
+		quarantined: make(map[util.PublicKey]bool),
+		heard:       make(map[util.PublicKey]int),
 	}
 	return block
 }
 
+func (b *Block) Logf(format string, a ...interface{}) {
+	util.Logf("BL", b.publicKey, format, a...)
+}
+
+// Metrics reports how consensus is going on this block.
+func (b *Block) Metrics() *Metrics {
+	m := &Metrics{
+		Slot:             b.slot,
+		Phase:            b.bState.phase,
+		BallotBumps:      b.bState.bumps,
+		MessagesReceived: b.received,
+		TimeInSlot:       b.clock.Now().Sub(b.start),
+	}
+	if b.bState.b != nil {
+		m.BallotNumber = b.bState.b.n
+	}
+	for peer := range b.quarantined {
+		m.Quarantined = append(m.Quarantined, peer)
+	}
+	util.SortPublicKeys(m.Quarantined)
+	return m
+}
+
 func (block *Block) AssertValid() {
 	block.nState.AssertValid()
 	block.bState.AssertValid()
@@ -76,6 +135,8 @@ func (b *Block) OutgoingMessages() []util.Message {
 		b.bState.GoToNextBallot()
 	}
 
+	b.noteTimes()
+
 	if b.bState.HasMessage() {
 		m := b.bState.Message(b.slot, b.D)
 		answer = append(answer, m)
@@ -90,32 +151,178 @@ func (b *Block) Done() bool {
 
 // ValueStoreUpdated should be called when the value store is updated.
 func (b *Block) ValueStoreUpdated() {
+	b.nState.RevalidatePending()
 	b.nState.MaybeNominateNewValue()
 }
 
+// HandleTimerTick should be called at regular intervals, to drive the
+// nomination and ballot timers. It returns whether we nominated a new value
+// or our ballot changed.
+func (b *Block) HandleTimerTick() bool {
+	if b.external != nil {
+		return false
+	}
+	nominated := b.nState.HandleTimerTick()
+	changed := b.bState.HandleTimerTick() || nominated
+	b.noteTimes()
+	return changed
+}
+
 // Handle handles an incoming message
-func (b *Block) Handle(sender string, message util.Message) {
+func (b *Block) Handle(sender util.PublicKey, message util.Message) {
 	if sender == b.publicKey {
 		// It's one of our own returning to us, we can ignore it
 		return
 	}
+	b.received++
+	if !b.tracks(sender) {
+		return
+	}
+	old, _ := b.QuorumSlice(sender)
+	var err error
 	switch m := message.(type) {
 	case *NominationMessage:
 		b.nState.Handle(sender, m)
 		b.nState.MaybeNominateNewValue()
 	case *PrepareMessage:
-		b.bState.Handle(sender, m)
+		err = b.bState.Handle(sender, m)
 	case *ConfirmMessage:
-		b.bState.Handle(sender, m)
+		err = b.bState.Handle(sender, m)
 	case *ExternalizeMessage:
-		b.bState.Handle(sender, m)
+		err = b.bState.Handle(sender, m)
 	default:
 		log.Printf("unrecognized message: %v", m)
 	}
+	if err != nil {
+		b.quarantined[sender] = true
+	}
+	if qs, ok := b.QuorumSlice(sender); ok && (old == nil || !old.equal(qs)) {
+		// Who is reachable may have changed
+		b.reach = nil
+		b.prune()
+	}
 
 	if b.bState.phase == Externalize && b.external == nil {
 		b.external = b.bState.Message(b.slot, b.D).(*ExternalizeMessage)
 	}
+	b.noteTimes()
 
 	b.AssertValid()
 }
+
+// QuorumSlice returns the latest slice we know a node uses in this block.
+func (b *Block) QuorumSlice(node util.PublicKey) (*QuorumSlice, bool) {
+	if qs, ok := b.bState.QuorumSlice(node); ok {
+		return qs, true
+	}
+	return b.nState.QuorumSlice(node)
+}
+
+func (b *Block) PublicKey() util.PublicKey {
+	return b.publicKey
+}
+
+// peers returns the nodes we are keeping messages from.
+func (b *Block) peers() map[util.PublicKey]bool {
+	answer := make(map[util.PublicKey]bool)
+	for node := range b.nState.N {
+		answer[node] = true
+	}
+	for node := range b.bState.M {
+		answer[node] = true
+	}
+	return answer
+}
+
+// isPeer returns whether we are keeping messages from this node.
+func (b *Block) isPeer(node util.PublicKey) bool {
+	if _, ok := b.nState.N[node]; ok {
+		return true
+	}
+	_, ok := b.bState.M[node]
+	return ok
+}
+
+// reachable returns how many quorum slices away from us each node that we
+// can reach is. It is only worked out again after a slice changes.
+func (b *Block) reachable() map[util.PublicKey]int {
+	if b.reach == nil {
+		b.reach = distances(b)
+	}
+	return b.reach
+}
+
+// tracks returns whether we should keep messages from this node. Messages
+// from nodes that aren't reachable from our quorum slice can't affect
+// consensus for us, so we ignore them.
+// When we are already tracking as many peers as we can, the node replaces
+// the farthest one from us, if that one is farther than it.
+func (b *Block) tracks(node util.PublicKey) bool {
+	if b.isPeer(node) {
+		b.heard[node] = b.received
+		return true
+	}
+	reach := b.reachable()
+	distance, ok := reach[node]
+	if !ok {
+		b.Logf("ignoring unreachable node %s", util.Shorten(string(node)))
+		return false
+	}
+	peers := b.peers()
+	if len(peers) >= MaxPeersPerBlock {
+		farthest := b.farthest(peers)
+		if reach[farthest] <= distance {
+			b.Logf("ignoring %s, already tracking %d peers",
+				util.Shorten(string(node)), len(peers))
+			return false
+		}
+		b.Logf("forgetting %s to make room for %s",
+			util.Shorten(string(farthest)), util.Shorten(string(node)))
+		b.forget(farthest)
+	}
+	b.heard[node] = b.received
+	return true
+}
+
+// farthest returns the peer that is the most quorum slices away from us.
+// Out of peers that are equally far away, it picks the one we heard from
+// least recently.
+func (b *Block) farthest(peers map[util.PublicKey]bool) util.PublicKey {
+	reach := b.reachable()
+	var answer util.PublicKey
+	for node := range peers {
+		if answer == "" {
+			answer = node
+			continue
+		}
+		d, best := reach[node], reach[answer]
+		if d > best || (d == best && (b.heard[node] < b.heard[answer] ||
+			(b.heard[node] == b.heard[answer] && node < answer))) {
+			answer = node
+		}
+	}
+	return answer
+}
+
+// forget drops the messages we have from a node. Its slice goes with them,
+// so who is reachable may change.
+func (b *Block) forget(node util.PublicKey) {
+	delete(b.nState.N, node)
+	delete(b.bState.M, node)
+	delete(b.heard, node)
+	b.reach = nil
+}
+
+// prune forgets messages from nodes that are no longer reachable, after
+// someone changes their quorum slice. Unreachable nodes' slices don't make
+// anyone reachable, so forgetting them doesn't change who is.
+func (b *Block) prune() {
+	reach := b.reachable()
+	for node := range b.peers() {
+		if _, ok := reach[node]; !ok {
+			delete(b.nState.N, node)
+			delete(b.bState.M, node)
+			delete(b.heard, node)
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package consensus
 
 import (
+	"fmt"
 	"log"
-	"math"
 	"math/rand"
 	"testing"
 
@@ -13,23 +13,23 @@ import (
 
 func TestSolipsistQuorum(t *testing.T) {
 	vs := NewTestValueStore(1)
-	s := NewBlock("foo", MakeQuorumSlice([]string{"foo"}, 1), 1, vs)
-	if !MeetsQuorum(s.nState, []string{"foo"}) {
+	s := NewBlock("foo", MakeQuorumSlice([]util.PublicKey{"foo"}, 1), 1, vs, RealClock{})
+	if !MeetsQuorum(s.nState, []util.PublicKey{"foo"}) {
 		t.Fatal("foo should meet the quorum")
 	}
-	if MeetsQuorum(s.nState, []string{"bar"}) {
+	if MeetsQuorum(s.nState, []util.PublicKey{"bar"}) {
 		t.Fatal("bar should not meet the quorum")
 	}
 }
 
 func TestConsensus(t *testing.T) {
-	members := []string{"amy", "bob", "cal", "dan"}
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
 	qs := MakeQuorumSlice(members, 3)
 	vs := NewTestValueStore(0)
-	amy := NewBlock("amy", qs, 1, vs)
-	bob := NewBlock("bob", qs, 1, vs)
-	cal := NewBlock("cal", qs, 1, vs)
-	dan := NewBlock("dan", qs, 1, vs)
+	amy := NewBlock("amy", qs, 1, vs, RealClock{})
+	bob := NewBlock("bob", qs, 1, vs, RealClock{})
+	cal := NewBlock("cal", qs, 1, vs, RealClock{})
+	dan := NewBlock("dan", qs, 1, vs, RealClock{})
 
 	// Let everyone receive an initial nomination from Amy
 	amy.nState.NominateNewValue(SlotValue("hello its amy"))
@@ -82,6 +82,59 @@ func TestConsensus(t *testing.T) {
 	}
 }
 
+func TestBlockMetrics(t *testing.T) {
+	blocks := blockCluster(4)
+	for i := 0; i < 10; i++ {
+		exchangeMessages(blocks, false)
+	}
+	m := blocks[0].Metrics()
+	if m.Slot != 1 || m.Phase != Externalize || m.BallotNumber < 1 {
+		t.Fatalf("bad metrics: %s", m)
+	}
+	if m.MessagesReceived == 0 {
+		t.Fatal("we should have counted messages")
+	}
+
+	// Starting the first ballot is not a bump, but moving on from it is
+	qs, names := MakeTestQuorumSlice(4)
+	block := NewBlock(names[0], qs, 1, NewTestValueStore(0), RealClock{})
+	block.nState.NominateNewValue(SlotValue("hello"))
+	block.bState.GoToNextBallot()
+	block.bState.GoToNextBallot()
+	m = block.Metrics()
+	if m.BallotNumber != 2 || m.BallotBumps != 1 {
+		t.Fatalf("expected one bump but got %s", m)
+	}
+}
+
+func TestNominationLeaders(t *testing.T) {
+	qs, names := MakeTestQuorumSlice(4)
+	leader := RoundLeader(1, 1, names)
+	blocks := []*Block{}
+	for _, name := range names {
+		blocks = append(blocks, NewBlock(name, qs, 1, NewTestValueStore(0), RealClock{}))
+	}
+
+	// Only the first round's leader nominates right away
+	for i, block := range blocks {
+		if block.nState.HasNomination() != (names[i] == leader) {
+			t.Fatalf("%s nominated out of turn", names[i])
+		}
+	}
+
+	// The others get their turns as rounds time out
+	for tick := 0; tick < 100; tick++ {
+		for _, block := range blocks {
+			block.HandleTimerTick()
+		}
+	}
+	for i, block := range blocks {
+		if !block.nState.HasNomination() {
+			t.Fatalf("%s never got a turn to nominate", names[i])
+		}
+	}
+}
+
 func exchangeMessages(blocks []*Block, beEvil bool) {
 	firstEvil := false
 
@@ -94,12 +147,8 @@ func exchangeMessages(blocks []*Block, beEvil bool) {
 			}
 
 			for _, message := range messages {
-				if (beEvil && !firstEvil) {
-					switch m := message.(type) {
-					case *PrepareMessage:
-						m.Hn = math.MaxInt32
-						firstEvil = true
-					}
+				if beEvil && !firstEvil && maxRange(nil, message) != nil {
+					firstEvil = true
 				}
 
 				block2.Handle(block.publicKey, message)
@@ -109,13 +158,13 @@ func exchangeMessages(blocks []*Block, beEvil bool) {
 }
 
 func TestProtectionAgainstBigRangeDDoS(t *testing.T) {
-	members := []string{"amy", "bob", "cal", "dan"}
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
 	qs := MakeQuorumSlice(members, 3)
 	vs := NewTestValueStore(0)
 
 	var blocks []*Block
 	for _, name  := range members {
-		blocks = append(blocks, NewBlock(name, qs, 1, vs))
+		blocks = append(blocks, NewBlock(name, qs, 1, vs, RealClock{}))
 	}
 
 	exchangeMessages(blocks, false)
@@ -146,7 +195,7 @@ func blockCluster(size int) []*Block {
 	blocks := []*Block{}
 	for i, name := range names {
 		vs := NewTestValueStore(i)
-		blocks = append(blocks, NewBlock(name, qs, 1, vs))
+		blocks = append(blocks, NewBlock(name, qs, 1, vs, RealClock{}))
 	}
 	return blocks
 }
@@ -195,6 +244,11 @@ func blockFuzzTest(blocks []*Block, seed int64, t *testing.T) {
 		j := rand.Intn(len(blocks))
 		k := rand.Intn(len(blocks))
 		blockSend(blocks[j], blocks[k])
+		if i%len(blocks) == 0 {
+			for _, block := range blocks {
+				block.HandleTimerTick()
+			}
+		}
 
 		if allDone(blocks) {
 			return
@@ -248,3 +302,279 @@ func TestBlockOneNodeKnockedOut(t *testing.T) {
 		blockFuzzTest(knockout, i, t)
 	}
 }
+
+// A value store that only validates values it has been told about
+type partialValueStore struct {
+	*TestValueStore
+	known map[SlotValue]bool
+}
+
+func (p *partialValueStore) ValidateValue(v SlotValue) bool {
+	return p.known[v]
+}
+
+func TestNominatingUnknownValue(t *testing.T) {
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
+	qs := MakeQuorumSlice(members, 3)
+	vs := &partialValueStore{
+		TestValueStore: NewTestValueStore(0),
+		known:          make(map[SlotValue]bool),
+	}
+	amy := NewBlock("amy", qs, 1, NewTestValueStore(0), RealClock{})
+	bob := NewBlock("bob", qs, 1, vs, RealClock{})
+
+	amy.nState.NominateNewValue(SlotValue("hello its amy"))
+	bob.Handle("amy", amy.OutgoingMessages()[0])
+	if HasSlotValue(bob.nState.X, SlotValue("hello its amy")) {
+		t.Fatal("bob should not support a value he cannot validate")
+	}
+
+	// Once bob learns about the value, he should support it
+	vs.known[SlotValue("hello its amy")] = true
+	bob.ValueStoreUpdated()
+	if !HasSlotValue(bob.nState.X, SlotValue("hello its amy")) {
+		t.Fatal("bob should support the value once he can validate it")
+	}
+	if len(bob.nState.pending) != 0 {
+		t.Fatal("bob should have nothing pending")
+	}
+}
+
+func TestNoNewVotesAfterConfirmedNomination(t *testing.T) {
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
+	qs := MakeQuorumSlice(members, 3)
+	amy := NewBlock("amy", qs, 1, NewTestValueStore(0), RealClock{})
+	amy.nState.NominateNewValue("x")
+
+	for _, sender := range []util.PublicKey{"bob", "cal"} {
+		amy.Handle(sender, &NominationMessage{
+			I:   1,
+			Nom: []SlotValue{"x"},
+			Acc: []SlotValue{"x"},
+			C:   2,
+			D:   qs,
+		})
+	}
+	if !HasSlotValue(amy.nState.Z, "x") {
+		t.Fatal("amy should have confirmed x")
+	}
+
+	amy.Handle("dan", &NominationMessage{
+		I:   1,
+		Nom: []SlotValue{"y"},
+		C:   1,
+		D:   qs,
+	})
+	if HasSlotValue(amy.nState.X, "y") {
+		t.Fatal("amy should not vote for new values after confirming one")
+	}
+}
+
+func TestNominationOrderDoesNotMatter(t *testing.T) {
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
+	qs := MakeQuorumSlice(members, 3)
+	amy := NewBlock("amy", qs, 1, NewTestValueStore(0), RealClock{})
+
+	amy.Handle("bob", &NominationMessage{
+		I:   1,
+		Nom: []SlotValue{"x", "y"},
+		C:   2,
+		D:   qs,
+	})
+
+	// The same values in another order are nothing new
+	amy.Handle("bob", &NominationMessage{
+		I:   1,
+		Nom: []SlotValue{"y", "x"},
+		C:   2,
+		D:   qs,
+	})
+	if amy.nState.N["bob"].Nom[0] != "x" {
+		t.Fatal("a dupe should not replace the message we have")
+	}
+
+	// A newer message counts even if the values moved around
+	amy.Handle("bob", &NominationMessage{
+		I:   1,
+		Nom: []SlotValue{"z", "y", "x"},
+		Acc: []SlotValue{"y"},
+		C:   4,
+		D:   qs,
+	})
+	if !HasSlotValue(amy.nState.N["bob"].Acc, "y") {
+		t.Fatal("amy should have taken the newer message")
+	}
+
+	// An older message doesn't, even if it has more values
+	amy.Handle("bob", &NominationMessage{
+		I:   1,
+		Nom: []SlotValue{"w", "x", "y", "z"},
+		C:   3,
+		D:   qs,
+	})
+	if HasSlotValue(amy.nState.N["bob"].Nom, "w") {
+		t.Fatal("amy should have ignored the stale message")
+	}
+}
+
+func TestUncountedNominations(t *testing.T) {
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
+	qs := MakeQuorumSlice(members, 3)
+	amy := NewBlock("amy", qs, 1, NewTestValueStore(0), RealClock{})
+
+	// Nodes on the previous protocol version don't send a counter
+	nominate := func(encoded string) {
+		m, err := util.DecodeMessage(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amy.Handle("bob", m)
+	}
+	d := `"D":{"Members":["amy","bob","cal","dan"],"Threshold":3}`
+	nominate(`{"T":"N","M":{"I":1,"Nom":["x"],` + d + `}}`)
+	nominate(`{"T":"N","M":{"I":1,"Nom":["x","y"],"Acc":["x"],` + d + `}}`)
+	m := amy.nState.N["bob"]
+	if m == nil || m.C != 3 || !HasSlotValue(m.Acc, "x") || !HasSlotValue(m.Nom, "y") {
+		t.Fatalf("the second uncounted nomination should be handled: %v", m)
+	}
+}
+
+func TestQuarantineBadBallotMessage(t *testing.T) {
+	StrictBallots = false
+	defer func() { StrictBallots = true }()
+
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
+	qs := MakeQuorumSlice(members, 3)
+	amy := NewBlock("amy", qs, 1, NewTestValueStore(0), RealClock{})
+
+	// Pretend amy already voted for a higher ballot with another value, so
+	// that being pushed onto ballot 1 would break monotonicity
+	amy.bState.last = &Ballot{n: 5, x: "y"}
+
+	for _, sender := range []util.PublicKey{"bob", "cal"} {
+		amy.Handle(sender, &PrepareMessage{
+			I:  1,
+			Bn: 1,
+			Bx: "x",
+			Pn: 1,
+			Px: "x",
+			D:  qs,
+		})
+	}
+
+	if amy.bState.b != nil || amy.bState.p != nil {
+		t.Fatalf("the ballot state should be unchanged but b=%s p=%s",
+			amy.bState.b, amy.bState.p)
+	}
+	if _, ok := amy.bState.M["cal"]; ok {
+		t.Fatal("the message from cal should have been quarantined")
+	}
+	if _, ok := amy.bState.M["bob"]; !ok {
+		t.Fatal("the message from bob was harmless")
+	}
+	q := amy.Metrics().Quarantined
+	if len(q) != 1 || q[0] != "cal" {
+		t.Fatalf("bad quarantined peers: %v", q)
+	}
+}
+
+// A blocking set that disagrees about the value can't be unblocked by going
+// to a higher ballot, so we shouldn't keep trying forever
+func TestBlockedByConflictingValues(t *testing.T) {
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
+	qs := MakeQuorumSlice(members, 3)
+	amy := NewBlock("amy", qs, 1, NewTestValueStore(0), RealClock{})
+	z := SlotValue("x")
+	amy.bState.b = &Ballot{n: 1, x: z}
+	amy.bState.z = &z
+
+	for sender, value := range map[util.PublicKey]SlotValue{"bob": "y", "cal": "evil"} {
+		amy.Handle(sender, &ExternalizeMessage{
+			I:  1,
+			X:  value,
+			Cn: 1,
+			Hn: 1,
+			D:  qs,
+		})
+	}
+
+	if amy.bState.b.n != 1 {
+		t.Fatalf("amy should not have bumped the ballot to %s", amy.bState.b)
+	}
+}
+
+func TestBlockOnlyTracksReachableNodes(t *testing.T) {
+	members := []util.PublicKey{"amy", "bob", "cal", "dan"}
+	qs := MakeQuorumSlice(members, 3)
+	amy := NewBlock("amy", qs, 1, NewTestValueStore(0), RealClock{})
+	nominate := func(sender util.PublicKey, d QuorumSlice) {
+		amy.Handle(sender, &NominationMessage{
+			I:   1,
+			Nom: []SlotValue{SlotValue(sender)},
+			C:   1,
+			D:   d,
+		})
+	}
+
+	// Nobody we listen to listens to eve
+	eveSlice := MakeQuorumSlice([]util.PublicKey{"eve"}, 1)
+	nominate("eve", eveSlice)
+	if _, ok := amy.nState.N["eve"]; ok {
+		t.Fatal("eve is not reachable")
+	}
+
+	// Once bob listens to eve, she matters
+	bobSlice := MakeQuorumSlice(append([]util.PublicKey{"eve"}, members...), 4)
+	nominate("bob", bobSlice)
+	nominate("eve", eveSlice)
+	if _, ok := amy.nState.N["eve"]; !ok {
+		t.Fatal("eve is reachable through bob")
+	}
+
+	// When bob stops listening to eve, we forget about her
+	amy.Handle("bob", &NominationMessage{
+		I:   1,
+		Nom: []SlotValue{"bob", "more"},
+		C:   2,
+		D:   qs,
+	})
+	if _, ok := amy.nState.N["eve"]; ok {
+		t.Fatal("eve is not reachable any more")
+	}
+
+	// A reachable node with a huge slice can't make us track everyone in it
+	huge := []util.PublicKey{"cal"}
+	for i := 0; i < 2*MaxPeersPerBlock; i++ {
+		huge = append(huge, util.PublicKey(fmt.Sprintf("sybil%d", i)))
+	}
+	nominate("cal", MakeQuorumSlice(huge, 1))
+	for _, sybil := range huge[1:] {
+		nominate(sybil, eveSlice)
+	}
+	if len(amy.peers()) != MaxPeersPerBlock {
+		t.Fatalf("tracking %d peers", len(amy.peers()))
+	}
+
+	// A member of our own slice still gets in once the sybils have filled
+	// up the block, by replacing one of them
+	if _, ok := amy.nState.N["dan"]; ok {
+		t.Fatal("dan has not sent anything yet")
+	}
+	nominate("dan", qs)
+	if _, ok := amy.nState.N["dan"]; !ok {
+		t.Fatal("a slice member should not be crowded out by sybils")
+	}
+	if _, ok := amy.nState.N["cal"]; !ok {
+		t.Fatal("the node that listed the sybils should still be tracked")
+	}
+	if len(amy.peers()) != MaxPeersPerBlock {
+		t.Fatalf("tracking %d peers", len(amy.peers()))
+	}
+
+	// Another sybil can't push out a slice member
+	nominate("sybil1999", eveSlice)
+	nominate("dan", qs)
+	if _, ok := amy.nState.N["dan"]; !ok {
+		t.Fatal("sybils should not replace slice members")
+	}
+}
@@ -1,6 +1,8 @@
 package consensus
 
 import (
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/davecgh/go-spew/spew"
@@ -21,10 +23,61 @@ type Chain struct {
 	// The quorum logic we use for future blocks
 	D QuorumSlice
 
+	// The quorum slice declarations we know of, for each node, in order of
+	// slot. Includes our own.
+	declarations map[util.PublicKey][]*QuorumSliceMessage
+
 	// Who we are
-	publicKey string
+	publicKey util.PublicKey
 
 	values ValueStore
+
+	// What we measure time with
+	clock Clock
+
+	// Who gets an event whenever a block externalizes
+	subscribers []chan<- *ExternalizeEvent
+
+	// How many timer ticks we have handled
+	ticks int
+
+	// The tick when we last heard from each node
+	lastHeard map[util.PublicKey]int
+
+	// Whether a node got back in touch after a partition, since the last
+	// call to Resync
+	resync bool
+
+	// The hash chain over every value externalized so far. It is empty
+	// before slot 1, or if we restored from a checkpoint that didn't have it
+	hash string
+
+	// Our digests, keyed by slot, along with the signatures we have
+	// collected for them. Pruning keeps only the latest one
+	digests map[int]*DigestMessage
+
+	// When we have a signer, we sign our own digests
+	signer *util.KeyPair
+
+	// Who took part in the recent slots we decided through consensus,
+	// oldest first
+	participation []*Participation
+
+	// How long the recent slots we decided through consensus took, oldest
+	// first
+	stats []*SlotStats
+
+	// How many timer ticks the current block has been externalized without
+	// the value store being able to finalize it
+	stalledTicks int
+
+	// How many timer ticks a slot can go without a nomination before we
+	// nominate an empty value. Zero means we never do
+	emptySlotTicks int
+
+	// When we are paused, this is the first slot we don't vote in.
+	// Zero means we aren't paused
+	pauseSlot int
 }
 
 func (c *Chain) Logf(format string, a ...interface{}) {
@@ -34,35 +87,55 @@ func (c *Chain) Logf(format string, a ...interface{}) {
 // Handle handles an incoming message.
 // It may return a message to be sent back to the original sender, or it may
 // just return nil if it has no particular response.
-func (c *Chain) Handle(sender string, message util.Message) util.Message {
+func (c *Chain) Handle(sender util.PublicKey, message util.Message) util.Message {
 	if sender == c.publicKey {
 		// It's one of our own returning to us, we can ignore it
 		return nil
 	}
+	c.heardFrom(sender)
+
+	// Messages that contradict themselves could break our state
+	if v, ok := message.(validatable); ok {
+		if err := v.Validate(); err != nil {
+			c.Logf("ignoring %s from %s: %s", message, util.Shorten(string(sender)), err)
+			return nil
+		}
+	}
 
 	slot := message.Slot()
 	if slot == 0 {
 		log.Fatalf("slot should not be zero in %s", message)
 	}
 
+	// Every node picks its own quorum slice, so we check each one we hear
+	// about before trusting it
+	if qs, ok := declaredQuorumSlice(message); ok {
+		if err := qs.Validate(sender); err != nil {
+			c.Logf("ignoring %s from %s: %s", message, util.Shorten(string(sender)), err)
+			return nil
+		}
+	}
+
+	if m, ok := message.(*QuorumSliceMessage); ok {
+		c.declare(sender, m)
+		return nil
+	}
+
+	if m, ok := message.(*DigestMessage); ok {
+		return c.handleDigest(m)
+	}
+
 	// Handle info messages
 	if _, ok := message.(*util.InfoMessage); ok {
-		block := c.history[slot]
-		if block != nil {
-			return block.external
+		if e := c.Externalized(slot); e != nil {
+			return e
 		}
 		return nil
 	}
 
 	if slot == c.current.slot {
 		c.current.Handle(sender, message)
-		if c.current.Done() && c.values.CanFinalize(c.current.external.X) {
-			// This block is done, let's move on to the next one
-			c.Logf("advancing to slot %d", slot+1)
-			c.values.Finalize(c.current.external.X)
-			c.history[slot] = c.current
-			c.current = NewBlock(c.publicKey, c.D, slot+1, c.values)
-		}
+		c.maybeAdvance()
 		return nil
 	}
 
@@ -83,6 +156,26 @@ func (c *Chain) Handle(sender string, message util.Message) util.Message {
 	return nil
 }
 
+// The consensus messages can all check themselves for consistency
+type validatable interface {
+	Validate() error
+}
+
+// declaredQuorumSlice returns the quorum slice that the sender of a message
+// says it uses, if the message has one.
+func declaredQuorumSlice(message util.Message) (*QuorumSlice, bool) {
+	switch m := message.(type) {
+	case *QuorumSliceMessage:
+		return &m.D, true
+	case *NominationMessage:
+		return &m.D, true
+	case BallotMessage:
+		qs := m.QuorumSlice()
+		return &qs, true
+	}
+	return nil, false
+}
+
 func (c *Chain) AssertValid() {
 	c.current.AssertValid()
 }
@@ -92,26 +185,276 @@ func (c *Chain) Slot() int {
 	return c.current.slot
 }
 
-func NewEmptyChain(publicKey string, qs QuorumSlice, vs ValueStore) *Chain {
-	return &Chain{
-		current:   NewBlock(publicKey, qs, 1, vs),
-		history:   make(map[int]*Block),
-		D:         qs,
-		values:    vs,
-		publicKey: publicKey,
+// We keep at most this many quorum slice declarations for each node
+const MaxDeclarations = 100
+
+// We collect at most this many signatures on each of our digests
+const MaxDigestSignatures = 1000
+
+// NewEmptyChain makes a chain that starts at slot 1. It measures how long
+// slots take with clock.
+func NewEmptyChain(publicKey util.PublicKey, qs QuorumSlice, vs ValueStore, clock Clock) *Chain {
+	c := &Chain{
+		current:      NewBlock(publicKey, qs, 1, vs, clock),
+		history:      make(map[int]*Block),
+		D:            qs,
+		declarations: make(map[util.PublicKey][]*QuorumSliceMessage),
+		values:       vs,
+		clock:        clock,
+		publicKey:    publicKey,
+		lastHeard:    make(map[util.PublicKey]int),
+		digests:      make(map[int]*DigestMessage),
+	}
+	c.declare(publicKey, &QuorumSliceMessage{I: 1, D: qs})
+	return c
+}
+
+// SetQuorumSlice changes our quorum slice, starting with the next slot, and
+// announces the change to other nodes.
+// It returns an error, and changes nothing, if the new slice is not valid
+// for us or does not intersect the old one. If the slices are too big to
+// check, the change goes ahead.
+func (c *Chain) SetQuorumSlice(qs QuorumSlice) error {
+	if err := qs.Validate(c.publicKey); err != nil {
+		return err
+	}
+	err := CheckIntersection(c.publicKey, c.D, qs)
+	if errors.Is(err, ErrIntersectionUnchecked) {
+		c.Logf("%s", err)
+	} else if err != nil {
+		return err
+	}
+	slot := c.current.slot + 1
+	c.Logf("quorum slice changes from %s to %s at slot %d", &c.D, &qs, slot)
+	c.D = qs
+	c.declare(c.publicKey, &QuorumSliceMessage{I: slot, D: qs})
+	return nil
+}
+
+// declare records a quorum slice declaration from a node. A later declaration
+// for the same slot replaces an earlier one.
+func (c *Chain) declare(node util.PublicKey, m *QuorumSliceMessage) {
+	list := c.declarations[node]
+	i := len(list)
+	for i > 0 && list[i-1].I >= m.I {
+		i--
+	}
+	if i < len(list) && list[i].I == m.I {
+		list[i] = m
+	} else {
+		list = append(list, nil)
+		copy(list[i+1:], list[i:])
+		list[i] = m
+	}
+	if len(list) > MaxDeclarations {
+		list = list[len(list)-MaxDeclarations:]
+	}
+	c.declarations[node] = list
+}
+
+// QuorumSliceOf returns the quorum slice a node has declared for a slot, or
+// nil if we don't know it.
+func (c *Chain) QuorumSliceOf(node util.PublicKey, slot int) *QuorumSlice {
+	list := c.declarations[node]
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].I <= slot {
+			return &list[i].D
+		}
+	}
+	return nil
+}
+
+// Declarations returns every quorum slice declaration a node has made that we
+// know of, in order of slot.
+func (c *Chain) Declarations(node util.PublicKey) []*QuorumSliceMessage {
+	return append([]*QuorumSliceMessage{}, c.declarations[node]...)
+}
+
+// maybeAdvance moves on to the next block if the current one is done and
+// the value store is ready to finalize it.
+func (c *Chain) maybeAdvance() {
+	c.advance(false)
+}
+
+// advance is maybeAdvance, noting whether the block was restored.
+func (c *Chain) advance(restored bool) {
+	if c.current.Done() && c.values.CanFinalize(c.current.external.X) {
+		// This block is done, let's move on to the next one
+		slot := c.current.slot
+		c.Logf("advancing to slot %d", slot+1)
+		c.values.Finalize(c.current.external.X)
+		c.history[slot] = c.current
+		c.extendHash(c.current.external)
+		if !restored {
+			c.recordParticipation(c.current)
+			c.recordStats(c.current)
+		}
+		c.publish(c.current, restored)
+		c.current = c.newBlock(slot + 1)
+		c.stalledTicks = 0
+	}
+}
+
+// Stalled returns how the current slot was decided, if it has externalized
+// but the value store can't finalize it yet. Otherwise it returns nil.
+// The application should go find whatever data it is missing, and call
+// ValueStoreUpdated once it has it.
+func (c *Chain) Stalled() *ExternalizeMessage {
+	if !c.current.Done() {
+		return nil
+	}
+	return c.current.external
+}
+
+// Restore finishes the current block with a value that was externalized
+// before, without going through consensus. It is used to rebuild the chain
+// from our own saved history, so it should not be used on data from peers.
+func (c *Chain) Restore(e *ExternalizeMessage) error {
+	if e.I != c.current.slot {
+		return fmt.Errorf("cannot restore slot %d while on slot %d", e.I, c.current.slot)
+	}
+	if !c.values.CanFinalize(e.X) {
+		return fmt.Errorf("cannot finalize restored value for slot %d", e.I)
+	}
+	c.current.external = e
+	c.advance(true)
+	return nil
+}
+
+// RestoreCheckpoint moves a chain that has not finished any blocks on to the
+// slot after e, without finalizing e's value. It is used when the value store
+// was restored from a checkpoint that already includes that value.
+// hash is the hash chain as of e. If it is empty, we stop making digests.
+// digest is our latest digest as of e, which the next digest refers to. It
+// can be nil if we haven't made one yet.
+func (c *Chain) RestoreCheckpoint(e *ExternalizeMessage, hash string, digest *DigestMessage) error {
+	if c.current.slot != 1 || len(c.history) != 0 {
+		return fmt.Errorf("cannot restore a checkpoint while on slot %d", c.current.slot)
+	}
+	if digest != nil {
+		if digest.I > e.I || digest.I <= e.I-DigestInterval {
+			return fmt.Errorf("digest for slot %d is not the latest as of slot %d", digest.I, e.I)
+		}
+		if digest.I == e.I && digest.Hash != hash {
+			return fmt.Errorf("digest for slot %d does not match the hash chain", digest.I)
+		}
+		c.digests[digest.I] = digest
+	}
+	block := NewBlock(c.publicKey, c.D, e.I, c.values, c.clock)
+	block.external = e
+	c.history[e.I] = block
+	c.current = c.newBlock(e.I + 1)
+	c.hash = hash
+	return nil
+}
+
+// Externalized returns the externalize message for a finished slot, or nil
+// if we don't have it.
+func (c *Chain) Externalized(slot int) *ExternalizeMessage {
+	block := c.history[slot]
+	if block == nil {
+		return nil
+	}
+	return block.external
+}
+
+// Prune forgets the blocks and digests for all slots before the provided
+// one. The latest digest is kept, since the next one refers to it.
+func (c *Chain) Prune(before int) {
+	for slot, _ := range c.history {
+		if slot < before {
+			delete(c.history, slot)
+		}
+	}
+	latest := c.latestDigestSlot()
+	for slot := range c.digests {
+		if slot < before && slot < latest {
+			delete(c.digests, slot)
+		}
+	}
+}
+
+// HandleTimerTick should be called at regular intervals, to drive the
+// nomination and ballot timers. It returns whether we have anything new to
+// say about the current slot.
+func (c *Chain) HandleTimerTick() bool {
+	c.ticks++
+	if c.current.Done() {
+		// We might have missed the update that lets the value store
+		// finalize this block, so we retry every tick
+		slot := c.current.slot
+		c.maybeAdvance()
+		if c.current.slot != slot {
+			return true
+		}
+		c.stalledTicks++
+		if c.stalledTicks%PartitionTicks == 0 {
+			c.Logf("slot %d has been externalized for %d ticks but cannot be finalized",
+				slot, c.stalledTicks)
+		}
+		return false
+	}
+	return c.current.HandleTimerTick()
+}
+
+// If we go this many timer ticks without hearing from a node, we treat it
+// as cut off from us
+const PartitionTicks = 10
+
+// heardFrom notes that a node is in touch with us, and whether it had been
+// cut off for a while.
+func (c *Chain) heardFrom(node util.PublicKey) {
+	last, ok := c.lastHeard[node]
+	if ok && c.ticks-last > PartitionTicks {
+		c.Logf("heard from %s again after %d ticks", util.Shorten(string(node)), c.ticks-last)
+		c.resync = true
 	}
+	c.lastHeard[node] = c.ticks
+}
+
+// Resync returns whether a node got back in touch after being cut off from
+// us, since the last time Resync was called.
+// While it was cut off, it missed messages that we won't be changing, so
+// everything in OutgoingMessages should be sent out again right away,
+// rather than just what changed.
+func (c *Chain) Resync() bool {
+	answer := c.resync
+	c.resync = false
+	return answer
+}
+
+// Metrics reports how consensus is going on the slot we are working on.
+func (c *Chain) Metrics() *Metrics {
+	m := c.current.Metrics()
+	m.Participation = c.ParticipationRates()
+	return m
 }
 
 // ValueStoreUpdated should be called when the value store is updated
 func (c *Chain) ValueStoreUpdated() {
 	c.current.ValueStoreUpdated()
+
+	// We might have been waiting on the value store to finalize this block
+	c.maybeAdvance()
 }
 
 func (c *Chain) OutgoingMessages() []util.Message {
-	answer := c.current.OutgoingMessages()
+	answer := []util.Message{}
+	if !c.silent(c.current.slot) {
+		answer = c.current.OutgoingMessages()
+	}
+
+	// Keep everyone up to date on our quorum slice
+	ours := c.declarations[c.publicKey]
+	answer = append(answer, ours[len(ours)-1])
+
+	// Share our latest digest, so that others can collect our signature
+	if d := c.LatestDigest(); d != nil {
+		answer = append(answer, d)
+	}
 
 	prev := c.history[c.current.slot-1]
-	if prev != nil {
+	if prev != nil && !c.silent(prev.slot) {
 		// We also send out the externalize data for the previous block
 		answer = append(answer, prev.OutgoingMessages()...)
 	}
@@ -119,10 +462,6 @@ func (c *Chain) OutgoingMessages() []util.Message {
 	return answer
 }
 
-func (chain *Chain) Stats() {
-	chain.Logf("%d blocks externalized", chain.Slot()-1)
-}
-
 func (chain *Chain) Log() {
 	log.Printf("--------------------------------------------------------------------------")
 	log.Printf("%s is working on slot %d", chain.publicKey, chain.current.slot)
@@ -139,3 +478,175 @@ func LogChains(chains []*Chain) {
 	}
 	log.Printf("**************************************************************************")
 }
+
+// Pause stops us from voting, for maintenance. If we have already said
+// something about the current slot, we keep voting until it is finished, so
+// that no slot is left with half of our votes.
+// While paused, we keep handling messages and finalizing the slots that the
+// rest of the network decides, so that we can pick up where we left off.
+// Everything we hold back is consistent with what we already said, so it is
+// like our messages being delayed, which consensus can always survive.
+func (c *Chain) Pause() {
+	if c.pauseSlot != 0 {
+		return
+	}
+	c.pauseSlot = c.current.slot
+	if len(c.current.OutgoingMessages()) > 0 {
+		c.pauseSlot++
+	}
+	c.Logf("pausing, starting with slot %d", c.pauseSlot)
+}
+
+// Resume starts voting again after Pause.
+func (c *Chain) Resume() {
+	if c.pauseSlot == 0 {
+		return
+	}
+	c.pauseSlot = 0
+	c.Logf("resuming on slot %d", c.current.slot)
+}
+
+// Paused returns whether Pause was called without Resume. We might still be
+// finishing the slot we were on.
+func (c *Chain) Paused() bool {
+	return c.pauseSlot != 0
+}
+
+// silent returns whether we are keeping quiet about a slot, because we are
+// paused.
+func (c *Chain) silent(slot int) bool {
+	return c.pauseSlot != 0 && slot >= c.pauseSlot
+}
+
+// newBlock starts work on a slot with our current settings.
+func (c *Chain) newBlock(slot int) *Block {
+	block := NewBlock(c.publicKey, c.D, slot, c.values, c.clock)
+	block.nState.EmptySlotTicks = c.emptySlotTicks
+	return block
+}
+
+// SetEmptySlotTicks makes us nominate EmptyValue when a slot goes this many
+// timer ticks without anything to nominate, so that slots advance at a
+// steady pace even when the value store has nothing to suggest. Zero, the
+// default, means we wait for the value store.
+// Other nodes accept empty values whether or not they nominate them, as long
+// as their value store validates EmptyValue.
+func (c *Chain) SetEmptySlotTicks(ticks int) {
+	c.emptySlotTicks = ticks
+	c.current.nState.EmptySlotTicks = ticks
+}
+
+// SetSigner makes the chain sign its digests with kp, which should be the key
+// pair for our public key.
+func (c *Chain) SetSigner(kp *util.KeyPair) {
+	c.signer = kp
+}
+
+// Hash returns the hash chain over every value externalized so far, or an
+// empty string if we don't know it.
+func (c *Chain) Hash() string {
+	return c.hash
+}
+
+// extendHash adds a newly externalized value to the hash chain, and makes a
+// digest if it is time for one.
+func (c *Chain) extendHash(e *ExternalizeMessage) {
+	if c.hash == "" && e.I != 1 {
+		// We don't know the earlier history
+		return
+	}
+	prev := c.hash
+	c.hash = ChainHash(prev, e)
+	if e.I%DigestInterval != 0 {
+		return
+	}
+	d := &DigestMessage{
+		I:    e.I,
+		Hash: c.hash,
+	}
+	if e.I > DigestInterval {
+		before := c.digests[e.I-DigestInterval]
+		if before == nil {
+			// We can't tell where the previous digest left off
+			return
+		}
+		d.Prev = before.Hash
+	}
+	if c.signer != nil {
+		d.Sign(c.signer)
+	}
+	c.digests[e.I] = d
+}
+
+// Digest returns our digest for a slot, with the signatures we have
+// collected, or nil if we don't have one.
+func (c *Chain) Digest(slot int) *DigestMessage {
+	return c.digests[slot]
+}
+
+// latestDigestSlot is the slot of the latest digest we could have made.
+func (c *Chain) latestDigestSlot() int {
+	finished := c.current.slot - 1
+	return finished - finished%DigestInterval
+}
+
+// LatestDigest returns our most recent digest, or nil if we don't have one.
+func (c *Chain) LatestDigest() *DigestMessage {
+	return c.digests[c.latestDigestSlot()]
+}
+
+// handleDigest collects the signatures on another node's digest, if it
+// matches ours, or answers a request for our digest.
+func (c *Chain) handleDigest(m *DigestMessage) util.Message {
+	ours := c.digests[m.I]
+	if ours == nil {
+		return nil
+	}
+	if m.Hash == "" {
+		return ours
+	}
+	if m.Hash != ours.Hash || m.Prev != ours.Prev {
+		c.Logf("our digest for slot %d does not match %s", m.I, m)
+		return nil
+	}
+	for signer, signature := range m.Signatures {
+		// Checking a signature is slow, and we hear the same ones over and
+		// over, so only check the ones we don't have
+		if _, ok := ours.Signatures[signer]; ok {
+			continue
+		}
+		if ours.rejected[signer] == signature {
+			continue
+		}
+		// Anyone can make up keys, and we pass these signatures along, so
+		// we only keep them from nodes we know
+		if !c.knows(signer) || len(ours.Signatures) >= MaxDigestSignatures {
+			continue
+		}
+		if !util.Verify(signer, ours.signedString(), signature) {
+			if ours.rejected == nil {
+				ours.rejected = make(map[util.PublicKey]string)
+			}
+			ours.rejected[signer] = signature
+			continue
+		}
+		if ours.Signatures == nil {
+			ours.Signatures = make(map[util.PublicKey]string)
+		}
+		ours.Signatures[signer] = signature
+	}
+	return nil
+}
+
+// knows returns whether a node is in our quorum slice or has declared its own.
+func (c *Chain) knows(node util.PublicKey) bool {
+	if _, ok := c.declarations[node]; ok {
+		return true
+	}
+	for _, member := range c.D.AllMembers() {
+		if member == node {
+			return true
+		}
+	}
+	return false
+}
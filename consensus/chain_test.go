@@ -1,6 +1,8 @@
 package consensus
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"testing"
@@ -8,6 +10,11 @@ import (
 	"coinkit/util"
 )
 
+func init() {
+	// Broken ballot invariants should fail tests loudly
+	StrictBallots = true
+}
+
 // Simulate the sending of messages from source to target
 func chainSend(source *Chain, target *Chain) {
 	if source == target {
@@ -32,7 +39,7 @@ func chainCluster(size int) []*Chain {
 	chains := []*Chain{}
 	for i, name := range names {
 		vs := NewTestValueStore(i)
-		chains = append(chains, NewEmptyChain(name, qs, vs))
+		chains = append(chains, NewEmptyChain(name, qs, vs, RealClock{}))
 	}
 	return chains
 }
@@ -77,6 +84,15 @@ func chainFuzzTest(chains []*Chain, seed int64, t *testing.T) {
 		j := rand.Intn(len(chains))
 		k := rand.Intn(len(chains))
 		chainSend(chains[j], chains[k])
+		if i%len(chains) == 0 {
+			for _, chain := range chains {
+				chain.HandleTimerTick()
+				vs, ok := chain.values.(*TestValueStore)
+				if ok && vs.Learn() {
+					chain.ValueStoreUpdated()
+				}
+			}
+		}
 		if progress(chains) >= limit {
 			break
 		}
@@ -112,3 +128,572 @@ func TestChainOneNodeKnockedOut(t *testing.T) {
 		chainFuzzTest(knockout, i, t)
 	}
 }
+
+// Value stores that are slow to finalize, don't know other nodes' values
+// right away, and keep changing their suggestions
+func TestChainDifficultValueStores(t *testing.T) {
+	var i int64
+	for i = 0; i < util.GetTestLoopLength(10, 1000); i++ {
+		chains := chainCluster(4)
+		for j, chain := range chains {
+			vs := chain.values.(*TestValueStore)
+			vs.Unknown = j%2 == 0
+			vs.FinalizeDelay = j
+			vs.Conflicting = j >= 2
+		}
+		chainFuzzTest(chains, i, t)
+	}
+}
+
+// Each chain uses its own quorum slice, including a nested one
+func TestChainHeterogeneousSlices(t *testing.T) {
+	var i int64
+	for i = 0; i < util.GetTestLoopLength(10, 1000); i++ {
+		chains := chainCluster(4)
+		names := []util.PublicKey{}
+		for _, chain := range chains {
+			names = append(names, chain.publicKey)
+		}
+
+		// node1 only needs node0, node3, and itself
+		err := chains[1].SetQuorumSlice(MakeQuorumSlice(
+			[]util.PublicKey{names[0], names[1], names[3]}, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// node2 needs itself and two of the others
+		nested := MakeQuorumSlice([]util.PublicKey{names[2]}, 2)
+		nested.Inner = []QuorumSlice{MakeQuorumSlice(
+			[]util.PublicKey{names[0], names[1], names[3]}, 2)}
+		if err := chains[2].SetQuorumSlice(nested); err != nil {
+			t.Fatal(err)
+		}
+
+		chainFuzzTest(chains, i, t)
+	}
+}
+
+// Only some chains have something to suggest for the second app, so
+// finalized values may or may not have a section for it
+func TestCompositeChain(t *testing.T) {
+	qs, names := MakeTestQuorumSlice(4)
+	chains := []*Chain{}
+	apps := []*TestValueStore{}
+	for i, name := range names {
+		vs := NewCompositeValueStore()
+		first := NewTestValueStore(i)
+		vs.Add("first", first)
+		if i%2 == 0 {
+			vs.Add("second", NewTestValueStore(10+i))
+		} else {
+			vs.Add("second", &TestValueStore{})
+		}
+		apps = append(apps, first)
+		chains = append(chains, NewEmptyChain(name, qs, vs, RealClock{}))
+	}
+	for i := 0; i < 100; i++ {
+		for _, source := range chains {
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+		if chains[3].Slot() > 3 {
+			break
+		}
+	}
+	checkProgress(chains, 3, t)
+	sections, ok := SplitSections(chains[0].history[1].external.X)
+	if !ok || sections["first"] == "" {
+		t.Fatalf("bad composite value: %s", chains[0].history[1].external.X)
+	}
+	if apps[1].Last() != sections["first"] {
+		t.Fatalf("the first app did not finalize its section")
+	}
+}
+
+func TestCompositeSections(t *testing.T) {
+	v := JoinSections(map[string]SlotValue{"b": "x,y", "a": "z", "c": ""})
+	if v != "a=z;b=x,y" {
+		t.Fatalf("bad joined value: %s", v)
+	}
+	sections, ok := SplitSections(v)
+	if !ok || len(sections) != 2 || sections["b"] != "x,y" {
+		t.Fatalf("bad split: %+v", sections)
+	}
+	for _, bad := range []SlotValue{"a", "a=", "=x", "a=x;a=y"} {
+		if _, ok := SplitSections(bad); ok {
+			t.Fatalf("%s should not split", bad)
+		}
+	}
+}
+
+func TestQuorumSliceDeclarations(t *testing.T) {
+	chains := chainCluster(4)
+	for i := 0; i < 10; i++ {
+		for _, source := range chains {
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+	}
+	slot := chains[0].Slot()
+	qs, _ := MakeTestQuorumSlice(4)
+	qs.Threshold = 4
+	if err := chains[0].SetQuorumSlice(qs); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range chains {
+		chainSend(chains[0], target)
+	}
+
+	// Everyone should know about both of chain 0's slices
+	for _, c := range chains[1:] {
+		old := c.QuorumSliceOf(chains[0].publicKey, slot)
+		if old == nil || old.Threshold != 3 {
+			t.Fatalf("bad old slice: %+v", old)
+		}
+		current := c.QuorumSliceOf(chains[0].publicKey, slot+1)
+		if current == nil || current.Threshold != 4 {
+			t.Fatalf("bad new slice: %+v", current)
+		}
+		if len(c.Declarations(chains[0].publicKey)) != 2 {
+			t.Fatalf("expected two declarations but got %+v",
+				c.Declarations(chains[0].publicKey))
+		}
+	}
+}
+
+func TestChainIgnoresInvalidMessages(t *testing.T) {
+	chains := chainCluster(4)
+	c, sender := chains[0], chains[1].publicKey
+	qs := chains[1].D
+	invalid := []util.Message{
+		&NominationMessage{I: 1, Nom: []SlotValue{"x", "x"}, D: qs},
+		&NominationMessage{I: 1, Acc: []SlotValue{""}, D: qs},
+		&PrepareMessage{I: 1, Bn: 0, Bx: "x", D: qs},
+		&PrepareMessage{I: 1, Bn: 2, Bx: "x", Cn: 2, Hn: 1, D: qs},
+		&PrepareMessage{I: 1, Bn: 2, Bx: "x", Pn: 1, Px: "x", Ppn: 1, Ppx: "x", D: qs},
+		&ConfirmMessage{I: 1, X: "x", Pn: 2, Cn: 2, Hn: 1, D: qs},
+		&ExternalizeMessage{I: 1, X: "", Cn: 1, Hn: 1, D: qs},
+		&ExternalizeMessage{I: 0, X: "x", Cn: 1, Hn: 1, D: qs},
+	}
+	for _, m := range invalid {
+		if m.(validatable).Validate() == nil {
+			t.Fatalf("%s should be invalid", m)
+		}
+		if c.Handle(sender, m) != nil {
+			t.Fatalf("%s should not get a response", m)
+		}
+	}
+	if len(c.current.nState.N) != 0 || len(c.current.bState.M) != 0 {
+		t.Fatal("invalid messages should not be processed")
+	}
+	if c.Slot() != 1 {
+		t.Fatal("an invalid externalize should not finalize a block")
+	}
+
+	valid := &PrepareMessage{I: 1, Bn: 2, Bx: "x", Pn: 1, Px: "x", Cn: 1, Hn: 3, D: qs}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainSubscribe(t *testing.T) {
+	chains := chainCluster(4)
+	events := make(chan *ExternalizeEvent, 10)
+	chains[0].Subscribe(events)
+	for i := 0; i < 100 && chains[0].Slot() < 3; i++ {
+		for _, source := range chains {
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+	}
+	if chains[0].Slot() < 3 {
+		t.Fatal("the chains did not make progress")
+	}
+	for slot := 1; slot <= 2; slot++ {
+		select {
+		case e := <-events:
+			if e.Slot != slot || e.Value != chains[0].Externalized(slot).X || e.Restored {
+				t.Fatalf("bad event for slot %d: %s", slot, e)
+			}
+		default:
+			t.Fatalf("no event for slot %d", slot)
+		}
+	}
+
+	// Restoring a block sends an event too
+	qs, names := MakeTestQuorumSlice(4)
+	restored := NewEmptyChain(names[0], qs, NewTestValueStore(0), RealClock{})
+	restoredEvents := make(chan *ExternalizeEvent, 1)
+	restored.Subscribe(restoredEvents)
+	if err := restored.Restore(chains[0].Externalized(1)); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-restoredEvents; !e.Restored {
+		t.Fatalf("expected a restored event but got %s", e)
+	}
+}
+
+func TestChainDigests(t *testing.T) {
+	keys := []*util.KeyPair{}
+	names := []util.PublicKey{}
+	for i := 0; i < 4; i++ {
+		kp := util.NewKeyPairFromSecretPhrase(fmt.Sprintf("digest%d", i))
+		keys = append(keys, kp)
+		names = append(names, kp.PublicKey())
+	}
+	qs := MakeQuorumSlice(names, 3)
+	chains := []*Chain{}
+	for i, name := range names {
+		chain := NewEmptyChain(name, qs, NewTestValueStore(i), RealClock{})
+		chain.SetSigner(keys[i])
+		chains = append(chains, chain)
+	}
+	for i := 0; i < 1000 && progress(chains) < 2*DigestInterval+1; i++ {
+		for _, source := range chains {
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+	}
+	if progress(chains) <= 2*DigestInterval {
+		t.Fatalf("the chains only externalized %d blocks", progress(chains))
+	}
+
+	// Everyone should have every signature on the second digest
+	d := util.EncodeThenDecode(chains[0].Handle(names[1], &DigestMessage{
+		I: 2 * DigestInterval,
+	})).(*DigestMessage)
+	if len(d.Signers()) != len(names) {
+		t.Fatalf("expected every signature on %s", d)
+	}
+	if err := d.VerifySigners(qs); err != nil {
+		t.Fatal(err)
+	}
+	if d.Prev != chains[0].Digest(DigestInterval).Hash {
+		t.Fatal("the digests should be chained together")
+	}
+
+	// A light client can check the blocks since the last digest
+	history := []*ExternalizeMessage{}
+	for slot := DigestInterval + 1; slot <= 2*DigestInterval; slot++ {
+		history = append(history, chains[1].Externalized(slot))
+	}
+	if err := d.VerifyHistory(history); err != nil {
+		t.Fatal(err)
+	}
+	history[3] = chains[1].Externalized(1)
+	if d.VerifyHistory(history) == nil {
+		t.Fatal("out of order history should not verify")
+	}
+
+	// Forged signatures don't count
+	forged := util.EncodeThenDecode(d).(*DigestMessage)
+	forged.Hash = "forged"
+	if forged.VerifySigners(qs) == nil {
+		t.Fatal("signatures should not carry over to a different hash")
+	}
+
+	// Signatures only count from nodes we know
+	stranger := util.NewKeyPairFromSecretPhrase("stranger")
+	ours := chains[2].Digest(2 * DigestInterval)
+	delete(ours.Signatures, names[3])
+	signed := util.EncodeThenDecode(d).(*DigestMessage)
+	signed.Sign(stranger)
+	good := signed.Signatures[names[3]]
+	signed.Signatures[names[3]] = "bad"
+	chains[2].Handle(names[3], signed)
+	if _, ok := ours.Signatures[stranger.PublicKey()]; ok {
+		t.Fatal("a signature from a stranger should not be kept")
+	}
+	if _, ok := ours.Signatures[names[3]]; ok || ours.rejected[names[3]] != "bad" {
+		t.Fatal("a bad signature should be rejected")
+	}
+	signed.Signatures[names[3]] = good
+	chains[2].Handle(names[3], signed)
+	if len(ours.Signers()) != len(names) {
+		t.Fatal("a good signature should still count after a bad one")
+	}
+
+	// A chain restarted from a checkpoint keeps making digests
+	slot := DigestInterval + 5
+	hash := ""
+	for i := 1; i <= slot; i++ {
+		hash = ChainHash(hash, chains[1].Externalized(i))
+	}
+	restarted := NewEmptyChain(names[0], qs, NewTestValueStore(0), RealClock{})
+	restarted.SetSigner(keys[0])
+	latest := util.EncodeThenDecode(chains[0].Digest(DigestInterval)).(*DigestMessage)
+	if restarted.RestoreCheckpoint(chains[1].Externalized(slot), hash, d) == nil {
+		t.Fatal("a digest from after the checkpoint should be refused")
+	}
+	if err := restarted.RestoreCheckpoint(chains[1].Externalized(slot), hash, latest); err != nil {
+		t.Fatal(err)
+	}
+	for i := slot + 1; i <= 2*DigestInterval; i++ {
+		if err := restarted.Restore(chains[1].Externalized(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	again := restarted.Digest(2 * DigestInterval)
+	if again == nil || again.Hash != d.Hash || again.Prev != d.Prev {
+		t.Fatalf("the restarted chain made a bad digest: %s", again)
+	}
+
+	// Pruning keeps the latest digest, which the next one needs
+	chains[0].Prune(2*DigestInterval + 1)
+	if chains[0].Digest(DigestInterval) != nil || chains[0].Digest(2*DigestInterval) == nil {
+		t.Fatal("pruning should only keep the latest digest")
+	}
+}
+
+func TestChainParticipation(t *testing.T) {
+	chains := chainCluster(4)
+	live := chains[0:3]
+	for i := 0; i < 1000 && progress(live) < 5; i++ {
+		for _, source := range live {
+			for _, target := range live {
+				chainSend(source, target)
+			}
+		}
+		for _, chain := range live {
+			chain.HandleTimerTick()
+		}
+	}
+	if progress(live) < 5 {
+		t.Fatal("the chains did not make progress")
+	}
+
+	p := live[0].Participation(1)
+	if p == nil || len(p.Balloted) < 3 {
+		t.Fatalf("bad participation for slot 1: %+v", p)
+	}
+	rates := live[0].Metrics().Participation
+	if len(rates) != 4 {
+		t.Fatalf("expected a rate for every member but got %d", len(rates))
+	}
+	for _, r := range rates {
+		if r.Slots < 5 {
+			t.Fatalf("expected at least 5 slots in %s", r)
+		}
+		knockedOut := r.Node == chains[3].publicKey
+		if knockedOut != (r.Balloted == 0) {
+			t.Fatalf("unexpected participation: %s", r)
+		}
+		if knockedOut && r.NominationRate() != 0 {
+			t.Fatalf("the knocked out node should not have nominated: %s", r)
+		}
+	}
+}
+
+func TestChainSlotStats(t *testing.T) {
+	chains := chainCluster(4)
+	for i := 0; i < 1000 && progress(chains) < 3; i++ {
+		for _, source := range chains {
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+	}
+	if progress(chains) < 3 {
+		t.Fatal("the chains did not make progress")
+	}
+
+	stats := chains[0].Stats()
+	if len(stats) < 3 {
+		t.Fatalf("expected stats for at least 3 slots but got %d", len(stats))
+	}
+	for i, s := range stats {
+		if s.Slot != i+1 {
+			t.Fatalf("stats are out of order: %s", s)
+		}
+		if s.MessagesProcessed == 0 {
+			t.Fatalf("expected messages in %s", s)
+		}
+		if s.NominationDuration < 0 || s.BallotDuration < 0 {
+			t.Fatalf("negative durations in %s", s)
+		}
+	}
+	if chains[0].SlotStats(2) != stats[1] {
+		t.Fatal("SlotStats should find the stats for slot 2")
+	}
+	if chains[0].SlotStats(chains[0].Slot()) != nil {
+		t.Fatal("the current slot should not have stats yet")
+	}
+}
+
+func TestChainRetriesFinalizing(t *testing.T) {
+	chains := chainCluster(4)
+	vs := chains[0].values.(*TestValueStore)
+	vs.FinalizeDelay = 1000000
+	for i := 0; i < 100 && chains[0].Stalled() == nil; i++ {
+		for _, source := range chains {
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+	}
+	e := chains[0].Stalled()
+	if e == nil || e.I != 1 || chains[0].Slot() != 1 {
+		t.Fatal("chain 0 should be stuck on slot 1")
+	}
+	if chains[1].Stalled() != nil {
+		t.Fatal("chain 1 should not be stuck")
+	}
+
+	// The value store can finalize now, but nobody told the chain
+	vs.FinalizeDelay = 0
+	if !chains[0].HandleTimerTick() || chains[0].Slot() != 2 {
+		t.Fatal("a timer tick should retry finalizing")
+	}
+	if chains[0].Stalled() != nil || chains[0].Externalized(1).X != e.X {
+		t.Fatal("chain 0 should have finalized slot 1")
+	}
+}
+
+func TestChainRejectsDisjointQuorumSlice(t *testing.T) {
+	chains := chainCluster(4)
+	c := chains[0]
+	old := c.D
+	names := append([]util.PublicKey{}, old.Members...)
+
+	// Dropping one node still leaves the old and new slices overlapping
+	smaller := MakeQuorumSlice([]util.PublicKey{names[0], names[1], names[2]}, 3)
+	if err := c.SetQuorumSlice(smaller); err != nil {
+		t.Fatal(err)
+	}
+	if c.D.Threshold != 3 || len(c.D.Members) != 3 {
+		t.Fatalf("the slice did not change: %s", &c.D)
+	}
+
+	// Switching to strangers would let two quorums decide different values
+	strangers := MakeQuorumSlice([]util.PublicKey{names[0], "X", "Y"}, 2)
+	err := c.SetQuorumSlice(strangers)
+	if !errors.Is(err, ErrNoIntersection) {
+		t.Fatalf("expected no intersection but got %v", err)
+	}
+	if len(c.D.Members) != 3 || c.D.Members[2] != names[2] {
+		t.Fatalf("a rejected slice should not change anything: %s", &c.D)
+	}
+	if len(c.Declarations(c.publicKey)) != 2 {
+		t.Fatalf("a rejected slice should not be declared: %+v",
+			c.Declarations(c.publicKey))
+	}
+
+	// We have to be in our own slice
+	if c.SetQuorumSlice(MakeQuorumSlice([]util.PublicKey{names[1], names[2]}, 2)) == nil {
+		t.Fatal("a slice without ourselves should be rejected")
+	}
+}
+
+// idleValueStore never has anything to suggest
+type idleValueStore struct {
+	*TestValueStore
+}
+
+func (s idleValueStore) SuggestValue() (SlotValue, bool) {
+	return SlotValue(""), false
+}
+
+func TestChainEmptySlots(t *testing.T) {
+	qs, names := MakeTestQuorumSlice(4)
+	chains := []*Chain{}
+	apps := []idleValueStore{}
+	for i, name := range names {
+		vs := NewCompositeValueStore()
+		app := idleValueStore{NewTestValueStore(i)}
+		vs.Add("app", app)
+		apps = append(apps, app)
+		chains = append(chains, NewEmptyChain(name, qs, vs, RealClock{}))
+	}
+	run := func(ticks int) {
+		for i := 0; i < ticks; i++ {
+			for _, chain := range chains {
+				chain.HandleTimerTick()
+			}
+			for _, source := range chains {
+				for _, target := range chains {
+					chainSend(source, target)
+				}
+			}
+		}
+	}
+
+	run(20)
+	if progress(chains) != 0 {
+		t.Fatal("slots should not advance with nothing to nominate")
+	}
+
+	// Only one chain needs to nominate empty values for the others to agree
+	chains[0].SetEmptySlotTicks(3)
+	run(100)
+	if progress(chains) < 3 {
+		t.Fatalf("only %d slots advanced", progress(chains))
+	}
+	checkProgress(chains, 3, t)
+	if chains[1].Externalized(1).X != EmptyValue {
+		t.Fatalf("slot 1 should be empty but it is %s", chains[1].Externalized(1).X)
+	}
+	if apps[1].Last() != "" {
+		t.Fatalf("empty slots should not be finalized by the app")
+	}
+
+	// Anything real still wins over an empty value
+	v := chains[1].values.Combine([]SlotValue{EmptyValue, "app=x"})
+	if v != "app=x" {
+		t.Fatalf("bad combined value: %s", v)
+	}
+}
+
+func TestChainPause(t *testing.T) {
+	chains := chainCluster(4)
+	exchange := func() {
+		for _, source := range chains {
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+	}
+	votes := func(c *Chain, slot int) bool {
+		for _, m := range c.OutgoingMessages() {
+			switch m.(type) {
+			case *NominationMessage, *PrepareMessage, *ConfirmMessage, *ExternalizeMessage:
+				if m.Slot() >= slot {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// Chain 0 has voted on slot 1, so it finishes that slot before pausing
+	exchange()
+	chains[0].Pause()
+	if !chains[0].Paused() || !votes(chains[0], 1) {
+		t.Fatal("chain 0 should still vote on slot 1")
+	}
+
+	// The others can go on without chain 0, and chain 0 keeps up
+	for i := 0; i < 100 && progress(chains) < 4; i++ {
+		exchange()
+		if votes(chains[0], 2) {
+			t.Fatal("chain 0 should not vote after slot 1")
+		}
+	}
+	if progress(chains) < 4 {
+		t.Fatalf("only %d slots were finished while chain 0 was paused", progress(chains))
+	}
+	checkProgress(chains, 4, t)
+
+	chains[0].Resume()
+	if chains[0].Paused() || !votes(chains[0], chains[0].Slot()) {
+		t.Fatal("chain 0 should vote again after resuming")
+	}
+	for i := 0; i < 100 && progress(chains) < 6; i++ {
+		exchange()
+	}
+	checkProgress(chains, 6, t)
+}
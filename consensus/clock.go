@@ -0,0 +1,46 @@
+package consensus
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the consensus logic what time it is. The timers that drive
+// consensus count ticks rather than reading the clock, but how long slots
+// take is measured with it. Simulations and tests use a SimulatedClock, so
+// that they can advance time deterministically, in step with the ticks.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the system clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// A SimulatedClock only moves when it is advanced.
+// SimulatedClock is threadsafe.
+type SimulatedClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewSimulatedClock makes a clock that starts at the given time.
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	return &SimulatedClock{now: start}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward.
+func (c *SimulatedClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
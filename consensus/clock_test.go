@@ -0,0 +1,148 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"coinkit/util"
+)
+
+// A simulation runs a cluster of chains against a simulated clock. Each
+// step delivers every outgoing message once, then advances the clock by one
+// tick and ticks every chain, so simulated time matches the timers exactly.
+type simulation struct {
+	chains []*Chain
+	clock  *SimulatedClock
+
+	// filter can change or drop messages on their way. Nil delivers them
+	// unchanged
+	filter func(util.Message) util.Message
+}
+
+// How much simulated time one tick takes
+const simulatedTick = time.Second
+
+func newSimulation(size int) *simulation {
+	clock := NewSimulatedClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	qs, names := MakeTestQuorumSlice(size)
+	chains := []*Chain{}
+	for i, name := range names {
+		chains = append(chains, NewEmptyChain(name, qs, NewTestValueStore(i), clock))
+	}
+	return &simulation{chains: chains, clock: clock}
+}
+
+func (sim *simulation) deliver() {
+	for _, source := range sim.chains {
+		for _, target := range sim.chains {
+			if source == target {
+				continue
+			}
+			for _, message := range source.OutgoingMessages() {
+				m := util.EncodeThenDecode(message)
+				if sim.filter != nil {
+					m = sim.filter(m)
+				}
+				if m == nil {
+					continue
+				}
+				if response := target.Handle(source.publicKey, m); response != nil {
+					source.Handle(target.publicKey, response)
+				}
+			}
+		}
+	}
+}
+
+func (sim *simulation) step() {
+	sim.deliver()
+	sim.clock.Advance(simulatedTick)
+	for _, chain := range sim.chains {
+		chain.HandleTimerTick()
+	}
+}
+
+// forgetCommits strips the votes to commit out of prepare messages, and
+// drops the later phases entirely. Nodes can still prepare ballots, but
+// never commit one, so they keep timing out and moving to higher ballots.
+func forgetCommits(m util.Message) util.Message {
+	switch m := m.(type) {
+	case *PrepareMessage:
+		stripped := *m
+		stripped.Cn = 0
+		stripped.Hn = 0
+		return &stripped
+	case *ConfirmMessage, *ExternalizeMessage:
+		return nil
+	}
+	return m
+}
+
+func TestSimulatedSlotTimes(t *testing.T) {
+	sim := newSimulation(4)
+	start := sim.clock.Now()
+	for i := 0; i < 100 && progress(sim.chains) < 3; i++ {
+		sim.step()
+	}
+	if progress(sim.chains) < 3 {
+		t.Fatalf("only externalized %d slots", progress(sim.chains))
+	}
+	for _, chain := range sim.chains {
+		total := time.Duration(0)
+		for _, stats := range chain.Stats() {
+			if stats.Duration()%simulatedTick != 0 {
+				t.Fatalf("slot %d took %s, which is not a whole number of ticks",
+					stats.Slot, stats.Duration())
+			}
+			total += stats.Duration()
+		}
+		if total > sim.clock.Now().Sub(start) {
+			t.Fatalf("the slots took %s, but only %s went by",
+				total, sim.clock.Now().Sub(start))
+		}
+	}
+
+	// Without any messages, the current slot just waits
+	before := sim.chains[0].Metrics().TimeInSlot
+	for i := 0; i < 5; i++ {
+		sim.clock.Advance(simulatedTick)
+		sim.chains[0].HandleTimerTick()
+	}
+	if after := sim.chains[0].Metrics().TimeInSlot; after-before != 5*simulatedTick {
+		t.Fatalf("expected the slot to take 5s longer, but it went from %s to %s",
+			before, after)
+	}
+}
+
+func TestSimulatedBallotTimeouts(t *testing.T) {
+	sim := newSimulation(4)
+	sim.filter = forgetCommits
+	chain := sim.chains[0]
+
+	// When we reached each ballot
+	reached := map[int]time.Time{}
+	for i := 0; i < 60; i++ {
+		sim.step()
+		if b := chain.current.bState.b; b != nil {
+			if _, ok := reached[b.n]; !ok {
+				reached[b.n] = sim.clock.Now()
+			}
+		}
+	}
+	if chain.Slot() != 1 {
+		t.Fatal("nothing should externalize when nobody can commit")
+	}
+	n := chain.current.bState.b.n
+	if n < 5 {
+		t.Fatalf("expected the ballot to time out repeatedly, but only reached ballot %d", n)
+	}
+	for i := 1; i < n; i++ {
+		waited := reached[i+1].Sub(reached[i])
+		if waited < time.Duration(BallotTimeout(i))*simulatedTick {
+			t.Fatalf("ballot %d only lasted %s", i, waited)
+		}
+	}
+	if bumps := chain.Metrics().BallotBumps; bumps != n-1 {
+		t.Fatalf("expected %d ballot bumps but got %d", n-1, bumps)
+	}
+}
@@ -0,0 +1,199 @@
+package consensus
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// An App is an application that can share a chain with other applications,
+// through a CompositeValueStore.
+type App interface {
+	ValueStore
+
+	// Skip is called instead of Finalize when a value is finalized that has
+	// nothing for this app, so that the app can keep track of the slot.
+	Skip()
+}
+
+// A CompositeValueStore lets several apps share one chain. Its slot values
+// are made up of one section per app, so each app can finalize its own part.
+// App names and app values must not contain the separator characters "=" and
+// ";".
+// CompositeValueStore is not threadsafe.
+type CompositeValueStore struct {
+	names []string
+	apps  map[string]App
+	last  SlotValue
+}
+
+func NewCompositeValueStore() *CompositeValueStore {
+	return &CompositeValueStore{
+		names: []string{},
+		apps:  make(map[string]App),
+		last:  SlotValue(""),
+	}
+}
+
+// Add adds an app to the store. Every node in the network must have the same
+// apps, so this should only be called before the chain starts.
+func (c *CompositeValueStore) Add(name string, app App) {
+	if strings.ContainsAny(name, "=;") || name == "" {
+		log.Fatalf("bad app name: %q", name)
+	}
+	if _, ok := c.apps[name]; ok {
+		log.Fatalf("app %s was added twice", name)
+	}
+	c.names = append(c.names, name)
+	sort.Strings(c.names)
+	c.apps[name] = app
+}
+
+// JoinSections makes a composite slot value out of per-app slot values.
+// Apps with an empty value are left out.
+func JoinSections(sections map[string]SlotValue) SlotValue {
+	parts := []string{}
+	for name, v := range sections {
+		if v != "" {
+			parts = append(parts, name+"="+string(v))
+		}
+	}
+	sort.Strings(parts)
+	return SlotValue(strings.Join(parts, ";"))
+}
+
+// SplitSections splits a composite slot value into per-app slot values.
+// It returns false if the value is malformed.
+func SplitSections(v SlotValue) (map[string]SlotValue, bool) {
+	answer := make(map[string]SlotValue)
+	if v == "" {
+		return answer, true
+	}
+	for _, part := range strings.Split(string(v), ";") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, false
+		}
+		if _, ok := answer[pair[0]]; ok {
+			return nil, false
+		}
+		answer[pair[0]] = SlotValue(pair[1])
+	}
+	return answer, true
+}
+
+// sections splits a value, returning false if it is malformed or has
+// sections for apps we don't have. EmptyValue has no sections.
+func (c *CompositeValueStore) sections(v SlotValue) (map[string]SlotValue, bool) {
+	if v == EmptyValue {
+		return make(map[string]SlotValue), true
+	}
+	sections, ok := SplitSections(v)
+	if !ok {
+		return nil, false
+	}
+	for name, _ := range sections {
+		if _, ok := c.apps[name]; !ok {
+			return nil, false
+		}
+	}
+	return sections, true
+}
+
+// Combine combines each app's sections separately. Empty values only count
+// when there is nothing else.
+func (c *CompositeValueStore) Combine(list []SlotValue) SlotValue {
+	combined := make(map[string]SlotValue)
+	for _, name := range c.names {
+		values := []SlotValue{}
+		for _, v := range list {
+			sections, ok := c.sections(v)
+			if !ok {
+				continue
+			}
+			if section, ok := sections[name]; ok {
+				values = append(values, section)
+			}
+		}
+		if len(values) > 0 {
+			combined[name] = c.apps[name].Combine(values)
+		}
+	}
+	if len(combined) == 0 && HasSlotValue(list, EmptyValue) {
+		return EmptyValue
+	}
+	return JoinSections(combined)
+}
+
+func (c *CompositeValueStore) CanFinalize(v SlotValue) bool {
+	sections, ok := c.sections(v)
+	if !ok {
+		return false
+	}
+	// Check every app, so that they all go fetch whatever they are missing
+	answer := true
+	for _, name := range c.names {
+		if section, ok := sections[name]; ok {
+			if !c.apps[name].CanFinalize(section) {
+				answer = false
+			}
+		}
+	}
+	return answer
+}
+
+func (c *CompositeValueStore) Finalize(v SlotValue) {
+	sections, ok := c.sections(v)
+	if !ok {
+		log.Fatalf("cannot finalize malformed value %s", v)
+	}
+	for _, name := range c.names {
+		if section, ok := sections[name]; ok {
+			c.apps[name].Finalize(section)
+		} else {
+			c.apps[name].Skip()
+		}
+	}
+	c.last = v
+}
+
+func (c *CompositeValueStore) Last() SlotValue {
+	return c.last
+}
+
+// SuggestValue combines the suggestions of every app that has one.
+func (c *CompositeValueStore) SuggestValue() (SlotValue, bool) {
+	suggestions := make(map[string]SlotValue)
+	for _, name := range c.names {
+		if v, ok := c.apps[name].SuggestValue(); ok {
+			suggestions[name] = v
+		}
+	}
+	if len(suggestions) == 0 {
+		return SlotValue(""), false
+	}
+	return JoinSections(suggestions), true
+}
+
+// ValidateValue validates every section of a value with its app.
+// EmptyValue is always valid, so that nodes which don't externalize empty
+// slots themselves still agree to them.
+func (c *CompositeValueStore) ValidateValue(v SlotValue) bool {
+	if v == EmptyValue {
+		return true
+	}
+	sections, ok := c.sections(v)
+	if !ok || len(sections) == 0 {
+		return false
+	}
+	// Check every app, so that they all go fetch whatever they are missing
+	answer := true
+	for _, name := range c.names {
+		if section, ok := sections[name]; ok {
+			if !c.apps[name].ValidateValue(section) {
+				answer = false
+			}
+		}
+	}
+	return answer
+}
@@ -0,0 +1,122 @@
+package consensus
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// Every this many slots, a chain makes a digest of everything it has
+// externalized
+const DigestInterval = 10
+
+// A DigestMessage commits to every value externalized up to and including
+// slot I, through a hash chain. Nodes sign the digests they agree with, so a
+// light client that trusts their quorum can check history against a digest
+// without downloading every block.
+// A DigestMessage with no Hash asks for our digest of slot I.
+// Implements Message.
+type DigestMessage struct {
+	// The last slot that is included. A multiple of DigestInterval
+	I int
+
+	// The hash chain as of the previous digest, DigestInterval slots earlier
+	Prev string
+
+	// The hash chain as of slot I
+	Hash string
+
+	// Signatures of the digest, keyed by the public key of the signer
+	Signatures map[util.PublicKey]string `json:",omitempty"`
+
+	// Signatures that we found to be bad, so we don't check them again
+	rejected map[util.PublicKey]string
+}
+
+func (m *DigestMessage) MessageType() string {
+	return "G"
+}
+
+func (m *DigestMessage) Slot() int {
+	return m.I
+}
+
+func (m *DigestMessage) String() string {
+	if m.Hash == "" {
+		return fmt.Sprintf("digest i=%d request", m.I)
+	}
+	return fmt.Sprintf("digest i=%d hash=%s signatures=%d",
+		m.I, util.Shorten(m.Hash), len(m.Signatures))
+}
+
+func (m *DigestMessage) Validate() error {
+	if m.I < 1 || m.I%DigestInterval != 0 {
+		return invalidf("digest slot %d", m.I)
+	}
+	return nil
+}
+
+func init() {
+	util.RegisterMessageType(&DigestMessage{})
+}
+
+// ChainHash extends the hash chain as of the slot before e with e's value.
+// The hash chain before slot 1 is empty.
+func ChainHash(prev string, e *ExternalizeMessage) string {
+	return HashString(fmt.Sprintf("%s\n%d\n%s", prev, e.I, e.X))
+}
+
+// signedString is what signers of the digest sign.
+func (m *DigestMessage) signedString() string {
+	return fmt.Sprintf("digest %d %s %s", m.I, m.Prev, m.Hash)
+}
+
+// Sign adds a signature of the digest by kp.
+func (m *DigestMessage) Sign(kp *util.KeyPair) {
+	if m.Signatures == nil {
+		m.Signatures = make(map[util.PublicKey]string)
+	}
+	m.Signatures[kp.PublicKey()] = kp.Sign(m.signedString())
+}
+
+// Signers returns the nodes whose signatures of the digest are valid, in
+// sorted order.
+func (m *DigestMessage) Signers() []util.PublicKey {
+	answer := []util.PublicKey{}
+	for signer, signature := range m.Signatures {
+		if util.Verify(signer, m.signedString(), signature) {
+			answer = append(answer, signer)
+		}
+	}
+	util.SortPublicKeys(answer)
+	return answer
+}
+
+// VerifySigners checks that the valid signatures of the digest satisfy qs.
+func (m *DigestMessage) VerifySigners(qs QuorumSlice) error {
+	signers := m.Signers()
+	if !qs.SatisfiedWith(signers) {
+		return fmt.Errorf("digest for slot %d is only signed by %d nodes", m.I, len(signers))
+	}
+	return nil
+}
+
+// VerifyHistory checks that the externalized values for the slots after the
+// previous digest, in order, lead to this digest.
+func (m *DigestMessage) VerifyHistory(history []*ExternalizeMessage) error {
+	if len(history) != DigestInterval {
+		return fmt.Errorf("digest for slot %d covers %d slots, not %d",
+			m.I, DigestInterval, len(history))
+	}
+	hash := m.Prev
+	for i, e := range history {
+		if e == nil || e.I != m.I-DigestInterval+1+i {
+			return fmt.Errorf("history for digest %d is out of order", m.I)
+		}
+		hash = ChainHash(hash, e)
+	}
+	if hash != m.Hash {
+		return fmt.Errorf("history does not match the digest for slot %d", m.I)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidMessage means a message contradicts itself, so no honest
+	// node could have sent it.
+	ErrInvalidMessage = errors.New("invalid message")
+
+	// ErrBrokenInvariant means that handling a message would have left the
+	// ballot state inconsistent. With well-behaved peers this can't happen.
+	ErrBrokenInvariant = errors.New("ballot invariant violated")
+)
+
+func invalidf(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidMessage, fmt.Sprintf(format, a...))
+}
+
+// validateValues checks that a list of slot values has no blanks or dupes.
+func validateValues(name string, values []SlotValue) error {
+	seen := make(map[SlotValue]bool)
+	for _, v := range values {
+		if v == "" {
+			return invalidf("%s has a blank value", name)
+		}
+		if seen[v] {
+			return invalidf("%s has %s twice", name, v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+// validateRange checks the c and h ballot numbers that ballot messages share.
+func validateRange(cn int, hn int) error {
+	if cn < 0 || hn < 0 {
+		return invalidf("negative ballot number")
+	}
+	if cn > hn {
+		return invalidf("c=%d is above h=%d", cn, hn)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package consensus_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A wordStore is a tiny application. Each node proposes a word, and the
+// network agrees on a sorted list of words for each slot.
+type wordStore struct {
+	word string
+	last consensus.SlotValue
+}
+
+func (s *wordStore) Combine(list []consensus.SlotValue) consensus.SlotValue {
+	words := map[string]bool{}
+	for _, v := range list {
+		for _, word := range strings.Split(string(v), " ") {
+			words[word] = true
+		}
+	}
+	answer := []string{}
+	for word := range words {
+		answer = append(answer, word)
+	}
+	sort.Strings(answer)
+	return consensus.SlotValue(strings.Join(answer, " "))
+}
+
+func (s *wordStore) CanFinalize(v consensus.SlotValue) bool {
+	return true
+}
+
+func (s *wordStore) Finalize(v consensus.SlotValue) {
+	s.last = v
+}
+
+func (s *wordStore) Last() consensus.SlotValue {
+	return s.last
+}
+
+func (s *wordStore) SuggestValue() (consensus.SlotValue, bool) {
+	return consensus.SlotValue(s.word), true
+}
+
+func (s *wordStore) ValidateValue(v consensus.SlotValue) bool {
+	return v != ""
+}
+
+// A delivery is a message on its way from one node to another
+type delivery struct {
+	from    util.PublicKey
+	to      util.PublicKey
+	message util.Message
+}
+
+// localNetwork is a Transport for nodes in the same process. Messages wait
+// in a queue until the network delivers them.
+type localNetwork struct {
+	nodes   map[util.PublicKey]*consensus.Node
+	names   []util.PublicKey
+	pending []*delivery
+}
+
+// localTransport is how a single node sends messages on a localNetwork
+type localTransport struct {
+	network *localNetwork
+	name    util.PublicKey
+}
+
+func (t *localTransport) Broadcast(messages []util.Message) {
+	for _, name := range t.network.names {
+		if name == t.name {
+			continue
+		}
+		for _, m := range messages {
+			t.Send(name, m)
+		}
+	}
+}
+
+func (t *localTransport) Send(node util.PublicKey, message util.Message) {
+	// Encoding the message makes sure that nodes don't share memory, just
+	// like on a real network
+	t.network.pending = append(t.network.pending, &delivery{
+		from:    t.name,
+		to:      node,
+		message: util.EncodeThenDecode(message),
+	})
+}
+
+// deliver delivers every message that is waiting.
+func (n *localNetwork) deliver() {
+	for len(n.pending) > 0 {
+		d := n.pending[0]
+		n.pending = n.pending[1:]
+		n.nodes[d.to].Receive(d.from, d.message)
+	}
+}
+
+// slowest returns the lowest slot that any node is working on.
+func (n *localNetwork) slowest() int {
+	answer := 0
+	for _, node := range n.nodes {
+		if answer == 0 || node.Slot() < answer {
+			answer = node.Slot()
+		}
+	}
+	return answer
+}
+
+// This example runs a network of four nodes in one process. Each proposes a
+// word, and they agree on a value for the first slot.
+func Example() {
+	words := []string{"apple", "banana", "cherry", "date"}
+	qs, names := consensus.MakeTestQuorumSlice(len(words))
+	network := &localNetwork{
+		nodes: make(map[util.PublicKey]*consensus.Node),
+		names: names,
+	}
+	for i, name := range names {
+		transport := &localTransport{network: network, name: name}
+		store := &wordStore{word: words[i]}
+		network.nodes[name] = consensus.NewNode(name, qs, store, transport)
+	}
+
+	// Normally each node would tick on its own timer
+	for network.slowest() == 1 {
+		for _, name := range names {
+			network.nodes[name].Tick()
+		}
+		network.deliver()
+	}
+
+	// Every node decided on the same value
+	for _, name := range names {
+		fmt.Println(network.nodes[name].Externalized(1).X)
+	}
+	// Output:
+	// date
+	// date
+	// date
+	// date
+}
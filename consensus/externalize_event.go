@@ -0,0 +1,56 @@
+package consensus
+
+import (
+	"fmt"
+	"time"
+
+	"coinkit/util"
+)
+
+// An ExternalizeEvent is sent to subscribers whenever a chain finishes a block.
+type ExternalizeEvent struct {
+	Slot  int
+	Value SlotValue
+
+	// When we started working on the block, and how long it took
+	Start    time.Time
+	Duration time.Duration
+
+	// Whether the block was restored from saved history rather than going
+	// through consensus
+	Restored bool
+}
+
+func (e *ExternalizeEvent) String() string {
+	return fmt.Sprintf("slot %d externalized %s in %.1fs",
+		e.Slot, util.Shorten(string(e.Value)), e.Duration.Seconds())
+}
+
+// Subscribe registers a channel to get an event whenever a block
+// externalizes. Events are sent without blocking, since the chain is not
+// threadsafe and can't wait on subscribers, so a subscriber that falls behind
+// misses events. Give the channel a buffer.
+func (c *Chain) Subscribe(ch chan<- *ExternalizeEvent) {
+	c.subscribers = append(c.subscribers, ch)
+}
+
+// publish sends an event for a finished block to every subscriber.
+func (c *Chain) publish(b *Block, restored bool) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+	e := &ExternalizeEvent{
+		Slot:     b.slot,
+		Value:    b.external.X,
+		Start:    b.start,
+		Duration: b.clock.Now().Sub(b.start),
+		Restored: restored,
+	}
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- e:
+		default:
+			c.Logf("a subscriber is full, dropping event for slot %d", e.Slot)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package consensus
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"coinkit/util"
+)
+
+// Metrics describe how consensus is going on the slot a node is working on,
+// so that operators can tell whether it is healthy.
+type Metrics struct {
+	Slot  int
+	Phase Phase
+
+	// The current ballot number, or zero if we haven't started balloting
+	BallotNumber int
+
+	// How many times we gave up on a ballot and went to the next one
+	BallotBumps int
+
+	// How many consensus messages we have received for this slot
+	MessagesReceived int
+
+	// How long we have been working on this slot
+	TimeInSlot time.Duration
+
+	// The peers that sent us ballot messages which would have broken our
+	// ballot state. Those messages were dropped
+	Quarantined []util.PublicKey
+
+	// How often each node took part in the recent slots
+	Participation []*ParticipationRate
+}
+
+func (m *Metrics) String() string {
+	s := fmt.Sprintf("slot %d: %s, ballot %d, %d bumps, %d messages, %.1fs",
+		m.Slot, m.Phase, m.BallotNumber, m.BallotBumps, m.MessagesReceived,
+		m.TimeInSlot.Seconds())
+	if len(m.Quarantined) > 0 {
+		peers := []string{}
+		for _, peer := range m.Quarantined {
+			peers = append(peers, util.Shorten(string(peer)))
+		}
+		s += fmt.Sprintf(", quarantined %s", strings.Join(peers, ","))
+	}
+	return s
+}
@@ -0,0 +1,144 @@
+package consensus
+
+import (
+	"coinkit/util"
+)
+
+// A Transport delivers consensus messages between nodes. Applications that
+// embed a Node provide one over whatever network they use. Messages can be
+// serialized with util.EncodeMessage and read back with util.DecodeMessage.
+type Transport interface {
+	// Broadcast sends messages to every node we are connected to
+	Broadcast(messages []util.Message)
+
+	// Send sends a message to a single node
+	Send(node util.PublicKey, message util.Message)
+}
+
+// A Node runs the consensus protocol for one participant in a network,
+// agreeing with the others on one value per slot. The values come from a
+// ValueStore, which is where the application plugs in, and messages go
+// through a Transport.
+// Node is not threadsafe. The application should call it from one goroutine.
+type Node struct {
+	chain     *Chain
+	transport Transport
+}
+
+// NewNode creates a node with the given public key, which is how the other
+// nodes refer to it. qs is the set of nodes it listens to.
+func NewNode(publicKey util.PublicKey, qs QuorumSlice, values ValueStore,
+	transport Transport) *Node {
+	return &Node{
+		chain:     NewEmptyChain(publicKey, qs, values, RealClock{}),
+		transport: transport,
+	}
+}
+
+// Receive handles a message that the transport got from another node. If
+// the message needs a response, it is sent straight back to the sender.
+func (n *Node) Receive(sender util.PublicKey, message util.Message) {
+	response := n.chain.Handle(sender, message)
+	if response != nil {
+		n.transport.Send(sender, response)
+	}
+}
+
+// Tick drives the nomination and ballot timers, and broadcasts our current
+// messages. It should be called at regular intervals, about once a second.
+func (n *Node) Tick() {
+	n.chain.HandleTimerTick()
+	n.Broadcast()
+}
+
+// Broadcast sends our current messages to everyone. Tick does this already,
+// but the application can call it in between to speed things up.
+func (n *Node) Broadcast() {
+	n.transport.Broadcast(n.chain.OutgoingMessages())
+}
+
+// ValueStoreUpdated should be called when the value store learns something
+// that could make ValidateValue or CanFinalize return true where they didn't
+// before.
+func (n *Node) ValueStoreUpdated() {
+	n.chain.ValueStoreUpdated()
+}
+
+// SetQuorumSlice changes the set of nodes we listen to, starting with the
+// next slot. See Chain.SetQuorumSlice for the safety checks.
+func (n *Node) SetQuorumSlice(qs QuorumSlice) error {
+	return n.chain.SetQuorumSlice(qs)
+}
+
+// SetEmptySlotTicks makes the node nominate an empty value when a slot goes
+// this many ticks with nothing to nominate. See Chain.SetEmptySlotTicks.
+func (n *Node) SetEmptySlotTicks(ticks int) {
+	n.chain.SetEmptySlotTicks(ticks)
+}
+
+// Pause stops the node from voting, once it finishes the current slot. See
+// Chain.Pause.
+func (n *Node) Pause() {
+	n.chain.Pause()
+}
+
+// Resume starts voting again after Pause.
+func (n *Node) Resume() {
+	n.chain.Resume()
+}
+
+// SetSigner makes the node sign its digests with kp.
+func (n *Node) SetSigner(kp *util.KeyPair) {
+	n.chain.SetSigner(kp)
+}
+
+// Slot returns the slot the node is working on. Every earlier slot has been
+// finalized.
+func (n *Node) Slot() int {
+	return n.chain.Slot()
+}
+
+// Externalized returns how a finished slot was decided, or nil if we don't
+// know.
+func (n *Node) Externalized(slot int) *ExternalizeMessage {
+	return n.chain.Externalized(slot)
+}
+
+// Stalled returns how the current slot was decided, if the value store can't
+// finalize it yet. See Chain.Stalled.
+func (n *Node) Stalled() *ExternalizeMessage {
+	return n.chain.Stalled()
+}
+
+// Subscribe registers a channel to get an event whenever a slot is
+// finalized. See Chain.Subscribe.
+func (n *Node) Subscribe(ch chan<- *ExternalizeEvent) {
+	n.chain.Subscribe(ch)
+}
+
+// Prune forgets how slots before the provided one were decided.
+func (n *Node) Prune(before int) {
+	n.chain.Prune(before)
+}
+
+// Metrics reports how consensus is going on the current slot.
+func (n *Node) Metrics() *Metrics {
+	return n.chain.Metrics()
+}
+
+// Stats returns how long the recent slots took, oldest first.
+func (n *Node) Stats() []*SlotStats {
+	return n.chain.Stats()
+}
+
+// ParticipationRates returns how often each node took part in the recent
+// slots.
+func (n *Node) ParticipationRates() []*ParticipationRate {
+	return n.chain.ParticipationRates()
+}
+
+// Chain returns the chain underneath the node, for applications that need
+// more control than the node gives them.
+func (n *Node) Chain() *Chain {
+	return n.chain
+}
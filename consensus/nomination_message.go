@@ -1,6 +1,7 @@
 package consensus
 
 import (
+	"encoding/json"
 	"strings"
 	
 	"coinkit/util"
@@ -20,6 +21,11 @@ type NominationMessage struct {
 	// The values we have accepted as nominated
 	Acc []SlotValue
 
+	// Goes up every time the sender's nomination changes, so that a newer
+	// message can be told from an older one. Nom and Acc are sets, so their
+	// order means nothing
+	C int
+
 	D QuorumSlice
 }
 
@@ -50,6 +56,39 @@ func (m *NominationMessage) String() string {
 	return answer
 }
 
+// UnmarshalJSON fills in the counter for nominations from nodes that don't
+// send one yet. Those nodes only ever add to Nom and Acc, so the number of
+// values in them goes up whenever their nomination changes, the same as C.
+func (m *NominationMessage) UnmarshalJSON(bytes []byte) error {
+	type plain NominationMessage
+	if err := json.Unmarshal(bytes, (*plain)(m)); err != nil {
+		return err
+	}
+	var counter struct {
+		C *int
+	}
+	if err := json.Unmarshal(bytes, &counter); err != nil {
+		return err
+	}
+	if counter.C == nil {
+		m.C = len(m.Nom) + len(m.Acc)
+	}
+	return nil
+}
+
+func (m *NominationMessage) Validate() error {
+	if m.I < 1 {
+		return invalidf("slot %d", m.I)
+	}
+	if m.C < 0 {
+		return invalidf("counter %d", m.C)
+	}
+	if err := validateValues("nominated", m.Nom); err != nil {
+		return err
+	}
+	return validateValues("accepted", m.Acc)
+}
+
 func init() {
 	util.RegisterMessageType(&NominationMessage{})
 }
@@ -18,38 +18,69 @@ type NominationState struct {
 	Z []SlotValue
 
 	// The last NominationMessage received from each node
-	N map[string]*NominationMessage
+	N map[util.PublicKey]*NominationMessage
+
+	// Values that peers nominated or accepted but that we could not
+	// validate yet. The value store might just not know about them yet.
+	pending []SlotValue
 
 	// Who we are
-	publicKey string
+	publicKey util.PublicKey
 
 	// Who we listen to for quorum
 	D QuorumSlice
 
-	// The number of messages this state has processed
-	received int
+	// Which slot we are nominating values for
+	slot int
+
+	// Nomination happens in rounds. Each round adds one more leader, a node
+	// that should nominate its own value, so that at first only the highest
+	// priority nodes nominate. Everyone else just supports their values.
+	round   int
+	leaders map[util.PublicKey]bool
+
+	// How many ticks we have spent in this round
+	timer int
+
+	// How many ticks we have spent in this slot without a nomination
+	idle int
 
-	// Which priority we think we are for creating a nomination
-	// 0 is the first priority
-	priority int
+	// Once we have been idle this many ticks, a leader with nothing to
+	// nominate nominates EmptyValue instead. Zero means we never do.
+	EmptySlotTicks int
 
 	// The value store we use to validate or combine values
 	values ValueStore
 }
 
 func NewNominationState(
-	publicKey string, qs QuorumSlice, vs ValueStore) *NominationState {
+	publicKey util.PublicKey, qs QuorumSlice, slot int, vs ValueStore) *NominationState {
 
-	return &NominationState{
+	s := &NominationState{
 		X:         make([]SlotValue, 0),
 		Y:         make([]SlotValue, 0),
 		Z:         make([]SlotValue, 0),
-		N:         make(map[string]*NominationMessage),
+		N:         make(map[util.PublicKey]*NominationMessage),
+		pending:   make([]SlotValue, 0),
 		publicKey: publicKey,
 		D:         qs,
-		priority:  SeedPriority(string(vs.Last()), qs.Members, publicKey),
+		slot:      slot,
+		leaders:   make(map[util.PublicKey]bool),
 		values:    vs,
-	}	
+	}
+	s.startRound(1)
+	return s
+}
+
+// startRound moves on to a round of nomination, adding its leader.
+func (s *NominationState) startRound(round int) {
+	s.round = round
+	s.timer = 0
+	leader := RoundLeader(s.slot, round, s.D.AllMembers())
+	if !s.leaders[leader] {
+		s.Logf("round %d leader is %s", round, util.Shorten(string(leader)))
+		s.leaders[leader] = true
+	}
 }
 
 func (s *NominationState) Logf(format string, a ...interface{}) {
@@ -71,6 +102,14 @@ func (s *NominationState) HasNomination() bool {
 	return len(s.X) > 0
 }
 
+// VotingClosed returns whether we have stopped voting to nominate new values.
+// Like the SCP paper says, once we confirm a candidate we stop voting for
+// new values, so that the candidates can converge. We can still accept
+// values that other nodes already accepted.
+func (s *NominationState) VotingClosed() bool {
+	return len(s.Z) > 0
+}
+
 // Returns whether we nominated a new value
 func (s *NominationState) MaybeNominateNewValue() bool {
 	if len(s.X) > 0 {
@@ -78,15 +117,18 @@ func (s *NominationState) MaybeNominateNewValue() bool {
 		return false
 	}
 
-	if s.D.Threshold * s.priority > s.received {
-		// We don't think it's our turn
+	if !s.leaders[s.publicKey] {
+		// It's not our turn
 		return false
 	}
 
 	v, ok := s.values.SuggestValue()
 	if !ok {
-		// We have nothing to nominate
-		return false
+		if s.EmptySlotTicks == 0 || s.idle < s.EmptySlotTicks {
+			// We have nothing to nominate
+			return false
+		}
+		v = EmptyValue
 	}
 
 	s.Logf("nominating %s", util.Shorten(string(v)))
@@ -94,12 +136,38 @@ func (s *NominationState) MaybeNominateNewValue() bool {
 	return true
 }
 
-// WantsToNominateNewValue is a heuristic. If we already have some value, we don't
-// want to nominate a new one. We also want to wait some time, according to our
-// priority, before we are willing to make a nomination.
+// WantsToNominateNewValue tells you whether it is our turn to nominate a value
+// of our own, because we are one of the leaders for this slot.
 func (s *NominationState) WantsToNominateNewValue() bool {
+	return s.leaders[s.publicKey]
+}
 
-	return s.D.Threshold * s.priority <= s.received
+// NominationTimeout returns how many ticks round n of nomination lasts. Like
+// the ballot timeout, it grows, so eventually the network has time to
+// converge.
+func NominationTimeout(round int) int {
+	return round
+}
+
+// HandleTimerTick should be called at regular intervals. When a round of
+// nomination times out before we have any value to nominate, the next round
+// starts, with one more leader. When the slot has been idle for
+// EmptySlotTicks, the leaders nominate EmptyValue.
+// Returns whether we nominated a new value.
+func (s *NominationState) HandleTimerTick() bool {
+	if s.HasNomination() {
+		return false
+	}
+	s.idle++
+	s.timer++
+	if s.timer < NominationTimeout(s.round) {
+		if s.idle == s.EmptySlotTicks {
+			return s.MaybeNominateNewValue()
+		}
+		return false
+	}
+	s.startRound(s.round + 1)
+	return s.MaybeNominateNewValue()
 }
 
 func (s *NominationState) NominateNewValue(v SlotValue) {
@@ -124,7 +192,7 @@ func (s *NominationState) PredictValue() SlotValue {
 	panic("PredictValue was called when HasNomination was false")
 }
 
-func (s *NominationState) QuorumSlice(node string) (*QuorumSlice, bool) {
+func (s *NominationState) QuorumSlice(node util.PublicKey) (*QuorumSlice, bool) {
 	if node == s.publicKey {
 		return &s.D, true
 	}
@@ -135,7 +203,7 @@ func (s *NominationState) QuorumSlice(node string) (*QuorumSlice, bool) {
 	return &m.D, true
 }
 
-func (s *NominationState) PublicKey() string {
+func (s *NominationState) PublicKey() util.PublicKey {
 	return s.publicKey
 }
 
@@ -148,16 +216,24 @@ func (s *NominationState) AssertValid() {
 // MaybeAdvance checks whether we should accept the nomination for this slot value,
 // and adds it to our accepted list if appropriate.
 // It also checks whether we should confirm the nomination.
+// We never accept a value we can't validate, since we would have to combine
+// it without knowing what it is. It waits in pending until we can.
 // Returns whether we made any changes.
 func (s *NominationState) MaybeAdvance(v SlotValue) bool {
 	if HasSlotValue(s.Z, v) {
 		// We already confirmed this, so we can't do anything more
 		return false
 	}
+	if !HasSlotValue(s.X, v) && !HasSlotValue(s.Y, v) && !s.values.ValidateValue(v) {
+		if !HasSlotValue(s.pending, v) {
+			s.pending = append(s.pending, v)
+		}
+		return false
+	}
 
 	changed := false
-	votedOrAccepted := []string{}
-	accepted := []string{}
+	votedOrAccepted := []util.PublicKey{}
+	accepted := []util.PublicKey{}
 	if HasSlotValue(s.X, v) {
 		votedOrAccepted = append(votedOrAccepted, s.publicKey)
 	}
@@ -201,52 +277,53 @@ func (s *NominationState) MaybeAdvance(v SlotValue) bool {
 }
 
 // Handles an incoming nomination message from a peer node
-func (s *NominationState) Handle(node string, m *NominationMessage) {
-	s.received++
-	
+func (s *NominationState) Handle(node util.PublicKey, m *NominationMessage) {
 	// What nodes we have seen new information about
 	touched := []SlotValue{}
 
 	// Check if there's anything new
 	old, ok := s.N[node]
-	var oldLenNom, oldLenAcc int
+	oldNom, oldAcc := []SlotValue{}, []SlotValue{}
 	if ok {
-		oldLenNom = len(old.Nom)
-		oldLenAcc = len(old.Acc)
-	}
-	if len(m.Nom) < oldLenNom {
-		s.Logf("%s sent a stale message: %v", node, m)
-		return
-	}
-	if len(m.Acc) < oldLenAcc {
-		s.Logf("%s sent a stale message: %v", node, m)
-		return
-	}
-	if len(m.Nom) == oldLenNom && len(m.Acc) == oldLenAcc {
-		// It's just a dupe
-		return
+		if m.C < old.C {
+			s.Logf("%s sent a stale message: %v", node, m)
+			return
+		}
+		if m.C == old.C {
+			// It's just a dupe
+			return
+		}
+		oldNom, oldAcc = old.Nom, old.Acc
 	}
 	// Update our most-recent-message
-	s.Logf("got message from %s: %s", util.Shorten(node), m)
+	s.Logf("got message from %s: %s", util.Shorten(string(node)), m)
 	s.N[node] = m
 
-	for i := oldLenNom; i < len(m.Nom); i++ {
-		value := m.Nom[i]
+	for _, value := range m.Nom {
+		if HasSlotValue(oldNom, value) {
+			continue
+		}
 		if !HasSlotValue(touched, value) {
 			touched = append(touched, value)
 		}
 
-		// If we don't have a candidate, and the value is valid,
-		// we can support this new nomination
-		if !HasSlotValue(s.X, value) && s.values.ValidateValue(value) {
+		if HasSlotValue(s.X, value) || s.VotingClosed() {
+			continue
+		}
+
+		// If the value is valid, we can support this new nomination.
+		// If not, we might just not know about it yet, so check again later.
+		if s.values.ValidateValue(value) {
 			s.Logf("supports the nomination of %s", util.Shorten(string(value)))
 			s.X = append(s.X, value)
+		} else if !HasSlotValue(s.pending, value) {
+			s.pending = append(s.pending, value)
 		}
 	}
 
-	for i := oldLenAcc; i < len(m.Acc); i++ {
-		if !HasSlotValue(touched, m.Acc[i]) {
-			touched = append(touched, m.Acc[i])
+	for _, value := range m.Acc {
+		if !HasSlotValue(oldAcc, value) && !HasSlotValue(touched, value) {
+			touched = append(touched, value)
 		}
 	}
 	for _, v := range touched {
@@ -254,11 +331,42 @@ func (s *NominationState) Handle(node string, m *NominationMessage) {
 	}
 }
 
+// RevalidatePending checks whether any values we could not validate before
+// are valid now. If so, we support their nomination, unless voting is closed,
+// and see whether we can accept them.
+// Returns whether we made any changes.
+func (s *NominationState) RevalidatePending() bool {
+	changed := false
+	stillPending := []SlotValue{}
+	for _, v := range s.pending {
+		if HasSlotValue(s.X, v) || HasSlotValue(s.Z, v) {
+			continue
+		}
+		if !s.values.ValidateValue(v) {
+			stillPending = append(stillPending, v)
+			continue
+		}
+		if !s.VotingClosed() {
+			s.Logf("supports the nomination of %s", util.Shorten(string(v)))
+			s.X = append(s.X, v)
+			changed = true
+		}
+		if s.MaybeAdvance(v) {
+			changed = true
+		}
+	}
+	s.pending = stillPending
+	return changed
+}
+
 func (s *NominationState) Message(slot int, qs QuorumSlice) *NominationMessage {
 	return &NominationMessage{
 		I:   slot,
 		Nom: s.X,
 		Acc: s.Y,
-		D:   qs,
+		// We only ever add to X and Y, so this goes up whenever they change.
+		// It comes back with them when we restore a snapshot, too
+		C: len(s.X) + len(s.Y),
+		D: qs,
 	}
 }
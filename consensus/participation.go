@@ -0,0 +1,133 @@
+package consensus
+
+import (
+	"fmt"
+	"sort"
+
+	"coinkit/util"
+)
+
+// We keep track of who took part in this many recent slots
+const ParticipationWindow = 100
+
+// A Participation records which nodes took part in deciding a slot, as far
+// as we could tell when it externalized. We always count ourselves.
+type Participation struct {
+	Slot int
+
+	// The nodes whose nomination messages voted for or accepted a value
+	Nominated []util.PublicKey
+
+	// The nodes that sent us ballot messages
+	Balloted []util.PublicKey
+}
+
+// A ParticipationRate is how often a node took part over recent slots.
+type ParticipationRate struct {
+	Node util.PublicKey
+
+	// How many slots the rate covers
+	Slots int
+
+	// How many of those slots the node took part in, in each phase
+	Nominated int
+	Balloted  int
+}
+
+// NominationRate returns the fraction of slots the node nominated in.
+func (r *ParticipationRate) NominationRate() float64 {
+	if r.Slots == 0 {
+		return 0
+	}
+	return float64(r.Nominated) / float64(r.Slots)
+}
+
+// BallotRate returns the fraction of slots the node balloted in.
+func (r *ParticipationRate) BallotRate() float64 {
+	if r.Slots == 0 {
+		return 0
+	}
+	return float64(r.Balloted) / float64(r.Slots)
+}
+
+func (r *ParticipationRate) String() string {
+	return fmt.Sprintf("%s nominated in %.0f%% and balloted in %.0f%% of %d slots",
+		util.Shorten(string(r.Node)), 100*r.NominationRate(), 100*r.BallotRate(), r.Slots)
+}
+
+// participation reports which nodes took part in this block.
+func (b *Block) participation() *Participation {
+	p := &Participation{
+		Slot:      b.slot,
+		Nominated: []util.PublicKey{b.publicKey},
+		Balloted:  []util.PublicKey{b.publicKey},
+	}
+	for node, m := range b.nState.N {
+		if len(m.Nom) > 0 || len(m.Acc) > 0 {
+			p.Nominated = append(p.Nominated, node)
+		}
+	}
+	for node := range b.bState.M {
+		p.Balloted = append(p.Balloted, node)
+	}
+	util.SortPublicKeys(p.Nominated)
+	util.SortPublicKeys(p.Balloted)
+	return p
+}
+
+// recordParticipation notes who took part in a block that just
+// externalized, forgetting slots that fall out of the window.
+func (c *Chain) recordParticipation(b *Block) {
+	c.participation = append(c.participation, b.participation())
+	if len(c.participation) > ParticipationWindow {
+		c.participation = c.participation[len(c.participation)-ParticipationWindow:]
+	}
+}
+
+// Participation returns who took part in a recent slot, or nil if we don't
+// know.
+func (c *Chain) Participation(slot int) *Participation {
+	for _, p := range c.participation {
+		if p.Slot == slot {
+			return p
+		}
+	}
+	return nil
+}
+
+// ParticipationRates returns how often each member of our quorum slice, and
+// anyone else who took part, took part in the recent slots we decided
+// through consensus. They are sorted by node.
+func (c *Chain) ParticipationRates() []*ParticipationRate {
+	rates := make(map[util.PublicKey]*ParticipationRate)
+	rate := func(node util.PublicKey) *ParticipationRate {
+		r, ok := rates[node]
+		if !ok {
+			r = &ParticipationRate{
+				Node:  node,
+				Slots: len(c.participation),
+			}
+			rates[node] = r
+		}
+		return r
+	}
+	for _, node := range c.D.AllMembers() {
+		rate(node)
+	}
+	for _, p := range c.participation {
+		for _, node := range p.Nominated {
+			rate(node).Nominated++
+		}
+		for _, node := range p.Balloted {
+			rate(node).Balloted++
+		}
+	}
+	answer := []*ParticipationRate{}
+	for _, r := range rates {
+		answer = append(answer, r)
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		return answer[i].Node < answer[j].Node
+	})
+	return answer
+}
@@ -1,29 +1,49 @@
 package consensus
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+
+	"coinkit/util"
 )
 
 type QuorumSlice struct {
 	// Members is a list of public keys for nodes that occur in the quorum slice.
-	// Members must be unique.
+	// Members must be unique, including across inner sets.
 	// Typically includes ourselves.
-	Members []string
+	Members []util.PublicKey
+
+	// Inner is a list of nested quorum slices. Each one counts as a single
+	// entry, alongside the members, that is satisfied when its own threshold
+	// is. This expresses slices like "2 of {A, B, {2 of C, D, E}}".
+	Inner []QuorumSlice `json:",omitempty"`
 
-	// The number of members we require for consensus, including ourselves.
-	// The protocol can support other sorts of slices, like weighted or any wacky
-	// thing, but for now we only do this simple "any k out of these n" voting.
+	// The number of entries we require for consensus, including ourselves.
+	// An entry is either a member or an inner set.
 	Threshold int
 }
 
-func MakeQuorumSlice(members []string, threshold int) QuorumSlice {
+func MakeQuorumSlice(members []util.PublicKey, threshold int) QuorumSlice {
 	return QuorumSlice{
 		Members: members,
 		Threshold: threshold,
 	}
 }
 
-func (qs *QuorumSlice) atLeast(nodes []string, t int) bool {
+// size is the number of entries in the slice, counting each inner set once.
+func (qs *QuorumSlice) size() int {
+	return len(qs.Members) + len(qs.Inner)
+}
+
+// atLeast returns whether at least t entries pass the provided check.
+// Members pass when they are among the nodes, and inner sets pass when
+// the check passes for them.
+func (qs *QuorumSlice) atLeast(
+	nodes []util.PublicKey, t int, check func(*QuorumSlice) bool) bool {
+	if t <= 0 {
+		return true
+	}
 	count := 0
 	for _, member := range qs.Members {
 		for _, node := range nodes {
@@ -36,41 +56,243 @@ func (qs *QuorumSlice) atLeast(nodes []string, t int) bool {
 			}
 		}
 	}
+	for i := range qs.Inner {
+		if check(&qs.Inner[i]) {
+			count++
+			if count >= t {
+				return true
+			}
+		}
+	}
 	return false
 }
 
-func (qs *QuorumSlice) BlockedBy(nodes []string) bool {
-	return qs.atLeast(nodes, len(qs.Members)-qs.Threshold+1)
+// BlockedBy returns whether these nodes intersect every way of satisfying
+// the slice.
+func (qs *QuorumSlice) BlockedBy(nodes []util.PublicKey) bool {
+	return qs.atLeast(nodes, qs.size()-qs.Threshold+1, func(inner *QuorumSlice) bool {
+		return inner.BlockedBy(nodes)
+	})
+}
+
+func (qs *QuorumSlice) SatisfiedWith(nodes []util.PublicKey) bool {
+	return qs.atLeast(nodes, qs.Threshold, func(inner *QuorumSlice) bool {
+		return inner.SatisfiedWith(nodes)
+	})
+}
+
+// AllMembers returns the members of the slice along with the members of
+// every inner set.
+func (qs *QuorumSlice) AllMembers() []util.PublicKey {
+	answer := append([]util.PublicKey{}, qs.Members...)
+	for i := range qs.Inner {
+		answer = append(answer, qs.Inner[i].AllMembers()...)
+	}
+	return answer
+}
+
+// equal returns whether two slices have the same members, inner sets, and
+// thresholds, in the same order.
+func (qs *QuorumSlice) equal(other *QuorumSlice) bool {
+	if qs.Threshold != other.Threshold || len(qs.Members) != len(other.Members) ||
+		len(qs.Inner) != len(other.Inner) {
+		return false
+	}
+	for i, member := range qs.Members {
+		if other.Members[i] != member {
+			return false
+		}
+	}
+	for i := range qs.Inner {
+		if !qs.Inner[i].equal(&other.Inner[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate returns an error if the slice could not be used by this node.
+// Every threshold must be reachable and at least one, members must be unique,
+// and the node must be in its own slice.
+func (qs *QuorumSlice) Validate(node util.PublicKey) error {
+	if err := qs.validateShape(); err != nil {
+		return err
+	}
+	seen := make(map[util.PublicKey]bool)
+	for _, member := range qs.AllMembers() {
+		if seen[member] {
+			return fmt.Errorf("%s is in the quorum slice twice", util.Shorten(string(member)))
+		}
+		seen[member] = true
+	}
+	if !seen[node] {
+		return fmt.Errorf("the quorum slice for %s does not include it",
+			util.Shorten(string(node)))
+	}
+	return nil
+}
+
+func (qs *QuorumSlice) validateShape() error {
+	if qs.Threshold < 1 || qs.Threshold > qs.size() {
+		return fmt.Errorf("bad threshold %d for %d entries", qs.Threshold, qs.size())
+	}
+	for i := range qs.Inner {
+		if err := qs.Inner[i].validateShape(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (qs *QuorumSlice) SatisfiedWith(nodes []string) bool {
-	return qs.atLeast(nodes, qs.Threshold)
+func (qs *QuorumSlice) String() string {
+	parts := []string{}
+	for _, member := range qs.Members {
+		parts = append(parts, util.Shorten(string(member)))
+	}
+	for i := range qs.Inner {
+		parts = append(parts, qs.Inner[i].String())
+	}
+	return fmt.Sprintf("%d of {%s}", qs.Threshold, strings.Join(parts, ", "))
+}
+
+// We only check whether slices with nested sets intersect when they have at
+// most this many other nodes between them, since it takes time exponential in
+// the number of nodes
+const MaxIntersectionCheck = 16
+
+var (
+	// ErrNoIntersection means that two quorum slices could be satisfied by
+	// nodes that have nothing in common, so they could agree on different
+	// values.
+	ErrNoIntersection = errors.New("quorum slices do not intersect")
+
+	// ErrIntersectionUnchecked means that two quorum slices were too big to
+	// check whether they intersect.
+	ErrIntersectionUnchecked = errors.New("quorum slices are too big to check for intersection")
+)
+
+// CheckIntersection checks that whenever one set of nodes satisfies a and
+// another satisfies b, they have some node in common apart from node itself.
+// node is in both slices, so it counts toward both.
+func CheckIntersection(node util.PublicKey, a QuorumSlice, b QuorumSlice) error {
+	if len(a.Inner) == 0 && len(b.Inner) == 0 {
+		return checkFlatIntersection(node, a, b)
+	}
+	return searchIntersection(node, a, b)
+}
+
+// searchIntersection is CheckIntersection for any slices, trying every way
+// of splitting the other nodes between them.
+func searchIntersection(node util.PublicKey, a QuorumSlice, b QuorumSlice) error {
+	others := []util.PublicKey{}
+	seen := map[util.PublicKey]bool{node: true}
+	for _, member := range append(a.AllMembers(), b.AllMembers()...) {
+		if !seen[member] {
+			seen[member] = true
+			others = append(others, member)
+		}
+	}
+	if len(others) > MaxIntersectionCheck {
+		return ErrIntersectionUnchecked
+	}
+
+	// Both checks are monotonic, so it is enough to give b every node that
+	// a doesn't use
+	for mask := 0; mask < 1<<uint(len(others)); mask++ {
+		inA := []util.PublicKey{node}
+		inB := []util.PublicKey{node}
+		for i, other := range others {
+			if mask&(1<<uint(i)) != 0 {
+				inA = append(inA, other)
+			} else {
+				inB = append(inB, other)
+			}
+		}
+		if a.SatisfiedWith(inA) && b.SatisfiedWith(inB) {
+			return fmt.Errorf("%w: %s and %s", ErrNoIntersection, &a, &b)
+		}
+	}
+	return nil
+}
+
+// checkFlatIntersection is CheckIntersection for slices with no inner sets,
+// which can be worked out by counting.
+func checkFlatIntersection(node util.PublicKey, a QuorumSlice, b QuorumSlice) error {
+	inA := make(map[util.PublicKey]bool)
+	for _, member := range a.Members {
+		inA[member] = true
+	}
+	inB := make(map[util.PublicKey]bool)
+	for _, member := range b.Members {
+		inB[member] = true
+	}
+
+	// How many other nodes each slice needs, and how many nodes are only in
+	// a, only in b, or shared
+	needA, needB := a.Threshold, b.Threshold
+	if inA[node] {
+		needA--
+	}
+	if inB[node] {
+		needB--
+	}
+	onlyA, onlyB, shared := 0, 0, 0
+	for member := range inA {
+		if member == node {
+			continue
+		}
+		if inB[member] {
+			shared++
+		} else {
+			onlyA++
+		}
+	}
+	for member := range inB {
+		if member != node && !inA[member] {
+			onlyB++
+		}
+	}
+	if needA > onlyA+shared || needB > onlyB+shared {
+		// One of the slices can't be satisfied at all
+		return nil
+	}
+	sharedA, sharedB := needA-onlyA, needB-onlyB
+	if sharedA < 0 {
+		sharedA = 0
+	}
+	if sharedB < 0 {
+		sharedB = 0
+	}
+	if sharedA+sharedB <= shared {
+		return fmt.Errorf("%w: %s and %s", ErrNoIntersection, &a, &b)
+	}
+	return nil
 }
 
 // Makes data for a test quorum slice that requires a consensus of more
 // than two thirds of the given size.
 // Also returns a list of all node names.
-func MakeTestQuorumSlice(size int) (QuorumSlice, []string) {
+func MakeTestQuorumSlice(size int) (QuorumSlice, []util.PublicKey) {
 	threshold := 2*size/3 + 1
-	names := []string{}
+	names := []util.PublicKey{}
 	for i := 0; i < size; i++ {
-		names = append(names, fmt.Sprintf("node%d", i))
+		names = append(names, util.PublicKey(fmt.Sprintf("node%d", i)))
 	}
 	qs := MakeQuorumSlice(names, threshold)
 	return qs, names
 }
 
 type QuorumFinder interface {
-	QuorumSlice(node string) (*QuorumSlice, bool)
-	PublicKey() string
+	QuorumSlice(node util.PublicKey) (*QuorumSlice, bool)
+	PublicKey() util.PublicKey
 }
 
 // Returns whether this set of nodes meets the quorum for the network overall.
-func MeetsQuorum(f QuorumFinder, nodes []string) bool {
+func MeetsQuorum(f QuorumFinder, nodes []util.PublicKey) bool {
 	// Filter out the nodes in the potential quorum that do not have their
 	// own quorum slices met
 	hasUs := false
-	filtered := []string{}
+	filtered := []util.PublicKey{}
 	for _, node := range nodes {
 		qs, ok := f.QuorumSlice(node)
 		if ok && qs.SatisfiedWith(nodes) {
@@ -88,3 +310,36 @@ func MeetsQuorum(f QuorumFinder, nodes []string) bool {
 	}
 	return MeetsQuorum(f, filtered)
 }
+
+// Reachable returns the nodes that can matter to us: our own quorum slice's
+// members, the members of their slices, and so on, as far as the finder
+// knows about slices.
+func Reachable(f QuorumFinder) map[util.PublicKey]bool {
+	answer := make(map[util.PublicKey]bool)
+	for node := range distances(f) {
+		answer[node] = true
+	}
+	return answer
+}
+
+// distances returns how many quorum slices away from us each reachable node
+// is. We are zero away, and the members of our own slice are one away.
+func distances(f QuorumFinder) map[util.PublicKey]int {
+	answer := map[util.PublicKey]int{f.PublicKey(): 0}
+	queue := []util.PublicKey{f.PublicKey()}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		qs, ok := f.QuorumSlice(node)
+		if !ok {
+			continue
+		}
+		for _, member := range qs.AllMembers() {
+			if _, ok := answer[member]; !ok {
+				answer[member] = answer[node] + 1
+				queue = append(queue, member)
+			}
+		}
+	}
+	return answer
+}
@@ -0,0 +1,41 @@
+package consensus
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// A QuorumSliceMessage announces the quorum slice a node uses, starting at
+// a particular slot. Nodes send one whenever their quorum slice changes, so
+// that other nodes know who they are listening to.
+// Implements Message.
+type QuorumSliceMessage struct {
+	// The first slot that uses this quorum slice
+	I int
+
+	D QuorumSlice
+}
+
+func (m *QuorumSliceMessage) MessageType() string {
+	return "S"
+}
+
+func (m *QuorumSliceMessage) Slot() int {
+	return m.I
+}
+
+func (m *QuorumSliceMessage) String() string {
+	return fmt.Sprintf("quorumslice i=%d %s", m.I, m.D.String())
+}
+
+func (m *QuorumSliceMessage) Validate() error {
+	if m.I < 1 {
+		return invalidf("slot %d", m.I)
+	}
+	return nil
+}
+
+func init() {
+	util.RegisterMessageType(&QuorumSliceMessage{})
+}
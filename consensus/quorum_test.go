@@ -0,0 +1,143 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"coinkit/util"
+)
+
+// 2 of {A, B, {2 of C, D, E}}
+func makeNestedQuorumSlice() QuorumSlice {
+	qs := MakeQuorumSlice([]util.PublicKey{"A", "B"}, 2)
+	qs.Inner = []QuorumSlice{MakeQuorumSlice([]util.PublicKey{"C", "D", "E"}, 2)}
+	return qs
+}
+
+func TestNestedQuorumSlice(t *testing.T) {
+	qs := makeNestedQuorumSlice()
+
+	if !qs.SatisfiedWith([]util.PublicKey{"A", "B"}) {
+		t.Fatal("A and B should satisfy the slice")
+	}
+	if !qs.SatisfiedWith([]util.PublicKey{"A", "C", "E"}) {
+		t.Fatal("A with two of the inner set should satisfy the slice")
+	}
+	if qs.SatisfiedWith([]util.PublicKey{"A", "C"}) {
+		t.Fatal("one of the inner set should not count")
+	}
+	if qs.SatisfiedWith([]util.PublicKey{"C", "D", "E"}) {
+		t.Fatal("the inner set only counts once")
+	}
+
+	if !qs.BlockedBy([]util.PublicKey{"A", "B"}) {
+		t.Fatal("A and B should block the slice")
+	}
+	if !qs.BlockedBy([]util.PublicKey{"A", "C", "D"}) {
+		t.Fatal("A and a blocking set for the inner set should block the slice")
+	}
+	if qs.BlockedBy([]util.PublicKey{"A", "C"}) {
+		t.Fatal("A and C should not block the slice")
+	}
+
+	if len(qs.AllMembers()) != 5 {
+		t.Fatalf("bad members: %+v", qs.AllMembers())
+	}
+}
+
+func TestNestedQuorumSliceEncoding(t *testing.T) {
+	m := &QuorumSliceMessage{
+		I: 3,
+		D: makeNestedQuorumSlice(),
+	}
+	m2 := util.EncodeThenDecode(m).(*QuorumSliceMessage)
+	if len(m2.D.Inner) != 1 || m2.D.Inner[0].Threshold != 2 ||
+		len(m2.D.Inner[0].Members) != 3 {
+		t.Fatalf("the inner set did not survive encoding: %s", m2)
+	}
+	if m2.String() != m.String() {
+		t.Fatalf("%s turned into %s", m, m2)
+	}
+}
+
+func TestQuorumSliceValidation(t *testing.T) {
+	qs := makeNestedQuorumSlice()
+	if err := qs.Validate("D"); err != nil {
+		t.Fatal(err)
+	}
+	if qs.Validate("F") == nil {
+		t.Fatal("a slice without ourselves should not be valid")
+	}
+	qs.Inner[0].Threshold = 4
+	if qs.Validate("D") == nil {
+		t.Fatal("an unreachable inner threshold should not be valid")
+	}
+	qs.Inner[0].Threshold = 2
+	qs.Inner[0].Members = append(qs.Inner[0].Members, "A")
+	if qs.Validate("D") == nil {
+		t.Fatal("a repeated member should not be valid")
+	}
+}
+
+func TestCheckIntersection(t *testing.T) {
+	old := MakeQuorumSlice([]util.PublicKey{"A", "B", "C", "D"}, 3)
+	if err := CheckIntersection("A", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckIntersection("A", old, MakeQuorumSlice([]util.PublicKey{"A", "B", "C"}, 3)); err != nil {
+		t.Fatal(err)
+	}
+	err := CheckIntersection("A", old, MakeQuorumSlice([]util.PublicKey{"A", "E", "F"}, 2))
+	if !errors.Is(err, ErrNoIntersection) {
+		t.Fatalf("expected no intersection but got %v", err)
+	}
+
+	// 2 of {A, B, {2 of C, D, E}} can be satisfied by A and B alone, which
+	// only a slice needing all of them is sure to overlap
+	nested := makeNestedQuorumSlice()
+	everyone := MakeQuorumSlice(nested.AllMembers(), 5)
+	if err := CheckIntersection("A", nested, everyone); err != nil {
+		t.Fatal(err)
+	}
+	err = CheckIntersection("A", nested, MakeQuorumSlice([]util.PublicKey{"A", "C", "D"}, 2))
+	if !errors.Is(err, ErrNoIntersection) {
+		t.Fatalf("expected no intersection but got %v", err)
+	}
+}
+
+func TestFlatIntersectionMatchesSearch(t *testing.T) {
+	names := []util.PublicKey{"A", "B", "C", "D", "E", "F"}
+	for i := 0; i < 500; i++ {
+		slices := []QuorumSlice{}
+		for j := 0; j < 2; j++ {
+			members := []util.PublicKey{"A"}
+			for _, name := range names[1:] {
+				if rand.Intn(2) == 0 {
+					members = append(members, name)
+				}
+			}
+			slices = append(slices, MakeQuorumSlice(members, 1+rand.Intn(len(members))))
+		}
+		flat := checkFlatIntersection("A", slices[0], slices[1])
+		search := searchIntersection("A", slices[0], slices[1])
+		if (flat == nil) != (search == nil) {
+			t.Fatalf("for %s and %s, counting gave %v but searching gave %v",
+				&slices[0], &slices[1], flat, search)
+		}
+	}
+}
+
+func TestIntersectionTooBigToCheck(t *testing.T) {
+	members := []util.PublicKey{}
+	for i := 0; i <= MaxIntersectionCheck+1; i++ {
+		members = append(members, util.PublicKey(fmt.Sprintf("node%d", i)))
+	}
+	qs := MakeQuorumSlice(members, len(members))
+	nested := MakeQuorumSlice([]util.PublicKey{"node0"}, 2)
+	nested.Inner = []QuorumSlice{MakeQuorumSlice(members[1:], 3)}
+	if err := CheckIntersection("node0", qs, nested); !errors.Is(err, ErrIntersectionUnchecked) {
+		t.Fatalf("expected an unchecked intersection but got %v", err)
+	}
+}
@@ -2,15 +2,18 @@ package consensus
 
 import (
 	"encoding/base64"
+	"fmt"
 	"sort"
 
 	"golang.org/x/crypto/sha3"
+
+	"coinkit/util"
 )
 
 func HashString(x string) string {
 	h := sha3.New512()
-	hashBytes := h.Sum([]byte(x))
-	return base64.RawStdEncoding.EncodeToString(hashBytes)
+	h.Write([]byte(x))
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
 }
 
 // SeedSort sorts in a way that is repeatable depending on the seed string.
@@ -41,3 +44,26 @@ func SeedPriority(seed string, input []string, node string) int {
 	}
 	panic("we have no seed priority")
 }
+
+// NominationPriority is the priority function from the SCP paper. It ranks a
+// node for one round of nomination on a slot, where a lower string means a
+// higher priority. Every node computes the same ranking, so they agree on who
+// should nominate first without having to talk about it.
+func NominationPriority(slot int, round int, node util.PublicKey) string {
+	return HashString(fmt.Sprintf("%d %d %s", slot, round, node))
+}
+
+// RoundLeader returns the node with the highest priority for a round of
+// nomination on a slot.
+func RoundLeader(slot int, round int, nodes []util.PublicKey) util.PublicKey {
+	leader := ""
+	best := ""
+	for _, node := range nodes {
+		p := NominationPriority(slot, round, node)
+		if leader == "" || p < best {
+			leader = string(node)
+			best = p
+		}
+	}
+	return util.PublicKey(leader)
+}
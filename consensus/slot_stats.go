@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"fmt"
+	"time"
+)
+
+// We keep timing statistics for this many recent slots
+const SlotStatsWindow = 100
+
+// SlotStats describe how long it took to decide a slot that externalized.
+type SlotStats struct {
+	Slot int
+
+	// How long we nominated before we started balloting
+	NominationDuration time.Duration
+
+	// How long we balloted before the slot externalized. Zero if we never
+	// got a ballot of our own, which happens when we catch up to the rest
+	// of the network
+	BallotDuration time.Duration
+
+	// How many times we gave up on a ballot and went to the next one
+	BallotBumps int
+
+	// How many consensus messages we received for the slot
+	MessagesProcessed int
+}
+
+// Duration returns how long the slot took in all.
+func (s *SlotStats) Duration() time.Duration {
+	return s.NominationDuration + s.BallotDuration
+}
+
+func (s *SlotStats) String() string {
+	return fmt.Sprintf("slot %d: %.2fs nominating, %.2fs balloting, %d bumps, %d messages",
+		s.Slot, s.NominationDuration.Seconds(), s.BallotDuration.Seconds(),
+		s.BallotBumps, s.MessagesProcessed)
+}
+
+// noteTimes records when the block started balloting and when it
+// externalized, the first time we see each of them happen.
+func (b *Block) noteTimes() {
+	if b.ballotStart.IsZero() && b.bState.b != nil {
+		b.ballotStart = b.clock.Now()
+	}
+	if b.end.IsZero() && b.external != nil {
+		b.end = b.clock.Now()
+	}
+}
+
+// stats reports how long an externalized block took.
+func (b *Block) stats() *SlotStats {
+	end := b.end
+	if end.IsZero() {
+		end = b.clock.Now()
+	}
+	s := &SlotStats{
+		Slot:              b.slot,
+		BallotBumps:       b.bState.bumps,
+		MessagesProcessed: b.received,
+	}
+	if b.ballotStart.IsZero() {
+		s.NominationDuration = end.Sub(b.start)
+	} else {
+		s.NominationDuration = b.ballotStart.Sub(b.start)
+		s.BallotDuration = end.Sub(b.ballotStart)
+	}
+	return s
+}
+
+// recordStats keeps the stats for a block that just externalized, forgetting
+// slots that fall out of the window.
+func (c *Chain) recordStats(b *Block) {
+	c.stats = append(c.stats, b.stats())
+	if len(c.stats) > SlotStatsWindow {
+		c.stats = c.stats[len(c.stats)-SlotStatsWindow:]
+	}
+}
+
+// Stats returns the timing statistics for the recent slots we decided
+// through consensus, oldest first.
+func (c *Chain) Stats() []*SlotStats {
+	return append([]*SlotStats{}, c.stats...)
+}
+
+// SlotStats returns the timing statistics for a recent slot, or nil if we
+// don't have them.
+func (c *Chain) SlotStats(slot int) *SlotStats {
+	for _, s := range c.stats {
+		if s.Slot == slot {
+			return s
+		}
+	}
+	return nil
+}
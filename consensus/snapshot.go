@@ -0,0 +1,342 @@
+package consensus
+
+import (
+	"fmt"
+	"time"
+
+	"coinkit/util"
+)
+
+// A snapshot is the in-progress consensus state for a slot, in a form that
+// encodes to JSON. A node can save a snapshot of its chain to disk as it
+// works on a slot, and after a crash, restore its history and then the
+// snapshot, to pick the slot up where it left off. Starting the slot from
+// scratch would be safe for us, but it could make us vote against what we
+// voted for before we crashed, which is unsafe for the network.
+// Snapshots don't include the value store. The application has to restore
+// it first, so that it can validate the values in the snapshot.
+
+// A BallotSnapshot is a Ballot in a form that encodes.
+type BallotSnapshot struct {
+	N int
+	X SlotValue
+}
+
+func snapshotBallot(b *Ballot) *BallotSnapshot {
+	if b == nil {
+		return nil
+	}
+	return &BallotSnapshot{N: b.n, X: b.x}
+}
+
+func restoreBallot(b *BallotSnapshot) *Ballot {
+	if b == nil {
+		return nil
+	}
+	return &Ballot{n: b.N, x: b.X}
+}
+
+// A NominationSnapshot is the state of a NominationState.
+type NominationSnapshot struct {
+	Slot int
+
+	X []SlotValue
+	Y []SlotValue
+	Z []SlotValue
+
+	N map[util.PublicKey]*NominationMessage
+
+	Pending []SlotValue `json:",omitempty"`
+
+	Round   int
+	Leaders []util.PublicKey
+	Timer   int
+	Idle    int
+}
+
+// Snapshot returns the state of the nomination.
+func (s *NominationState) Snapshot() *NominationSnapshot {
+	snap := &NominationSnapshot{
+		Slot:    s.slot,
+		X:       append([]SlotValue{}, s.X...),
+		Y:       append([]SlotValue{}, s.Y...),
+		Z:       append([]SlotValue{}, s.Z...),
+		N:       make(map[util.PublicKey]*NominationMessage),
+		Pending: append([]SlotValue{}, s.pending...),
+		Round:   s.round,
+		Leaders: []util.PublicKey{},
+		Timer:   s.timer,
+		Idle:    s.idle,
+	}
+	for node, m := range s.N {
+		snap.N[node] = m
+	}
+	for leader := range s.leaders {
+		snap.Leaders = append(snap.Leaders, leader)
+	}
+	util.SortPublicKeys(snap.Leaders)
+	return snap
+}
+
+// RestoreSnapshot replaces the state of the nomination with a snapshot of
+// the same slot.
+func (s *NominationState) RestoreSnapshot(snap *NominationSnapshot) error {
+	if snap.Slot != s.slot {
+		return fmt.Errorf("cannot restore a nomination snapshot for slot %d on slot %d",
+			snap.Slot, s.slot)
+	}
+	s.X = append([]SlotValue{}, snap.X...)
+	s.Y = append([]SlotValue{}, snap.Y...)
+	s.Z = append([]SlotValue{}, snap.Z...)
+	s.N = make(map[util.PublicKey]*NominationMessage)
+	for node, m := range snap.N {
+		s.N[node] = m
+	}
+	s.pending = append([]SlotValue{}, snap.Pending...)
+	s.round = snap.Round
+	s.leaders = make(map[util.PublicKey]bool)
+	for _, leader := range snap.Leaders {
+		s.leaders[leader] = true
+	}
+	s.timer = snap.Timer
+	s.idle = snap.Idle
+	return nil
+}
+
+// A BallotStateSnapshot is the state of a BallotState.
+type BallotStateSnapshot struct {
+	Phase Phase
+
+	B      *BallotSnapshot `json:",omitempty"`
+	Last   *BallotSnapshot `json:",omitempty"`
+	P      *BallotSnapshot `json:",omitempty"`
+	PPrime *BallotSnapshot `json:",omitempty"`
+
+	Cn int
+	Hn int
+
+	Z *SlotValue `json:",omitempty"`
+
+	// The latest ballot message from each peer. BallotMessage is an
+	// interface, so they are encoded with util.EncodeMessage
+	M map[util.PublicKey]string
+
+	Timer  int
+	TimerN int
+	Bumps  int
+}
+
+// Snapshot returns the state of the balloting.
+func (s *BallotState) Snapshot() *BallotStateSnapshot {
+	snap := &BallotStateSnapshot{
+		Phase:  s.phase,
+		B:      snapshotBallot(s.b),
+		Last:   snapshotBallot(s.last),
+		P:      snapshotBallot(s.p),
+		PPrime: snapshotBallot(s.pPrime),
+		Cn:     s.cn,
+		Hn:     s.hn,
+		M:      make(map[util.PublicKey]string),
+		Timer:  s.timer,
+		TimerN: s.timerN,
+		Bumps:  s.bumps,
+	}
+	if s.z != nil {
+		z := *s.z
+		snap.Z = &z
+	}
+	for node, m := range s.M {
+		snap.M[node] = util.EncodeMessage(m)
+	}
+	return snap
+}
+
+// RestoreSnapshot replaces the state of the balloting with a snapshot.
+// It returns an error, and changes nothing, if the snapshot is not
+// consistent.
+func (s *BallotState) RestoreSnapshot(snap *BallotStateSnapshot) error {
+	messages := make(map[util.PublicKey]BallotMessage)
+	for node, encoded := range snap.M {
+		decoded, err := util.DecodeMessage(encoded)
+		if err != nil {
+			return err
+		}
+		m, ok := decoded.(BallotMessage)
+		if !ok {
+			return fmt.Errorf("%s is not a ballot message", decoded)
+		}
+		messages[node] = m
+	}
+	restored := *s
+	restored.phase = snap.Phase
+	restored.b = restoreBallot(snap.B)
+	restored.last = restoreBallot(snap.Last)
+	restored.p = restoreBallot(snap.P)
+	restored.pPrime = restoreBallot(snap.PPrime)
+	restored.cn = snap.Cn
+	restored.hn = snap.Hn
+	restored.z = nil
+	if snap.Z != nil {
+		z := *snap.Z
+		restored.z = &z
+	}
+	restored.M = messages
+	restored.timer = snap.Timer
+	restored.timerN = snap.TimerN
+	restored.bumps = snap.Bumps
+	restored.err = nil
+	if err := restored.Validate(); err != nil {
+		return err
+	}
+	*s = restored
+	return nil
+}
+
+// A BlockSnapshot is the state of a Block.
+type BlockSnapshot struct {
+	Slot int
+
+	// The quorum slice we use for this block
+	D QuorumSlice
+
+	Nomination *NominationSnapshot
+	Ballot     *BallotStateSnapshot
+
+	// Nil until the block externalizes
+	External *ExternalizeMessage `json:",omitempty"`
+
+	Start       time.Time
+	BallotStart time.Time
+	End         time.Time
+
+	Received    int
+	Quarantined []util.PublicKey `json:",omitempty"`
+}
+
+// Snapshot returns the state of the block.
+func (b *Block) Snapshot() *BlockSnapshot {
+	snap := &BlockSnapshot{
+		Slot:        b.slot,
+		D:           b.D,
+		Nomination:  b.nState.Snapshot(),
+		Ballot:      b.bState.Snapshot(),
+		External:    b.external,
+		Start:       b.start,
+		BallotStart: b.ballotStart,
+		End:         b.end,
+		Received:    b.received,
+	}
+	for peer := range b.quarantined {
+		snap.Quarantined = append(snap.Quarantined, peer)
+	}
+	util.SortPublicKeys(snap.Quarantined)
+	return snap
+}
+
+// RestoreSnapshot replaces the state of the block with a snapshot of the
+// same slot. It returns an error, and changes nothing, if the snapshot is
+// not for this slot or is not consistent.
+func (b *Block) RestoreSnapshot(snap *BlockSnapshot) error {
+	if snap.Slot != b.slot {
+		return fmt.Errorf("cannot restore a block snapshot for slot %d on slot %d",
+			snap.Slot, b.slot)
+	}
+	if snap.Nomination == nil || snap.Ballot == nil {
+		return fmt.Errorf("the block snapshot for slot %d is incomplete", snap.Slot)
+	}
+	if err := snap.D.Validate(b.publicKey); err != nil {
+		return err
+	}
+	if snap.External != nil && snap.External.I != b.slot {
+		return fmt.Errorf("the block snapshot for slot %d externalized slot %d",
+			snap.Slot, snap.External.I)
+	}
+
+	// The nomination state is shared with the ballot state, so we restore
+	// them both into a copy first
+	nState := *b.nState
+	nState.D = snap.D
+	if err := nState.RestoreSnapshot(snap.Nomination); err != nil {
+		return err
+	}
+	bState := *b.bState
+	bState.D = snap.D
+	bState.nState = b.nState
+	if err := bState.RestoreSnapshot(snap.Ballot); err != nil {
+		return err
+	}
+	*b.nState = nState
+	*b.bState = bState
+
+	b.D = snap.D
+	b.external = snap.External
+	b.start = snap.Start
+	b.ballotStart = snap.BallotStart
+	b.end = snap.End
+	b.received = snap.Received
+	b.reach = nil
+	b.heard = make(map[util.PublicKey]int)
+	b.quarantined = make(map[util.PublicKey]bool)
+	for _, peer := range snap.Quarantined {
+		b.quarantined[peer] = true
+	}
+	return nil
+}
+
+// A ChainSnapshot is the state of a Chain as it works on a slot. It doesn't
+// include the history, which the application keeps on its own.
+type ChainSnapshot struct {
+	Block *BlockSnapshot
+
+	// The quorum slice we use for future blocks
+	D QuorumSlice
+
+	// The quorum slice declarations we know of, for each node
+	Declarations map[util.PublicKey][]*QuorumSliceMessage
+
+	PauseSlot int `json:",omitempty"`
+}
+
+// Snapshot returns the state of the slot the chain is working on.
+func (c *Chain) Snapshot() *ChainSnapshot {
+	snap := &ChainSnapshot{
+		Block:        c.current.Snapshot(),
+		D:            c.D,
+		Declarations: make(map[util.PublicKey][]*QuorumSliceMessage),
+		PauseSlot:    c.pauseSlot,
+	}
+	for node, list := range c.declarations {
+		snap.Declarations[node] = append([]*QuorumSliceMessage{}, list...)
+	}
+	return snap
+}
+
+// RestoreSnapshot picks up a slot where a snapshot left off. The chain
+// should already be on the snapshot's slot, after restoring the history
+// before it. It returns an error, and changes nothing, if it isn't, or if
+// the snapshot is not consistent.
+func (c *Chain) RestoreSnapshot(snap *ChainSnapshot) error {
+	if snap.Block == nil {
+		return fmt.Errorf("the chain snapshot has no block")
+	}
+	if snap.Block.Slot != c.current.slot {
+		return fmt.Errorf("cannot restore a snapshot of slot %d while on slot %d",
+			snap.Block.Slot, c.current.slot)
+	}
+	if err := snap.D.Validate(c.publicKey); err != nil {
+		return err
+	}
+	block := c.newBlock(c.current.slot)
+	if err := block.RestoreSnapshot(snap.Block); err != nil {
+		return err
+	}
+	c.current = block
+	c.D = snap.D
+	c.declarations = make(map[util.PublicKey][]*QuorumSliceMessage)
+	for node, list := range snap.Declarations {
+		c.declarations[node] = append([]*QuorumSliceMessage{}, list...)
+	}
+	c.pauseSlot = snap.PauseSlot
+	c.maybeAdvance()
+	return nil
+}
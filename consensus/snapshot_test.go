@@ -0,0 +1,87 @@
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"coinkit/util"
+)
+
+func encodeOutgoing(c *Chain) []string {
+	answer := []string{}
+	for _, m := range c.OutgoingMessages() {
+		answer = append(answer, util.EncodeMessage(m))
+	}
+	return answer
+}
+
+func TestChainSnapshotResumesSlot(t *testing.T) {
+	chains := chainCluster(4)
+	for i := 0; i < 10 && chains[0].current.bState.b == nil; i++ {
+		for _, source := range chains {
+			source.HandleTimerTick()
+			for _, target := range chains {
+				chainSend(source, target)
+			}
+		}
+	}
+	if chains[0].Slot() != 1 || chains[0].current.bState.b == nil {
+		t.Fatalf("expected to be balloting on slot 1, but on slot %d", chains[0].Slot())
+	}
+
+	// Save the snapshot like it would be saved to disk
+	bytes, err := json.Marshal(chains[0].Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := &ChainSnapshot{}
+	if err := json.Unmarshal(bytes, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	old := chains[0]
+	c := NewEmptyChain(old.publicKey, old.D, NewTestValueStore(0), RealClock{})
+	if err := c.RestoreSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	want := encodeOutgoing(old)
+	got := encodeOutgoing(c)
+	if len(got) != len(want) {
+		t.Fatalf("restored chain sends %v but the original sends %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("restored chain sends %s but the original sends %s", got[i], want[i])
+		}
+	}
+	if c.Metrics().MessagesReceived != old.Metrics().MessagesReceived {
+		t.Fatal("the restored block should remember how many messages it got")
+	}
+
+	chains[0] = c
+	chainFuzzTest(chains, 0, t)
+}
+
+func TestChainSnapshotChecksSlot(t *testing.T) {
+	chains := chainCluster(4)
+	snap := chains[0].Snapshot()
+	snap.Block.Slot = 2
+	if err := chains[1].RestoreSnapshot(snap); err == nil {
+		t.Fatal("restoring a snapshot of another slot should fail")
+	}
+}
+
+func TestBallotSnapshotMustBeConsistent(t *testing.T) {
+	chains := chainCluster(4)
+	snap := chains[0].Snapshot()
+	snap.Block.Ballot.Cn = 2
+	snap.Block.Ballot.Hn = 1
+	err := chains[0].RestoreSnapshot(snap)
+	if !errors.Is(err, ErrBrokenInvariant) {
+		t.Fatalf("expected a broken invariant but got %v", err)
+	}
+	if chains[0].current.bState.cn != 0 {
+		t.Fatal("a failed restore should not change the ballot state")
+	}
+}
@@ -11,6 +11,12 @@ import (
 // provide application-relevant information about it.
 type SlotValue string
 
+// EmptyValue is the value for a slot with nothing in it. When a chain is set
+// to externalize empty slots, it nominates EmptyValue once a slot has been
+// idle long enough, so that slots keep advancing even without anything to
+// agree on.
+const EmptyValue = SlotValue("empty")
+
 func AssertNoDupes(list []SlotValue) {
 	m := make(map[string]bool)
 	for _, v := range list {
@@ -36,12 +42,18 @@ func HasSlotValue(a []SlotValue, b SlotValue) bool {
 // use a value manager to have a unique id for every possible value.
 // This also helps test the consensus protocol with test values.
 type ValueStore interface {
+	// Combine merges a list of nominated values into the one value to vote
+	// on. This is how each application decides how nominations merge.
+	// It must be deterministic: every node with the same application data
+	// must get the same value from the same list, no matter what order the
+	// list is in.
 	Combine(list []SlotValue) SlotValue
 
 	// Whether the ValueStore is ready to finalize this value
 	CanFinalize(v SlotValue) bool
 
-	// Called when a value is finalized
+	// Called when a value is finalized. Finalizing EmptyValue should change
+	// nothing but the slot
 	Finalize(v SlotValue)
 
 	// The last finalized slot value
@@ -54,29 +66,63 @@ type ValueStore interface {
 
 	// ValidateValue returns whether a value can be used by the consensus
 	// mechanism.
+	// If the ValueStore does not know enough about a value to validate it yet,
+	// it should return false and go find out more. Once it knows more,
+	// the chain's ValueStoreUpdated should be called, and values that failed
+	// validation will be validated again.
+	// EmptyValue should be valid whenever any node in the network might
+	// externalize empty slots.
 	ValidateValue(v SlotValue) bool
 }
 
 // For testing, id strings are comma-separated lists of values.
+// By default a TestValueStore accepts everything right away. The exported
+// fields make it behave more like a real application, to test the edge cases
+// of the ValueStore contract.
 type TestValueStore struct {
 	last       SlotValue
 	suggestion SlotValue
+
+	// When Unknown is set, values from other nodes fail validation until
+	// Learn is called, as if we had to go fetch their data first
+	Unknown bool
+	known   map[SlotValue]bool
+	seen    map[SlotValue]bool
+
+	// CanFinalize returns false this many times for each value before it
+	// returns true, as if finalizing had to wait on something slow
+	FinalizeDelay int
+	delays        map[SlotValue]int
+
+	// When Conflicting is set, every suggestion is a new value, like an
+	// application that keeps getting new data while consensus is running
+	Conflicting bool
+	suggestions int
 }
 
 func NewTestValueStore(n int) *TestValueStore {
 	return &TestValueStore{
 		last:       "",
 		suggestion: SlotValue(fmt.Sprintf("value%d", n)),
+		known:      make(map[SlotValue]bool),
+		seen:       make(map[SlotValue]bool),
+		delays:     make(map[SlotValue]int),
 	}
 }
 
 func (t *TestValueStore) Combine(list []SlotValue) SlotValue {
 	m := make(map[string]bool)
 	for _, s := range list {
+		if s == EmptyValue {
+			continue
+		}
 		for _, part := range strings.Split(string(s), ",") {
 			m[part] = true
 		}
 	}
+	if len(m) == 0 {
+		return EmptyValue
+	}
 	parts := []string{}
 	for part, _ := range m {
 		parts = append(parts, part)
@@ -86,11 +132,19 @@ func (t *TestValueStore) Combine(list []SlotValue) SlotValue {
 }
 
 func (t *TestValueStore) CanFinalize(v SlotValue) bool {
+	if t.delays[v] < t.FinalizeDelay {
+		t.delays[v]++
+		return false
+	}
 	return true
 }
 
 func (t *TestValueStore) Finalize(v SlotValue) {
 	t.last = v
+	t.delays = make(map[SlotValue]int)
+}
+
+func (t *TestValueStore) Skip() {
 }
 
 func (t *TestValueStore) Last() SlotValue {
@@ -98,9 +152,33 @@ func (t *TestValueStore) Last() SlotValue {
 }
 
 func (t *TestValueStore) SuggestValue() (SlotValue, bool) {
-	return t.suggestion, true
+	if !t.Conflicting {
+		return t.suggestion, true
+	}
+	t.suggestions++
+	v := SlotValue(fmt.Sprintf("%s.%d", t.suggestion, t.suggestions))
+	t.known[v] = true
+	return v, true
 }
 
 func (t *TestValueStore) ValidateValue(v SlotValue) bool {
+	if !t.Unknown || v == t.suggestion || t.known[v] {
+		return true
+	}
+	t.seen[v] = true
+	return false
+}
+
+// Learn makes every value that failed validation valid. It returns whether
+// there were any, in which case the chain's ValueStoreUpdated should be
+// called.
+func (t *TestValueStore) Learn() bool {
+	if len(t.seen) == 0 {
+		return false
+	}
+	for v, _ := range t.seen {
+		t.known[v] = true
+	}
+	t.seen = make(map[SlotValue]bool)
 	return true
 }
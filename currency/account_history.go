@@ -0,0 +1,120 @@
+package currency
+
+import (
+	"coinkit/util"
+)
+
+// We take a snapshot of every account this often, in slots. Historical
+// queries start from the latest snapshot and replay the chunks after it.
+const SnapshotInterval = 100
+
+// An accountSnapshot is the state of every account at the start of a slot,
+// before that slot's chunk was processed.
+type accountSnapshot struct {
+	slot  int
+	state map[util.PublicKey]*Account
+}
+
+// snapshot records the current state of the accounts, replacing any
+// snapshot already taken for this slot.
+func (q *TransactionQueue) snapshot() {
+	s := &accountSnapshot{
+		slot:  q.slot,
+		state: q.accounts.Snapshot(),
+	}
+	n := len(q.snapshots)
+	if n > 0 && q.snapshots[n-1].slot == q.slot {
+		q.snapshots[n-1] = s
+	} else {
+		q.snapshots = append(q.snapshots, s)
+	}
+}
+
+// pruneSnapshots forgets the snapshots for all slots before the provided one.
+func (q *TransactionQueue) pruneSnapshots(before int) {
+	i := 0
+	for i < len(q.snapshots) && q.snapshots[i].slot < before {
+		i++
+	}
+	q.snapshots = q.snapshots[i:]
+}
+
+// AccountAt returns the state of an account as of the end of a finalized
+// slot. The second return value is false when we don't have the history to
+// tell, either because the slot is not finalized yet or because the history
+// has been pruned.
+// A nil account with true means the account did not exist at that slot.
+func (q *TransactionQueue) AccountAt(owner util.PublicKey, slot int) (*Account, bool) {
+	if slot < 1 || slot >= q.slot {
+		return nil, false
+	}
+
+	// Find the latest snapshot taken at or before the end of this slot
+	var start *accountSnapshot
+	for i := len(q.snapshots) - 1; i >= 0; i-- {
+		if q.snapshots[i].slot <= slot+1 {
+			start = q.snapshots[i]
+			break
+		}
+	}
+	if start == nil {
+		return nil, false
+	}
+
+	// Every chunk after a snapshot is kept at least as long as the snapshot
+	// is, so a missing chunk just means the slot had no currency data.
+	// Slots we finalized from a state diff have the same state in the diff.
+	answer := start.state[owner]
+	for s := start.slot; s <= slot; s++ {
+		if account, ok := q.finalizedState(s)[owner]; ok {
+			answer = account
+		}
+	}
+	if answer == nil {
+		return nil, true
+	}
+	return &Account{
+		Sequence: answer.Sequence,
+		Balance:  answer.Balance,
+	}, true
+}
+
+// IncludedSlot returns the finalized slot that included the transaction from
+// owner with this sequence number, or 0 if it hasn't been finalized.
+// If that slot has been pruned, it returns the last slot before the history
+// we still have, which is never earlier than the real one.
+func (q *TransactionQueue) IncludedSlot(owner util.PublicKey, sequence uint32) int {
+	account := q.accounts.Get(owner)
+	if account == nil || account.Sequence < sequence || len(q.snapshots) == 0 {
+		return 0
+	}
+
+	// Walk back to the earliest slot that ended with the sequence reached
+	start := q.snapshots[0]
+	answer := q.slot - 1
+	for s := q.slot - 1; s >= start.slot; s-- {
+		if account, ok := q.finalizedState(s)[owner]; ok {
+			if account.Sequence < sequence {
+				return answer
+			}
+			answer = s
+		}
+	}
+	if before := start.state[owner]; before != nil && before.Sequence >= sequence &&
+		start.slot > 1 {
+		return start.slot - 1
+	}
+	return answer
+}
+
+// finalizedState returns the state of the accounts that changed in a
+// finalized slot.
+func (q *TransactionQueue) finalizedState(slot int) map[util.PublicKey]*Account {
+	if chunk := q.oldChunks[slot]; chunk != nil {
+		return chunk.State
+	}
+	if diff := q.diffs[slot]; diff != nil {
+		return diff.State
+	}
+	return nil
+}
@@ -1,20 +1,60 @@
 package currency
 
-import ()
+import (
+	"fmt"
+	"math/big"
+	"sync/atomic"
+
+	"coinkit/util"
+)
 
 // Used to map a public key to its Account
+// All account data is kept in memory, so looking up an account is a map
+// access for each layer of copy-on-write, no matter how many accounts
+// there are.
 type AccountMap struct {
 	// Storing real account data
-	data map[string]*Account
+	data map[util.PublicKey]*Account
 
 	// We use the fallback when we don't have data on an account
 	// Can be nil
 	fallback *AccountMap
+
+	// Set to a new version whenever data is written, so that callers can
+	// tell whether a cached validation result is still good
+	version uint64
+
+	// Delegates that accounts have authorized, indexed by delegationKey
+	delegations map[string]*delegation
+
+	// Spending for accounts that have a spending limit
+	spending map[util.PublicKey]*spendingState
+
+	// The slot that transactions are being processed for
+	slot int
+
+	// The sum of the hashes of every visible account. See StateRoot
+	root *big.Int
+}
+
+// accountVersions is the last version handed out to any account map. Every
+// account map shares it, so that two different maps never have the same
+// version.
+var accountVersions uint64
+
+// nextVersion returns a version that no account map has had before.
+func nextVersion() uint64 {
+	return atomic.AddUint64(&accountVersions, 1)
 }
 
 func NewAccountMap() *AccountMap {
 	return &AccountMap{
-		data: make(map[string]*Account),
+		data:        make(map[util.PublicKey]*Account),
+		delegations: make(map[string]*delegation),
+		spending:    make(map[util.PublicKey]*spendingState),
+		version:     nextVersion(),
+		slot:        1,
+		root:        new(big.Int),
 	}
 }
 
@@ -22,11 +62,22 @@ func NewAccountMap() *AccountMap {
 // made won't be visible in the original
 func (m *AccountMap) CowCopy() *AccountMap {
 	return &AccountMap{
-		data:     make(map[string]*Account),
-		fallback: m,
+		data:        make(map[util.PublicKey]*Account),
+		delegations: make(map[string]*delegation),
+		spending:    make(map[util.PublicKey]*spendingState),
+		fallback:    m,
+		version:     nextVersion(),
+		slot:        m.slot,
+		root:        new(big.Int).Set(m.root),
 	}
 }
 
+// SetSlot sets the slot that transactions are being processed for.
+// Delegated spending limits depend on it.
+func (m *AccountMap) SetSlot(slot int) {
+	m.slot = slot
+}
+
 func (m *AccountMap) MaxBalance() uint64 {
 	answer := uint64(0)
 	for _, account := range m.data {
@@ -44,7 +95,7 @@ func (m *AccountMap) MaxBalance() uint64 {
 }
 
 // Checks that the data in the account map is what we expect
-func (m *AccountMap) CheckEqual(key string, account *Account) bool {
+func (m *AccountMap) CheckEqual(key util.PublicKey, account *Account) bool {
 	a := m.Get(key)
 	if a == nil && account == nil {
 		return true
@@ -55,7 +106,7 @@ func (m *AccountMap) CheckEqual(key string, account *Account) bool {
 	return a.Sequence == account.Sequence && a.Balance == account.Balance
 }
 
-func (m *AccountMap) Get(key string) *Account {
+func (m *AccountMap) Get(key util.PublicKey) *Account {
 	answer := m.data[key]
 	if answer == nil && m.fallback != nil {
 		return m.fallback.Get(key)
@@ -63,28 +114,152 @@ func (m *AccountMap) Get(key string) *Account {
 	return answer
 }
 
-func (m *AccountMap) Set(key string, account *Account) {
+func (m *AccountMap) Set(key util.PublicKey, account *Account) {
+	m.updateRoot(key, m.Get(key), account)
 	m.data[key] = account
+	m.version = nextVersion()
+}
+
+// Snapshot returns a copy of the data for every account visible through this
+// account map.
+func (m *AccountMap) Snapshot() map[util.PublicKey]*Account {
+	answer := make(map[util.PublicKey]*Account)
+	if m.fallback != nil {
+		answer = m.fallback.Snapshot()
+	}
+	for key, account := range m.data {
+		answer[key] = &Account{
+			Sequence: account.Sequence,
+			Balance:  account.Balance,
+		}
+	}
+	return answer
+}
+
+func (m *AccountMap) getDelegation(owner util.PublicKey, delegate util.PublicKey) *delegation {
+	answer := m.delegations[delegationKey(owner, delegate)]
+	if answer == nil && m.fallback != nil {
+		return m.fallback.getDelegation(owner, delegate)
+	}
+	return answer
+}
+
+func (m *AccountMap) setDelegation(owner util.PublicKey, delegate util.PublicKey, d *delegation) {
+	m.delegations[delegationKey(owner, delegate)] = d
+	m.version = nextVersion()
+}
+
+func (m *AccountMap) getSpending(owner util.PublicKey) *spendingState {
+	answer := m.spending[owner]
+	if answer == nil && m.fallback != nil {
+		return m.fallback.getSpending(owner)
+	}
+	return answer
+}
+
+func (m *AccountMap) setSpending(owner util.PublicKey, s *spendingState) {
+	m.spending[owner] = s
+	m.version = nextVersion()
+}
+
+// SpendingLimit returns the spending limit in effect for an account, or nil
+// if it has none.
+func (m *AccountMap) SpendingLimit(owner util.PublicKey) *SpendingLimit {
+	s := m.getSpending(owner)
+	if s == nil {
+		return nil
+	}
+	limit := s.current(m.slot).limit
+	if limit.Amount == 0 {
+		return nil
+	}
+	return limit
+}
+
+// Capability returns the capability that owner has given to delegate, or nil
+// if there is none.
+func (m *AccountMap) Capability(owner util.PublicKey, delegate util.PublicKey) *Capability {
+	d := m.getDelegation(owner, delegate)
+	if d == nil || d.capability.MaxAmount == 0 {
+		return nil
+	}
+	return d.capability
+}
+
+// Version changes whenever the data visible through this account map changes.
+// Versions only ever go up, and no two account maps have the same version,
+// as long as a fallback isn't written to after a copy is made of it.
+func (m *AccountMap) Version() uint64 {
+	if m.fallback != nil {
+		if v := m.fallback.Version(); v > m.version {
+			return v
+		}
+	}
+	return m.version
 }
 
-// Validate returns whether this transaction is valid
-func (m *AccountMap) Validate(t *Transaction) bool {
+// Validate returns an error if this transaction is not valid
+func (m *AccountMap) Validate(t *Transaction) error {
+	if t == nil {
+		return ErrNilTransaction
+	}
+	if t.From.Validate() != nil || t.To.Validate() != nil {
+		return ErrBadPublicKey
+	}
 	account := m.Get(t.From)
 	if account == nil {
-		return false
+		return ErrNoAccount
+	}
+	if t.Sequence <= account.Sequence {
+		return ErrOldSequence
 	}
 	if account.Sequence+1 != t.Sequence {
-		return false
+		return ErrFutureSequence
 	}
 	cost := t.Amount + t.Fee
 	if cost > account.Balance {
-		return false
+		return ErrInsufficientBalance
 	}
+	if t.Limit != nil && !t.Limit.Valid() {
+		return ErrInvalidSpendingLimit
+	}
+	if s := m.getSpending(t.From); s != nil {
+		s = s.current(m.slot)
+		if s.limit.Amount != 0 && s.spent+cost > s.limit.Amount {
+			return ErrSpendingLimitExceeded
+		}
+	}
+	if t.Delegate != "" {
+		return m.validateDelegated(t)
+	}
+
+	return nil
+}
 
-	return true
+// validateDelegated checks that a transaction signed by a delegate is within
+// the delegate's capability.
+func (m *AccountMap) validateDelegated(t *Transaction) error {
+	if t.Grant != nil || t.Limit != nil {
+		return ErrDelegateCannotGrant
+	}
+	d := m.getDelegation(t.From, t.Delegate)
+	if d == nil || d.capability.MaxAmount == 0 {
+		return ErrUnknownDelegate
+	}
+	if !d.capability.Allows(t.To) {
+		return ErrDestinationNotAllowed
+	}
+	spent := uint64(0)
+	if d.window == m.slot/DelegationWindow {
+		spent = d.spent
+	}
+	if spent+t.Amount+t.Fee > d.capability.MaxAmount {
+		return ErrCapabilityExceeded
+	}
+	return nil
 }
 
-func (m *AccountMap) SetBalance(owner string, amount uint64) {
+func (m *AccountMap) SetBalance(owner util.PublicKey, amount uint64) {
 	oldAccount := m.Get(owner)
 	sequence := uint32(0)
 	if oldAccount != nil {
@@ -93,57 +268,111 @@ func (m *AccountMap) SetBalance(owner string, amount uint64) {
 	m.Set(owner, &Account{Sequence: sequence, Balance: amount})
 }
 
-// Process returns false if the transaction cannot be processed
-func (m *AccountMap) Process(t *Transaction) bool {
-	if !m.Validate(t) {
-		return false
+// Process returns an error if the transaction cannot be processed
+func (m *AccountMap) Process(t *Transaction) error {
+	if err := m.Validate(t); err != nil {
+		return err
 	}
 	source := m.Get(t.From)
-	target := m.Get(t.To)
-	if target == nil {
-		target = &Account{}
-	}
 	newSource := &Account{
 		Sequence: t.Sequence,
 		Balance:  source.Balance - t.Amount - t.Fee,
 	}
+	m.Set(t.From, newSource)
+
+	// Look up the target after updating the source, in case they are the same
+	target := m.Get(t.To)
+	if target == nil {
+		target = &Account{}
+	}
 	newTarget := &Account{
 		Sequence: target.Sequence,
 		Balance:  target.Balance + t.Amount,
 	}
-	m.Set(t.From, newSource)
 	m.Set(t.To, newTarget)
-	return true
+
+	m.processSpending(t)
+	if t.Grant != nil {
+		m.setDelegation(t.From, t.Grant.Key, &delegation{
+			capability: t.Grant,
+			window:     m.slot / DelegationWindow,
+		})
+	}
+	if t.Delegate != "" {
+		d := m.getDelegation(t.From, t.Delegate)
+		window := m.slot / DelegationWindow
+		spent := t.Amount + t.Fee
+		if d.window == window {
+			spent += d.spent
+		}
+		m.setDelegation(t.From, t.Delegate, &delegation{
+			capability: d.capability,
+			window:     window,
+			spent:      spent,
+		})
+	}
+	return nil
 }
 
-// ProcessChunk returns false if the whole chunk cannot be processed.
-// In this situation, the account map may be left with only some of
-// the transactions in the chunk processed.
-func (m *AccountMap) ProcessChunk(chunk *LedgerChunk) bool {
+// processSpending updates the spending state of the sender of a transaction
+// that is being processed.
+func (m *AccountMap) processSpending(t *Transaction) {
+	s := m.getSpending(t.From)
+	if s == nil && t.Limit == nil {
+		return
+	}
+	if s == nil {
+		s = &spendingState{limit: &SpendingLimit{}}
+	}
+	s = s.current(m.slot)
+	if t.Limit != nil {
+		if s.limit.Looser(t.Limit) {
+			s.pending = t.Limit
+			s.pendingStart = m.slot + s.limit.Slots
+		} else {
+			// Stricter limits take effect right away
+			s.limit = t.Limit
+			s.pending = nil
+			s.window = -1
+			s = s.current(m.slot)
+		}
+	}
+	s.spent += t.Amount + t.Fee
+	m.setSpending(t.From, s)
+}
+
+// ProcessChunk returns an error if the whole chunk cannot be processed.
+// In this situation, the account map is left as it was.
+// Transactions that don't share accounts are processed in parallel.
+func (m *AccountMap) ProcessChunk(chunk *LedgerChunk) error {
 	if chunk == nil {
-		return false
+		return ErrNilTransaction
 	}
 	if len(chunk.Transactions) > MaxChunkSize {
-		return false
+		return ErrChunkTooLarge
 	}
 
-	for _, t := range chunk.Transactions {
-		if t == nil || !t.Verify() || !m.Process(t.Transaction) {
-			return false
-		}
+	changes := m.CowCopy()
+	if err := changes.processTransactions(chunk.Transactions); err != nil {
+		return err
 	}
 
 	for owner, account := range chunk.State {
-		if !m.CheckEqual(owner, account) {
-			return false
+		if !changes.CheckEqual(owner, account) {
+			return fmt.Errorf("account %s: %w", util.Shorten(string(owner)), ErrStateMismatch)
 		}
 	}
+	delegations, spending := changes.limitStates()
+	if !sameLimits(delegations, spending, chunk.Delegations, chunk.Spending) {
+		return fmt.Errorf("delegations or spending limits: %w", ErrStateMismatch)
+	}
 
-	return true
+	m.merge(changes)
+	return nil
 }
 
-// ValidateChunk returns true iff ProcessChunk could succeed.
-func (m *AccountMap) ValidateChunk(chunk *LedgerChunk) bool {
+// ValidateChunk returns nil iff ProcessChunk could succeed.
+func (m *AccountMap) ValidateChunk(chunk *LedgerChunk) error {
 	copy := m.CowCopy()
 	return copy.ProcessChunk(chunk)
 }
@@ -18,7 +18,20 @@ type AccountMessage struct {
 
 	// The state of accounts as of the provided slot.
 	// Nil values mean it is unknown.
-	State map[string]*Account
+	State map[util.PublicKey]*Account
+
+	// When the request asked about a transaction, Included is the slot
+	// that finalized it. 0 means it hasn't been finalized.
+	Included int `json:",omitempty"`
+}
+
+// Depth returns how many slots have been finalized after the one that
+// included the transaction asked about, or -1 if it hasn't been finalized.
+func (m *AccountMessage) Depth() int {
+	if m.Included == 0 {
+		return -1
+	}
+	return m.I - 1 - m.Included
 }
 
 func (m *AccountMessage) Slot() int {
@@ -34,9 +47,12 @@ func (m *AccountMessage) String() string {
 	if m.I != 0 {
 		parts = append(parts, fmt.Sprintf("i=%d", m.I))
 	}
+	if m.Included != 0 {
+		parts = append(parts, fmt.Sprintf("included=%d", m.Included))
+	}
 	for user, account := range m.State {
 		parts = append(parts, fmt.Sprintf("%s=%s",
-			util.Shorten(user), StringifyAccount(account)))
+			util.Shorten(string(user)), StringifyAccount(account)))
 	}
 	return strings.Join(parts, " ")
 }
@@ -1,33 +1,247 @@
 package currency
 
 import (
+	"fmt"
 	"testing"
+
+	"coinkit/util"
 )
 
 func TestTransactionProcessing(t *testing.T) {
+	alice, bob := testKey("alice"), testKey("bob")
 	m := NewAccountMap()
 	payBob := &Transaction{
 		Sequence: 1,
 		Amount: 100,
 		Fee: 3,
-		From: "alice",
-		To: "bob",
+		From: alice,
+		To: bob,
 	}
-	if m.Validate(payBob) {
+	if m.Validate(payBob) != ErrNoAccount {
 		t.Fatalf("alice should not be able to pay bob with no account")
 	}
-	m.SetBalance("alice", 50)
-	if m.Validate(payBob) {
+	m.SetBalance(alice, 50)
+	if m.Validate(payBob) != ErrInsufficientBalance {
 		t.Fatalf("alice should not be able to pay bob with only 50 money")
 	}
-	m.SetBalance("alice", 200)
-	if !m.Validate(payBob) {
+	m.SetBalance(alice, 200)
+	if m.Validate(payBob) != nil {
 		t.Fatalf("alice should be able to pay bob with 200 money")
 	}
-	if !m.Process(payBob) {
+	if m.Process(payBob) != nil {
 		t.Fatalf("the payment should have worked")
 	}
-	if m.Validate(payBob) {
-		t.Fatalf("validation should reject replay attacks")
+	err := m.Validate(payBob)
+	if err != ErrOldSequence || IsTransient(err) {
+		t.Fatalf("validation should permanently reject replay attacks")
+	}
+}
+
+func TestDelegatedSigning(t *testing.T) {
+	alice, bob, carol := testKey("alice"), testKey("bob"), testKey("carol")
+	m := NewAccountMap()
+	m.SetBalance(alice, 1000)
+	payBob := &Transaction{
+		Sequence: 1,
+		Amount:   10,
+		Fee:      0,
+		From:     alice,
+		To:       bob,
+		Delegate: "hot",
+	}
+	if m.Validate(payBob) != ErrUnknownDelegate {
+		t.Fatalf("the delegate should not work before it is granted")
+	}
+	grant := &Transaction{
+		Sequence: 1,
+		From:     alice,
+		To:       alice,
+		Grant: &Capability{
+			Key:          "hot",
+			MaxAmount:    25,
+			Destinations: []util.PublicKey{bob},
+		},
+	}
+	if m.Process(grant) != nil {
+		t.Fatalf("alice should be able to grant a capability")
+	}
+
+	payBob.Sequence = 2
+	if m.Process(payBob) != nil {
+		t.Fatalf("the delegate should be able to pay bob")
+	}
+	payCarol := &Transaction{
+		Sequence: 3,
+		Amount:   10,
+		From:     alice,
+		To:       carol,
+		Delegate: "hot",
+	}
+	if m.Validate(payCarol) != ErrDestinationNotAllowed {
+		t.Fatalf("the delegate should not be able to pay carol")
+	}
+	payBob = &Transaction{
+		Sequence: 3,
+		Amount:   10,
+		Fee:      10,
+		From:     alice,
+		To:       bob,
+		Delegate: "hot",
+	}
+	if m.Validate(payBob) != ErrCapabilityExceeded {
+		t.Fatalf("the delegate should be limited to 25 per window")
+	}
+
+	// The limit resets in the next window
+	m.SetSlot(DelegationWindow)
+	if m.Process(payBob) != nil {
+		t.Fatalf("the delegate should be able to spend again in a new window")
+	}
+	if m.Get(bob).Balance != 20 || m.Get(alice).Balance != 970 {
+		t.Fatalf("bad balances after delegated payments")
+	}
+
+	// Delegates can't grant themselves more
+	regrant := &Transaction{
+		Sequence: 4,
+		From:     alice,
+		To:       alice,
+		Delegate: "hot",
+		Grant:    &Capability{Key: "hot", MaxAmount: 1000},
+	}
+	if m.Validate(regrant) != ErrDelegateCannotGrant {
+		t.Fatalf("delegates should not be able to grant capabilities")
+	}
+
+	// Delegated transactions are signed by the delegate
+	owner := util.NewKeyPairFromSecretPhrase("owner")
+	hot := util.NewKeyPairFromSecretPhrase("hot")
+	tr := &Transaction{
+		Sequence: 1,
+		Amount:   1,
+		From:     owner.PublicKey(),
+		To:       bob,
+		Delegate: hot.PublicKey(),
+	}
+	if !tr.SignWith(hot).Verify() {
+		t.Fatalf("the delegate's signature should verify")
+	}
+}
+
+func TestSpendingLimit(t *testing.T) {
+	alice, bob := testKey("alice"), testKey("bob")
+	m := NewAccountMap()
+	m.SetBalance(alice, 1000)
+	limit := &Transaction{
+		Sequence: 1,
+		Amount:   10,
+		From:     alice,
+		To:       bob,
+		Limit:    &SpendingLimit{Amount: 50, Slots: 10},
+	}
+	if m.Process(limit) != nil {
+		t.Fatalf("alice should be able to set a limit")
+	}
+	pay := func(seq uint32, amount uint64) *Transaction {
+		return &Transaction{
+			Sequence: seq,
+			Amount:   amount,
+			From:     alice,
+			To:       bob,
+		}
+	}
+	if m.Process(pay(2, 40)) != nil {
+		t.Fatalf("alice should be able to spend up to her limit")
+	}
+	if m.Validate(pay(3, 1)) != ErrSpendingLimitExceeded {
+		t.Fatalf("alice should not be able to spend past her limit")
+	}
+
+	// Loosening the limit takes a full window to take effect
+	m.SetSlot(10)
+	loosen := pay(3, 0)
+	loosen.Limit = &SpendingLimit{}
+	if m.Process(loosen) != nil {
+		t.Fatalf("alice should be able to ask for a looser limit")
+	}
+	if m.Validate(pay(4, 51)) != ErrSpendingLimitExceeded {
+		t.Fatalf("a looser limit should not take effect right away")
+	}
+	m.SetSlot(20)
+	if m.SpendingLimit(alice) != nil {
+		t.Fatalf("the limit should be gone after a window")
+	}
+	if m.Process(pay(4, 500)) != nil {
+		t.Fatalf("alice should be able to spend freely without a limit")
+	}
+
+	bad := pay(5, 0)
+	bad.Limit = &SpendingLimit{Amount: 10}
+	if m.Validate(bad) != ErrInvalidSpendingLimit {
+		t.Fatalf("a limit needs a window")
+	}
+}
+
+// Account data is all in memory, so validating a transaction should take
+// about as long no matter how many accounts there are.
+func TestStateRootFollowsWrites(t *testing.T) {
+	alice, bob, carol := testKey("alice"), testKey("bob"), testKey("carol")
+	m := NewAccountMap()
+	m.SetBalance(alice, 200)
+	m.SetBalance(carol, 7)
+	copy := m.CowCopy()
+	err := copy.Process(&Transaction{
+		Sequence: 1,
+		Amount:   100,
+		Fee:      3,
+		From:     alice,
+		To:       bob,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copy.StateRoot() == m.StateRoot() {
+		t.Fatalf("the payment should change the state root")
+	}
+	m.merge(copy)
+
+	// The same accounts, written in a different order
+	other := NewAccountMap()
+	for _, key := range []util.PublicKey{carol, bob, alice} {
+		account := m.Get(key)
+		other.Set(key, &Account{Sequence: account.Sequence, Balance: account.Balance})
+	}
+	if m.StateRoot() != copy.StateRoot() || m.StateRoot() != other.StateRoot() {
+		t.Fatalf("maps with the same accounts should have the same state root")
+	}
+	if NewAccountMap().StateRoot() == m.StateRoot() {
+		t.Fatalf("the empty map should have a different state root")
+	}
+}
+
+func BenchmarkValidateByAccountCount(b *testing.B) {
+	for _, count := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("accounts=%d", count), func(b *testing.B) {
+			m := NewAccountMap()
+			for i := 0; i < count; i++ {
+				m.SetBalance(util.PublicKey(fmt.Sprintf("account %d", i)), 100)
+			}
+			t := &Transaction{
+				From:     "account 7",
+				Sequence: 1,
+				To:       "account 8",
+				Amount:   10,
+			}
+
+			// Validation happens on a copy of the accounts, as when a
+			// chunk is built
+			validator := m.CowCopy()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := validator.Validate(t); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,85 @@
+package currency
+
+import (
+	"hash/fnv"
+)
+
+// How many finalized transactions each generation of the recent transaction
+// filter holds. The filter remembers between one and two generations' worth.
+const RecentTransactions = 100000
+
+// Bits per entry and hash functions per entry for a false positive rate of
+// about one percent
+const (
+	bloomBitsPerEntry = 10
+	bloomHashes       = 7
+)
+
+// A bloomFilter is a set of strings in a fixed amount of memory. It can have
+// false positives, but never false negatives.
+type bloomFilter struct {
+	bits []uint64
+}
+
+func newBloomFilter(entries int) *bloomFilter {
+	return &bloomFilter{
+		bits: make([]uint64, (entries*bloomBitsPerEntry+63)/64),
+	}
+}
+
+// positions calls f with each bit position for s, using double hashing.
+func (f *bloomFilter) positions(s string, fn func(uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	a, b := sum&0xffffffff, sum>>32
+	size := uint64(len(f.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		fn((a + i*b) % size)
+	}
+}
+
+func (f *bloomFilter) add(s string) {
+	f.positions(s, func(p uint64) {
+		f.bits[p/64] |= 1 << (p % 64)
+	})
+}
+
+func (f *bloomFilter) mayContain(s string) bool {
+	answer := true
+	f.positions(s, func(p uint64) {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			answer = false
+		}
+	})
+	return answer
+}
+
+// A recentFilter remembers recently added strings. When the current
+// generation fills up, the older one is dropped, so memory stays bounded.
+type recentFilter struct {
+	current *bloomFilter
+	older   *bloomFilter
+	count   int
+}
+
+func newRecentFilter() *recentFilter {
+	return &recentFilter{
+		current: newBloomFilter(RecentTransactions),
+		older:   newBloomFilter(RecentTransactions),
+	}
+}
+
+func (f *recentFilter) add(s string) {
+	if f.count >= RecentTransactions {
+		f.older = f.current
+		f.current = newBloomFilter(RecentTransactions)
+		f.count = 0
+	}
+	f.current.add(s)
+	f.count++
+}
+
+func (f *recentFilter) mayContain(s string) bool {
+	return f.current.mayContain(s) || f.older.mayContain(s)
+}
@@ -0,0 +1,67 @@
+package currency
+
+import (
+	"fmt"
+	"strings"
+
+	"coinkit/util"
+)
+
+// Delegated spending limits apply to fixed windows of this many slots.
+const DelegationWindow = 100
+
+// A Capability authorizes a secondary key to sign transactions on behalf of
+// an account, within limits. This lets a hot wallet hold a key that can only
+// do limited damage if it is stolen.
+type Capability struct {
+	// The delegated public key
+	Key util.PublicKey
+
+	// The most the delegate can spend, including fees, in one delegation
+	// window. Zero means the delegate is revoked.
+	MaxAmount uint64
+
+	// When nonempty, the delegate can only send money to these accounts
+	Destinations []util.PublicKey `json:",omitempty"`
+}
+
+func (c *Capability) String() string {
+	return fmt.Sprintf("delegate %s max %d to %d destinations",
+		util.Shorten(string(c.Key)), c.MaxAmount, len(c.Destinations))
+}
+
+// Allows returns whether the delegate can send money to this account.
+func (c *Capability) Allows(to util.PublicKey) bool {
+	if len(c.Destinations) == 0 {
+		return true
+	}
+	for _, d := range c.Destinations {
+		if d == to {
+			return true
+		}
+	}
+	return false
+}
+
+// A delegation tracks how much a delegate has spent, so that we can
+// enforce its capability.
+type delegation struct {
+	capability *Capability
+
+	// The delegation window that spent applies to
+	window int
+
+	// How much the delegate has spent in the window
+	spent uint64
+}
+
+// delegationKey is how the account map indexes delegations, since a key can
+// be a delegate for more than one account.
+func delegationKey(owner util.PublicKey, delegate util.PublicKey) string {
+	return string(owner) + ":" + string(delegate)
+}
+
+// delegationOwner returns the owner part of a delegation key.
+func delegationOwner(key string) util.PublicKey {
+	return util.PublicKey(strings.SplitN(key, ":", 2)[0])
+}
@@ -0,0 +1,56 @@
+package currency
+
+import (
+	"errors"
+)
+
+// These errors mean the transaction or chunk can never be processed, no matter
+// what happens to the state of accounts.
+var (
+	ErrNilTransaction   = errors.New("missing transaction")
+	ErrBadSignature     = errors.New("signature failed verification")
+	ErrOldSequence      = errors.New("sequence number was already used")
+	ErrAlreadyFinalized = errors.New("transaction was already finalized")
+	ErrChunkTooLarge    = errors.New("chunk has too many transactions")
+	ErrChunkHashInvalid = errors.New("chunk does not match its hash")
+	ErrBadPublicKey     = errors.New("transaction has a malformed public key")
+
+	ErrDelegateCannotGrant   = errors.New("delegates cannot grant capabilities or set limits")
+	ErrDestinationNotAllowed = errors.New("delegate cannot send to this account")
+	ErrInvalidSpendingLimit  = errors.New("spending limit has no window")
+)
+
+// These errors mean the transaction or chunk cannot be processed right now,
+// but it might be possible later on, once the state of accounts changes.
+var (
+	ErrNoAccount             = errors.New("source account does not exist")
+	ErrFutureSequence        = errors.New("sequence number is too high")
+	ErrInsufficientBalance   = errors.New("insufficient balance")
+	ErrStateMismatch         = errors.New("chunk state does not match accounts")
+	ErrQueueFull             = errors.New("queue is full of higher priority transactions")
+	ErrUnknownDelegate       = errors.New("signer is not a delegate for this account")
+	ErrCapabilityExceeded    = errors.New("delegate spending limit exceeded")
+	ErrSpendingLimitExceeded = errors.New("account spending limit exceeded")
+	ErrImportBacklogFull     = errors.New("import backlog is full")
+)
+
+// IsTransient returns whether an error might go away if the same operation
+// is tried again later.
+func IsTransient(err error) bool {
+	for _, transient := range []error{
+		ErrNoAccount,
+		ErrFutureSequence,
+		ErrInsufficientBalance,
+		ErrStateMismatch,
+		ErrQueueFull,
+		ErrUnknownDelegate,
+		ErrCapabilityExceeded,
+		ErrSpendingLimitExceeded,
+		ErrImportBacklogFull,
+	} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
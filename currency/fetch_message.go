@@ -0,0 +1,38 @@
+package currency
+
+import (
+	"fmt"
+	"strings"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A FetchMessage asks peers for the ledger chunks behind some slot values.
+// Nodes send this when other nodes nominate chunks they have not seen yet.
+// The response is a TransactionMessage containing whichever of the chunks
+// the peer knows about.
+type FetchMessage struct {
+	// The hashes of the chunks we would like to know
+	Chunks []consensus.SlotValue
+}
+
+func (m *FetchMessage) Slot() int {
+	return 0
+}
+
+func (m *FetchMessage) MessageType() string {
+	return "F"
+}
+
+func (m *FetchMessage) String() string {
+	cnames := []string{}
+	for _, name := range m.Chunks {
+		cnames = append(cnames, util.Shorten(string(name)))
+	}
+	return fmt.Sprintf("fetch chunks (%s)", strings.Join(cnames, ","))
+}
+
+func init() {
+	util.RegisterMessageType(&FetchMessage{})
+}
@@ -0,0 +1,103 @@
+package currency
+
+import (
+	"sort"
+
+	"coinkit/util"
+)
+
+// The most imported transactions a queue holds before it refuses more
+const MaxImportBacklog = 100 * QueueLimit
+
+// Imported transactions skip the usual limits on pending transactions. They
+// wait in a backlog, grouped by sender, and each one moves into the queue as
+// soon as it has the next sequence number for its sender. From the queue
+// they go into chunks and get shared with our peers like any other
+// transaction.
+// A sender can only have one transaction in the queue at a time, so an
+// import goes fastest when it is spread across many senders, up to
+// MaxChunkSize transactions per slot.
+
+// Import adds a batch of transactions to the import backlog. If they don't
+// all fit, none of them are added. Transactions whose sequence number has
+// already been used are skipped, so an interrupted import can just be sent
+// again.
+// Returns whether the queue changed.
+func (q *TransactionQueue) Import(ts []*SignedTransaction) (bool, error) {
+	for _, t := range ts {
+		if t == nil || t.Transaction == nil {
+			return false, ErrNilTransaction
+		}
+	}
+	if q.importCount+len(ts) > MaxImportBacklog {
+		return false, ErrImportBacklogFull
+	}
+	for _, t := range ts {
+		account := q.accounts.Get(t.From)
+		if account != nil && t.Sequence <= account.Sequence {
+			continue
+		}
+		list := q.imports[t.From]
+		i := sort.Search(len(list), func(i int) bool {
+			return list[i].Sequence >= t.Sequence
+		})
+		if i < len(list) && list[i].Sequence == t.Sequence {
+			// We already have a transaction with this sequence number
+			continue
+		}
+		list = append(list, nil)
+		copy(list[i+1:], list[i:])
+		list[i] = t
+		q.imports[t.From] = list
+		q.importCount++
+	}
+	return q.feedImports(), nil
+}
+
+// ImportBacklog returns how many imported transactions have not been
+// finalized yet.
+func (q *TransactionQueue) ImportBacklog() int {
+	return q.importCount
+}
+
+// feedImports moves imported transactions into the queue, for each sender
+// whose next transaction we have, as long as the queue has room.
+// Returns whether the queue changed.
+func (q *TransactionQueue) feedImports() bool {
+	senders := []util.PublicKey{}
+	for sender := range q.imports {
+		senders = append(senders, sender)
+	}
+	util.SortPublicKeys(senders)
+
+	changed := false
+	for _, sender := range senders {
+		list := q.imports[sender]
+		account := q.accounts.Get(sender)
+		for len(list) > 0 && account != nil && list[0].Sequence <= account.Sequence {
+			// This one was finalized, or something else used its sequence
+			list = list[1:]
+			q.importCount--
+		}
+		if len(list) == 0 {
+			delete(q.imports, sender)
+			continue
+		}
+		q.imports[sender] = list
+		if q.pending.size() >= QueueLimit || q.Contains(list[0]) {
+			continue
+		}
+		added, err := q.Add(list[0])
+		if err != nil && !IsTransient(err) {
+			q.Logf("dropping imported transaction %s: %s", list[0].Transaction, err)
+			q.imports[sender] = list[1:]
+			q.importCount--
+			if len(list) == 1 {
+				delete(q.imports, sender)
+			}
+			continue
+		}
+		changed = changed || added
+	}
+	return changed
+}
@@ -0,0 +1,38 @@
+package currency
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// An ImportMessage carries a batch of signed transactions for bulk import,
+// like when balances are migrated onto this chain from another system.
+// Only keys with admin access can send them. The node answers with an
+// ImportMessage that has no transactions, just the size of its backlog, so
+// that the importer can pace itself.
+type ImportMessage struct {
+	Transactions []*SignedTransaction
+
+	// How many imported transactions are waiting to get into a chunk
+	Backlog int `json:",omitempty"`
+}
+
+func (m *ImportMessage) Slot() int {
+	return 0
+}
+
+func (m *ImportMessage) MessageType() string {
+	return "J"
+}
+
+func (m *ImportMessage) String() string {
+	if len(m.Transactions) == 0 {
+		return fmt.Sprintf("import backlog %d", m.Backlog)
+	}
+	return fmt.Sprintf("import %s", StringifyTransactions(m.Transactions))
+}
+
+func init() {
+	util.RegisterMessageType(&ImportMessage{})
+}
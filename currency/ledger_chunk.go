@@ -1,12 +1,14 @@
 package currency
 
 import (
+	"bytes"
 	"encoding/base64"
-	"sort"
+	"hash"
 
 	"golang.org/x/crypto/sha3"
 	
 	"coinkit/consensus"
+	"coinkit/util"
 )
 
 // MaxChunkSize defines how many items can be put in a chunk
@@ -19,27 +21,102 @@ type LedgerChunk struct {
 	// The state of accounts after these transactions have been processed.
 	// This only includes account information for the accounts that are
 	// mentioned in the transactions.
-	State map[string]*Account
+	State map[util.PublicKey]*Account
+
+	// The delegations and spending limits that these transactions changed,
+	// after they have been processed, indexed the same way as in the
+	// account map. Most chunks don't change any
+	Delegations map[string]*DelegationState       `json:",omitempty"`
+	Spending    map[util.PublicKey]*SpendingState `json:",omitempty"`
 }
 
 func (c *LedgerChunk) Hash() consensus.SlotValue {
-	h := sha3.New512()
+	return chunkHash(c.Signatures(), c.State, c.Delegations, c.Spending)
+}
+
+// Signatures returns the signatures of the transactions in this chunk, in
+// order.
+func (c *LedgerChunk) Signatures() []string {
+	answer := []string{}
 	for _, t := range c.Transactions {
-		h.Write([]byte(t.Signature))
+		answer = append(answer, t.Signature)
+	}
+	return answer
+}
+
+// chunkHash is the hash of a chunk with these transaction signatures and
+// state. Signatures are enough to stand in for whole transactions, since
+// each one covers its transaction.
+// Chunks that don't change any delegations or spending limits hash the same
+// as they did before chunks kept track of them.
+func chunkHash(signatures []string, state map[util.PublicKey]*Account,
+	delegations map[string]*DelegationState,
+	spending map[util.PublicKey]*SpendingState) consensus.SlotValue {
+	h := sha3.New512()
+	for _, signature := range signatures {
+		h.Write([]byte(signature))
 	}
-	keys := []string{}
-	for key, _ := range c.State {
+	keys := []util.PublicKey{}
+	for key, _ := range state {
 		keys = append(keys, key)
 	}
-	sort.Strings(keys)
+	util.SortPublicKeys(keys)
 	for _, key := range keys {
 		h.Write([]byte(key))
-		account := c.State[key]
+		account := state[key]
 		h.Write(account.Bytes())
 	}
+	writeLimits(h, delegations, spending)
 	return consensus.SlotValue(base64.RawStdEncoding.EncodeToString(h.Sum(nil)))
 }
 
+// writeLimits adds delegations and spending limits to a hash, in order of
+// their keys.
+func writeLimits(h hash.Hash, delegations map[string]*DelegationState,
+	spending map[util.PublicKey]*SpendingState) {
+	for _, key := range sortedKeys(delegations) {
+		h.Write([]byte(key))
+		h.Write(stateBytes(delegations[key]))
+	}
+	for _, key := range sortedKeys(spending) {
+		h.Write([]byte(key))
+		h.Write(stateBytes(spending[util.PublicKey(key)]))
+	}
+}
+
+// sameLimits returns whether two sets of delegations and spending limits
+// are the same.
+func sameLimits(d1 map[string]*DelegationState, s1 map[util.PublicKey]*SpendingState,
+	d2 map[string]*DelegationState, s2 map[util.PublicKey]*SpendingState) bool {
+	h1, h2 := sha3.New512(), sha3.New512()
+	writeLimits(h1, d1, s1)
+	writeLimits(h2, d2, s2)
+	return bytes.Equal(h1.Sum(nil), h2.Sum(nil))
+}
+
+// limitStates returns the delegations and spending limits that m has
+// itself, without its fallback. For a copy-on-write copy, that is what
+// changed since the copy was made. It returns nil maps rather than empty
+// ones.
+func (m *AccountMap) limitStates() (map[string]*DelegationState,
+	map[util.PublicKey]*SpendingState) {
+	var delegations map[string]*DelegationState
+	var spending map[util.PublicKey]*SpendingState
+	for key, d := range m.delegations {
+		if delegations == nil {
+			delegations = make(map[string]*DelegationState)
+		}
+		delegations[key] = d.state()
+	}
+	for owner, s := range m.spending {
+		if spending == nil {
+			spending = make(map[util.PublicKey]*SpendingState)
+		}
+		spending[owner] = s.state()
+	}
+	return delegations, spending
+}
+
 func (c *LedgerChunk) String() string {
 	return StringifyTransactions(c.Transactions)
 }
@@ -2,6 +2,8 @@ package currency
 
 import (
 	"testing"
+
+	"coinkit/util"
 )
 
 func TestLedgerChunkHashing(t *testing.T) {
@@ -15,7 +17,7 @@ func TestLedgerChunkHashing(t *testing.T) {
 
 	chunk1 := &LedgerChunk{
 		Transactions: []*SignedTransaction{t1, t2},
-		State: map[string]*Account{
+		State: map[util.PublicKey]*Account{
 			"a1": a1,
 			"a2": a2,
 		},
@@ -23,7 +25,7 @@ func TestLedgerChunkHashing(t *testing.T) {
 
 	chunk1copy := &LedgerChunk{
 		Transactions: []*SignedTransaction{t1copy, t2},
-		State: map[string]*Account{
+		State: map[util.PublicKey]*Account{
 			"a1": a1copy,
 			"a2": a2,
 		},
@@ -31,7 +33,7 @@ func TestLedgerChunkHashing(t *testing.T) {
 
 	chunk2 := &LedgerChunk{
 		Transactions: []*SignedTransaction{t1, t3},
-		State: map[string]*Account{
+		State: map[util.PublicKey]*Account{
 			"a1": a1,
 			"a2": a2,
 		},
@@ -39,7 +41,7 @@ func TestLedgerChunkHashing(t *testing.T) {
 
 	chunk3 := &LedgerChunk{
 		Transactions: []*SignedTransaction{t1, t2},
-		State: map[string]*Account{
+		State: map[util.PublicKey]*Account{
 			"a1": a2,
 			"a2": a1,
 		},
@@ -47,7 +49,7 @@ func TestLedgerChunkHashing(t *testing.T) {
 
 	chunk4 := &LedgerChunk{
 		Transactions: []*SignedTransaction{t1},
-		State: map[string]*Account{
+		State: map[util.PublicKey]*Account{
 			"a1": a1,
 			"a2": a2,
 		},
@@ -0,0 +1,160 @@
+package currency
+
+import (
+	"fmt"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A LedgerState is everything a transaction queue needs to pick up where
+// another left off, so that a node can save it and restart from it instead
+// of replaying history from the first slot.
+type LedgerState struct {
+	// The slot the queue was working on. Every earlier slot is reflected in
+	// the rest of the state
+	Slot int
+
+	// The key of the last chunk to get finalized
+	Last consensus.SlotValue
+
+	// How many transactions have been finalized
+	Finalized int
+
+	Accounts map[util.PublicKey]*Account
+
+	// Delegations and spending limits, indexed the same way as in the
+	// account map
+	Delegations map[string]*DelegationState       `json:",omitempty"`
+	Spending    map[util.PublicKey]*SpendingState `json:",omitempty"`
+}
+
+// A DelegationState is the saved form of a delegation.
+type DelegationState struct {
+	Capability *Capability
+	Window     int
+	Spent      uint64
+}
+
+// A SpendingState is the saved form of a spendingState.
+type SpendingState struct {
+	Limit        *SpendingLimit
+	Pending      *SpendingLimit `json:",omitempty"`
+	PendingStart int            `json:",omitempty"`
+	Window       int
+	Spent        uint64
+}
+
+func (d *delegation) state() *DelegationState {
+	return &DelegationState{
+		Capability: d.capability,
+		Window:     d.window,
+		Spent:      d.spent,
+	}
+}
+
+func (d *DelegationState) delegation() *delegation {
+	return &delegation{
+		capability: d.Capability,
+		window:     d.Window,
+		spent:      d.Spent,
+	}
+}
+
+func (s *spendingState) state() *SpendingState {
+	return &SpendingState{
+		Limit:        s.limit,
+		Pending:      s.pending,
+		PendingStart: s.pendingStart,
+		Window:       s.window,
+		Spent:        s.spent,
+	}
+}
+
+func (s *SpendingState) spendingState() *spendingState {
+	return &spendingState{
+		limit:        s.Limit,
+		pending:      s.Pending,
+		pendingStart: s.PendingStart,
+		window:       s.Window,
+		spent:        s.Spent,
+	}
+}
+
+// saveState copies everything visible through this account map into state.
+func (m *AccountMap) saveState(state *LedgerState) {
+	if m.fallback != nil {
+		m.fallback.saveState(state)
+	}
+	for key, account := range m.data {
+		state.Accounts[key] = &Account{
+			Sequence: account.Sequence,
+			Balance:  account.Balance,
+		}
+	}
+	for key, d := range m.delegations {
+		state.Delegations[key] = d.state()
+	}
+	for owner, s := range m.spending {
+		state.Spending[owner] = s.state()
+	}
+}
+
+// LedgerState returns the state of the queue as of the start of the slot it
+// is working on.
+func (q *TransactionQueue) LedgerState() *LedgerState {
+	state := &LedgerState{
+		Slot:        q.slot,
+		Last:        q.last,
+		Finalized:   q.finalized,
+		Accounts:    make(map[util.PublicKey]*Account),
+		Delegations: make(map[string]*DelegationState),
+		Spending:    make(map[util.PublicKey]*SpendingState),
+	}
+	q.accounts.saveState(state)
+	return state
+}
+
+// RestoreLedgerState replaces the state of a queue that has not finalized
+// anything yet with a saved one. Migrations for slots up to and including the
+// saved one are dropped, since they already ran before it was saved.
+func (q *TransactionQueue) RestoreLedgerState(state *LedgerState) error {
+	if q.slot != 1 || q.finalized != 0 {
+		return fmt.Errorf("cannot restore the ledger state for slot %d on slot %d",
+			state.Slot, q.slot)
+	}
+	if state.Slot < 1 {
+		return fmt.Errorf("bad ledger state slot: %d", state.Slot)
+	}
+
+	accounts := NewAccountMap()
+	for key, account := range state.Accounts {
+		accounts.Set(key, &Account{
+			Sequence: account.Sequence,
+			Balance:  account.Balance,
+		})
+	}
+	for key, d := range state.Delegations {
+		accounts.delegations[key] = d.delegation()
+	}
+	for owner, s := range state.Spending {
+		accounts.spending[owner] = s.spendingState()
+	}
+	accounts.SetSlot(state.Slot)
+
+	q.accounts = accounts
+	// Chunks that were validated against the old accounts have to be
+	// validated again
+	q.validated = make(map[consensus.SlotValue]uint64)
+	q.invalid = make(map[consensus.SlotValue]bool)
+	q.slot = state.Slot
+	q.last = state.Last
+	q.finalized = state.Finalized
+	for len(q.migrations) > 0 && q.migrations[0].Slot <= q.slot {
+		q.migrations = q.migrations[1:]
+	}
+	q.snapshots = nil
+	q.snapshot()
+	q.Revalidate()
+	return nil
+}
@@ -0,0 +1,63 @@
+package currency
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/sha3"
+
+	"coinkit/util"
+)
+
+// A Migration is a deterministic change to the state of accounts that every
+// node runs at the same slot, so that the state can change shape without
+// starting over from a fresh genesis.
+type Migration struct {
+	// A name for logging
+	Name string
+
+	// The migration runs right before the chunk for this slot is processed
+	Slot int
+
+	// When Before or After is set, the account hash must match it before or
+	// after the migration runs. A mismatch means this node has diverged from
+	// the network, so it should stop rather than continue with bad data.
+	Before string
+	After  string
+
+	// Apply transforms the account data. It must be deterministic.
+	Apply func(accounts *AccountMap)
+}
+
+// Hash returns a base64 hash of the data for every account.
+// Two account maps with the same data have the same hash.
+func (m *AccountMap) Hash() string {
+	accounts := m.Snapshot()
+	keys := []util.PublicKey{}
+	for key, _ := range accounts {
+		keys = append(keys, key)
+	}
+	util.SortPublicKeys(keys)
+	h := sha3.New512()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write(accounts[key].Bytes())
+	}
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Run applies the migration, checking the hashes before and after.
+// It returns an error if either hash doesn't match. When the hash before
+// doesn't match, the migration isn't applied.
+func (migration *Migration) Run(accounts *AccountMap) error {
+	if migration.Before != "" && accounts.Hash() != migration.Before {
+		return fmt.Errorf("account hash before migration %s is %s but should be %s",
+			migration.Name, accounts.Hash(), migration.Before)
+	}
+	migration.Apply(accounts)
+	if migration.After != "" && accounts.Hash() != migration.After {
+		return fmt.Errorf("account hash after migration %s is %s but should be %s",
+			migration.Name, accounts.Hash(), migration.After)
+	}
+	return nil
+}
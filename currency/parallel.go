@@ -0,0 +1,212 @@
+package currency
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"coinkit/util"
+)
+
+// How many goroutines process the transactions in a chunk at once
+var ChunkWorkers = runtime.NumCPU()
+
+// How many goroutines check the signatures on a batch of incoming
+// transactions at once. Checking signatures is most of the work of adding a
+// transaction to the queue, so more workers cut the latency of a big batch,
+// at the cost of using more cores while it is checked. 1 checks them one at
+// a time.
+var VerifyWorkers = runtime.NumCPU()
+
+// verifyAll checks the signatures on some transactions, using up to
+// VerifyWorkers goroutines. It returns whether each one is signed correctly.
+// Transactions that skip[i] is set for are not checked.
+func verifyAll(transactions []*SignedTransaction, skip []bool) []bool {
+	verified := make([]bool, len(transactions))
+	verify := func(i int) {
+		t := transactions[i]
+		if !skip[i] && t != nil {
+			verified[i] = t.Verify()
+		}
+	}
+	if VerifyWorkers <= 1 || len(transactions) <= 1 {
+		for i := range transactions {
+			verify(i)
+		}
+		return verified
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < VerifyWorkers && w < len(transactions); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				verify(i)
+			}
+		}()
+	}
+	for i := range transactions {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return verified
+}
+
+// independentGroups splits the transactions in a chunk into groups that
+// share no accounts, so that each group can be processed on its own.
+// Delegations and spending limits belong to the sending account, so a
+// transaction only touches its sender and its recipient.
+// Each group lists transaction indices in order, and the groups are ordered
+// by their first index, so the split is deterministic.
+func independentGroups(transactions []*SignedTransaction) [][]int {
+	// A union-find over transaction indices, joined through accounts
+	parent := make([]int, len(transactions))
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	owner := make(map[util.PublicKey]int)
+	for i, t := range transactions {
+		parent[i] = i
+		if t == nil || t.Transaction == nil {
+			continue
+		}
+		for _, account := range []util.PublicKey{t.From, t.To} {
+			j, ok := owner[account]
+			if !ok {
+				owner[account] = i
+				continue
+			}
+			a, b := find(i), find(j)
+			if a < b {
+				parent[b] = a
+			} else {
+				parent[a] = b
+			}
+		}
+	}
+
+	byRoot := make(map[int][]int)
+	for i := range transactions {
+		root := find(i)
+		byRoot[root] = append(byRoot[root], i)
+	}
+	groups := [][]int{}
+	for _, group := range byRoot {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0] < groups[j][0]
+	})
+	return groups
+}
+
+// The outcome of processing one group of transactions
+type groupResult struct {
+	accounts *AccountMap
+
+	// The index of the transaction that failed, and why. err is nil if they
+	// all succeeded
+	index int
+	err   error
+}
+
+// processGroup verifies and processes some transactions on a copy of the
+// account map, stopping at the first one that fails.
+func (m *AccountMap) processGroup(transactions []*SignedTransaction, group []int) *groupResult {
+	result := &groupResult{accounts: m.CowCopy()}
+	for _, i := range group {
+		t := transactions[i]
+		if t == nil {
+			result.index, result.err = i, ErrNilTransaction
+			return result
+		}
+		if !t.Verify() {
+			result.index, result.err = i, ErrBadSignature
+			return result
+		}
+		if err := result.accounts.Process(t.Transaction); err != nil {
+			result.index, result.err = i, err
+			return result
+		}
+	}
+	return result
+}
+
+// processTransactions processes transactions as if one at a time, in order,
+// but works on independent groups of them in parallel. It returns an error
+// for the first transaction that fails, in which case nothing is processed.
+func (m *AccountMap) processTransactions(transactions []*SignedTransaction) error {
+	groups := independentGroups(transactions)
+	results := make([]*groupResult, len(groups))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < ChunkWorkers && w < len(groups); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range work {
+				results[g] = m.processGroup(transactions, groups[g])
+			}
+		}()
+	}
+	for g := range groups {
+		work <- g
+	}
+	close(work)
+	wg.Wait()
+
+	// Each group only depends on its own earlier transactions, so the
+	// lowest failing index is the one that would fail processing in order
+	var failed *groupResult
+	for _, r := range results {
+		if r.err != nil && (failed == nil || r.index < failed.index) {
+			failed = r
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("chunk transaction %d: %w", failed.index, failed.err)
+	}
+
+	for _, r := range results {
+		m.merge(r.accounts)
+	}
+	return nil
+}
+
+// owners returns the accounts that have anything set in this layer of the
+// map, not counting its fallback. A delegation counts for its owner.
+func (m *AccountMap) owners() map[util.PublicKey]bool {
+	answer := make(map[util.PublicKey]bool)
+	for key := range m.data {
+		answer[key] = true
+	}
+	for key := range m.delegations {
+		answer[delegationOwner(key)] = true
+	}
+	for owner := range m.spending {
+		answer[owner] = true
+	}
+	return answer
+}
+
+// merge writes the changes made in a copy-on-write copy back into this map.
+func (m *AccountMap) merge(copy *AccountMap) {
+	for key, account := range copy.data {
+		m.Set(key, account)
+	}
+	for key, d := range copy.delegations {
+		m.delegations[key] = d
+		m.version = nextVersion()
+	}
+	for owner, s := range copy.spending {
+		m.setSpending(owner, s)
+	}
+}
@@ -0,0 +1,96 @@
+package currency
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"coinkit/util"
+)
+
+// processSerially is how chunks were processed before parallel processing,
+// one transaction at a time.
+func processSerially(m *AccountMap, transactions []*SignedTransaction) error {
+	for i, t := range transactions {
+		if t == nil {
+			return fmt.Errorf("chunk transaction %d: %w", i, ErrNilTransaction)
+		}
+		if !t.Verify() {
+			return fmt.Errorf("chunk transaction %d: %w", i, ErrBadSignature)
+		}
+		if err := m.Process(t.Transaction); err != nil {
+			return fmt.Errorf("chunk transaction %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func TestIndependentGroups(t *testing.T) {
+	kps := []*util.KeyPair{}
+	for i := 0; i < 4; i++ {
+		kps = append(kps, util.NewKeyPairFromSecretPhrase(fmt.Sprintf("group %d", i)))
+	}
+	send := func(from int, to util.PublicKey) *SignedTransaction {
+		tr := &Transaction{From: kps[from].PublicKey(), Sequence: 1, To: to, Amount: 1}
+		return tr.SignWith(kps[from])
+	}
+	groups := independentGroups([]*SignedTransaction{
+		send(0, "x"),
+		send(1, "y"),
+		send(2, "x"),
+		nil,
+		send(3, kps[1].PublicKey()),
+	})
+	expected := [][]int{{0, 2}, {1, 4}, {3}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected groups %v but got %v", expected, groups)
+	}
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	defer func(workers int) { ChunkWorkers = workers }(ChunkWorkers)
+	ChunkWorkers = 4
+
+	kps := []*util.KeyPair{}
+	for i := 0; i < 20; i++ {
+		kps = append(kps, util.NewKeyPairFromSecretPhrase(fmt.Sprintf("parallel %d", i)))
+	}
+	for seed := int64(0); seed < int64(util.GetTestLoopLength(20, 200)); seed++ {
+		r := rand.New(rand.NewSource(seed))
+		serial := NewAccountMap()
+		parallel := NewAccountMap()
+		for _, kp := range kps {
+			balance := uint64(r.Intn(50))
+			serial.SetBalance(kp.PublicKey(), balance)
+			parallel.SetBalance(kp.PublicKey(), balance)
+		}
+		sequences := make(map[int]uint32)
+		transactions := []*SignedTransaction{}
+		for i := 0; i < 30; i++ {
+			from := r.Intn(len(kps))
+			sequences[from]++
+			if r.Intn(100) == 0 {
+				// Sometimes a transaction is out of order
+				sequences[from]++
+			}
+			tr := &Transaction{
+				From:     kps[from].PublicKey(),
+				Sequence: sequences[from],
+				To:       kps[r.Intn(len(kps))].PublicKey(),
+				Amount:   uint64(r.Intn(5)),
+				Fee:      uint64(r.Intn(2)),
+			}
+			transactions = append(transactions, tr.SignWith(kps[from]))
+		}
+
+		err1 := processSerially(serial, transactions)
+		err2 := parallel.processTransactions(transactions)
+		if fmt.Sprint(err1) != fmt.Sprint(err2) {
+			t.Fatalf("seed %d: serial got %v but parallel got %v", seed, err1, err2)
+		}
+		if err1 == nil && !reflect.DeepEqual(serial.Snapshot(), parallel.Snapshot()) {
+			t.Fatalf("seed %d: the account data does not match", seed)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package currency
+
+import (
+	"math/rand"
+
+	"coinkit/util"
+)
+
+// The most levels a node in the priority index can have. With a quarter of
+// the nodes promoted at each level, this is plenty for millions of entries
+const priorityMaxLevel = 12
+
+// A priorityIndex is a set of transactions kept in the canonical order, the
+// order of HighestPriorityFirst. It is a skip list, plus a map from hash to
+// node. Adding and removing take O(log n), checking whether a transaction is
+// in the set takes O(1), and the top n transactions are just the first n
+// nodes.
+// priorityIndex is not threadsafe.
+type priorityIndex struct {
+	// A sentinel before the first node, with a link at every level
+	head *priorityNode
+
+	// The lowest priority node, or nil when the index is empty
+	tail *priorityNode
+
+	// The nodes, indexed by transaction hash
+	nodes map[string]*priorityNode
+
+	// The transactions from each sender, indexed by hash
+	senders map[util.PublicKey]map[string]*SignedTransaction
+
+	// How many levels are in use
+	level int
+
+	// Only used to pick levels, so it doesn't need to be unpredictable
+	rand *rand.Rand
+}
+
+type priorityNode struct {
+	t *SignedTransaction
+
+	// The next node at each level this node is on
+	next []*priorityNode
+
+	// The previous node on the bottom level. Nil for the first node
+	prev *priorityNode
+}
+
+func newPriorityIndex() *priorityIndex {
+	return &priorityIndex{
+		head:    &priorityNode{next: make([]*priorityNode, priorityMaxLevel)},
+		nodes:   make(map[string]*priorityNode),
+		senders: make(map[util.PublicKey]map[string]*SignedTransaction),
+		level:   1,
+		rand:    rand.New(rand.NewSource(1)),
+	}
+}
+
+func (p *priorityIndex) randomLevel() int {
+	level := 1
+	for level < priorityMaxLevel && p.rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// search returns the last node before t on each level.
+func (p *priorityIndex) search(t *SignedTransaction) [priorityMaxLevel]*priorityNode {
+	var before [priorityMaxLevel]*priorityNode
+	node := p.head
+	for i := p.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && comparePriority(node.next[i].t, t) < 0 {
+			node = node.next[i]
+		}
+		before[i] = node
+	}
+	return before
+}
+
+// add adds a transaction, and returns whether it was not already there.
+func (p *priorityIndex) add(t *SignedTransaction) bool {
+	if p.contains(t) {
+		return false
+	}
+	before := p.search(t)
+	level := p.randomLevel()
+	for ; p.level < level; p.level++ {
+		before[p.level] = p.head
+	}
+	node := &priorityNode{t: t, next: make([]*priorityNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = before[i].next[i]
+		before[i].next[i] = node
+	}
+	if before[0] != p.head {
+		node.prev = before[0]
+	}
+	if node.next[0] == nil {
+		p.tail = node
+	} else {
+		node.next[0].prev = node
+	}
+	p.nodes[t.Hash()] = node
+	sent, ok := p.senders[t.From]
+	if !ok {
+		sent = make(map[string]*SignedTransaction)
+		p.senders[t.From] = sent
+	}
+	sent[t.Hash()] = t
+	return true
+}
+
+// remove removes a transaction, and returns whether it was there.
+func (p *priorityIndex) remove(t *SignedTransaction) bool {
+	if !p.contains(t) {
+		return false
+	}
+	node := p.nodes[t.Hash()]
+	before := p.search(node.t)
+	for i := 0; i < len(node.next); i++ {
+		before[i].next[i] = node.next[i]
+	}
+	if node.next[0] == nil {
+		p.tail = node.prev
+	} else {
+		node.next[0].prev = node.prev
+	}
+	for p.level > 1 && p.head.next[p.level-1] == nil {
+		p.level--
+	}
+	delete(p.nodes, t.Hash())
+	delete(p.senders[node.t.From], t.Hash())
+	if len(p.senders[node.t.From]) == 0 {
+		delete(p.senders, node.t.From)
+	}
+	return true
+}
+
+func (p *priorityIndex) contains(t *SignedTransaction) bool {
+	if t == nil || t.Transaction == nil {
+		return false
+	}
+	_, ok := p.nodes[t.Hash()]
+	return ok
+}
+
+func (p *priorityIndex) size() int {
+	return len(p.nodes)
+}
+
+// sentBy returns the transactions from one sender, in no particular order.
+func (p *priorityIndex) sentBy(sender util.PublicKey) []*SignedTransaction {
+	answer := []*SignedTransaction{}
+	for _, t := range p.senders[sender] {
+		answer = append(answer, t)
+	}
+	return answer
+}
+
+// top returns the n highest priority transactions, or all of them if there
+// are fewer than n.
+func (p *priorityIndex) top(n int) []*SignedTransaction {
+	answer := []*SignedTransaction{}
+	for node := p.head.next[0]; node != nil && len(answer) < n; node = node.next[0] {
+		answer = append(answer, node.t)
+	}
+	return answer
+}
+
+// each calls f on each transaction, highest priority first, until f returns
+// false. f may remove the transaction it is called on, but no others.
+func (p *priorityIndex) each(f func(*SignedTransaction) bool) {
+	node := p.head.next[0]
+	for node != nil {
+		next := node.next[0]
+		if !f(node.t) {
+			return
+		}
+		node = next
+	}
+}
+
+// values returns every transaction, highest priority first.
+func (p *priorityIndex) values() []*SignedTransaction {
+	return p.top(p.size())
+}
+
+// last returns the lowest priority transaction, or nil if there are none.
+func (p *priorityIndex) last() *SignedTransaction {
+	if p.tail == nil {
+		return nil
+	}
+	return p.tail.t
+}
@@ -0,0 +1,117 @@
+package currency
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// checkIndex fails if the index does not hold exactly these transactions,
+// in the canonical order.
+func checkIndex(t *testing.T, p *priorityIndex, expected map[string]*SignedTransaction) {
+	if p.size() != len(expected) {
+		t.Fatalf("expected %d transactions but the index has %d", len(expected), p.size())
+	}
+	sorted := []*SignedTransaction{}
+	for _, st := range expected {
+		sorted = append(sorted, st)
+	}
+	SortTransactions(sorted)
+	values := p.values()
+	for i, st := range sorted {
+		if values[i] != st {
+			t.Fatalf("transaction %d is %s but should be %s", i, values[i], st)
+		}
+	}
+
+	// Walk the bottom level backwards too, to check the prev links
+	i := len(sorted) - 1
+	for node := p.tail; node != nil; node = node.prev {
+		if node.t != sorted[i] {
+			t.Fatalf("walking backwards, transaction %d is %s but should be %s",
+				i, node.t, sorted[i])
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("walking backwards missed %d transactions", i+1)
+	}
+}
+
+func TestPriorityIndexMatchesSort(t *testing.T) {
+	ts := []*SignedTransaction{}
+	for i := 1; i <= 200; i++ {
+		st := makeTestTransaction(i)
+		// Lots of ties, so the hash decides the order
+		st.Transaction.Fee = uint64(i % 7)
+		ts = append(ts, st)
+	}
+
+	r := rand.New(rand.NewSource(2))
+	p := newPriorityIndex()
+	expected := make(map[string]*SignedTransaction)
+	for step := 0; step < 2000; step++ {
+		st := ts[r.Intn(len(ts))]
+		_, ok := expected[st.Hash()]
+		if r.Intn(3) == 0 {
+			if p.remove(st) != ok {
+				t.Fatalf("remove should return %t", ok)
+			}
+			delete(expected, st.Hash())
+		} else {
+			if p.add(st) == ok {
+				t.Fatalf("add should return %t", !ok)
+			}
+			expected[st.Hash()] = st
+		}
+		if step%100 == 0 {
+			checkIndex(t, p, expected)
+		}
+	}
+	checkIndex(t, p, expected)
+
+	for _, st := range ts {
+		p.remove(st)
+	}
+	if p.size() != 0 || p.last() != nil || len(p.top(10)) != 0 {
+		t.Fatal("the index should be empty")
+	}
+	if p.level != 1 {
+		t.Fatalf("an empty index should use one level, not %d", p.level)
+	}
+}
+
+func TestPriorityIndexNil(t *testing.T) {
+	p := newPriorityIndex()
+	if p.contains(nil) || p.contains(&SignedTransaction{}) {
+		t.Fatal("the index should not contain an empty transaction")
+	}
+	if p.remove(nil) {
+		t.Fatal("removing nil should do nothing")
+	}
+}
+
+func BenchmarkPriorityIndexAddRemove(b *testing.B) {
+	_, ts := benchmarkQueue(QueueLimit)
+	p := newPriorityIndex()
+	for _, t := range ts {
+		p.add(t)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t := ts[i%len(ts)]
+		p.remove(t)
+		p.add(t)
+	}
+}
+
+func BenchmarkPriorityIndexTop(b *testing.B) {
+	_, ts := benchmarkQueue(QueueLimit)
+	p := newPriorityIndex()
+	for _, t := range ts {
+		p.add(t)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.top(MaxChunkSize)
+	}
+}
@@ -0,0 +1,74 @@
+package currency
+
+import (
+	"fmt"
+)
+
+// A SpendingLimit caps how much an account can send, including fees, in each
+// window of Slots slots. It limits the damage a stolen key can do.
+type SpendingLimit struct {
+	// The most the account can send in one window.
+	// Zero means there is no limit.
+	Amount uint64
+
+	// How many slots a window lasts
+	Slots int
+}
+
+func (l *SpendingLimit) String() string {
+	return fmt.Sprintf("limit %d per %d slots", l.Amount, l.Slots)
+}
+
+// Looser returns whether changing to other would let the account spend more.
+func (l *SpendingLimit) Looser(other *SpendingLimit) bool {
+	if other.Amount == 0 {
+		return l.Amount != 0
+	}
+	if l.Amount == 0 {
+		return false
+	}
+	// Either a bigger amount or a shorter window could allow more spending
+	return other.Amount > l.Amount || other.Slots < l.Slots
+}
+
+// Valid returns whether this is a limit that can be set.
+func (l *SpendingLimit) Valid() bool {
+	return l.Amount == 0 || l.Slots > 0
+}
+
+// A spendingState tracks an account's spending, so that we can enforce its
+// limit.
+type spendingState struct {
+	limit *SpendingLimit
+
+	// A looser limit only takes effect after a full window of the old limit,
+	// so that a stolen key can't just raise it
+	pending      *SpendingLimit
+	pendingStart int
+
+	// The window that spent applies to
+	window int
+
+	// How much the account has spent in the window
+	spent uint64
+}
+
+// current returns the state as of the provided slot, with any pending limit
+// applied if it has taken effect, and spending reset if the window is over.
+func (s *spendingState) current(slot int) *spendingState {
+	answer := *s
+	if answer.pending != nil && slot >= answer.pendingStart {
+		answer.limit = answer.pending
+		answer.pending = nil
+		answer.window = -1
+	}
+	if answer.limit.Amount == 0 {
+		return &answer
+	}
+	window := slot / answer.limit.Slots
+	if window != answer.window {
+		answer.window = window
+		answer.spent = 0
+	}
+	return &answer
+}
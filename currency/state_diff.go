@@ -0,0 +1,207 @@
+package currency
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/sha3"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A StateDiffMessage is how the ledger changed in one slot: the new state of
+// everything that the slot's chunk touched. Followers can apply it instead of
+// processing the chunk's transactions themselves.
+type StateDiffMessage struct {
+	// The slot that the chunk was finalized in
+	I int
+
+	// The hash of the chunk
+	Chunk consensus.SlotValue
+
+	// The signatures of the chunk's transactions, in order. Along with State,
+	// they are enough to check the diff against the chunk hash
+	Signatures []string
+
+	// The state of the accounts that changed, after the slot. This is the
+	// same as the chunk's State
+	State map[util.PublicKey]*Account
+
+	// The delegations and spending limits that changed, after the slot,
+	// indexed the same way as in the account map
+	Delegations map[string]*DelegationState       `json:",omitempty"`
+	Spending    map[util.PublicKey]*SpendingState `json:",omitempty"`
+
+	// Hashes of everything the diff touches, before and after the slot, so
+	// that a follower can tell whether it is applying the diff on top of the
+	// right state
+	Before string
+	After  string
+}
+
+func (m *StateDiffMessage) Slot() int {
+	return m.I
+}
+
+func (m *StateDiffMessage) MessageType() string {
+	return "D"
+}
+
+func (m *StateDiffMessage) String() string {
+	return fmt.Sprintf("statediff i=%d chunk=%s accounts=%d", m.I,
+		util.Shorten(string(m.Chunk)), len(m.State))
+}
+
+func init() {
+	util.RegisterMessageType(&StateDiffMessage{})
+}
+
+// Verify returns whether the diff matches its chunk hash. The chunk hash
+// covers everything the diff changes, so only Before and After are left
+// to check against the state the diff gets applied to.
+func (m *StateDiffMessage) Verify() bool {
+	return chunkHash(m.Signatures, m.State, m.Delegations, m.Spending) == m.Chunk
+}
+
+// stateBytes is how the saved form of some state goes into a hash.
+func stateBytes(value interface{}) []byte {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return bytes
+}
+
+// hashDiffState hashes the current state of everything that a diff touches.
+func (m *AccountMap) hashDiffState(diff *StateDiffMessage) string {
+	h := sha3.New512()
+	write := func(key string, value interface{}) {
+		h.Write([]byte(key))
+		h.Write(stateBytes(value))
+	}
+	for _, key := range sortedKeys(diff.State) {
+		account := m.Get(util.PublicKey(key))
+		if account == nil {
+			write(key, nil)
+		} else {
+			write(key, account.Bytes())
+		}
+	}
+	for _, key := range sortedKeys(diff.Delegations) {
+		var state *DelegationState
+		if d := m.lookupDelegation(key); d != nil {
+			state = d.state()
+		}
+		write(key, state)
+	}
+	for _, key := range sortedKeys(diff.Spending) {
+		var state *SpendingState
+		if s := m.getSpending(util.PublicKey(key)); s != nil {
+			state = s.state()
+		}
+		write(key, state)
+	}
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// lookupDelegation is getDelegation by delegation key.
+func (m *AccountMap) lookupDelegation(key string) *delegation {
+	answer := m.delegations[key]
+	if answer == nil && m.fallback != nil {
+		return m.fallback.lookupDelegation(key)
+	}
+	return answer
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[util.PublicKey]*Account:
+		for key := range m {
+			keys = append(keys, string(key))
+		}
+	case map[string]*DelegationState:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[util.PublicKey]*SpendingState:
+		for key := range m {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newStateDiff makes the diff for a chunk that was processed into changes, a
+// copy-on-write copy of m.
+func (m *AccountMap) newStateDiff(slot int, key consensus.SlotValue,
+	chunk *LedgerChunk, changes *AccountMap) *StateDiffMessage {
+	diff := &StateDiffMessage{
+		I:           slot,
+		Chunk:       key,
+		Signatures:  chunk.Signatures(),
+		State:       chunk.State,
+		Delegations: chunk.Delegations,
+		Spending:    chunk.Spending,
+	}
+	diff.Before = m.hashDiffState(diff)
+	diff.After = changes.hashDiffState(diff)
+	return diff
+}
+
+// owners returns the accounts that the diff changes anything for. A
+// delegation counts for its owner.
+func (m *StateDiffMessage) owners() map[util.PublicKey]bool {
+	answer := make(map[util.PublicKey]bool)
+	for key := range m.State {
+		answer[key] = true
+	}
+	for key := range m.Delegations {
+		answer[delegationOwner(key)] = true
+	}
+	for owner := range m.Spending {
+		answer[owner] = true
+	}
+	return answer
+}
+
+// applyStateDiff writes a diff into the account map, checking that it
+// starts and ends at the state it should.
+func (m *AccountMap) applyStateDiff(diff *StateDiffMessage) error {
+	changes, err := m.stateDiffChanges(diff)
+	if err != nil {
+		return err
+	}
+	m.merge(changes)
+	return nil
+}
+
+// stateDiffChanges returns a copy-on-write copy of the account map with a
+// diff written into it, checking that the diff starts at the state of the
+// account map and ends at the state it says.
+func (m *AccountMap) stateDiffChanges(diff *StateDiffMessage) (*AccountMap, error) {
+	if m.hashDiffState(diff) != diff.Before {
+		return nil, fmt.Errorf("state diff for slot %d: %w", diff.I, ErrStateMismatch)
+	}
+	changes := m.CowCopy()
+	for key, account := range diff.State {
+		changes.Set(key, &Account{
+			Sequence: account.Sequence,
+			Balance:  account.Balance,
+		})
+	}
+	for key, d := range diff.Delegations {
+		changes.delegations[key] = d.delegation()
+	}
+	for owner, s := range diff.Spending {
+		changes.spending[owner] = s.spendingState()
+	}
+	if changes.hashDiffState(diff) != diff.After {
+		return nil, fmt.Errorf("state diff for slot %d does not match its own hash", diff.I)
+	}
+	return changes, nil
+}
@@ -0,0 +1,42 @@
+package currency
+
+import (
+	"encoding/base64"
+	"math/big"
+
+	"golang.org/x/crypto/sha3"
+
+	"coinkit/util"
+)
+
+// The state root is the sum of a hash of every account, modulo 2^512.
+// Unlike Hash, it does not depend on the order of the accounts, so Set can
+// keep it up to date without looking at any other account.
+var stateRootModulus = new(big.Int).Lsh(big.NewInt(1), 512)
+
+func accountHash(key util.PublicKey, account *Account) *big.Int {
+	h := sha3.New512()
+	h.Write([]byte(key))
+	h.Write(account.Bytes())
+	return new(big.Int).SetBytes(h.Sum(nil))
+}
+
+// updateRoot changes the state root for the data for key going from
+// before to after. Either may be nil.
+func (m *AccountMap) updateRoot(key util.PublicKey, before *Account, after *Account) {
+	if before != nil {
+		m.root.Sub(m.root, accountHash(key, before))
+	}
+	if after != nil {
+		m.root.Add(m.root, accountHash(key, after))
+	}
+	m.root.Mod(m.root, stateRootModulus)
+}
+
+// StateRoot returns a base64 hash of the data for every account, like Hash,
+// but without going through all of them.
+func (m *AccountMap) StateRoot() string {
+	b := make([]byte, 64)
+	m.root.FillBytes(b)
+	return base64.RawStdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,132 @@
+package currency
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+
+	"coinkit/util"
+)
+
+// A StatementLine is one transaction on an account statement.
+type StatementLine struct {
+	// The slot the transaction was finalized in
+	Slot int
+
+	// The other side of the transaction
+	Counterparty util.PublicKey
+
+	// Positive when the account received money, negative when it sent money
+	Amount int64
+
+	// The fee the account paid. Zero for money received
+	Fee uint64
+
+	// The memo ID on the transaction, or zero
+	Memo uint64
+
+	// The balance of the account right after this transaction
+	Balance uint64
+}
+
+// A Statement lists the activity of one account over a range of slots, for
+// bookkeeping. Slots are added in order with Add.
+type Statement struct {
+	Owner util.PublicKey
+	Lines []*StatementLine
+
+	// The balance before the first transaction on the statement.
+	// Only valid once Known is set
+	Opening uint64
+	Known   bool
+}
+
+func NewStatement(owner util.PublicKey) *Statement {
+	return &Statement{
+		Owner: owner,
+		Lines: []*StatementLine{},
+	}
+}
+
+// Add adds the transactions in the chunk finalized for a slot to the
+// statement. The chunk may be nil, for a slot with no currency data.
+// Chunks only carry the state of the accounts after all their transactions,
+// so balances are worked out backwards from there.
+func (s *Statement) Add(slot int, chunk *LedgerChunk) {
+	if chunk == nil {
+		return
+	}
+	after, ok := chunk.State[s.Owner]
+	if !ok {
+		return
+	}
+
+	lines := []*StatementLine{}
+	var net int64
+	for _, st := range chunk.Transactions {
+		t := st.Transaction
+		if t.From != s.Owner && t.To != s.Owner {
+			continue
+		}
+		line := &StatementLine{
+			Slot: slot,
+			Memo: t.Memo,
+		}
+		if t.From == s.Owner {
+			line.Counterparty = t.To
+			line.Fee = t.Fee
+			if t.To != s.Owner {
+				line.Amount = -int64(t.Amount)
+			}
+		} else {
+			line.Counterparty = t.From
+			line.Amount = int64(t.Amount)
+		}
+		net += line.Amount - int64(line.Fee)
+		lines = append(lines, line)
+	}
+
+	// Work backwards from the final state, rather than forwards from the
+	// last chunk, in case a migration changed the balance in between
+	balance := uint64(int64(after.Balance) - net)
+	if !s.Known {
+		s.Opening = balance
+		s.Known = true
+	}
+	for _, line := range lines {
+		balance = uint64(int64(balance) + line.Amount - int64(line.Fee))
+		line.Balance = balance
+	}
+	s.Lines = append(s.Lines, lines...)
+}
+
+// WriteCSV writes the statement as CSV, with a header row.
+func (s *Statement) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"slot", "counterparty", "amount", "fee", "memo", "balance"})
+	for _, line := range s.Lines {
+		writer.Write([]string{
+			strconv.Itoa(line.Slot),
+			string(line.Counterparty),
+			strconv.FormatInt(line.Amount, 10),
+			strconv.FormatUint(line.Fee, 10),
+			strconv.FormatUint(line.Memo, 10),
+			strconv.FormatUint(line.Balance, 10),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Deposits returns the total amount received for each memo ID, for crediting
+// deposits that many users make into one shared account. Money received
+// without a memo is totaled under zero.
+func (s *Statement) Deposits() map[uint64]uint64 {
+	answer := make(map[uint64]uint64)
+	for _, line := range s.Lines {
+		if line.Amount > 0 {
+			answer[line.Memo] += uint64(line.Amount)
+		}
+	}
+	return answer
+}
@@ -0,0 +1,80 @@
+package currency
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"coinkit/util"
+)
+
+func TestStatement(t *testing.T) {
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+	carol := util.NewKeyPairFromSecretPhrase("carol")
+	m := NewAccountMap()
+	m.SetBalance(bob.PublicKey(), 100)
+	s := NewStatement(bob.PublicKey())
+
+	transfers := []*Transaction{
+		&Transaction{
+			From:     bob.PublicKey(),
+			Sequence: 1,
+			To:       carol.PublicKey(),
+			Amount:   30,
+			Fee:      2,
+		},
+		&Transaction{
+			From:     carol.PublicKey(),
+			Sequence: 1,
+			To:       bob.PublicKey(),
+			Amount:   10,
+			Fee:      1,
+			Memo:     42,
+		},
+	}
+	keys := []*util.KeyPair{bob, carol}
+	for i, tr := range transfers {
+		st := tr.SignWith(keys[i])
+		if err := m.Process(tr); err != nil {
+			t.Fatal(err)
+		}
+		s.Add(i+1, &LedgerChunk{
+			Transactions: []*SignedTransaction{st},
+			State: map[util.PublicKey]*Account{
+				bob.PublicKey():   m.Get(bob.PublicKey()),
+				carol.PublicKey(): m.Get(carol.PublicKey()),
+			},
+		})
+	}
+
+	// A slot without currency data
+	s.Add(3, nil)
+
+	if !s.Known || s.Opening != 100 {
+		t.Fatalf("bad opening balance: %d", s.Opening)
+	}
+	if len(s.Lines) != 2 {
+		t.Fatalf("expected 2 lines but got %d", len(s.Lines))
+	}
+	if s.Lines[0].Amount != -30 || s.Lines[0].Fee != 2 || s.Lines[0].Balance != 68 {
+		t.Fatalf("bad first line: %+v", s.Lines[0])
+	}
+	if s.Lines[1].Amount != 10 || s.Lines[1].Fee != 0 || s.Lines[1].Memo != 42 ||
+		s.Lines[1].Balance != 78 {
+		t.Fatalf("bad second line: %+v", s.Lines[1])
+	}
+
+	deposits := s.Deposits()
+	if len(deposits) != 1 || deposits[42] != 10 {
+		t.Fatalf("bad deposits: %+v", deposits)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(rows) != 3 || rows[0] != "slot,counterparty,amount,fee,memo,balance" {
+		t.Fatalf("bad csv: %s", buf.String())
+	}
+}
@@ -0,0 +1,48 @@
+package currency
+
+import (
+	"sort"
+
+	"coinkit/util"
+)
+
+// PlanSweep builds the transactions that move the money in many accounts,
+// like deposit accounts, to one address, like a cold wallet.
+// Each transaction pays the given fee, and the fees add up to at most budget.
+// When the budget doesn't cover every account, the largest balances are swept
+// first. Accounts that don't have more than the fee are skipped.
+// The transactions are unsigned, so that they can be signed offline.
+func PlanSweep(
+	accounts map[util.PublicKey]*Account, to util.PublicKey, fee uint64, budget uint64) []*Transaction {
+	owners := []util.PublicKey{}
+	for owner, account := range accounts {
+		if owner != to && account != nil && account.Balance > fee {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		a, b := accounts[owners[i]], accounts[owners[j]]
+		if a.Balance != b.Balance {
+			return a.Balance > b.Balance
+		}
+		return owners[i] < owners[j]
+	})
+
+	answer := []*Transaction{}
+	spent := uint64(0)
+	for _, owner := range owners {
+		if spent+fee > budget {
+			break
+		}
+		spent += fee
+		account := accounts[owner]
+		answer = append(answer, &Transaction{
+			From:     owner,
+			Sequence: account.Sequence + 1,
+			To:       to,
+			Amount:   account.Balance - fee,
+			Fee:      fee,
+		})
+	}
+	return answer
+}
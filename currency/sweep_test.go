@@ -0,0 +1,45 @@
+package currency
+
+import (
+	"testing"
+
+	"coinkit/util"
+)
+
+func TestPlanSweep(t *testing.T) {
+	a, b, c, dust, cold := testKey("a"), testKey("b"), testKey("c"), testKey("dust"), testKey("cold")
+	accounts := map[util.PublicKey]*Account{
+		a:    &Account{Sequence: 3, Balance: 100},
+		b:    &Account{Sequence: 0, Balance: 50},
+		c:    &Account{Sequence: 1, Balance: 200},
+		dust: &Account{Sequence: 0, Balance: 2},
+		cold: &Account{Sequence: 0, Balance: 1000},
+	}
+	plan := PlanSweep(accounts, cold, 2, 4)
+	if len(plan) != 2 {
+		t.Fatalf("the budget should cover two transactions: %+v", plan)
+	}
+	if plan[0].From != c || plan[0].Amount != 198 || plan[0].Sequence != 2 {
+		t.Fatalf("bad first transaction: %s", plan[0])
+	}
+	if plan[1].From != a || plan[1].Amount != 98 || plan[1].Sequence != 4 {
+		t.Fatalf("bad second transaction: %s", plan[1])
+	}
+
+	plan = PlanSweep(accounts, cold, 2, 100)
+	if len(plan) != 3 {
+		t.Fatalf("dust and the cold wallet should be skipped: %+v", plan)
+	}
+	m := NewAccountMap()
+	for owner, account := range accounts {
+		m.Set(owner, account)
+	}
+	for _, tr := range plan {
+		if err := m.Process(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.Get(cold).Balance != 1000+198+98+48 {
+		t.Fatalf("bad cold balance: %d", m.Get(cold).Balance)
+	}
+}
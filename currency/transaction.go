@@ -1,22 +1,26 @@
 package currency
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
-	
+
+	"golang.org/x/crypto/sha3"
+
 	"coinkit/util"
 )
 
 type Transaction struct {
 	// Who is sending this money
-	From string
+	From util.PublicKey
 	
 	// The sequence number for this transaction
 	Sequence uint32
 
 	// Who is receiving this money
-	To string
+	To util.PublicKey
 	
 	// The amount of currency to transfer
 	Amount uint64
@@ -24,11 +28,52 @@ type Transaction struct {
 	// How much the sender is willing to pay to get this transfer registered
 	// This is on top of the amount
 	Fee uint64
+
+	// When Delegate is set, this transaction is signed by that key on behalf
+	// of the sender, rather than by the sender itself
+	Delegate util.PublicKey `json:",omitempty"`
+
+	// When Grant is set, this transaction also gives a capability to a
+	// delegate key, replacing any capability it had before.
+	// Only the sender itself can grant capabilities.
+	Grant *Capability `json:",omitempty"`
+
+	// When Limit is set, this transaction also changes the sender's spending
+	// limit. Stricter limits take effect right away. Looser ones only take
+	// effect after a full window of the old limit.
+	// Only the sender itself can change its limit.
+	Limit *SpendingLimit `json:",omitempty"`
+
+	// Memo is an ID the sender attaches for the recipient. Exchanges that
+	// take deposits for many users into one account use it to tell which
+	// user each deposit is for. Zero means no memo.
+	Memo uint64 `json:",omitempty"`
 }
 
 func (t *Transaction) String() string {
-	return fmt.Sprintf("send %d from %s -> %s, seq %d fee %d",
-		t.Amount, util.Shorten(t.From), util.Shorten(t.To), t.Sequence, t.Fee)
+	s := fmt.Sprintf("send %d from %s -> %s, seq %d fee %d",
+		t.Amount, util.Shorten(string(t.From)), util.Shorten(string(t.To)), t.Sequence, t.Fee)
+	if t.Delegate != "" {
+		s += fmt.Sprintf(", via %s", util.Shorten(string(t.Delegate)))
+	}
+	if t.Grant != nil {
+		s += fmt.Sprintf(", grant %s", t.Grant)
+	}
+	if t.Limit != nil {
+		s += fmt.Sprintf(", %s", t.Limit)
+	}
+	if t.Memo != 0 {
+		s += fmt.Sprintf(", memo %d", t.Memo)
+	}
+	return s
+}
+
+// Signer returns the public key that should sign this transaction.
+func (t *Transaction) Signer() util.PublicKey {
+	if t.Delegate != "" {
+		return t.Delegate
+	}
+	return t.From
 }
 
 type SignedTransaction struct {
@@ -37,12 +82,15 @@ type SignedTransaction struct {
 	// The signature to prove that the sender has signed this
 	// Nil if the transaction has not been signed
 	Signature string	
+
+	// A cache of Hash()
+	hash string
 }
 
 // Signs the transaction with the provided keypair.
-// The caller must check the keypair is the actual sender.
+// The caller must check the keypair is the actual sender, or its delegate.
 func (t *Transaction) SignWith(keyPair *util.KeyPair) *SignedTransaction {
-	if keyPair.PublicKey() != t.From {
+	if keyPair.PublicKey() != t.Signer() {
 		panic("you can only sign your own transactions")
 	}
 	bytes, err := json.Marshal(t)
@@ -63,40 +111,84 @@ func (s *SignedTransaction) Verify() bool {
 	if err != nil {
 		return false
 	}
-	return util.Verify(s.Transaction.From, string(bytes), s.Signature)
+	return util.Verify(s.Transaction.Signer(), string(bytes), s.Signature)
 }
 
-// HighestPriorityFirst is a comparator in the emirpasic/gods comparator style.
+// Hash returns a base64 hash of the transaction along with its signature.
+// Two signed transactions have the same hash iff they are the same.
+func (s *SignedTransaction) Hash() string {
+	if s.hash == "" {
+		bytes, err := json.Marshal(s.Transaction)
+		if err != nil {
+			panic("failed to hash transaction because json encoding failed")
+		}
+		h := sha3.New512()
+		h.Write(bytes)
+		h.Write([]byte(s.Signature))
+		s.hash = base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+	}
+	return s.hash
+}
+
+// HighestPriorityFirst is a comparator in the style of sort and container
+// libraries that work with interface{} values.
 // Negative return indicates a < b
 // Positive return indicates a > b
 // Comparison indicates overall "priority" putting the highest priority first.
 // This means that when a has a higher fee than b, a < b.
+//
+// This is the canonical transaction ordering. Every node must build chunks
+// from transactions in exactly this order, or nodes with the same set of
+// transactions will end up with chunks that hash differently. The rules are:
+// 1. Higher fees come first.
+// 2. Ties are broken by Hash(), lowest first.
+// Hash() is unique per transaction, so this is a total order.
 func HighestPriorityFirst(a, b interface{}) int {
-	s1 := a.(*SignedTransaction)
-	s2 := b.(*SignedTransaction)
+	return comparePriority(a.(*SignedTransaction), b.(*SignedTransaction))
+}
 
+// comparePriority is HighestPriorityFirst without the type assertions.
+func comparePriority(s1, s2 *SignedTransaction) int {
 	switch {
 	case s1.Transaction.Fee > s2.Transaction.Fee:
 		// s1 is higher priority. so a < b
 		return -1
 	case s1.Transaction.Fee < s2.Transaction.Fee:
 		return 1
-	case s1.Signature < s2.Signature:
+	}
+
+	h1 := s1.Hash()
+	h2 := s2.Hash()
+	switch {
+	case h1 < h2:
 		// s1 is higher priority
 		return -1
-	case s1.Signature > s2.Signature:
+	case h1 > h2:
 		return 1
 	default:
 		return 0
 	}
 }
 
+// SortTransactions sorts a list of transactions into the canonical order,
+// in place.
+func SortTransactions(ts []*SignedTransaction) {
+	sort.Slice(ts, func(i, j int) bool {
+		return comparePriority(ts[i], ts[j]) < 0
+	})
+}
+
+// testKey returns the public key for the test account with this name.
+func testKey(name string) util.PublicKey {
+	return util.NewKeyPairFromSecretPhrase(name).PublicKey()
+}
+
 func makeTestTransaction(n int) *SignedTransaction {
 	kp := util.NewKeyPairFromSecretPhrase(fmt.Sprintf("blorp %d", n))
 	t := &Transaction{
 		From: kp.PublicKey(),
 		Sequence: 1,
-		To: "nobody",
+		To: testKey("nobody"),
 		Amount: uint64(n),
 		Fee: uint64(n),
 	}
@@ -2,7 +2,6 @@ package currency
 
 import (
 	"fmt"
-	"sort"
 	"strings"
 
 	"coinkit/consensus"
@@ -21,6 +20,10 @@ type TransactionMessage struct {
 
 	// Contains any chunks that might be in the immediately following messages
 	Chunks map[consensus.SlotValue]*LedgerChunk
+
+	// Clients can set this so that if they retry the same message, they get
+	// the original response instead of the transactions being handled again
+	IdempotencyKey string `json:",omitempty"`
 }
 
 func (m *TransactionMessage) Slot() int {
@@ -42,9 +45,7 @@ func (m *TransactionMessage) String() string {
 
 // Orders the transactions
 func NewTransactionMessage(ts ...*SignedTransaction) *TransactionMessage {
-	sort.Slice(ts, func(i, j int) bool {
-		return HighestPriorityFirst(ts[i], ts[j]) < 0
-	})
+	SortTransactions(ts)
 
 	return &TransactionMessage{
 		Transactions: ts,
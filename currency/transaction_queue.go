@@ -1,9 +1,9 @@
 package currency
 
 import (
+	"fmt"
 	"log"
-
-	"github.com/emirpasic/gods/sets/treeset"
+	"sort"
 
 	"coinkit/consensus"
 	"coinkit/util"
@@ -17,10 +17,10 @@ const QueueLimit = 1000
 // TransactionQueue is not threadsafe.
 type TransactionQueue struct {
 	// Just for logging
-	publicKey string
+	publicKey util.PublicKey
 
 	// The pool of pending transactions.
-	set *treeset.Set
+	pending *priorityIndex
 
 	// The ledger chunks that are being considered
 	// They are indexed by their hash
@@ -30,9 +30,34 @@ type TransactionQueue struct {
 	// They are indexed by slot
 	oldChunks map[int]*LedgerChunk
 
+	// The slot for each chunk that already got finalized
+	// They are indexed by hash
+	oldSlots map[consensus.SlotValue]int
+
+	// How the state changed in each finalized slot
+	// They are indexed by slot
+	diffs map[int]*StateDiffMessage
+
+	// State diffs we got for chunks we might finalize in this slot, so that
+	// we can finalize them without knowing their transactions
+	// They are indexed by chunk hash
+	pendingDiffs map[consensus.SlotValue]*StateDiffMessage
+
+	// The account version that each chunk was last validated against
+	// They are indexed by hash
+	validated map[consensus.SlotValue]uint64
+
+	// Chunks we have logged as no longer valid, so that revalidating them
+	// doesn't log it again
+	invalid map[consensus.SlotValue]bool
+
+	// Chunks that we have been asked to validate but do not know yet.
+	// We ask our peers for these.
+	missing map[consensus.SlotValue]bool
+
 	// accounts is used to validate transactions
-	// For now this is the actual authentic store of account data
-	// TODO: get this into a real database
+	// This is the actual authentic store of account data. It is not saved
+	// directly; servers rebuild it from their saved history at startup.
 	accounts *AccountMap
 
 	// The key of the last chunk to get finalized
@@ -43,32 +68,53 @@ type TransactionQueue struct {
 
 	// A count of the number of transactions this queue has finalized
 	finalized int
+
+	// Migrations that have not run yet
+	migrations []*Migration
+
+	// Set when a migration finds that we have diverged from the network
+	diverged error
+
+	// Snapshots of the accounts, in order of slot, for historical queries
+	snapshots []*accountSnapshot
+
+	// The hashes of recently finalized transactions, so that resubmitted
+	// ones can be rejected before checking their signatures
+	recent *recentFilter
+
+	// Imported transactions that are not in the queue yet, by sender, in
+	// order of sequence number, and how many there are in all
+	imports     map[util.PublicKey][]*SignedTransaction
+	importCount int
 }
 
-func NewTransactionQueue(publicKey string) *TransactionQueue {
-	return &TransactionQueue{
-		publicKey: publicKey,
-		set:       treeset.NewWith(HighestPriorityFirst),
-		chunks:    make(map[consensus.SlotValue]*LedgerChunk),
-		oldChunks: make(map[int]*LedgerChunk),
-		accounts:  NewAccountMap(),
-		last:      consensus.SlotValue(""),
-		slot:      1,
-		finalized: 0,
+func NewTransactionQueue(publicKey util.PublicKey) *TransactionQueue {
+	q := &TransactionQueue{
+		publicKey:    publicKey,
+		pending:      newPriorityIndex(),
+		chunks:       make(map[consensus.SlotValue]*LedgerChunk),
+		oldChunks:    make(map[int]*LedgerChunk),
+		oldSlots:     make(map[consensus.SlotValue]int),
+		diffs:        make(map[int]*StateDiffMessage),
+		pendingDiffs: make(map[consensus.SlotValue]*StateDiffMessage),
+		validated:    make(map[consensus.SlotValue]uint64),
+		invalid:      make(map[consensus.SlotValue]bool),
+		missing:      make(map[consensus.SlotValue]bool),
+		accounts:     NewAccountMap(),
+		last:         consensus.SlotValue(""),
+		slot:         1,
+		finalized:    0,
+		recent:       newRecentFilter(),
+		imports:      make(map[util.PublicKey][]*SignedTransaction),
 	}
+	q.snapshot()
+	return q
 }
 
 // Returns the top n items in the queue
 // If the queue does not have enough, return as many as we can
 func (q *TransactionQueue) Top(n int) []*SignedTransaction {
-	answer := []*SignedTransaction{}
-	for _, item := range q.set.Values() {
-		answer = append(answer, item.(*SignedTransaction))
-		if len(answer) == n {
-			break
-		}
-	}
-	return answer
+	return q.pending.top(n)
 }
 
 // Remove removes a transaction from the queue
@@ -76,7 +122,7 @@ func (q *TransactionQueue) Remove(t *SignedTransaction) {
 	if t == nil {
 		return
 	}
-	q.set.Remove(t)
+	q.pending.remove(t)
 }
 
 func (q *TransactionQueue) Logf(format string, a ...interface{}) {
@@ -87,37 +133,63 @@ func (q *TransactionQueue) Logf(format string, a ...interface{}) {
 // If it isn't valid, we just discard it.
 // We don't constantly revalidate so it's possible we have invalid
 // transactions in the queue.
-// Returns whether any changes were made.
-func (q *TransactionQueue) Add(t *SignedTransaction) bool {
-	if !q.Validate(t) || q.Contains(t) {
-		return false
+// Returns whether any changes were made, and an error explaining why the
+// transaction was rejected if it was.
+func (q *TransactionQueue) Add(t *SignedTransaction) (bool, error) {
+	if q.finalizedRecently(t) {
+		return false, ErrAlreadyFinalized
+	}
+	return q.add(t, t != nil && t.Verify())
+}
+
+// add is Add for a transaction whose signature has already been checked.
+func (q *TransactionQueue) add(t *SignedTransaction, verified bool) (bool, error) {
+	if err := q.validate(t, verified); err != nil {
+		return false, err
+	}
+	if q.Contains(t) {
+		return false, nil
 	}
 
 	q.Logf("saw a new transaction: %s", t.Transaction)
-	q.set.Add(t)
+	q.pending.add(t)
 
-	if q.set.Size() > QueueLimit {
-		it := q.set.Iterator()
-		if !it.Last() {
-			log.Fatal("logical failure with treeset")
-		}
-		worst := it.Value()
-		q.set.Remove(worst)
+	if q.pending.size() > QueueLimit {
+		q.pending.remove(q.pending.last())
 	}
 
-	return q.Contains(t)
+	if !q.Contains(t) {
+		return false, ErrQueueFull
+	}
+	return true, nil
+}
+
+// finalizedRecently returns whether this transaction is one we finalized
+// recently. The filter can have false positives, so a hit is confirmed by
+// checking that the sequence number was used.
+func (q *TransactionQueue) finalizedRecently(t *SignedTransaction) bool {
+	if t == nil || t.Transaction == nil || !q.recent.mayContain(t.Hash()) {
+		return false
+	}
+	account := q.accounts.Get(t.From)
+	return account != nil && t.Sequence <= account.Sequence
 }
 
 func (q *TransactionQueue) Contains(t *SignedTransaction) bool {
-	return q.set.Contains(t)
+	return q.pending.contains(t)
 }
 
+// Transactions returns a copy of the pending transactions, highest priority
+// first. ForEach is cheaper when a copy isn't needed.
 func (q *TransactionQueue) Transactions() []*SignedTransaction {
-	answer := []*SignedTransaction{}
-	for _, t := range q.set.Values() {
-		answer = append(answer, t.(*SignedTransaction))
-	}
-	return answer
+	return q.pending.values()
+}
+
+// ForEach calls f on each pending transaction, highest priority first, until
+// f returns false. f may remove the transaction it is called on from the
+// queue, but it should not change the queue otherwise.
+func (q *TransactionQueue) ForEach(f func(*SignedTransaction) bool) {
+	q.pending.each(f)
 }
 
 // SharingMessage returns the pending transactions we want to share with other nodes.
@@ -138,8 +210,9 @@ func (q *TransactionQueue) MaxBalance() uint64 {
 }
 
 // SetBalance is used for testing
-func (q *TransactionQueue) SetBalance(owner string, balance uint64) {
+func (q *TransactionQueue) SetBalance(owner util.PublicKey, balance uint64) {
 	q.accounts.SetBalance(owner, balance)
+	q.snapshot()
 }
 
 func (q *TransactionQueue) OldChunkMessage(slot int) *TransactionMessage {
@@ -155,29 +228,135 @@ func (q *TransactionQueue) OldChunkMessage(slot int) *TransactionMessage {
 	}
 }
 
-func (q *TransactionQueue) HandleInfoMessage(m *util.InfoMessage) *AccountMessage {
+// HandleInfoMessage answers a query about an account. It returns an
+// ErrorMessage for a malformed account, or for a historical query we don't
+// have the history for.
+func (q *TransactionQueue) HandleInfoMessage(m *util.InfoMessage) util.Message {
 	if m == nil || m.Account == "" {
 		return nil
 	}
+	if err := m.Account.Validate(); err != nil {
+		return &util.ErrorMessage{Error: err.Error()}
+	}
+	if m.At != 0 {
+		// This is a historical query
+		account, ok := q.AccountAt(m.Account, m.At)
+		if !ok {
+			return &util.ErrorMessage{
+				Error: fmt.Sprintf("no history for slot %d", m.At),
+			}
+		}
+		return &AccountMessage{
+			I:     m.At,
+			State: map[util.PublicKey]*Account{m.Account: account},
+		}
+	}
 	output := &AccountMessage{
 		I:     q.slot,
-		State: make(map[string]*Account),
+		State: make(map[util.PublicKey]*Account),
 	}
 	output.State[m.Account] = q.accounts.Get(m.Account)
+	if m.Sequence != 0 {
+		output.Included = q.IncludedSlot(m.Account, m.Sequence)
+	}
 	return output
 }
 
+// SnapshotMessage returns an AccountMessage with the state of every account.
+func (q *TransactionQueue) SnapshotMessage() *AccountMessage {
+	return &AccountMessage{
+		I:     q.slot,
+		State: q.accounts.Snapshot(),
+	}
+}
+
+// Prune forgets the finalized chunks for all slots before the provided one.
+func (q *TransactionQueue) Prune(before int) {
+	for slot, chunk := range q.oldChunks {
+		if slot < before {
+			delete(q.oldSlots, chunk.Hash())
+			delete(q.oldChunks, slot)
+		}
+	}
+	for slot := range q.diffs {
+		if slot < before {
+			delete(q.diffs, slot)
+		}
+	}
+	q.pruneSnapshots(before)
+}
+
+// FetchMessage returns a message asking our peers for the chunks we are
+// missing, or nil if we are not missing anything.
+func (q *TransactionQueue) FetchMessage() *FetchMessage {
+	if len(q.missing) == 0 {
+		return nil
+	}
+	m := &FetchMessage{}
+	for key, _ := range q.missing {
+		m.Chunks = append(m.Chunks, key)
+	}
+	sort.Slice(m.Chunks, func(i, j int) bool {
+		return m.Chunks[i] < m.Chunks[j]
+	})
+	return m
+}
+
+// HandleFetchMessage returns a message with whichever of the requested
+// chunks we know about, or nil if we don't know any of them.
+func (q *TransactionQueue) HandleFetchMessage(m *FetchMessage) *TransactionMessage {
+	if m == nil {
+		return nil
+	}
+	chunks := make(map[consensus.SlotValue]*LedgerChunk)
+	for _, key := range m.Chunks {
+		if chunk, ok := q.chunks[key]; ok {
+			chunks[key] = chunk
+		} else if slot, ok := q.oldSlots[key]; ok {
+			chunks[key] = q.oldChunks[slot]
+		}
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	return &TransactionMessage{
+		Transactions: []*SignedTransaction{},
+		Chunks:       chunks,
+	}
+}
+
 // Handles a transaction message from another node.
-// Returns whether it made any internal updates.
-func (q *TransactionQueue) HandleTransactionMessage(m *TransactionMessage) bool {
+// Returns whether it made any internal updates, and the error for the first
+// transaction that got rejected, if any did.
+// Invalid chunks are skipped without an error, because peers share every
+// chunk they know about, even ones from the past.
+func (q *TransactionQueue) HandleTransactionMessage(m *TransactionMessage) (bool, error) {
 	if m == nil {
-		return false
+		return false, nil
 	}
 
 	updated := false
+	var rejected error
 	if m.Transactions != nil {
-		for _, t := range m.Transactions {
-			updated = updated || q.Add(t)
+		// Recently finalized transactions are rejected without checking
+		// their signatures, and the rest are checked all at once
+		recent := make([]bool, len(m.Transactions))
+		for i, t := range m.Transactions {
+			recent[i] = q.finalizedRecently(t)
+		}
+		verified := verifyAll(m.Transactions, recent)
+		for i, t := range m.Transactions {
+			var added bool
+			var err error
+			if recent[i] {
+				err = ErrAlreadyFinalized
+			} else {
+				added, err = q.add(t, verified[i])
+			}
+			if err != nil && rejected == nil {
+				rejected = err
+			}
+			updated = updated || added
 		}
 	}
 	if m.Chunks != nil {
@@ -185,68 +364,136 @@ func (q *TransactionQueue) HandleTransactionMessage(m *TransactionMessage) bool
 			if _, ok := q.chunks[key]; ok {
 				continue
 			}
-			if !q.accounts.ValidateChunk(chunk) {
+			if chunk.Hash() != key {
 				continue
 			}
-			if chunk.Hash() != key {
+			if err := q.validateChunk(key, chunk); err != nil {
+				q.Logf("rejected chunk %s: %s", util.Shorten(string(key)), err)
 				continue
 			}
 			q.Logf("learned that %s = %s", util.Shorten(string(key)), chunk)
 			q.chunks[key] = chunk
+			delete(q.missing, key)
 			updated = true
 		}
 	}
-	return updated
+	return updated, rejected
 }
 
 func (q *TransactionQueue) Size() int {
-	return q.set.Size()
+	return q.pending.size()
+}
+
+// Validate returns an error if the transaction is not valid
+func (q *TransactionQueue) Validate(t *SignedTransaction) error {
+	return q.validate(t, t != nil && t.Verify())
+}
+
+// validate is Validate for a transaction whose signature has already been
+// checked.
+func (q *TransactionQueue) validate(t *SignedTransaction, verified bool) error {
+	if t == nil {
+		return ErrNilTransaction
+	}
+	if !verified {
+		return ErrBadSignature
+	}
+	return q.accounts.Validate(t.Transaction)
 }
 
-func (q *TransactionQueue) Validate(t *SignedTransaction) bool {
-	return t != nil && t.Verify() && q.accounts.Validate(t.Transaction)
+// validateChunk is like AccountMap.ValidateChunk but it skips the work when
+// this chunk has already been validated against the current account data.
+// The caller is responsible for checking that key is the hash of chunk.
+func (q *TransactionQueue) validateChunk(
+	key consensus.SlotValue, chunk *LedgerChunk) error {
+	version := q.accounts.Version()
+	if v, ok := q.validated[key]; ok && v == version {
+		return nil
+	}
+	if err := q.accounts.ValidateChunk(chunk); err != nil {
+		return err
+	}
+	q.validated[key] = version
+	return nil
 }
 
 // Revalidate checks all pending transactions to see if they are still valid
+// Their signatures were checked when they were added, so they aren't
+// checked again.
 func (q *TransactionQueue) Revalidate() {
-	for _, t := range q.Transactions() {
-		if !q.Validate(t) {
+	q.ForEach(func(t *SignedTransaction) bool {
+		if q.validate(t, true) != nil {
 			q.Remove(t)
 		}
+		return true
+	})
+}
+
+// revalidateSenders checks the pending transactions from these senders to
+// see if they are still valid. Whether a transaction is valid only depends
+// on its sender's account, spending limit, and delegations, and moving on to
+// a new slot never makes those stricter, so after a slot is finalized, only
+// the transactions from the accounts it changed need to be checked.
+func (q *TransactionQueue) revalidateSenders(senders map[util.PublicKey]bool) {
+	for sender := range senders {
+		for _, t := range q.pending.sentBy(sender) {
+			if q.validate(t, true) != nil {
+				q.Remove(t)
+			}
+		}
 	}
 }
 
 // NewLedgerChunk creates a ledger chunk from a list of signed transactions.
-// The list should already be sorted and deduped and the signed transactions
-// should be verified.
+// The list should already be sorted in the canonical order defined by
+// HighestPriorityFirst, and deduped, and the signed transactions should be
+// verified.
 // Returns "", nil if there were no valid transactions.
 // This adds a cache entry to q.chunks
 func (q *TransactionQueue) NewChunk(
 	ts []*SignedTransaction) (consensus.SlotValue, *LedgerChunk) {
+	return q.newChunk(func(f func(*SignedTransaction) bool) {
+		for _, t := range ts {
+			if !f(t) {
+				return
+			}
+		}
+	})
+}
+
+// newChunk is NewChunk for transactions that come from an iterator like
+// ForEach, so that building a chunk from the queue doesn't copy the queue.
+// It stops iterating once the chunk is full.
+func (q *TransactionQueue) newChunk(
+	each func(func(*SignedTransaction) bool)) (consensus.SlotValue, *LedgerChunk) {
 	var last *SignedTransaction
 	transactions := []*SignedTransaction{}
 	validator := q.accounts.CowCopy()
-	state := make(map[string]*Account)
-	for _, t := range ts {
-		if last != nil && HighestPriorityFirst(last, t) >= 0 {
+	state := make(map[util.PublicKey]*Account)
+	each(func(t *SignedTransaction) bool {
+		if last != nil && comparePriority(last, t) >= 0 {
 			panic("NewLedgerChunk called on non-sorted list")
 		}
 		last = t
-		if validator.Process(t.Transaction) {
-			transactions = append(transactions, t)
+		if validator.Process(t.Transaction) != nil {
+			// This transaction conflicts with an earlier one, or it was
+			// never valid. Either way it gets dropped.
+			return true
 		}
+		transactions = append(transactions, t)
 		state[t.From] = validator.Get(t.From)
 		state[t.To] = validator.Get(t.To)
-		if len(transactions) == MaxChunkSize {
-			break
-		}
-	}
+		return len(transactions) < MaxChunkSize
+	})
 	if len(transactions) == 0 {
 		return consensus.SlotValue(""), nil
 	}
+	delegations, spending := validator.limitStates()
 	chunk := &LedgerChunk{
 		Transactions: transactions,
 		State:        state,
+		Delegations:  delegations,
+		Spending:     spending,
 	}
 	key := chunk.Hash()
 	if _, ok := q.chunks[key]; !ok {
@@ -254,56 +501,215 @@ func (q *TransactionQueue) NewChunk(
 		q.Logf("i=%d, new chunk %s -> %s", q.slot, util.Shorten(string(key)), chunk)
 		q.chunks[key] = chunk
 	}
+
+	// The chunk was built by processing it, so it is valid by construction
+	q.validated[key] = q.accounts.Version()
 	return key, chunk
 }
 
+// Combine merges the transactions from a list of chunks, and builds a new
+// chunk from them in the canonical order.
+// Conflicting transactions are resolved deterministically. Transactions are
+// applied in the canonical order, and any transaction that is no longer valid
+// once the ones before it have been applied is dropped. So when two
+// transactions use the same sequence number, the higher priority one wins.
+// This means that nodes with the same account data always combine a list of
+// chunks into the same chunk, no matter what order the list is in.
+// If none of the transactions are valid any more, it returns EmptyValue.
 func (q *TransactionQueue) Combine(list []consensus.SlotValue) consensus.SlotValue {
-	set := treeset.NewWith(HighestPriorityFirst)
+	index := newPriorityIndex()
 	for _, v := range list {
 		chunk := q.chunks[v]
 		if chunk == nil {
-			log.Fatalf("%s cannot combine unknown chunk %s", q.publicKey, v)
+			// Consensus only combines values that it could validate, so
+			// this should never happen
+			q.Logf("cannot combine unknown chunk %s", util.Shorten(string(v)))
+			continue
 		}
 		for _, t := range chunk.Transactions {
-			set.Add(t)
+			index.add(t)
 		}
 	}
-	transactions := []*SignedTransaction{}
-	for _, t := range set.Values() {
-		transactions = append(transactions, t.(*SignedTransaction))
-	}
-	value, chunk := q.NewChunk(transactions)
+	value, chunk := q.newChunk(index.each)
 	if chunk == nil {
-		panic("combining valid chunks led to nothing")
+		// The chunks have all gone stale. Falling back to one of them would
+		// mean finalizing a chunk we know is invalid, so we combine them into
+		// nothing instead. Every node working on this slot has finalized the
+		// same slots before it, so they all see the same accounts and agree
+		// that nothing is left.
+		q.Logf("combining %d chunks led to nothing", len(list))
+		return consensus.EmptyValue
 	}
 	return value
 }
 
+// CanFinalize returns whether we know about this chunk, or have a state diff
+// for it.
+// If we don't know about the chunk yet, we will ask our peers for it.
 func (q *TransactionQueue) CanFinalize(v consensus.SlotValue) bool {
-	_, ok := q.chunks[v]
-	return ok
+	if v == consensus.EmptyValue {
+		return true
+	}
+	if _, ok := q.pendingDiffs[v]; ok {
+		return true
+	}
+	return q.hasChunk(v)
 }
 
 func (q *TransactionQueue) Finalize(v consensus.SlotValue) {
+	if v == consensus.EmptyValue {
+		q.Skip()
+		return
+	}
 	chunk, ok := q.chunks[v]
 	if !ok {
-		panic("We are finalizing a chunk but we don't know its data.")
+		diff, ok := q.pendingDiffs[v]
+		if !ok {
+			panic("We are finalizing a chunk but we don't know its data.")
+		}
+		q.finalizeDiff(v, diff)
+		return
 	}
 
-	if !q.accounts.ValidateChunk(chunk) {
-		panic("We could not validate a finalized chunk.")
+	if err := q.validateChunk(v, chunk); err != nil {
+		log.Fatalf("We could not validate a finalized chunk: %s", err)
 	}
 
-	if !q.accounts.ProcessChunk(chunk) {
-		panic("We could not process a finalized chunk.")
+	// Process the chunk on a copy first, to see what it changes
+	changes := q.accounts.CowCopy()
+	if err := changes.ProcessChunk(chunk); err != nil {
+		log.Fatalf("We could not process a finalized chunk: %s", err)
 	}
+	q.diffs[q.slot] = q.accounts.newStateDiff(q.slot, v, chunk, changes)
+	q.accounts.merge(changes)
+	touched := changes.owners()
 
+	for _, t := range chunk.Transactions {
+		q.recent.add(t.Hash())
+	}
 	q.oldChunks[q.slot] = chunk
+	q.oldSlots[v] = q.slot
 	q.finalized += len(chunk.Transactions)
 	q.last = v
+	q.advance(touched)
+}
+
+// finalizeDiff finalizes a chunk by applying its state diff, without
+// processing its transactions.
+func (q *TransactionQueue) finalizeDiff(v consensus.SlotValue, diff *StateDiffMessage) {
+	if err := q.accounts.applyStateDiff(diff); err != nil {
+		log.Fatalf("We could not apply a finalized state diff: %s", err)
+	}
+	q.diffs[q.slot] = diff
+	q.finalized += len(diff.Signatures)
+	q.last = v
+	q.advance(diff.owners())
+}
+
+// HandleStateDiffMessage keeps a state diff for the current slot, so that
+// its chunk can be finalized without knowing its transactions.
+// Returns whether the diff was usable.
+func (q *TransactionQueue) HandleStateDiffMessage(m *StateDiffMessage) bool {
+	if m == nil || m.I != q.slot {
+		return false
+	}
+	if !m.Verify() {
+		q.Logf("rejected a state diff that does not match chunk %s",
+			util.Shorten(string(m.Chunk)))
+		return false
+	}
+	if _, err := q.accounts.stateDiffChanges(m); err != nil {
+		q.Logf("rejected a state diff: %s", err)
+		return false
+	}
+	q.pendingDiffs[m.Chunk] = m
+	return true
+}
+
+// StateDiffMessage returns how the state changed in a finalized slot, or nil
+// if we don't know.
+func (q *TransactionQueue) StateDiffMessage(slot int) *StateDiffMessage {
+	return q.diffs[slot]
+}
+
+// AddMigration schedules a migration. Every node must have the same
+// migrations, so this should be done before the queue starts, or right after
+// its ledger state is restored. A restored ledger state already includes the
+// migrations up to and including its slot, so those are left out.
+func (q *TransactionQueue) AddMigration(m *Migration) {
+	if m.Slot < q.slot || (m.Slot == q.slot && q.slot > 1) {
+		q.Logf("migration %s for slot %d already ran", m.Name, m.Slot)
+		return
+	}
+	q.migrations = append(q.migrations, m)
+	sort.SliceStable(q.migrations, func(i, j int) bool {
+		return q.migrations[i].Slot < q.migrations[j].Slot
+	})
+	q.migrate()
+}
+
+// migrate runs the migrations for the current slot, and returns whether
+// there were any.
+func (q *TransactionQueue) migrate() bool {
+	ran := false
+	for len(q.migrations) > 0 && q.migrations[0].Slot == q.slot {
+		m := q.migrations[0]
+		q.migrations = q.migrations[1:]
+		q.Logf("i=%d, running migration %s", q.slot, m.Name)
+		if err := m.Run(q.accounts); err != nil && q.diverged == nil {
+			q.Logf("i=%d, diverged: %s", q.slot, err)
+			q.diverged = err
+		}
+		q.snapshot()
+		ran = true
+	}
+	return ran
+}
+
+// Diverged returns an error if a migration found that our accounts don't
+// match the rest of the network's, or nil if they do as far as we know.
+func (q *TransactionQueue) Diverged() error {
+	return q.diverged
+}
+
+// Skip is called when a slot is finalized without a chunk for this queue,
+// because the chain is shared with other apps.
+func (q *TransactionQueue) Skip() {
+	q.advance(nil)
+}
+
+// advance moves the queue on to the next slot. touched is the accounts that
+// the finalized slot changed.
+func (q *TransactionQueue) advance(touched map[util.PublicKey]bool) {
 	q.chunks = make(map[consensus.SlotValue]*LedgerChunk)
+	q.pendingDiffs = make(map[consensus.SlotValue]*StateDiffMessage)
+	q.validated = make(map[consensus.SlotValue]uint64)
+	q.invalid = make(map[consensus.SlotValue]bool)
+	q.missing = make(map[consensus.SlotValue]bool)
 	q.slot += 1
-	q.Revalidate()
+	q.accounts.SetSlot(q.slot)
+	if q.slot%SnapshotInterval == 0 {
+		q.snapshot()
+	}
+	if q.migrate() {
+		// A migration can change anything
+		q.Revalidate()
+	} else {
+		q.revalidateSenders(touched)
+	}
+	q.feedImports()
+}
+
+// Slot returns the slot that we are working on, which is the one after the
+// last finalized chunk.
+func (q *TransactionQueue) Slot() int {
+	return q.slot
+}
+
+// StateHash returns the state root of every account, as of the start of the
+// slot we are working on.
+func (q *TransactionQueue) StateHash() string {
+	return q.accounts.StateRoot()
 }
 
 func (q *TransactionQueue) Last() consensus.SlotValue {
@@ -312,7 +718,7 @@ func (q *TransactionQueue) Last() consensus.SlotValue {
 
 // SuggestValue returns a chunk that is keyed by its hash
 func (q *TransactionQueue) SuggestValue() (consensus.SlotValue, bool) {
-	key, chunk := q.NewChunk(q.Transactions())
+	key, chunk := q.newChunk(q.ForEach)
 	if chunk == nil {
 		q.Logf("has no suggestion")
 		return consensus.SlotValue(""), false
@@ -321,9 +727,39 @@ func (q *TransactionQueue) SuggestValue() (consensus.SlotValue, bool) {
 	return key, true
 }
 
+// ValidateValue returns whether we know about this chunk, and it is still
+// valid against the current accounts, so that we never vote to nominate a
+// chunk we could not finalize.
+// If we don't know about the chunk yet, we will ask our peers for it.
+// EmptyValue is always valid, since Combine can produce it.
 func (q *TransactionQueue) ValidateValue(v consensus.SlotValue) bool {
-	_, ok := q.chunks[v]
-	return ok
+	if v == consensus.EmptyValue {
+		return true
+	}
+	if !q.hasChunk(v) {
+		return false
+	}
+	if err := q.validateChunk(v, q.chunks[v]); err != nil {
+		if !q.invalid[v] {
+			q.invalid[v] = true
+			q.Logf("i=%d, %s is no longer valid: %s", q.slot, util.Shorten(string(v)), err)
+		}
+		return false
+	}
+	return true
+}
+
+// hasChunk returns whether we know the chunk for this value.
+// If we don't, it gets added to the chunks we ask our peers for.
+func (q *TransactionQueue) hasChunk(v consensus.SlotValue) bool {
+	if _, ok := q.chunks[v]; ok {
+		return true
+	}
+	if !q.missing[v] {
+		q.Logf("i=%d, needs to fetch %s", q.slot, util.Shorten(string(v)))
+		q.missing[v] = true
+	}
+	return false
 }
 
 func (q *TransactionQueue) Stats() {
@@ -331,9 +767,9 @@ func (q *TransactionQueue) Stats() {
 }
 
 func (q *TransactionQueue) Log() {
-	ts := q.Transactions()
-	q.Logf("has %d pending transactions:", q.publicKey, len(ts))
-	for _, t := range ts {
+	q.Logf("has %d pending transactions:", q.Size())
+	q.ForEach(func(t *SignedTransaction) bool {
 		q.Logf("%s", t.Transaction)
-	}
+		return true
+	})
 }
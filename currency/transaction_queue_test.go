@@ -1,7 +1,12 @@
 package currency
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+
+	"coinkit/consensus"
+	"coinkit/util"
 )
 
 func TestFullQueue(t *testing.T) {
@@ -40,3 +45,905 @@ func TestSharingMessage(t *testing.T) {
 		t.Fatal("there should be a sharing message after we add one transaction")
 	}
 }
+
+func TestChunkValidationCache(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	tr := makeTestTransaction(1)
+	q.accounts.SetBalance(tr.Transaction.From, 10*tr.Transaction.Amount)
+	q.Add(tr)
+	key, chunk := q.NewChunk(q.Transactions())
+	if chunk == nil {
+		t.Fatal("expected a chunk")
+	}
+	if q.validated[key] != q.accounts.Version() {
+		t.Fatal("a chunk we built ourselves should already be validated")
+	}
+
+	// Changing the account data should invalidate the cached result
+	q.accounts.SetBalance(tr.Transaction.From, 0)
+	if q.validateChunk(key, chunk) == nil {
+		t.Fatal("the chunk should no longer be valid")
+	}
+	q.accounts.SetBalance(tr.Transaction.From, 10*tr.Transaction.Amount)
+	if q.validateChunk(key, chunk) != nil {
+		t.Fatal("the chunk should be valid again")
+	}
+	q.Finalize(key)
+	if len(q.validated) != 0 {
+		t.Fatal("finalizing should clear the validation cache")
+	}
+}
+
+func TestRestoreClearsValidationCache(t *testing.T) {
+	if NewAccountMap().Version() == NewAccountMap().Version() {
+		t.Fatal("different account maps should have different versions")
+	}
+
+	q := NewTransactionQueue("testqueue")
+	tr := makeTestTransaction(1)
+	q.SetBalance(tr.From, 10)
+	key, chunk := q.NewChunk([]*SignedTransaction{tr})
+	if chunk == nil {
+		t.Fatal("expected a chunk")
+	}
+
+	// The saved state has an account that can't pay for the chunk
+	saved := NewTransactionQueue("saved")
+	saved.SetBalance(tr.From, 0)
+	if err := q.RestoreLedgerState(saved.LedgerState()); err != nil {
+		t.Fatal(err)
+	}
+	if q.ValidateValue(key) {
+		t.Fatal("the chunk should not be valid against the restored state")
+	}
+	if q.validateChunk(key, chunk) == nil {
+		t.Fatal("the cached validation should not survive a restore")
+	}
+}
+
+// Two queues that see the same transactions in a different order should
+// build chunks that hash identically.
+func TestCanonicalChunkOrdering(t *testing.T) {
+	ts := []*SignedTransaction{}
+	for i := 1; i <= 20; i++ {
+		kp := util.NewKeyPairFromSecretPhrase(fmt.Sprintf("blorp %d", i))
+		tr := &Transaction{
+			From:     kp.PublicKey(),
+			Sequence: 1,
+			To:       testKey("nobody"),
+			Amount:   uint64(i),
+			Fee:      uint64(i % 3),
+		}
+		ts = append(ts, tr.SignWith(kp))
+	}
+
+	q1 := NewTransactionQueue("q1")
+	q2 := NewTransactionQueue("q2")
+	for _, q := range []*TransactionQueue{q1, q2} {
+		for _, tr := range ts {
+			q.SetBalance(tr.From, 100)
+		}
+	}
+	for i := 0; i < len(ts); i++ {
+		q1.Add(ts[i])
+		q2.Add(ts[len(ts)-1-i])
+	}
+
+	key1, _ := q1.NewChunk(q1.Transactions())
+	key2, _ := q2.NewChunk(q2.Transactions())
+	if key1 != key2 {
+		t.Fatal("independently built chunks should hash identically")
+	}
+
+	sorted := q1.Transactions()
+	for i := 1; i < len(sorted); i++ {
+		a, b := sorted[i-1], sorted[i]
+		if a.Fee < b.Fee || (a.Fee == b.Fee && a.Hash() >= b.Hash()) {
+			t.Fatalf("transactions %d and %d are out of order", i-1, i)
+		}
+	}
+
+	shuffled := append([]*SignedTransaction{}, ts...)
+	SortTransactions(shuffled)
+	for i := range shuffled {
+		if shuffled[i] != sorted[i] {
+			t.Fatal("SortTransactions should match the queue ordering")
+		}
+	}
+
+	// Combining should not depend on the order of the chunks
+	a, _ := q1.NewChunk(sorted[:10])
+	b, _ := q1.NewChunk(sorted[10:])
+	if q1.Combine([]consensus.SlotValue{a, b}) != q1.Combine([]consensus.SlotValue{b, a}) {
+		t.Fatal("Combine should be order-independent")
+	}
+	if q1.Combine([]consensus.SlotValue{a, b}) != key1 {
+		t.Fatal("Combine should match building the chunk directly")
+	}
+}
+
+func TestCombineConflictingChunks(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("double spender")
+	toBob := &Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       testKey("bob"),
+		Amount:   10,
+		Fee:      1,
+	}
+	toCarol := &Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       testKey("carol"),
+		Amount:   10,
+		Fee:      2,
+	}
+	other := makeTestTransaction(3)
+
+	q1 := NewTransactionQueue("q1")
+	q2 := NewTransactionQueue("q2")
+	for _, q := range []*TransactionQueue{q1, q2} {
+		q.SetBalance(kp.PublicKey(), 100)
+		q.SetBalance(other.From, 100)
+	}
+
+	// Each node builds a chunk with one of the conflicting transactions
+	// and shares it with the other node
+	a, chunkA := q1.NewChunk([]*SignedTransaction{other, toBob.SignWith(kp)})
+	b, chunkB := q2.NewChunk([]*SignedTransaction{toCarol.SignWith(kp)})
+	m1 := NewTransactionMessage()
+	m1.Chunks[a] = chunkA
+	m2 := NewTransactionMessage()
+	m2.Chunks[b] = chunkB
+	q2.HandleTransactionMessage(m1)
+	q1.HandleTransactionMessage(m2)
+
+	c1 := q1.Combine([]consensus.SlotValue{a, b})
+	c2 := q2.Combine([]consensus.SlotValue{b, a})
+	if c1 != c2 {
+		t.Fatal("nodes should combine conflicting chunks the same way")
+	}
+	combined := q1.chunks[c1]
+	if len(combined.Transactions) != 2 {
+		t.Fatalf("expected 2 transactions but got %s", combined)
+	}
+	if combined.Transactions[1].To != testKey("carol") {
+		t.Fatal("the higher priority transaction should win the conflict")
+	}
+	if q1.accounts.ValidateChunk(combined) != nil {
+		t.Fatal("the combined chunk should be valid")
+	}
+
+	// Unknown chunks should not crash, and should fall back deterministically
+	if q1.Combine([]consensus.SlotValue{"zzz", "yyy"}) != consensus.EmptyValue {
+		t.Fatal("combining only unknown chunks should be empty")
+	}
+	if q1.Combine([]consensus.SlotValue{"zzz", a}) != a {
+		t.Fatal("unknown chunks should be skipped when combining")
+	}
+}
+
+func TestCombineStaleChunks(t *testing.T) {
+	t1 := makeTestTransaction(1)
+	t2 := makeTestTransaction(2)
+	q := NewTransactionQueue("q")
+	q.SetBalance(t1.From, 100)
+	q.SetBalance(t2.From, 100)
+	a, _ := q.NewChunk([]*SignedTransaction{t1})
+	b, _ := q.NewChunk([]*SignedTransaction{t2})
+
+	// Both senders run out of money, so neither chunk is valid any more
+	q.SetBalance(t1.From, 0)
+	q.SetBalance(t2.From, 0)
+	v := q.Combine([]consensus.SlotValue{a, b})
+	if v != consensus.EmptyValue {
+		t.Fatalf("combining stale chunks should be empty but got %s", v)
+	}
+	if !q.CanFinalize(v) {
+		t.Fatal("we should be able to finalize an empty combination")
+	}
+	q.Finalize(v)
+	if q.Slot() != 2 {
+		t.Fatalf("finalizing an empty combination should advance the slot")
+	}
+	if q.MaxBalance() != 0 {
+		t.Fatal("finalizing an empty combination should change no accounts")
+	}
+}
+
+func TestFetchingUnknownChunks(t *testing.T) {
+	tr := makeTestTransaction(1)
+	q1 := NewTransactionQueue("q1")
+	q2 := NewTransactionQueue("q2")
+	for _, q := range []*TransactionQueue{q1, q2} {
+		q.SetBalance(tr.From, 100)
+	}
+	key, _ := q2.NewChunk([]*SignedTransaction{tr})
+
+	if q1.FetchMessage() != nil {
+		t.Fatal("there should be nothing to fetch yet")
+	}
+	if q1.ValidateValue(key) {
+		t.Fatal("q1 should not be able to validate an unknown chunk")
+	}
+	fetch := util.EncodeThenDecode(q1.FetchMessage()).(*FetchMessage)
+	if len(fetch.Chunks) != 1 || fetch.Chunks[0] != key {
+		t.Fatalf("unexpected fetch message: %s", fetch)
+	}
+	if NewTransactionQueue("q3").HandleFetchMessage(fetch) != nil {
+		t.Fatal("a queue that doesn't know the chunk should not respond")
+	}
+	response := q2.HandleFetchMessage(fetch)
+	if response == nil {
+		t.Fatal("q2 should respond with the chunk")
+	}
+	updated, _ := q1.HandleTransactionMessage(
+		util.EncodeThenDecode(response).(*TransactionMessage))
+	if !updated {
+		t.Fatal("q1 should learn something from the response")
+	}
+	if !q1.ValidateValue(key) {
+		t.Fatal("q1 should be able to validate the chunk now")
+	}
+	if q1.FetchMessage() != nil {
+		t.Fatal("there should be nothing left to fetch")
+	}
+}
+
+func TestMigration(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	q.SetBalance("bob", 10)
+
+	// Figure out what the hashes should be
+	expected := NewAccountMap()
+	expected.SetBalance("bob", 10)
+	before := expected.Hash()
+	expected.SetBalance("bob", 20)
+	after := expected.Hash()
+
+	ran := 0
+	q.AddMigration(&Migration{
+		Name:   "double",
+		Slot:   2,
+		Before: before,
+		After:  after,
+		Apply: func(accounts *AccountMap) {
+			ran++
+			for owner, account := range accounts.Snapshot() {
+				accounts.SetBalance(owner, 2*account.Balance)
+			}
+		},
+	})
+	if ran != 0 {
+		t.Fatal("the migration should not run before its slot")
+	}
+	q.Skip()
+	if ran != 1 || q.accounts.Get("bob").Balance != 20 {
+		t.Fatal("the migration should run at its slot")
+	}
+	q.Skip()
+	if ran != 1 {
+		t.Fatal("the migration should only run once")
+	}
+
+	// A queue restored past the migration already has it
+	restored := NewTransactionQueue("restored")
+	if err := restored.RestoreLedgerState(q.LedgerState()); err != nil {
+		t.Fatal(err)
+	}
+	restored.AddMigration(&Migration{
+		Name: "double",
+		Slot: 2,
+		Apply: func(accounts *AccountMap) {
+			ran++
+		},
+	})
+	restored.Skip()
+	if ran != 1 || restored.accounts.Get("bob").Balance != 20 {
+		t.Fatal("a restored queue should not run the migration again")
+	}
+}
+
+func TestMigrationDivergence(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	q.SetBalance("bob", 10)
+	q.AddMigration(&Migration{
+		Name:   "double",
+		Slot:   2,
+		Before: "not the hash",
+		Apply: func(accounts *AccountMap) {
+			t.Fatal("a migration should not run on the wrong accounts")
+		},
+	})
+	if q.Diverged() != nil {
+		t.Fatal("the queue should not diverge before the migration's slot")
+	}
+	q.Skip()
+	if q.Diverged() == nil {
+		t.Fatal("a hash mismatch should mean the queue diverged")
+	}
+}
+
+func TestAccountAt(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	tr := makeTestTransaction(1)
+	from := tr.Transaction.From
+	q.SetBalance(from, 10)
+
+	// Slot 1 sends money, slot 2 is skipped
+	q.Add(tr)
+	key, chunk := q.NewChunk(q.Transactions())
+	if chunk == nil {
+		t.Fatal("expected a chunk")
+	}
+	q.Finalize(key)
+	q.Skip()
+
+	if _, ok := q.AccountAt(from, 3); ok {
+		t.Fatal("slot 3 is not finalized yet")
+	}
+	info := &util.InfoMessage{Account: from, At: 3}
+	if _, ok := q.HandleInfoMessage(info).(*util.ErrorMessage); !ok {
+		t.Fatal("expected an error for an unfinalized slot")
+	}
+	for slot := 1; slot <= 2; slot++ {
+		account, ok := q.AccountAt(from, slot)
+		if !ok || account.Balance != 8 || account.Sequence != 1 {
+			t.Fatalf("bad account at slot %d: %+v", slot, account)
+		}
+	}
+	account, ok := q.AccountAt(testKey("nobody"), 1)
+	if !ok || account.Balance != 1 {
+		t.Fatalf("bad recipient at slot 1: %+v", account)
+	}
+
+	// Once slots are pruned, we can no longer answer for them
+	for q.Slot() <= 2*SnapshotInterval {
+		q.Skip()
+	}
+	q.Prune(SnapshotInterval)
+	if _, ok := q.AccountAt(from, 1); ok {
+		t.Fatal("slot 1 should be pruned")
+	}
+	account, ok = q.AccountAt(from, SnapshotInterval+1)
+	if !ok || account.Balance != 8 {
+		t.Fatalf("bad account after pruning: %+v", account)
+	}
+}
+
+func TestRejectFinalizedTransaction(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	tr := makeTestTransaction(1)
+	q.SetBalance(tr.Transaction.From, 10)
+	if ok, err := q.Add(tr); !ok || err != nil {
+		t.Fatalf("could not add transaction: %s", err)
+	}
+	key, chunk := q.NewChunk(q.Transactions())
+	if chunk == nil {
+		t.Fatal("expected a chunk")
+	}
+	q.Finalize(key)
+
+	// Resubmitting it should be caught by the filter
+	if _, err := q.Add(tr); err != ErrAlreadyFinalized {
+		t.Fatalf("expected ErrAlreadyFinalized but got %v", err)
+	}
+
+	// A different transaction is checked normally
+	other := makeTestTransaction(2)
+	q.SetBalance(other.Transaction.From, 10)
+	if ok, err := q.Add(other); !ok || err != nil {
+		t.Fatalf("could not add another transaction: %s", err)
+	}
+}
+
+func TestRejectMalformedKeys(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	kp := util.NewKeyPairFromSecretPhrase("alice")
+	q.SetBalance(kp.PublicKey(), 10)
+	tr := (&Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       "bob",
+		Amount:   1,
+	}).SignWith(kp)
+	if _, err := q.Add(tr); err != ErrBadPublicKey || IsTransient(err) {
+		t.Fatalf("expected ErrBadPublicKey but got %v", err)
+	}
+	m := q.HandleInfoMessage(&util.InfoMessage{Account: "bob"})
+	if _, ok := m.(*util.ErrorMessage); !ok {
+		t.Fatalf("expected an error for a malformed account but got %s", m)
+	}
+
+	// A peer can nominate a chunk with the same transaction in it
+	chunk := &LedgerChunk{
+		Transactions: []*SignedTransaction{tr},
+		State: map[util.PublicKey]*Account{
+			kp.PublicKey(): &Account{Sequence: 1, Balance: 9},
+			"bob":          &Account{Sequence: 0, Balance: 1},
+		},
+	}
+	if err := q.accounts.ValidateChunk(chunk); !errors.Is(err, ErrBadPublicKey) {
+		t.Fatalf("expected ErrBadPublicKey but got %v", err)
+	}
+	message := NewTransactionMessage()
+	message.Chunks[chunk.Hash()] = chunk
+	if updated, _ := q.HandleTransactionMessage(message); updated {
+		t.Fatal("a chunk with a malformed key should be rejected")
+	}
+	if q.ValidateValue(chunk.Hash()) {
+		t.Fatal("a chunk with a malformed key should not be nominated")
+	}
+}
+
+func TestRecentFilter(t *testing.T) {
+	f := newRecentFilter()
+	for i := 0; i < RecentTransactions; i++ {
+		f.add(fmt.Sprintf("first %d", i))
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if f.mayContain(fmt.Sprintf("never %d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Fatalf("%d false positives out of 1000", falsePositives)
+	}
+
+	// After two more generations, the first one is forgotten
+	for i := 0; i < 2*RecentTransactions; i++ {
+		f.add(fmt.Sprintf("later %d", i))
+	}
+	if !f.mayContain(fmt.Sprintf("later %d", 2*RecentTransactions-1)) {
+		t.Fatal("the filter should remember recent entries")
+	}
+	forgotten := 0
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(fmt.Sprintf("first %d", i)) {
+			forgotten++
+		}
+	}
+	if forgotten < 900 {
+		t.Fatalf("only %d of 1000 old entries were forgotten", forgotten)
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	if q.ValidateValue("unknown") {
+		t.Fatal("an unknown chunk should not be valid")
+	}
+	if !q.missing["unknown"] {
+		t.Fatal("we should go fetch an unknown chunk")
+	}
+
+	tr := makeTestTransaction(1)
+	q.SetBalance(tr.Transaction.From, 10)
+	q.Add(tr)
+	key, chunk := q.NewChunk(q.Transactions())
+	if chunk == nil || !q.ValidateValue(key) {
+		t.Fatal("our own chunk should be valid")
+	}
+
+	// Once the sender can't afford it, we should not vote for it
+	q.SetBalance(tr.Transaction.From, 1)
+	if q.ValidateValue(key) {
+		t.Fatal("a chunk that no longer validates should not be valid")
+	}
+}
+
+func TestFinalizeFromStateDiff(t *testing.T) {
+	tr := makeTestTransaction(1)
+	from := tr.Transaction.From
+	q1 := NewTransactionQueue("q1")
+	q2 := NewTransactionQueue("q2")
+	for _, q := range []*TransactionQueue{q1, q2} {
+		q.SetBalance(from, 10)
+	}
+
+	q1.Add(tr)
+	key, chunk := q1.NewChunk(q1.Transactions())
+	if chunk == nil {
+		t.Fatal("expected a chunk")
+	}
+	q1.Finalize(key)
+	diff := util.EncodeThenDecode(q1.StateDiffMessage(1)).(*StateDiffMessage)
+	if !diff.Verify() {
+		t.Fatal("the diff should match its chunk")
+	}
+
+	// A diff whose state was tampered with should be rejected
+	tampered := util.EncodeThenDecode(diff).(*StateDiffMessage)
+	tampered.State[from].Balance = 100
+	if q2.HandleStateDiffMessage(tampered) {
+		t.Fatal("a tampered diff should be rejected")
+	}
+	if q2.CanFinalize(key) {
+		t.Fatal("q2 should not be able to finalize without the chunk or a diff")
+	}
+
+	if !q2.HandleStateDiffMessage(diff) || !q2.CanFinalize(key) {
+		t.Fatal("q2 should be able to finalize with the diff")
+	}
+	q2.Finalize(key)
+	if q2.Slot() != 2 || q2.Last() != key {
+		t.Fatalf("q2 did not finalize: slot %d last %s", q2.Slot(), q2.Last())
+	}
+	for _, owner := range []util.PublicKey{from, testKey("nobody")} {
+		if *q2.accounts.Get(owner) != *q1.accounts.Get(owner) {
+			t.Fatalf("account %s differs: %+v vs %+v",
+				owner, q2.accounts.Get(owner), q1.accounts.Get(owner))
+		}
+	}
+	if account, ok := q2.AccountAt(from, 1); !ok || account.Balance != 8 {
+		t.Fatalf("bad account at slot 1: %+v", account)
+	}
+
+	// The diff can't be applied on top of a different state
+	q3 := NewTransactionQueue("q3")
+	q3.SetBalance(from, 20)
+	if err := q3.accounts.applyStateDiff(diff); err == nil {
+		t.Fatal("the diff should not apply to a different starting state")
+	}
+	if q3.HandleStateDiffMessage(diff) {
+		t.Fatal("a diff that starts from a different state should be rejected")
+	}
+}
+
+func TestStateDiffCoversDelegations(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("alice")
+	alice := kp.PublicKey()
+	q1 := NewTransactionQueue("q1")
+	q2 := NewTransactionQueue("q2")
+	for _, q := range []*TransactionQueue{q1, q2} {
+		q.SetBalance(alice, 10)
+	}
+	grant := &Transaction{
+		From:     alice,
+		Sequence: 1,
+		To:       alice,
+		Grant:    &Capability{Key: "hot", MaxAmount: 5},
+	}
+	q1.Add(grant.SignWith(kp))
+	key, chunk := q1.NewChunk(q1.Transactions())
+	if chunk == nil || len(chunk.Delegations) != 1 {
+		t.Fatalf("the chunk should record the delegation: %+v", chunk)
+	}
+
+	// The delegation is part of what the chunk hash covers
+	stripped := &LedgerChunk{Transactions: chunk.Transactions, State: chunk.State}
+	if stripped.Hash() == key {
+		t.Fatal("leaving out the delegation should change the hash")
+	}
+	if q2.accounts.ValidateChunk(stripped) == nil {
+		t.Fatal("a chunk that leaves out a delegation it changes should not validate")
+	}
+
+	q1.Finalize(key)
+	diff := util.EncodeThenDecode(q1.StateDiffMessage(1)).(*StateDiffMessage)
+	tampered := util.EncodeThenDecode(diff).(*StateDiffMessage)
+	for _, d := range tampered.Delegations {
+		d.Capability.MaxAmount = 1000
+	}
+	if tampered.Verify() || q2.HandleStateDiffMessage(tampered) {
+		t.Fatal("a diff with a forged delegation should be rejected")
+	}
+
+	if !q2.HandleStateDiffMessage(diff) {
+		t.Fatal("q2 should accept the real diff")
+	}
+	q2.Finalize(key)
+	if q2.accounts.getDelegation(alice, "hot") == nil {
+		t.Fatal("q2 should have the delegation")
+	}
+}
+
+func TestIncludedSlot(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	tr := makeTestTransaction(1)
+	from := tr.Transaction.From
+	q.SetBalance(from, 10)
+
+	info := &util.InfoMessage{Account: from, Sequence: 1}
+	if m := q.HandleInfoMessage(info).(*AccountMessage); m.Depth() != -1 {
+		t.Fatalf("the transaction is not finalized yet: %s", m)
+	}
+
+	// Slot 1 is skipped, slot 2 includes the transaction
+	q.Skip()
+	q.Add(tr)
+	key, chunk := q.NewChunk(q.Transactions())
+	if chunk == nil {
+		t.Fatal("expected a chunk")
+	}
+	q.Finalize(key)
+	for depth := 0; depth < 3; depth++ {
+		m := util.EncodeThenDecode(q.HandleInfoMessage(info)).(*AccountMessage)
+		if m.Included != 2 || m.Depth() != depth {
+			t.Fatalf("expected depth %d but got %s", depth, m)
+		}
+		q.Skip()
+	}
+
+	// Once slot 2 is pruned, we can only tell that it is at least this deep
+	for q.Slot() <= 2*SnapshotInterval {
+		q.Skip()
+	}
+	q.Prune(SnapshotInterval)
+	if included := q.IncludedSlot(from, 1); included != SnapshotInterval-1 {
+		t.Fatalf("included was %d after pruning", included)
+	}
+}
+
+func TestImport(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	alice := util.NewKeyPairFromSecretPhrase("alice")
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+	q.accounts.SetBalance(alice.PublicKey(), 100)
+	q.accounts.SetBalance(bob.PublicKey(), 100)
+	send := func(kp *util.KeyPair, sequence uint32) *SignedTransaction {
+		return (&Transaction{
+			From:     kp.PublicKey(),
+			Sequence: sequence,
+			To:       testKey("carol"),
+			Amount:   1,
+		}).SignWith(kp)
+	}
+
+	// Out of order, with a repeat
+	ts := []*SignedTransaction{
+		send(alice, 3), send(alice, 1), send(bob, 1), send(alice, 2), send(alice, 1),
+	}
+	updated, err := q.Import(ts)
+	if !updated || err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if q.ImportBacklog() != 4 {
+		t.Fatalf("expected 4 imported transactions but got %d", q.ImportBacklog())
+	}
+
+	// Each sender gets one transaction into each chunk
+	for slot, size := range []int{2, 1, 1} {
+		if q.Size() != size {
+			t.Fatalf("slot %d should have %d transactions queued but has %d",
+				slot+1, size, q.Size())
+		}
+		key, chunk := q.NewChunk(q.Transactions())
+		if chunk == nil {
+			t.Fatalf("expected a chunk for slot %d", slot+1)
+		}
+		q.Finalize(key)
+	}
+	if q.ImportBacklog() != 0 || q.Size() != 0 {
+		t.Fatalf("the import should be done but %d are left", q.ImportBacklog())
+	}
+	if q.accounts.Get(testKey("carol")).Balance != 4 {
+		t.Fatalf("carol should have 4 but has %d", q.accounts.Get(testKey("carol")).Balance)
+	}
+
+	// Sending it all again changes nothing
+	updated, err = q.Import(ts)
+	if updated || err != nil || q.ImportBacklog() != 0 {
+		t.Fatalf("a repeated import should be skipped, got %v, %v", updated, err)
+	}
+}
+
+func TestImportBacklogFull(t *testing.T) {
+	q := NewTransactionQueue("testqueue")
+	kp := util.NewKeyPairFromSecretPhrase("alice")
+	q.importCount = MaxImportBacklog
+	_, err := q.Import([]*SignedTransaction{(&Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       testKey("carol"),
+		Amount:   1,
+	}).SignWith(kp)})
+	if err != ErrImportBacklogFull || !IsTransient(err) {
+		t.Fatalf("expected a transient full backlog but got %v", err)
+	}
+}
+
+// benchmarkQueue makes a queue whose accounts can afford transactions, and
+// n transactions for it. The transactions are made up front, since signing
+// is slow.
+func benchmarkQueue(n int) (*TransactionQueue, []*SignedTransaction) {
+	q := NewTransactionQueue("benchmark")
+	ts := []*SignedTransaction{}
+	for i := 1; i <= n; i++ {
+		t := makeTestTransaction(i)
+		q.accounts.SetBalance(t.Transaction.From, 10*t.Transaction.Amount)
+		ts = append(ts, t)
+	}
+	return q, ts
+}
+
+func TestRevalidate(t *testing.T) {
+	q, ts := benchmarkQueue(20)
+	for _, t := range ts {
+		q.Add(t)
+	}
+
+	// Every other sender loses their money
+	for i := 0; i < len(ts); i += 2 {
+		q.accounts.SetBalance(ts[i].Transaction.From, 0)
+	}
+	q.Revalidate()
+	if q.Size() != len(ts)/2 {
+		t.Fatalf("expected %d transactions left but got %d", len(ts)/2, q.Size())
+	}
+	for i, st := range ts {
+		if q.Contains(st) != (i%2 == 1) {
+			t.Fatalf("transaction %d should not be in the queue", i)
+		}
+	}
+
+	seen := 0
+	q.ForEach(func(st *SignedTransaction) bool {
+		seen++
+		return seen < 3
+	})
+	if seen != 3 {
+		t.Fatalf("ForEach should stop when asked to, but saw %d transactions", seen)
+	}
+}
+
+func TestFinalizeRevalidatesTouchedSenders(t *testing.T) {
+	q, ts := benchmarkQueue(3)
+	for _, t := range ts {
+		q.Add(t)
+	}
+
+	// Sneak around the queue to make two transactions invalid. The queue
+	// can't tell, so it only notices for the sender that the next slot
+	// touches.
+	q.accounts.SetBalance(ts[1].Transaction.From, 0)
+	q.accounts.SetBalance(ts[2].Transaction.From, 0)
+	kp := util.NewKeyPairFromSecretPhrase("other")
+	q.SetBalance(kp.PublicKey(), 100)
+	key, chunk := q.NewChunk([]*SignedTransaction{(&Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       ts[2].Transaction.From,
+		Amount:   1,
+	}).SignWith(kp)})
+	if chunk == nil {
+		t.Fatal("could not make a chunk")
+	}
+	q.Finalize(key)
+
+	if !q.Contains(ts[0]) {
+		t.Fatal("a valid transaction should stay in the queue")
+	}
+	if !q.Contains(ts[1]) {
+		t.Fatal("a sender the slot didn't touch should not be revalidated")
+	}
+	if q.Contains(ts[2]) {
+		t.Fatal("a sender the slot touched should be revalidated")
+	}
+}
+
+func TestVerifyWorkersMatchSerial(t *testing.T) {
+	defer func(workers int) { VerifyWorkers = workers }(VerifyWorkers)
+	_, ts := benchmarkQueue(20)
+
+	// Break some signatures
+	for i := 0; i < len(ts); i += 3 {
+		forged := *ts[i]
+		forged.Signature = ts[i+1].Signature
+		ts[i] = &forged
+	}
+	ts = append(ts, nil)
+
+	results := []string{}
+	for _, workers := range []int{1, 4} {
+		VerifyWorkers = workers
+		q, _ := benchmarkQueue(20)
+		_, err := q.HandleTransactionMessage(&TransactionMessage{Transactions: ts})
+		results = append(results, fmt.Sprintf("%v %s", err, StringifyTransactions(q.Transactions())))
+		if q.Size() != len(ts)-1-7 {
+			t.Fatalf("with %d workers, %d transactions were added", workers, q.Size())
+		}
+	}
+	if results[0] != results[1] {
+		t.Fatalf("serial verification got %s but parallel got %s", results[0], results[1])
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	q, ts := benchmarkQueue(MaxChunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, t := range ts {
+			q.Add(t)
+		}
+		b.StopTimer()
+		for _, t := range ts {
+			q.Remove(t)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkHandleTransactionMessage(b *testing.B) {
+	defer func(workers int) { VerifyWorkers = workers }(VerifyWorkers)
+	q, ts := benchmarkQueue(MaxChunkSize)
+	m := &TransactionMessage{Transactions: ts}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			VerifyWorkers = workers
+			for i := 0; i < b.N; i++ {
+				q.HandleTransactionMessage(m)
+				b.StopTimer()
+				for _, t := range ts {
+					q.Remove(t)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkTop(b *testing.B) {
+	q, ts := benchmarkQueue(QueueLimit)
+	for _, t := range ts {
+		q.Add(t)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Top(MaxChunkSize)
+	}
+}
+
+func BenchmarkNewChunk(b *testing.B) {
+	q, ts := benchmarkQueue(QueueLimit)
+	for _, t := range ts {
+		q.Add(t)
+	}
+	top := q.Top(MaxChunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.NewChunk(top)
+	}
+}
+
+func BenchmarkSuggestValue(b *testing.B) {
+	q, ts := benchmarkQueue(QueueLimit)
+	for _, t := range ts {
+		q.Add(t)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.SuggestValue()
+	}
+}
+
+func BenchmarkRevalidate(b *testing.B) {
+	q, ts := benchmarkQueue(QueueLimit)
+	for _, t := range ts {
+		q.Add(t)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Revalidate()
+	}
+}
+
+func BenchmarkFinalize(b *testing.B) {
+	q, ts := benchmarkQueue(QueueLimit)
+	for _, t := range ts {
+		q.Add(t)
+	}
+	sender := util.NewKeyPairFromSecretPhrase("benchmark sender")
+	q.SetBalance(sender.PublicKey(), uint64(b.N)+1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key, _ := q.NewChunk([]*SignedTransaction{(&Transaction{
+			From:     sender.PublicKey(),
+			Sequence: uint32(i + 1),
+			To:       testKey("nobody"),
+			Amount:   1,
+		}).SignWith(sender)})
+		q.Finalize(key)
+	}
+}
@@ -0,0 +1,313 @@
+package data
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"coinkit/util"
+)
+
+var ErrClosed = errors.New("database is closed")
+
+// A SyncPolicy says when appended messages are flushed to disk.
+type SyncPolicy int
+
+const (
+	// Every append waits until its messages are on disk
+	SyncAlways SyncPolicy = iota
+
+	// Appends flush to disk at most once per SyncInterval, and an append
+	// that doesn't flush schedules one for when the interval is up. A crash
+	// can lose the messages appended since the last flush
+	SyncPeriodically
+
+	// Flushing to disk is left up to the operating system
+	SyncNever
+)
+
+// How often a database with the SyncPeriodically policy flushes to disk
+const SyncInterval = time.Second
+
+// A Database stores messages on disk, in the order they were appended, so
+// that a node can rebuild its state after a restart.
+// Each message is one line of the file, so a write that was cut off by a
+// crash only loses the last message.
+// Database is threadsafe.
+type Database struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+
+	// Where each message starts in the file, and where the file ends, so
+	// that single messages can be read back. Only valid once indexed is set
+	offsets []int64
+	end     int64
+	indexed bool
+
+	// When appends are flushed to disk. Protected by mutex
+	policy   SyncPolicy
+	lastSync time.Time
+
+	// The scheduled flush for appends that weren't flushed yet, and the
+	// error from the last scheduled flush, which the next append or Close
+	// returns. Protected by mutex
+	flushTimer *time.Timer
+	flushErr   error
+}
+
+// NewDatabase opens the database at path, creating it if it does not exist.
+func NewDatabase(path string) (*Database, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Database{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Path returns where the database is on disk.
+func (db *Database) Path() string {
+	return db.path
+}
+
+// SetSyncPolicy changes when appends are flushed to disk. The default is
+// SyncAlways.
+func (db *Database) SetSyncPolicy(policy SyncPolicy) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.policy = policy
+}
+
+// Append writes messages to the end of the database, in a single write.
+// With the SyncAlways policy, it does not return until they are on disk.
+func (db *Database) Append(messages ...util.Message) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return ErrClosed
+	}
+	lines := []string{}
+	for _, m := range messages {
+		lines = append(lines, util.EncodeMessage(m)+"\n")
+	}
+	if _, err := io.WriteString(db.file, strings.Join(lines, "")); err != nil {
+		// We don't know how much got written
+		db.indexed = false
+		return err
+	}
+	if db.indexed {
+		for _, line := range lines {
+			db.offsets = append(db.offsets, db.end)
+			db.end += int64(len(line))
+		}
+	}
+	if err := db.flushErr; err != nil {
+		db.flushErr = nil
+		return err
+	}
+	switch db.policy {
+	case SyncNever:
+		return nil
+	case SyncPeriodically:
+		if since := time.Since(db.lastSync); since < SyncInterval {
+			if db.flushTimer == nil {
+				db.flushTimer = time.AfterFunc(SyncInterval-since, db.flush)
+			}
+			return nil
+		}
+	}
+	return db.sync()
+}
+
+// sync flushes the database to disk. The caller must hold the mutex.
+func (db *Database) sync() error {
+	if db.flushTimer != nil {
+		db.flushTimer.Stop()
+		db.flushTimer = nil
+	}
+	db.lastSync = time.Now()
+	return db.file.Sync()
+}
+
+// flush is the scheduled flush for appends that weren't flushed to disk.
+func (db *Database) flush() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.flushTimer = nil
+	if db.file == nil {
+		return
+	}
+	if err := db.sync(); err != nil {
+		db.flushErr = err
+	}
+}
+
+// ForEach calls f on every message in the database, in order.
+// An incomplete last line, from a write that was cut off, is removed.
+func (db *Database) ForEach(f func(util.Message) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return ErrClosed
+	}
+	if _, err := db.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	db.indexed = false
+	db.offsets = []int64{}
+	reader := bufio.NewReader(db.file)
+	offset := int64(0)
+	for line := 1; ; line++ {
+		data, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				if err := db.file.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			db.end = offset
+			db.indexed = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		db.offsets = append(db.offsets, offset)
+		offset += int64(len(data))
+		m, err := util.DecodeMessage(data[:len(data)-1])
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", db.path, line, err)
+		}
+		if err := f(m); err != nil {
+			return err
+		}
+	}
+}
+
+// Read returns the message at position i in the database, counting from zero,
+// or nil if there are not that many messages.
+// The first call may need to scan the whole file.
+func (db *Database) Read(i int) (util.Message, error) {
+	if !db.isIndexed() {
+		if err := db.ForEach(func(util.Message) error { return nil }); err != nil {
+			return nil, err
+		}
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return nil, ErrClosed
+	}
+	if i < 0 || i >= len(db.offsets) {
+		return nil, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(db.file, db.offsets[i], db.end-db.offsets[i]))
+	data, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	m, err := util.DecodeMessage(data[:len(data)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%s line %d: %w", db.path, i+1, err)
+	}
+	return m, nil
+}
+
+// Size returns how many bytes the database takes up on disk.
+func (db *Database) Size() (int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return 0, ErrClosed
+	}
+	info, err := db.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Replace atomically replaces the whole database with these messages. The
+// new contents are written to a temporary file that is renamed over the old
+// one, so a crash leaves either the old database or the new one.
+func (db *Database) Replace(messages []util.Message) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return ErrClosed
+	}
+	tmp := db.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	offsets := []int64{}
+	end := int64(0)
+	for _, m := range messages {
+		line := util.EncodeMessage(m) + "\n"
+		if _, err := io.WriteString(file, line); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+		offsets = append(offsets, end)
+		end += int64(len(line))
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	// Appends go to the end of the new file, like they do after opening it
+	file.Close()
+	file, err = os.OpenFile(db.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	db.file.Close()
+	db.file = file
+	db.offsets = offsets
+	db.end = end
+	db.indexed = true
+	return nil
+}
+
+func (db *Database) isIndexed() bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.indexed
+}
+
+// Close flushes the database to disk and closes it. Appending afterwards
+// returns ErrClosed.
+func (db *Database) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.file == nil {
+		return nil
+	}
+	err := db.sync()
+	if err == nil {
+		err = db.flushErr
+	}
+	if closeErr := db.file.Close(); err == nil {
+		err = closeErr
+	}
+	db.file = nil
+	return err
+}
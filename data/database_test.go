@@ -0,0 +1,211 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"coinkit/util"
+)
+
+func loadSlots(db *Database, t *testing.T) []int {
+	slots := []int{}
+	err := db.ForEach(func(m util.Message) error {
+		slots = append(slots, m.Slot())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slots
+}
+
+func TestDatabaseRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := db.Append(&util.InfoMessage{I: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	if db.Append(&util.InfoMessage{I: 4}) != ErrClosed {
+		t.Fatal("appending to a closed database should fail")
+	}
+
+	// Simulate a write that got cut off by a crash
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"T":"I","M":{"I":`)
+	file.Close()
+
+	db, err = NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if slots := loadSlots(db, t); len(slots) != 3 {
+		t.Fatalf("expected the three complete messages but got %v", slots)
+	}
+	if err := db.Append(&util.InfoMessage{I: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if slots := loadSlots(db, t); len(slots) != 4 || slots[3] != 4 {
+		t.Fatalf("the torn write should be gone, but got %v", slots)
+	}
+}
+
+func TestDatabaseRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		db.Append(&util.InfoMessage{I: i})
+	}
+	db.Close()
+
+	db, err = NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := db.Read(1)
+	if err != nil || m == nil || m.Slot() != 2 {
+		t.Fatalf("expected slot 2 but got %v, %v", m, err)
+	}
+
+	// Messages appended after indexing can be read too
+	db.Append(&util.InfoMessage{I: 4})
+	m, err = db.Read(3)
+	if err != nil || m == nil || m.Slot() != 4 {
+		t.Fatalf("expected slot 4 but got %v, %v", m, err)
+	}
+	if m, err := db.Read(4); m != nil || err != nil {
+		t.Fatalf("expected nothing past the end but got %v, %v", m, err)
+	}
+}
+
+func TestDatabaseReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i <= 10; i++ {
+		if err := db.Append(&util.InfoMessage{I: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Replace([]util.Message{&util.InfoMessage{I: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("replacing should shrink the database, but %d -> %d", before, after)
+	}
+	if err := db.Append(&util.InfoMessage{I: 11}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := db.Read(1)
+	if err != nil || m == nil || m.Slot() != 11 {
+		t.Fatalf("bad message after replace: %v %v", m, err)
+	}
+
+	// The replacement should be what's there after reopening
+	db.Close()
+	db, err = NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if slots := loadSlots(db, t); len(slots) != 2 || slots[0] != 10 || slots[1] != 11 {
+		t.Fatalf("expected slots 10 and 11 but got %v", slots)
+	}
+}
+
+func TestDatabaseBatchAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	for _, policy := range []SyncPolicy{SyncAlways, SyncPeriodically, SyncNever} {
+		os.Remove(path)
+		db, err := NewDatabase(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetSyncPolicy(policy)
+		batch := []util.Message{}
+		for i := 1; i <= 5; i++ {
+			batch = append(batch, &util.InfoMessage{I: i})
+		}
+		if err := db.Append(batch...); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Append(&util.InfoMessage{I: 6}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDatabase(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slots := loadSlots(db, t)
+		if len(slots) != 6 || slots[0] != 1 || slots[5] != 6 {
+			t.Fatalf("policy %d: expected slots 1-6 but got %v", policy, slots)
+		}
+		m, err := db.Read(4)
+		if err != nil || m == nil || m.Slot() != 5 {
+			t.Fatalf("policy %d: expected slot 5 but got %v, %v", policy, m, err)
+		}
+		db.Close()
+	}
+}
+
+func TestDatabaseFlushesAfterIdle(t *testing.T) {
+	db, err := NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetSyncPolicy(SyncPeriodically)
+
+	// The first append flushes, and the second is too soon after it
+	for i := 1; i <= 2; i++ {
+		if err := db.Append(&util.InfoMessage{I: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mutex.Lock()
+	synced := db.lastSync
+	scheduled := db.flushTimer != nil
+	db.mutex.Unlock()
+	if !scheduled {
+		t.Fatal("the second append should schedule a flush")
+	}
+
+	// Nothing else gets appended, but the second one still gets flushed
+	time.Sleep(SyncInterval + 100*time.Millisecond)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.flushTimer != nil || !db.lastSync.After(synced) {
+		t.Fatal("the scheduled flush should have run")
+	}
+}
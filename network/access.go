@@ -0,0 +1,92 @@
+package network
+
+import (
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/registry"
+	"coinkit/util"
+)
+
+// A Scope is a set of permissions for the signer of a message.
+// Since every message is signed, the signer's public key works as an
+// authentication token.
+type Scope int
+
+const (
+	// ReadScope allows queries, like InfoMessages
+	ReadScope Scope = 1 << iota
+
+	// SubmitScope allows submitting new transactions
+	SubmitScope
+
+	// PeerScope allows taking part in consensus
+	PeerScope
+
+	// AdminScope allows operator actions, like bulk imports. It is not part
+	// of AllScopes, so it has to be granted to a key explicitly, and a nil
+	// AccessPolicy does not allow it
+	AdminScope
+
+	AllScopes = ReadScope | SubmitScope | PeerScope
+)
+
+// RequiredScope returns the scope that a signer needs to send us this message.
+func RequiredScope(m util.Message) Scope {
+	switch m := m.(type) {
+	case *util.InfoMessage:
+		if m.Status {
+			// The status shows how consensus is going, like the metrics
+			return AdminScope
+		}
+		return ReadScope
+	case *HistoryRequestMessage, *consensus.DigestMessage, *BlockHeaderMessage:
+		return ReadScope
+	case *currency.TransactionMessage, *registry.RegistryMessage:
+		return SubmitScope
+	case *consensus.NominationMessage, *consensus.PrepareMessage,
+		*consensus.ConfirmMessage, *consensus.ExternalizeMessage,
+		*consensus.QuorumSliceMessage,
+		*HistoryMessage, *HistoryRangeMessage, *currency.FetchMessage, *HelloMessage,
+		*ChunkRequestMessage, *PingMessage, *PeerExchangeMessage,
+		*util.ErrorMessage:
+		return PeerScope
+	case *currency.ImportMessage, *PauseMessage, *MetricsMessage:
+		return AdminScope
+	case *currency.AccountMessage:
+		// Nodes drop account messages without looking at them
+		return 0
+	case *BatchMessage:
+		// A batch needs whatever any of its messages needs
+		var scope Scope
+		for _, inner := range m.Messages {
+			scope |= RequiredScope(inner)
+		}
+		return scope
+	default:
+		// Anything we haven't vetted is only for peers
+		return PeerScope
+	}
+}
+
+// An AccessPolicy decides what each signer is allowed to do.
+// A nil AccessPolicy allows everything but admin actions.
+type AccessPolicy struct {
+	// The scopes for particular public keys
+	Keys map[util.PublicKey]Scope
+
+	// The scopes for any signer not in Keys
+	Default Scope
+}
+
+// Allows returns whether the signer is allowed to send this message.
+func (p *AccessPolicy) Allows(signer util.PublicKey, m util.Message) bool {
+	if p == nil {
+		return RequiredScope(m)&AdminScope == 0
+	}
+	scope, ok := p.Keys[signer]
+	if !ok {
+		scope = p.Default
+	}
+	required := RequiredScope(m)
+	return scope&required == required
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"testing"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	var open *AccessPolicy
+	info := &util.InfoMessage{Account: "bob"}
+	trans := currency.NewTransactionMessage()
+	nom := &consensus.NominationMessage{I: 1}
+	if !open.Allows("anyone", nom) {
+		t.Fatal("a nil policy should allow everything")
+	}
+
+	p := &AccessPolicy{
+		Keys: map[util.PublicKey]Scope{
+			"submitter": ReadScope | SubmitScope,
+		},
+		Default: ReadScope,
+	}
+	if !p.Allows("anyone", info) {
+		t.Fatal("anyone should be able to read")
+	}
+	if p.Allows("anyone", trans) {
+		t.Fatal("only the submitter should be able to submit")
+	}
+	if !p.Allows("submitter", trans) {
+		t.Fatal("the submitter should be able to submit")
+	}
+	if p.Allows("submitter", nom) {
+		t.Fatal("the submitter should not take part in consensus")
+	}
+	if p.Allows("submitter", &BatchMessage{Messages: []util.Message{trans, nom}}) {
+		t.Fatal("a batch should need whatever its messages need")
+	}
+	if !p.Allows("submitter", &BatchMessage{Messages: []util.Message{trans, info}}) {
+		t.Fatal("the submitter should be able to batch what it can send alone")
+	}
+}
+
+func TestUnlistedMessagesNeedPeerScope(t *testing.T) {
+	p := &AccessPolicy{Default: ReadScope | SubmitScope}
+	for _, m := range []util.Message{
+		&currency.StateDiffMessage{},
+		&CheckpointMessage{},
+		&StatusMessage{},
+		&util.ErrorMessage{},
+	} {
+		if p.Allows("anyone", m) {
+			t.Fatalf("a non-peer should not be able to send %s", m.MessageType())
+		}
+	}
+	if !p.Allows("anyone", &currency.AccountMessage{}) {
+		t.Fatal("account messages should be harmless")
+	}
+}
+
+func TestAdminScope(t *testing.T) {
+	var open *AccessPolicy
+	im := &currency.ImportMessage{}
+	if open.Allows("anyone", im) {
+		t.Fatal("a nil policy should not allow imports")
+	}
+	p := &AccessPolicy{
+		Keys: map[util.PublicKey]Scope{
+			"admin": AdminScope,
+		},
+		Default: AllScopes,
+	}
+	if p.Allows("anyone", im) {
+		t.Fatal("only the admin should be able to import")
+	}
+	if !p.Allows("admin", im) {
+		t.Fatal("the admin should be able to import")
+	}
+	if p.Allows("anyone", &PauseMessage{}) || !p.Allows("admin", &PauseMessage{}) {
+		t.Fatal("only the admin should be able to pause")
+	}
+	if p.Allows("anyone", &MetricsMessage{}) || !p.Allows("admin", &MetricsMessage{}) {
+		t.Fatal("only the admin should be able to see metrics")
+	}
+	status := &util.InfoMessage{Status: true}
+	if p.Allows("anyone", status) || !p.Allows("admin", status) {
+		t.Fatal("only the admin should be able to see the status")
+	}
+}
+
+func TestServerAccessForMembers(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	configs[0].Access = &AccessPolicy{Default: ReadScope}
+	s := NewServer(configs[0])
+	member := configs[1].KeyPair.PublicKey()
+	if !s.access.Allows(member, &consensus.NominationMessage{I: 1}) {
+		t.Fatal("network members should always be able to take part in consensus")
+	}
+	if s.access.Allows("stranger", currency.NewTransactionMessage()) {
+		t.Fatal("strangers should not be able to submit")
+	}
+}
@@ -0,0 +1,366 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"coinkit/util"
+)
+
+// A server keeps an address book of where the other members of the network
+// are. It starts with the addresses in the network config, and learns more
+// from PeerExchangeMessages, so a new node only needs the public keys of the
+// members and one bootstrap address to join.
+// Each address has a score. Dialing it successfully raises the score, and
+// failing lowers it, and we always dial the best address we know.
+
+// How much we trust a new address, by where we heard about it
+const (
+	// Another node told us about it
+	gossipScore = 0
+
+	// The node at that address told us
+	selfScore = 5
+
+	// It is in our config. These addresses are never forgotten
+	configScore = 10
+)
+
+// Scores stay below maxScore, so that a long-lived address that goes bad
+// doesn't take forever to lose out. Addresses that drop below minScore are
+// forgotten.
+const (
+	maxScore = 20
+	minScore = -5
+)
+
+// How many addresses we keep for each node
+const maxAddressesPerPeer = 4
+
+type bookEntry struct {
+	address *Address
+	score   int
+	fixed   bool
+}
+
+// addressBook keeps a few addresses for each member of the network.
+// addressBook is threadsafe.
+type addressBook struct {
+	mutex sync.Mutex
+
+	// Our own public key, which never goes in the book
+	self util.PublicKey
+
+	// Only members of the network go in the book. Protected by mutex
+	members map[util.PublicKey]bool
+
+	// The addresses for each node, by public key
+	entries map[util.PublicKey][]*bookEntry
+}
+
+func newAddressBook(self util.PublicKey, members map[util.PublicKey]bool) *addressBook {
+	return &addressBook{
+		self:    self,
+		members: members,
+		entries: make(map[util.PublicKey][]*bookEntry),
+	}
+}
+
+// setMembers changes who can go in the book. Addresses we already have for
+// nodes that are no longer members are kept, in case they come back.
+func (b *addressBook) setMembers(members map[util.PublicKey]bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.members = members
+}
+
+func validAddress(a *Address) bool {
+	return a != nil && a.Host != "" && a.Port > 0 && a.Port < 65536
+}
+
+// add records an address for a node, starting at score if we don't already
+// know it. It returns whether this is the first address we know for the node.
+func (b *addressBook) add(publicKey util.PublicKey, address *Address, score int) bool {
+	if publicKey == b.self || !validAddress(address) {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.members[publicKey] {
+		return false
+	}
+	list := b.entries[publicKey]
+	for _, entry := range list {
+		if entry.address.String() != address.String() {
+			continue
+		}
+		if score >= selfScore {
+			// Nobody knows whether a node is an archive better than it does
+			copy := *address
+			entry.address = &copy
+		}
+		if entry.score < score {
+			entry.score = score
+		}
+		entry.fixed = entry.fixed || score == configScore
+		return false
+	}
+
+	copy := *address
+	entry := &bookEntry{address: &copy, score: score, fixed: score == configScore}
+	if len(list) < maxAddressesPerPeer {
+		b.entries[publicKey] = append(list, entry)
+		return len(list) == 0
+	}
+
+	// Replace the worst address, if the new one is better
+	worst := -1
+	for i, e := range list {
+		if !e.fixed && (worst == -1 || e.score < list[worst].score) {
+			worst = i
+		}
+	}
+	if worst != -1 && list[worst].score < score {
+		list[worst] = entry
+	}
+	return false
+}
+
+// bestEntry returns the highest scoring entry for a node, or nil.
+// The caller must hold the mutex.
+func (b *addressBook) bestEntry(publicKey util.PublicKey) *bookEntry {
+	var best *bookEntry
+	for _, entry := range b.entries[publicKey] {
+		if best == nil || entry.score > best.score {
+			best = entry
+		}
+	}
+	return best
+}
+
+// best returns the address we should dial a node at, or nil if we don't
+// know any.
+func (b *addressBook) best(publicKey util.PublicKey) *Address {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entry := b.bestEntry(publicKey)
+	if entry == nil {
+		return nil
+	}
+	copy := *entry.address
+	return &copy
+}
+
+// rate changes the score of an address by delta, and forgets it if it
+// scores too low.
+func (b *addressBook) rate(publicKey util.PublicKey, address *Address, delta int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	list := b.entries[publicKey]
+	for i, entry := range list {
+		if entry.address.String() != address.String() {
+			continue
+		}
+		entry.score += delta
+		if entry.score > maxScore {
+			entry.score = maxScore
+		}
+		if entry.score < minScore && !entry.fixed {
+			b.entries[publicKey] = append(list[:i:i], list[i+1:]...)
+			if len(b.entries[publicKey]) == 0 {
+				delete(b.entries, publicKey)
+			}
+		}
+		return
+	}
+}
+
+func (b *addressBook) success(publicKey util.PublicKey, address *Address) {
+	b.rate(publicKey, address, 1)
+}
+
+func (b *addressBook) failure(publicKey util.PublicKey, address *Address) {
+	b.rate(publicKey, address, -1)
+}
+
+// keys returns the public keys of the nodes we know an address for, sorted.
+func (b *addressBook) keys() []util.PublicKey {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	answer := []util.PublicKey{}
+	for key := range b.entries {
+		answer = append(answer, key)
+	}
+	util.SortPublicKeys(answer)
+	return answer
+}
+
+// exchange returns the best address we know for each node, leaving out
+// ones that keep failing.
+func (b *addressBook) exchange() map[util.PublicKey]*Address {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	answer := make(map[util.PublicKey]*Address)
+	for key := range b.entries {
+		if entry := b.bestEntry(key); entry.score >= gossipScore {
+			copy := *entry.address
+			answer[key] = &copy
+		}
+	}
+	return answer
+}
+
+// hostOf returns the host part of a network address.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// PeerAddresses returns the best address we know for each member of the
+// network, by public key.
+func (s *Server) PeerAddresses() map[util.PublicKey]*Address {
+	return s.book.exchange()
+}
+
+// peerExchangeMessage returns the addresses we share with other nodes.
+// Unless we know where we can be reached, our own address has no host, and
+// the receiver uses the host our connection comes from.
+func (s *Server) peerExchangeMessage() *PeerExchangeMessage {
+	m := &PeerExchangeMessage{Peers: s.book.exchange()}
+	self := &Address{Port: s.port}
+	if s.advertise != nil {
+		self.Host = s.advertise.Host
+		self.Port = s.advertise.Port
+	}
+	self.Archive = s.archive
+	self.OutboundOnly = s.outboundOnly
+	m.Peers[s.keyPair.PublicKey()] = self
+	return m
+}
+
+// handlePeerExchange adds the addresses from a peer exchange to our book,
+// and starts dialing any peers we just found. host is where the message
+// came from, which is where we find the sender if it doesn't say.
+func (s *Server) handlePeerExchange(signer util.PublicKey, host string, m *PeerExchangeMessage) {
+	for key := range m.Peers {
+		if err := key.Validate(); err != nil {
+			log.Printf("ignoring a peer exchange from %s: %s",
+				util.Shorten(string(signer)), err)
+			return
+		}
+	}
+	for key, address := range m.Peers {
+		if key != signer {
+			s.book.add(key, address, gossipScore)
+			continue
+		}
+		if address != nil && address.Host == "" {
+			copy := *address
+			copy.Host = host
+			address = &copy
+		}
+		s.book.add(key, address, selfScore)
+	}
+	for key := range m.Peers {
+		s.maybeDial(key)
+	}
+}
+
+// maybeDial starts dialing a peer, unless we shouldn't or already are.
+func (s *Server) maybeDial(publicKey util.PublicKey) {
+	if s.ctx.Err() != nil || !s.shouldDial(publicKey) {
+		return
+	}
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	if s.dialing[publicKey] {
+		return
+	}
+	s.dialing[publicKey] = true
+	go s.dialForever(publicKey)
+}
+
+// exchangeForever shares our addresses on a link every PeerExchangeInterval,
+// until the link closes.
+func (s *Server) exchangeForever(link *peerLink) {
+	ticker := time.NewTicker(s.PeerExchangeInterval)
+	defer ticker.Stop()
+	for {
+		sm := util.NewSignedMessage(s.keyPair, s.peerExchangeMessage())
+		s.linkMutex.Lock()
+		limit := s.linkLimit(link.publicKey)
+		s.linkMutex.Unlock()
+		link.send(util.SignedMessageToFrame(sm), limit)
+		select {
+		case <-link.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// exchangeWith sends our addresses to the node at address, and adds the
+// ones it answers with to our book.
+func (s *Server) exchangeWith(address *Address) error {
+	conn, err := net.DialTimeout("tcp", address.String(), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// We don't know what protocol version the node speaks yet, and every
+	// version reads lines
+	wire := util.NewWire(conn)
+	wire.UseLines()
+	wire.Write(util.NewSignedMessage(s.keyPair, s.peerExchangeMessage()))
+	sm, err := wire.Read()
+	if err != nil {
+		return err
+	}
+	if sm == nil {
+		return ErrNoResponse
+	}
+	m, ok := sm.Message().(*PeerExchangeMessage)
+	if !ok {
+		return fmt.Errorf("expected a peer exchange but got %s", sm.Message())
+	}
+	s.handlePeerExchange(sm.Signer(), address.Host, m)
+	return nil
+}
+
+// bootstrapForever asks our bootstrap nodes who they know, and keeps trying
+// until one of them answers.
+// It should be run in its own goroutine.
+func (s *Server) bootstrapForever() {
+	failCount := 0
+	for s.ctx.Err() == nil {
+		answered := false
+		for _, address := range s.bootstrap {
+			if err := s.exchangeWith(address); err != nil {
+				if s.ctx.Err() == nil {
+					log.Printf("could not bootstrap from %s: %s", address, err)
+				}
+				continue
+			}
+			answered = true
+		}
+		if answered {
+			s.Logf("bootstrapped, now we know where %d peers are", len(s.book.keys()))
+			return
+		}
+		failCount++
+		timer := time.NewTimer(backoff(failCount, 30*time.Second))
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"coinkit/util"
+)
+
+func testBook() *addressBook {
+	return newAddressBook("self", map[util.PublicKey]bool{"self": true, "peer": true})
+}
+
+func TestAddressBookOnlyHasMembers(t *testing.T) {
+	book := testBook()
+	address := &Address{Host: "127.0.0.1", Port: 9000}
+	if book.add("self", address, gossipScore) || book.add("stranger", address, gossipScore) {
+		t.Fatal("only other members should go in the book")
+	}
+	if book.add("peer", &Address{Port: 9000}, gossipScore) {
+		t.Fatal("an address without a host should not go in the book")
+	}
+	if !book.add("peer", address, gossipScore) {
+		t.Fatal("this is the first address for peer")
+	}
+	if book.add("peer", address, gossipScore) {
+		t.Fatal("the address is already known")
+	}
+	if len(book.keys()) != 1 {
+		t.Fatalf("expected one node in the book but got %d", len(book.keys()))
+	}
+}
+
+func TestAddressBookScoring(t *testing.T) {
+	book := testBook()
+	good := &Address{Host: "127.0.0.1", Port: 9000}
+	bad := &Address{Host: "127.0.0.2", Port: 9000}
+	book.add("peer", good, gossipScore)
+	book.add("peer", bad, selfScore)
+	if book.best("peer").String() != bad.String() {
+		t.Fatal("an address from the node itself should be tried first")
+	}
+
+	// Failing enough makes another address better, and then gets an address
+	// forgotten
+	for i := 0; i <= selfScore-minScore; i++ {
+		book.failure("peer", bad)
+	}
+	if book.best("peer").String() != good.String() {
+		t.Fatal("the failing address should have lost out")
+	}
+	if len(book.entries["peer"]) != 1 {
+		t.Fatal("the failing address should have been forgotten")
+	}
+	for i := 0; i < 100; i++ {
+		book.success("peer", good)
+	}
+	if book.entries["peer"][0].score != maxScore {
+		t.Fatalf("the score should stop at %d", maxScore)
+	}
+}
+
+func TestAddressBookKeepsConfig(t *testing.T) {
+	book := testBook()
+	address := &Address{Host: "127.0.0.1", Port: 9000}
+	book.add("peer", address, configScore)
+	for i := 0; i < 100; i++ {
+		book.failure("peer", address)
+	}
+	if book.best("peer") == nil {
+		t.Fatal("addresses from the config should never be forgotten")
+	}
+	if _, ok := book.exchange()["peer"]; ok {
+		t.Fatal("an address that keeps failing should not be shared")
+	}
+}
+
+func TestAddressBookIsBounded(t *testing.T) {
+	book := testBook()
+	for port := 9000; port < 9010; port++ {
+		book.add("peer", &Address{Host: "127.0.0.1", Port: port}, gossipScore)
+	}
+	if len(book.entries["peer"]) != maxAddressesPerPeer {
+		t.Fatalf("expected %d addresses but got %d",
+			maxAddressesPerPeer, len(book.entries["peer"]))
+	}
+	better := &Address{Host: "127.0.0.1", Port: 9999}
+	book.add("peer", better, selfScore)
+	if book.best("peer").String() != better.String() {
+		t.Fatal("a better address should replace a worse one")
+	}
+}
+
+// Each server only knows where the first one is, and finds the rest
+// through peer exchange.
+func TestPeerDiscovery(t *testing.T) {
+	network, configs := NewUnitTestNetwork()
+	bootstrap := network.Nodes[0]
+	servers := []*Server{}
+	for i, config := range configs {
+		nodes := make([]*Address, len(network.Nodes))
+		nodes[i] = network.Nodes[i]
+		limited := *network
+		limited.Nodes = nodes
+		config.Network = &limited
+		if i > 0 {
+			config.Bootstrap = []*Address{bootstrap}
+		}
+		s := NewServer(config)
+		s.PeerExchangeInterval = 100 * time.Millisecond
+		s.ServeInBackground()
+		servers = append(servers, s)
+	}
+	defer stopServers(servers)
+
+	for _, s := range servers {
+		for i := 0; s.linkCount() < len(servers)-1; i++ {
+			if i == 200 {
+				t.Fatalf("%s only linked to %d peers, and knows %d addresses",
+					s.keyPair.PublicKey(), s.linkCount(), len(s.PeerAddresses()))
+			}
+			time.Sleep(25 * time.Millisecond)
+		}
+		if len(s.PeerAddresses()) != len(servers)-1 {
+			t.Fatalf("expected to know where %d peers are", len(servers)-1)
+		}
+	}
+}
+
+func TestAdvertisedAddress(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	config := *configs[0]
+	config.Advertise = &Address{Host: "node0.example.com", Port: 9000}
+	s := NewServer(&config)
+	self := s.peerExchangeMessage().Peers[s.keyPair.PublicKey()]
+	if self.String() != "node0.example.com:9000" {
+		t.Fatalf("expected to advertise the configured address, but got %s", self)
+	}
+
+	// Our address in the network config may only work from this machine,
+	// so it isn't advertised
+	config.Advertise = nil
+	s = NewServer(&config)
+	self = s.peerExchangeMessage().Peers[s.keyPair.PublicKey()]
+	if self.Host != "" {
+		t.Fatalf("expected not to advertise a host, but got %s", self)
+	}
+
+	// Without any address for ourselves, peers have to use the host our
+	// connection comes from
+	network := *config.Network
+	network.Nodes = make([]*Address, len(network.Members))
+	config.Network = &network
+	config.Advertise = nil
+	s = NewServer(&config)
+	self = s.peerExchangeMessage().Peers[s.keyPair.PublicKey()]
+	if self.Host != "" || self.Port != config.Port {
+		t.Fatalf("expected to advertise only our port, but got %s", self)
+	}
+	peerConfig := *configs[1]
+	peerConfig.Network = &network
+	peer := NewServer(&peerConfig)
+	peer.handlePeerExchange(s.keyPair.PublicKey(), "10.0.0.5", s.peerExchangeMessage())
+	if got := peer.book.best(s.keyPair.PublicKey()); got == nil || got.Host != "10.0.0.5" {
+		t.Fatalf("the host should come from the connection, but got %v", got)
+	}
+}
@@ -0,0 +1,275 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"coinkit/util"
+)
+
+// The conditions we raise alerts for
+const (
+	// The node has been working on the same slot for too long
+	AlertStuckSlot = "stuck-slot"
+
+	// The node is not connected to enough of its quorum slice to make
+	// progress
+	AlertQuorumAtRisk = "quorum-at-risk"
+
+	// The node could not save history because its disk is full
+	AlertDiskFull = "disk-full"
+
+	// The node's clock is too far from the rest of the network's
+	AlertClockSkew = "clock-skew"
+
+	// The node's account state no longer matches the rest of the network's
+	AlertDivergence = "divergence"
+)
+
+// How long a node can spend on one slot before it counts as stuck, when the
+// config doesn't say
+const DefaultStuckSlotTimeout = time.Minute
+
+// Where PagerDuty sinks send events, when the config doesn't say
+const PagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// How many alerts can wait to be delivered before newer ones are dropped
+const alertQueueSize = 100
+
+// An Alert reports that a critical condition started, or that it resolved.
+type Alert struct {
+	// One of the Alert constants
+	Condition string
+
+	// The public key of the node with the problem
+	Node util.PublicKey
+
+	// A human-readable description
+	Message string
+
+	// Whether the condition has gone away
+	Resolved bool
+
+	Time time.Time
+}
+
+func (a *Alert) String() string {
+	if a.Resolved {
+		return fmt.Sprintf("resolved %s on %s: %s",
+			a.Condition, util.Shorten(string(a.Node)), a.Message)
+	}
+	return fmt.Sprintf("ALERT %s on %s: %s",
+		a.Condition, util.Shorten(string(a.Node)), a.Message)
+}
+
+// An AlertSink is somewhere alerts get sent, like a log or a paging service.
+type AlertSink interface {
+	SendAlert(ctx context.Context, a *Alert) error
+}
+
+// An AlertConfig sets up one sink for alerts.
+type AlertConfig struct {
+	// One of "stderr", "webhook", or "pagerduty"
+	Kind string
+
+	// Where webhook alerts are posted. For pagerduty this overrides
+	// PagerDutyEventsURL
+	URL string
+
+	// Used to sign webhook alerts, like transaction webhooks
+	Secret string
+
+	// The PagerDuty integration key
+	RoutingKey string
+}
+
+// NewAlertSink creates the sink described by a config.
+func NewAlertSink(config *AlertConfig) (AlertSink, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch config.Kind {
+	case "stderr":
+		return &stderrAlertSink{}, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("webhook alerts need a URL")
+		}
+		return &webhookAlertSink{
+			url:    config.URL,
+			secret: config.Secret,
+			client: client,
+		}, nil
+	case "pagerduty":
+		if config.RoutingKey == "" {
+			return nil, fmt.Errorf("pagerduty alerts need a routing key")
+		}
+		url := config.URL
+		if url == "" {
+			url = PagerDutyEventsURL
+		}
+		return &pagerDutyAlertSink{
+			url:        url,
+			routingKey: config.RoutingKey,
+			client:     client,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown kind of alert sink: %q", config.Kind)
+}
+
+type stderrAlertSink struct{}
+
+func (sink *stderrAlertSink) SendAlert(ctx context.Context, a *Alert) error {
+	log.Print(a)
+	return nil
+}
+
+// webhookAlertSink posts each alert as JSON, signed the same way as
+// transaction webhooks.
+type webhookAlertSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (sink *webhookAlertSink) SendAlert(ctx context.Context, a *Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, sink.client, sink.url, body, func(r *http.Request) {
+		r.Header.Set(WebhookSignatureHeader, SignWebhook(sink.secret, body))
+	})
+}
+
+// pagerDutyAlertSink sends alerts to the PagerDuty Events API. Each
+// condition on each node is one incident, which resolves with the condition.
+type pagerDutyAlertSink struct {
+	url        string
+	routingKey string
+	client     *http.Client
+}
+
+type pagerDutyPayload struct {
+	Summary  string `json:"summary"`
+	Source   string `json:"source"`
+	Severity string `json:"severity"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+func (sink *pagerDutyAlertSink) SendAlert(ctx context.Context, a *Alert) error {
+	event := &pagerDutyEvent{
+		RoutingKey:  sink.routingKey,
+		EventAction: "trigger",
+		DedupKey:    fmt.Sprintf("coinkit-%s-%s", a.Node, a.Condition),
+	}
+	if a.Resolved {
+		event.EventAction = "resolve"
+	} else {
+		event.Payload = &pagerDutyPayload{
+			Summary:  fmt.Sprintf("%s: %s", a.Condition, a.Message),
+			Source:   string(a.Node),
+			Severity: "critical",
+		}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, sink.client, sink.url, body, nil)
+}
+
+// alerter tracks which conditions are active and sends alerts to every sink
+// when one starts or stops, in the background.
+type alerter struct {
+	node  util.PublicKey
+	sinks []AlertSink
+	queue chan *Alert
+
+	// The conditions that are currently raised. Protected by mutex
+	active map[string]bool
+	mutex  sync.Mutex
+}
+
+func newAlerter(node util.PublicKey, sinks []AlertSink) *alerter {
+	return &alerter{
+		node:   node,
+		sinks:  sinks,
+		queue:  make(chan *Alert, alertQueueSize),
+		active: make(map[string]bool),
+	}
+}
+
+// update returns an alert if a condition is changing state, or nil if it
+// already was in that state.
+func (a *alerter) update(condition string, raised bool, message string) *Alert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.active[condition] == raised {
+		return nil
+	}
+	a.active[condition] = raised
+	return &Alert{
+		Condition: condition,
+		Node:      a.node,
+		Message:   message,
+		Resolved:  !raised,
+		Time:      time.Now(),
+	}
+}
+
+// set raises or resolves a condition. Nothing is sent when the condition is
+// already in that state, so this can be called every time it is checked.
+func (a *alerter) set(condition string, raised bool, message string) {
+	alert := a.update(condition, raised, message)
+	if alert == nil {
+		return
+	}
+	select {
+	case a.queue <- alert:
+	default:
+		log.Printf("alert queue is full, dropping: %s", alert)
+	}
+}
+
+// raiseNow raises a condition and waits for the alert to be sent. It is for
+// problems that are about to stop the node.
+func (a *alerter) raiseNow(condition string, message string, timeout time.Duration) {
+	alert := a.update(condition, true, message)
+	if alert == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	a.send(ctx, alert)
+}
+
+func (a *alerter) send(ctx context.Context, alert *Alert) {
+	for _, sink := range a.sinks {
+		if err := sink.SendAlert(ctx, alert); err != nil {
+			log.Printf("could not send alert %s: %s", alert, err)
+		}
+	}
+}
+
+// deliverForever sends queued alerts, in order. It should be run in its own
+// goroutine.
+func (a *alerter) deliverForever(ctx context.Context) {
+	for {
+		select {
+		case alert := <-a.queue:
+			a.send(ctx, alert)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
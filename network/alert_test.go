@@ -0,0 +1,166 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+)
+
+// Records every request body it gets
+func recordingServer() (*httptest.Server, chan *http.Request, chan []byte) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			requests <- r
+			bodies <- body
+		}))
+	return server, requests, bodies
+}
+
+func TestWebhookAlertSink(t *testing.T) {
+	server, requests, bodies := recordingServer()
+	defer server.Close()
+
+	sink, err := NewAlertSink(&AlertConfig{
+		Kind:   "webhook",
+		URL:    server.URL,
+		Secret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.SendAlert(context.Background(), &Alert{
+		Condition: AlertStuckSlot,
+		Node:      "node0",
+		Message:   "slot 7 has taken 90s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, body := <-requests, <-bodies
+	if r.Header.Get(WebhookSignatureHeader) != SignWebhook("secret", body) {
+		t.Fatal("bad signature")
+	}
+	alert := &Alert{}
+	if err := json.Unmarshal(body, alert); err != nil {
+		t.Fatal(err)
+	}
+	if alert.Condition != AlertStuckSlot || alert.Node != "node0" {
+		t.Fatalf("bad alert: %s", alert)
+	}
+}
+
+func TestPagerDutyAlertSink(t *testing.T) {
+	server, _, bodies := recordingServer()
+	defer server.Close()
+
+	sink, err := NewAlertSink(&AlertConfig{
+		Kind:       "pagerduty",
+		URL:        server.URL,
+		RoutingKey: "key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []*pagerDutyEvent{}
+	for _, resolved := range []bool{false, true} {
+		err = sink.SendAlert(context.Background(), &Alert{
+			Condition: AlertQuorumAtRisk,
+			Node:      "node0",
+			Message:   "only connected to 1 peers",
+			Resolved:  resolved,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := &pagerDutyEvent{}
+		if err := json.Unmarshal(<-bodies, event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if events[0].EventAction != "trigger" || events[0].Payload == nil ||
+		events[0].RoutingKey != "key" {
+		t.Fatalf("bad trigger: %+v", events[0])
+	}
+	if events[1].EventAction != "resolve" || events[1].DedupKey != events[0].DedupKey {
+		t.Fatalf("the resolve should match the trigger: %+v", events[1])
+	}
+}
+
+type fakeAlertSink struct {
+	alerts chan *Alert
+}
+
+func (sink *fakeAlertSink) SendAlert(ctx context.Context, a *Alert) error {
+	sink.alerts <- a
+	return nil
+}
+
+func TestDivergenceAlert(t *testing.T) {
+	qs, names := consensus.MakeTestQuorumSlice(1)
+	sink := &fakeAlertSink{alerts: make(chan *Alert, 10)}
+	s := &Server{
+		node:   NewNode(names[0], qs),
+		alerts: newAlerter(names[0], []AlertSink{sink}),
+	}
+	if err := s.unsafeCheckDivergence(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.node.queue.AddMigration(&currency.Migration{
+		Name:   "broken",
+		Slot:   1,
+		Before: "not the hash",
+		Apply:  func(accounts *currency.AccountMap) {},
+	})
+	if err := s.unsafeCheckDivergence(); err == nil {
+		t.Fatal("the server should notice that it diverged")
+	}
+	select {
+	case alert := <-sink.alerts:
+		if alert.Condition != AlertDivergence || alert.Resolved {
+			t.Fatalf("unexpected alert: %s", alert)
+		}
+	default:
+		t.Fatal("the alert should be sent before the server stops")
+	}
+}
+
+func TestAlerterOnlySendsChanges(t *testing.T) {
+	sink := &fakeAlertSink{alerts: make(chan *Alert, 10)}
+	a := newAlerter("node0", []AlertSink{sink})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.deliverForever(ctx)
+
+	a.set(AlertStuckSlot, false, "working on slot 1")
+	a.set(AlertStuckSlot, true, "slot 1 has taken 61s")
+	a.set(AlertStuckSlot, true, "slot 1 has taken 62s")
+	a.set(AlertStuckSlot, false, "working on slot 2")
+
+	for _, resolved := range []bool{false, true} {
+		select {
+		case alert := <-sink.alerts:
+			if alert.Resolved != resolved {
+				t.Fatalf("unexpected alert: %s", alert)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the alert was never sent")
+		}
+	}
+	select {
+	case alert := <-sink.alerts:
+		t.Fatalf("unexpected alert: %s", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
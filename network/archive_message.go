@@ -0,0 +1,72 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// The most slots of history an archive sends in response to one request
+const MaxHistoryRange = 100
+
+// A HistoryRequestMessage asks an archive node for a range of finalized
+// history, or for a snapshot of every account.
+
+type HistoryRequestMessage struct {
+	// The first and last slots of history wanted, inclusive
+	First int
+	Last  int
+
+	// When Snapshot is set, this requests an AccountMessage with the state of
+	// every account instead of history
+	Snapshot bool
+
+	// When Diffs is set, the history is sent with state diffs rather than
+	// chunks wherever the archive has them
+	Diffs bool `json:",omitempty"`
+}
+
+func (m *HistoryRequestMessage) Slot() int {
+	return 0
+}
+
+func (m *HistoryRequestMessage) MessageType() string {
+	return "Q"
+}
+
+func (m *HistoryRequestMessage) String() string {
+	if m.Snapshot {
+		return "historyrequest snapshot"
+	}
+	return fmt.Sprintf("historyrequest %d-%d", m.First, m.Last)
+}
+
+// A HistoryRangeMessage is an archive's response to a HistoryRequestMessage.
+// It contains history for consecutive slots, starting at the first slot
+// requested. It may stop early, if the range was too long or the archive
+// doesn't have that much history yet.
+
+type HistoryRangeMessage struct {
+	History []*HistoryMessage
+}
+
+func (m *HistoryRangeMessage) Slot() int {
+	return 0
+}
+
+func (m *HistoryRangeMessage) MessageType() string {
+	return "R"
+}
+
+func (m *HistoryRangeMessage) String() string {
+	if len(m.History) == 0 {
+		return "historyrange empty"
+	}
+	return fmt.Sprintf("historyrange %d-%d",
+		m.History[0].I, m.History[len(m.History)-1].I)
+}
+
+func init() {
+	util.RegisterMessageType(&HistoryRequestMessage{})
+	util.RegisterMessageType(&HistoryRangeMessage{})
+}
@@ -0,0 +1,102 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"coinkit/util"
+)
+
+// A BatchMessage holds several messages from the same node, so that they
+// share one signature and one frame. Whenever a node broadcasts, everything
+// that changed goes out in a single batch.
+// Each message in a batch is handled as if it had come on its own.
+type BatchMessage struct {
+	Messages []util.Message
+
+	// When we send a batch of messages that are already encoded, this is
+	// what they encode to, and Messages is empty
+	encoded []string
+}
+
+// newEncodedBatch makes a batch to send out of messages that are already
+// encoded.
+func newEncodedBatch(encoded []string) *BatchMessage {
+	return &BatchMessage{encoded: encoded}
+}
+
+var errNestedBatch = errors.New("a batch can't hold another batch")
+
+func (m *BatchMessage) Slot() int {
+	return 0
+}
+
+func (m *BatchMessage) MessageType() string {
+	return "Z"
+}
+
+func (m *BatchMessage) String() string {
+	if m.encoded != nil {
+		return fmt.Sprintf("batch of %d messages", len(m.encoded))
+	}
+	parts := []string{}
+	for _, inner := range m.Messages {
+		parts = append(parts, inner.String())
+	}
+	return fmt.Sprintf("batch [%s]", strings.Join(parts, ", "))
+}
+
+// The messages in a batch are encoded the same way they would be on their
+// own, so they keep their types.
+type encodedBatch struct {
+	Messages []json.RawMessage
+}
+
+func (m *BatchMessage) MarshalJSON() ([]byte, error) {
+	encoded := encodedBatch{Messages: []json.RawMessage{}}
+	for _, inner := range m.encoded {
+		encoded.Messages = append(encoded.Messages, json.RawMessage(inner))
+	}
+	for _, inner := range m.Messages {
+		encoded.Messages = append(encoded.Messages, json.RawMessage(util.EncodeMessage(inner)))
+	}
+	return json.Marshal(encoded)
+}
+
+func (m *BatchMessage) UnmarshalJSON(bytes []byte) error {
+	var encoded encodedBatch
+	if err := json.Unmarshal(bytes, &encoded); err != nil {
+		return err
+	}
+	m.Messages = []util.Message{}
+	for _, raw := range encoded.Messages {
+		inner, err := util.DecodeMessage(string(raw))
+		if err != nil {
+			return err
+		}
+		if _, ok := inner.(*BatchMessage); ok {
+			return errNestedBatch
+		}
+		m.Messages = append(m.Messages, inner)
+	}
+	return nil
+}
+
+// batchOf wraps messages in a batch. A single message doesn't need a batch,
+// and no messages at all is nil.
+func batchOf(messages []util.Message) util.Message {
+	switch len(messages) {
+	case 0:
+		return nil
+	case 1:
+		return messages[0]
+	default:
+		return &BatchMessage{Messages: messages}
+	}
+}
+
+func init() {
+	util.RegisterMessageType(&BatchMessage{})
+}
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A BlockHeaderMessage sums up a finalized slot in a few hashes, so that
+// light observers can follow the chain without the externalize messages and
+// chunks. Every node that finalized the same history makes the same header,
+// apart from its certificate.
+// A BlockHeaderMessage with no Value asks for our header of slot I, or for
+// our latest one if I is zero.
+type BlockHeaderMessage struct {
+	I int
+
+	// The hash of the header for slot I-1. Empty for slot 1, or if we
+	// don't know it
+	Prev string `json:",omitempty"`
+
+	// The hash of the value finalized in slot I
+	Value string `json:",omitempty"`
+
+	// The state root of every account as of the end of slot I
+	State string `json:",omitempty"`
+
+	// The hash of the externalize message we finalized slot I with. It
+	// holds our own quorum slice, so it is not part of the header's hash
+	Cert string `json:",omitempty"`
+}
+
+func (m *BlockHeaderMessage) Slot() int {
+	return m.I
+}
+
+// Every single letter is taken
+func (m *BlockHeaderMessage) MessageType() string {
+	return "BH"
+}
+
+func (m *BlockHeaderMessage) String() string {
+	if m.Value == "" {
+		return fmt.Sprintf("header i=%d request", m.I)
+	}
+	return fmt.Sprintf("header i=%d value=%s state=%s",
+		m.I, util.Shorten(m.Value), util.Shorten(m.State))
+}
+
+// Hash is what the header for the next slot refers to as Prev.
+func (m *BlockHeaderMessage) Hash() string {
+	return consensus.HashString(fmt.Sprintf("%d\n%s\n%s\n%s", m.I, m.Prev, m.Value, m.State))
+}
+
+func init() {
+	util.RegisterMessageType(&BlockHeaderMessage{})
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/registry"
+	"coinkit/util"
+)
+
+// A CheckpointMessage is the state of a node as of the end of a slot. A node
+// that compacts its saved history replaces everything up to that slot with a
+// checkpoint, and restarts from the checkpoint instead of the first slot.
+type CheckpointMessage struct {
+	// The last slot that is included
+	I int
+
+	// How slot I was finalized
+	E *consensus.ExternalizeMessage
+
+	// The ledger as of the start of slot I+1
+	State *currency.LedgerState
+
+	// The consensus hash chain as of slot I
+	Hash string `json:",omitempty"`
+
+	// Our latest consensus digest as of slot I, which the next one refers to
+	Digest *consensus.DigestMessage `json:",omitempty"`
+
+	// The hash of our block header for slot I
+	Header string `json:",omitempty"`
+
+	// The validator metadata in the registry as of slot I
+	Registry []*registry.SignedMetadata `json:",omitempty"`
+}
+
+func (m *CheckpointMessage) Slot() int {
+	return m.I
+}
+
+func (m *CheckpointMessage) MessageType() string {
+	return "K"
+}
+
+func (m *CheckpointMessage) String() string {
+	accounts := 0
+	if m.State != nil {
+		accounts = len(m.State.Accounts)
+	}
+	return fmt.Sprintf("checkpoint i=%d with %d accounts: %s", m.I, accounts, m.E)
+}
+
+func init() {
+	util.RegisterMessageType(&CheckpointMessage{})
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A ChunkRequestMessage asks peers for the data behind a slot that has
+// externalized. A node sends one when it knows how a slot was decided but
+// its value store can't finalize the value, because it never got the
+// chunks behind it. Peers that have finalized the slot respond with a
+// HistoryMessage.
+
+type ChunkRequestMessage struct {
+	// The slot we are stuck on
+	I int
+
+	// The value it externalized, so that peers don't send us data for a
+	// different value
+	X consensus.SlotValue
+}
+
+func (m *ChunkRequestMessage) Slot() int {
+	return 0
+}
+
+func (m *ChunkRequestMessage) MessageType() string {
+	return "B"
+}
+
+func (m *ChunkRequestMessage) String() string {
+	return fmt.Sprintf("chunkrequest i=%d x=%s", m.I, util.Shorten(string(m.X)))
+}
+
+func init() {
+	util.RegisterMessageType(&ChunkRequestMessage{})
+}
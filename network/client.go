@@ -1,15 +1,22 @@
 package network
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"time"
 
 	"coinkit/currency"
+	"coinkit/registry"
 	"coinkit/util"
 )
 
+var ErrClientClosed = errors.New("client is closed")
+var ErrNoResponse = errors.New("server sent no response")
+
 // A Client is a network connection established to a Server.
 // It will keep redialing even after disconnects.
 type Client struct {
@@ -18,6 +25,11 @@ type Client struct {
 	queue     chan *Request
 	connected bool
 
+	// How many slots must be finalized after the one that included a
+	// transaction before WaitToClear treats it as final. Zero means a
+	// transaction is final as soon as its slot is.
+	FinalityDepth int
+
 	// We set closing to true and close the quit channel when the
 	// client is closing
 	closing bool
@@ -73,9 +85,13 @@ func (c *Client) sendForever() {
 		if request.Timeout == 0 {
 			log.Fatalf("you should use a timeout with clients")
 		}
-		line := request.GetLine()
-		if len(line) == 0 {
-			log.Fatalf("cannot send line: [%s]", line)
+		if request.Context != nil && request.Context.Err() != nil {
+			// Nobody is waiting on this request any more
+			continue
+		}
+		frame := request.GetFrame()
+		if len(frame) == 0 {
+			log.Fatalf("cannot send an empty frame")
 		}
 
 		for {
@@ -83,11 +99,11 @@ func (c *Client) sendForever() {
 			if c.closing {
 				return
 			}
-			fmt.Fprintf(c.conn, line)
+			io.WriteString(c.conn, frame)
 
 			// If we get an ok, great.
 			// If we don't get an ok, disconnect and try again.
-			c.conn.SetReadDeadline(time.Now().Add(request.Timeout))
+			c.conn.SetReadDeadline(request.Deadline())
 			response, err := util.ReadSignedMessage(c.conn)
 
 			if c.closing {
@@ -97,11 +113,19 @@ func (c *Client) sendForever() {
 			if err != nil {
 				log.Printf("bad response from %s: %+v", c.address.String(), err)
 				c.disconnect()
+				if request.Context != nil && request.Context.Err() != nil {
+					break
+				}
 				continue
 			}
 
 			if request.Response != nil {
-				request.Response <- response
+				select {
+				case request.Response <- response:
+				case <-request.Done():
+				case <-c.quit:
+					return
+				}
 			}
 
 			break
@@ -129,6 +153,8 @@ func (c *Client) Send(r *Request) {
 			return
 		case <-c.quit:
 			return
+		case <-r.Done():
+			return
 		default:
 			// The queue filled up
 		}
@@ -139,6 +165,8 @@ func (c *Client) Send(r *Request) {
 			log.Printf("send queue overloaded, dropping message")
 		case <-c.quit:
 			return
+		case <-r.Done():
+			return
 		default:
 			// There must be some racing. Wait a bit and try again
 			time.Sleep(time.Millisecond)
@@ -147,18 +175,25 @@ func (c *Client) Send(r *Request) {
 }
 
 // Sends a signed message and waits for the response.
-func (c *Client) SendMessage(message *util.SignedMessage) *util.SignedMessage {
+// Gives up when the context is done.
+func (c *Client) SendMessage(
+	ctx context.Context, message *util.SignedMessage) (*util.SignedMessage, error) {
 	response := make(chan *util.SignedMessage)
 	request := &Request{
 		Message:  message,
 		Response: response,
 		Timeout:  5 * time.Second,
+		Context:  ctx,
 	}
-	// Wait on a response.
-	// This hangs on network failure
 	c.Send(request)
-	sm := <-response
-	return sm
+	select {
+	case sm := <-response:
+		return sm, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.quit:
+		return nil, ErrClientClosed
+	}
 }
 
 // NewClient connects to the Server at the given address.
@@ -175,31 +210,248 @@ func NewClient(address *Address) *Client {
 	return p
 }
 
-func (c *Client) SendInfoMessage(message *util.InfoMessage) util.Message {
+func (c *Client) SendInfoMessage(
+	ctx context.Context, message *util.InfoMessage) (util.Message, error) {
 	// We can use an anonymous key with info messages
 	kp := util.NewKeyPair()
 	sm := util.NewSignedMessage(kp, message)
-	response := c.SendMessage(sm)
-	if response == nil {
-		log.Fatal("got nil account message")
+	for {
+		response, err := c.SendMessage(ctx, sm)
+		if err != nil {
+			return nil, err
+		}
+		if response == nil {
+			return nil, ErrNoResponse
+		}
+		e, ok := response.Message().(*util.ErrorMessage)
+		if !ok || e.RetryAfter == 0 {
+			return response.Message(), nil
+		}
+
+		// We are over our quota, so wait before asking again
+		log.Printf("got %s", e)
+		select {
+		case <-time.After(e.RetryAfter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	return response.Message()
 }
 
-// WaitToClear waits for the transaction with this sequence number to clear.
-func (c *Client) WaitToClear(user string, sequence uint32) *currency.Account {
+// WaitToClear waits for the transaction with this sequence number to clear,
+// and then for FinalityDepth more slots to be finalized.
+func (c *Client) WaitToClear(
+	ctx context.Context, user util.PublicKey, sequence uint32) (*currency.Account, error) {
 	for {
-		m := c.SendInfoMessage(&util.InfoMessage{Account: user})
-		account := m.(*currency.AccountMessage).State[user]
-		if account.Sequence >= sequence {
-			return account
+		m, err := c.SendInfoMessage(ctx, &util.InfoMessage{
+			Account:  user,
+			Sequence: sequence,
+		})
+		if err != nil {
+			return nil, err
+		}
+		am := m.(*currency.AccountMessage)
+		account := am.State[user]
+		if account != nil && account.Sequence >= sequence &&
+			(c.FinalityDepth == 0 || am.Depth() >= c.FinalityDepth) {
+			return account, nil
 		}
 		log.Printf("waiting for slot %d", m.Slot())
-		c.SendInfoMessage(&util.InfoMessage{I: m.Slot()})
+		_, err = c.SendInfoMessage(ctx, &util.InfoMessage{I: m.Slot()})
+		if err != nil {
+			return nil, err
+		}
 	}
 }
 
-func (c *Client) GetAccount(user string) *currency.Account {
-	m := c.SendInfoMessage(&util.InfoMessage{Account: user}).(*currency.AccountMessage)
-	return m.State[user]
+// GetDepth returns how many slots have been finalized after the one that
+// included the transaction from user with this sequence number, or -1 if it
+// hasn't been finalized yet.
+func (c *Client) GetDepth(
+	ctx context.Context, user util.PublicKey, sequence uint32) (int, error) {
+	m, err := c.SendInfoMessage(ctx, &util.InfoMessage{
+		Account:  user,
+		Sequence: sequence,
+	})
+	if err != nil {
+		return 0, err
+	}
+	am, ok := m.(*currency.AccountMessage)
+	if !ok {
+		return 0, fmt.Errorf("expected account data but got %s", m)
+	}
+	return am.Depth(), nil
+}
+
+func (c *Client) GetAccount(ctx context.Context, user util.PublicKey) (*currency.Account, error) {
+	m, err := c.SendInfoMessage(ctx, &util.InfoMessage{Account: user})
+	if err != nil {
+		return nil, err
+	}
+	return m.(*currency.AccountMessage).State[user], nil
+}
+
+// GetAccountAt returns the state of an account as of the end of a past slot.
+// Most nodes only keep recent history, so this is typically sent to an
+// archive. A nil account means the account did not exist at that slot.
+func (c *Client) GetAccountAt(
+	ctx context.Context, user util.PublicKey, slot int) (*currency.Account, error) {
+	m, err := c.SendInfoMessage(ctx, &util.InfoMessage{Account: user, At: slot})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := m.(*util.ErrorMessage); ok {
+		return nil, errors.New(e.Error)
+	}
+	return m.(*currency.AccountMessage).State[user], nil
+}
+
+// GetValidators returns the metadata that validators have published in the
+// registry, sorted by validator.
+func (c *Client) GetValidators(ctx context.Context) ([]*registry.SignedMetadata, error) {
+	m, err := c.SendInfoMessage(ctx, &util.InfoMessage{Registry: true})
+	if err != nil {
+		return nil, err
+	}
+	rm, ok := m.(*registry.RegistryMessage)
+	if !ok {
+		return nil, fmt.Errorf("expected the registry but got %s", m)
+	}
+	return rm.Entries, nil
+}
+
+// GetStatus asks the node we are connected to how it is doing.
+// kp must be an admin on the node.
+func (c *Client) GetStatus(ctx context.Context, kp *util.KeyPair) (*StatusMessage, error) {
+	return c.sendForStatus(ctx, kp, &util.InfoMessage{Status: true})
+}
+
+// Pause asks the node to stop taking part in consensus, for maintenance.
+// It finishes the slot it is on first. kp must be an admin on the node.
+func (c *Client) Pause(ctx context.Context, kp *util.KeyPair) (*StatusMessage, error) {
+	return c.sendForStatus(ctx, kp, &PauseMessage{})
+}
+
+// Resume asks a paused node to take part in consensus again.
+func (c *Client) Resume(ctx context.Context, kp *util.KeyPair) (*StatusMessage, error) {
+	return c.sendForStatus(ctx, kp, &PauseMessage{Resume: true})
+}
+
+// sendForStatus sends an admin message that the node answers with its status.
+func (c *Client) sendForStatus(
+	ctx context.Context, kp *util.KeyPair, m util.Message) (*StatusMessage, error) {
+	response, err := c.SendMessage(ctx, util.NewSignedMessage(kp, m))
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, ErrNoResponse
+	}
+	switch m := response.Message().(type) {
+	case *StatusMessage:
+		return m, nil
+	case *util.ErrorMessage:
+		return nil, errors.New(m.Error)
+	default:
+		return nil, fmt.Errorf("expected a status but got %s", m)
+	}
+}
+
+// GetServerMetrics asks the node for everything its server keeps track of:
+// the recent metrics samples, the messages it could not decode, and its
+// peers. kp must be an admin on the node.
+func (c *Client) GetServerMetrics(ctx context.Context, kp *util.KeyPair) (*MetricsMessage, error) {
+	response, err := c.SendMessage(ctx, util.NewSignedMessage(kp, &MetricsMessage{}))
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, ErrNoResponse
+	}
+	switch m := response.Message().(type) {
+	case *MetricsMessage:
+		return m, nil
+	case *util.ErrorMessage:
+		return nil, errors.New(m.Error)
+	default:
+		return nil, fmt.Errorf("expected metrics but got %s", m)
+	}
+}
+
+// GetMetrics asks the node for its recent metrics samples, oldest first.
+// kp must be an admin on the node.
+func (c *Client) GetMetrics(ctx context.Context, kp *util.KeyPair) ([]*MetricsSample, error) {
+	m, err := c.GetServerMetrics(ctx, kp)
+	if err != nil {
+		return nil, err
+	}
+	return m.Samples, nil
+}
+
+// GetDeadLetters asks the node for the most recent messages it could not
+// decode, oldest first, and how many it has ever failed to decode.
+// kp must be an admin on the node.
+func (c *Client) GetDeadLetters(ctx context.Context, kp *util.KeyPair) ([]*DeadLetter, int, error) {
+	m, err := c.GetServerMetrics(ctx, kp)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m.DeadLetters, m.Undecodable, nil
+}
+
+// PublishMetadata sends a validator's metadata to the registry, signed with
+// its key pair. It does not wait for the metadata to be finalized.
+func (c *Client) PublishMetadata(
+	ctx context.Context, kp *util.KeyPair, metadata *registry.Metadata) error {
+	m := &registry.RegistryMessage{
+		Entries: []*registry.SignedMetadata{metadata.SignWith(kp)},
+	}
+	response, err := c.SendMessage(ctx, util.NewSignedMessage(kp, m))
+	if err != nil {
+		return err
+	}
+	if response != nil {
+		if e, ok := response.Message().(*util.ErrorMessage); ok {
+			return errors.New(e.Error)
+		}
+	}
+	return nil
+}
+
+// GetStatement builds a statement of an account's activity from slot first
+// through slot last, inclusive, from the history kept by an archive.
+// It stops early if the archive doesn't have that much history yet.
+func (c *Client) GetStatement(
+	ctx context.Context, user util.PublicKey, first int, last int) (*currency.Statement, error) {
+	statement := currency.NewStatement(user)
+	kp := util.NewKeyPair()
+	for slot := first; slot <= last; {
+		request := &HistoryRequestMessage{First: slot, Last: last}
+		response, err := c.SendMessage(ctx, util.NewSignedMessage(kp, request))
+		if err != nil {
+			return nil, err
+		}
+		if response == nil {
+			return nil, ErrNoResponse
+		}
+		switch m := response.Message().(type) {
+		case *HistoryRangeMessage:
+			if len(m.History) == 0 {
+				return statement, nil
+			}
+			for _, h := range m.History {
+				if h.T != nil {
+					for _, chunk := range h.T.Chunks {
+						statement.Add(h.I, chunk)
+					}
+				}
+			}
+			slot += len(m.History)
+		case *util.ErrorMessage:
+			return nil, errors.New(m.Error)
+		default:
+			return nil, fmt.Errorf("expected history but got %s", m)
+		}
+	}
+	return statement, nil
 }
@@ -0,0 +1,207 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"coinkit/util"
+)
+
+// Nodes can't agree on anything if their clocks disagree by much, so each
+// server estimates how far its clock is from each peer's, from the pings
+// they exchange. The estimate for a peer is the one from the ping with the
+// fastest round trip, like NTP does, since slow round trips are the least
+// accurate. The estimate for the network is the median over peers, so a few
+// peers with bad clocks don't skew it.
+
+// How often we ping each peer
+const PingInterval = 10 * time.Second
+
+// When our clock is further than this from the network's, we warn
+const MaxClockSkew = 2 * time.Second
+
+// How many recent pings we keep for each peer
+const clockSamples = 8
+
+// A clockSample is what one ping said about a peer's clock.
+type clockSample struct {
+	// How far ahead of our clock the peer's clock is
+	offset time.Duration
+
+	// How long the ping took to go there and back
+	rtt time.Duration
+}
+
+// clockTracker keeps the recent samples for each peer.
+// clockTracker is threadsafe.
+type clockTracker struct {
+	mutex   sync.Mutex
+	samples map[util.PublicKey][]clockSample
+}
+
+func newClockTracker() *clockTracker {
+	return &clockTracker{
+		samples: make(map[util.PublicKey][]clockSample),
+	}
+}
+
+// add records the answer to a ping. sent and received are when the ping
+// left and when its answer came back, on our clock, and peerTime is when the
+// peer answered, on its clock.
+func (c *clockTracker) add(peer util.PublicKey, sent time.Time, peerTime time.Time,
+	received time.Time) {
+	rtt := received.Sub(sent)
+	if rtt < 0 {
+		return
+	}
+	sample := clockSample{
+		offset: peerTime.Sub(sent.Add(rtt / 2)),
+		rtt:    rtt,
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	samples := append(c.samples[peer], sample)
+	if len(samples) > clockSamples {
+		samples = samples[1:]
+	}
+	c.samples[peer] = samples
+}
+
+func (c *clockTracker) peerSkew(peer util.PublicKey) (time.Duration, bool) {
+	samples := c.samples[peer]
+	if len(samples) == 0 {
+		return 0, false
+	}
+	best := samples[0]
+	for _, sample := range samples[1:] {
+		if sample.rtt < best.rtt {
+			best = sample
+		}
+	}
+	return best.offset, true
+}
+
+// PeerSkew returns how far ahead of our clock a peer's clock is, and false
+// if we haven't heard back from any pings to it yet.
+func (c *clockTracker) PeerSkew(peer util.PublicKey) (time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.peerSkew(peer)
+}
+
+// Skew returns how far ahead of our clock the network's clocks are, and false
+// if we haven't heard back from any pings yet.
+func (c *clockTracker) Skew() (time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	skews := []time.Duration{}
+	for peer := range c.samples {
+		if skew, ok := c.peerSkew(peer); ok {
+			skews = append(skews, skew)
+		}
+	}
+	if len(skews) == 0 {
+		return 0, false
+	}
+	sort.Slice(skews, func(i, j int) bool { return skews[i] < skews[j] })
+	middle := len(skews) / 2
+	if len(skews)%2 == 1 {
+		return skews[middle], true
+	}
+	return (skews[middle-1] + skews[middle]) / 2, true
+}
+
+// ClockSkew returns how far ahead of our clock the network's clocks are,
+// going by the pings we have exchanged with our peers. It is zero until we
+// hear back from a peer.
+func (s *Server) ClockSkew() time.Duration {
+	skew, _ := s.clocks.Skew()
+	return skew
+}
+
+// PeerClockSkew returns how far ahead of our clock a peer's clock is, and
+// false if we haven't heard back from it yet.
+func (s *Server) PeerClockSkew(publicKey util.PublicKey) (time.Duration, bool) {
+	return s.clocks.PeerSkew(publicKey)
+}
+
+// NetworkTime is the time according to the network rather than our own
+// clock. Anything that checks whether a message from a peer has expired
+// should use it, so that our clock being off doesn't make us reject
+// messages that the rest of the network accepts.
+func (s *Server) NetworkTime() time.Time {
+	return time.Now().Add(s.ClockSkew())
+}
+
+// pingForever pings a peer every PingInterval until the link is closed.
+// It should be run in its own goroutine.
+func (s *Server) pingForever(link *peerLink) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	for {
+		m := &PingMessage{Time: time.Now().UnixNano()}
+		link.sentPing(m.Time)
+		s.sendPing(link, m)
+		select {
+		case <-link.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) sendPing(link *peerLink, m *PingMessage) {
+	sm := util.NewSignedMessage(s.keyPair, m)
+	s.linkMutex.Lock()
+	limit := s.linkLimit(link.publicKey)
+	s.linkMutex.Unlock()
+	link.send(util.SignedMessageToFrame(sm), limit)
+}
+
+// handlePing answers a ping from a peer, or records the answer to ours.
+// Answers to pings we didn't send, or already got an answer to, are ignored,
+// so a peer can't make up round trips.
+func (s *Server) handlePing(link *peerLink, m *PingMessage) {
+	now := time.Now()
+	if m.Echo == 0 {
+		s.sendPing(link, &PingMessage{Time: now.UnixNano(), Echo: m.Time})
+		return
+	}
+	if !link.answeredPing(m.Echo) {
+		return
+	}
+	s.clocks.add(link.publicKey, time.Unix(0, m.Echo), time.Unix(0, m.Time), now)
+}
+
+// describeSkew says how far our clock is from the network's, in words.
+func describeSkew(skew time.Duration) string {
+	if skew < 0 {
+		return fmt.Sprintf("our clock is %s ahead of the network's", -skew)
+	}
+	return fmt.Sprintf("our clock is %s behind the network's", skew)
+}
+
+// unsafeCheckClock warns when our clock is too far from the network's. It is
+// called on every tick, but only logs when the clock goes out of or back
+// into line.
+func (s *Server) unsafeCheckClock() {
+	skew, ok := s.clocks.Skew()
+	if !ok {
+		return
+	}
+	off := skew > MaxClockSkew || skew < -MaxClockSkew
+	if off != s.clockOff {
+		s.clockOff = off
+		if off {
+			log.Printf("%s, check that it is synced", describeSkew(skew))
+		} else {
+			log.Printf("%s, which is close enough", describeSkew(skew))
+		}
+	}
+	if s.alerts != nil {
+		s.alerts.set(AlertClockSkew, off, describeSkew(skew))
+	}
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"coinkit/util"
+)
+
+func TestClockTrackerPrefersFastPings(t *testing.T) {
+	c := newClockTracker()
+	if _, ok := c.Skew(); ok {
+		t.Fatal("there should be no skew before any pings")
+	}
+	start := time.Now()
+
+	// A slow ping makes it look like bob is 1s ahead
+	c.add("bob", start, start.Add(2*time.Second), start.Add(2*time.Second))
+
+	// A fast one shows he is really 3s ahead
+	c.add("bob", start, start.Add(3*time.Second+5*time.Millisecond),
+		start.Add(10*time.Millisecond))
+	skew, ok := c.PeerSkew("bob")
+	if !ok || skew != 3*time.Second {
+		t.Fatalf("expected bob to be 3s ahead but got %s", skew)
+	}
+
+	// Old pings are forgotten
+	for i := 0; i < clockSamples; i++ {
+		c.add("bob", start, start.Add(time.Second+50*time.Millisecond),
+			start.Add(100*time.Millisecond))
+	}
+	skew, _ = c.PeerSkew("bob")
+	if skew != time.Second {
+		t.Fatalf("expected bob to be 1s ahead but got %s", skew)
+	}
+}
+
+func TestClockTrackerMedian(t *testing.T) {
+	c := newClockTracker()
+	start := time.Now()
+	for i, peer := range []util.PublicKey{"a", "b", "c", "d"} {
+		offset := time.Duration(i) * time.Second
+		if peer == "d" {
+			// One peer with a very wrong clock shouldn't matter
+			offset = time.Hour
+		}
+		c.add(peer, start, start.Add(offset), start)
+	}
+	skew, ok := c.Skew()
+	if !ok || skew != 1500*time.Millisecond {
+		t.Fatalf("expected a skew of 1.5s but got %s", skew)
+	}
+}
+
+func TestIgnoreUnexpectedEchoes(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	s := NewServer(configs[0])
+	peer := configs[1].KeyPair.PublicKey()
+	link := newPeerLink(peer, nil)
+	start := time.Now().Add(-time.Millisecond).UnixNano()
+
+	// An echo of a ping we never sent tells us nothing
+	s.handlePing(link, &PingMessage{Time: time.Now().UnixNano(), Echo: start})
+	if _, ok := s.PeerClockSkew(peer); ok {
+		t.Fatal("an echo we didn't ask for should be ignored")
+	}
+
+	link.sentPing(start)
+	s.handlePing(link, &PingMessage{Time: time.Now().UnixNano(), Echo: start})
+	if _, ok := s.PeerClockSkew(peer); !ok {
+		t.Fatal("the answer to our ping should be recorded")
+	}
+	if link.answeredPing(start) {
+		t.Fatal("each ping should only be answered once")
+	}
+}
+
+func TestServersPingEachOther(t *testing.T) {
+	servers := makeServers()
+	defer stopServers(servers)
+
+	for i := 0; i < 100; i++ {
+		measured := true
+		for _, s := range servers {
+			for _, peer := range servers {
+				if peer == s {
+					continue
+				}
+				if _, ok := s.PeerClockSkew(peer.keyPair.PublicKey()); !ok {
+					measured = false
+				}
+			}
+		}
+		if measured {
+			for _, s := range servers {
+				// Everyone shares a clock, so they should agree closely
+				if skew := s.ClockSkew(); skew > time.Second || skew < -time.Second {
+					t.Fatalf("servers on one machine have a skew of %s", skew)
+				}
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("servers did not measure each other's clocks")
+}
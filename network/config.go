@@ -1,32 +1,84 @@
 package network
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"coinkit/consensus"
+	"coinkit/data"
+	"coinkit/registry"
 	"coinkit/util"
 )
 
 type Address struct {
 	Host string
 	Port int
+
+	// Archive nodes keep all history and serve ranges of it, so nodes that
+	// are catching up should prefer them
+	Archive bool
+
+	// Outbound-only nodes don't accept connections, so peers wait for them
+	// to dial in. This lets a validator run behind a strict firewall.
+	OutboundOnly bool
 }
 
 func (a *Address) String() string {
-	return fmt.Sprintf("%s:%d", a.Host, a.Port)
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// UnmarshalJSON accepts a "host:port" string as well as the full object, so
+// that config files can list addresses the short way.
+func (a *Address) UnmarshalJSON(bytes []byte) error {
+	var s string
+	if err := json.Unmarshal(bytes, &s); err == nil {
+		parsed, err := ParseAddress(s)
+		if err != nil {
+			return err
+		}
+		*a = *parsed
+		return nil
+	}
+	type plain Address
+	return json.Unmarshal(bytes, (*plain)(a))
+}
+
+// ParseAddress parses a host:port address.
+func ParseAddress(s string) (*Address, error) {
+	host, portString, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port >= 65536 {
+		return nil, fmt.Errorf("bad port in %s", s)
+	}
+	return &Address{Host: host, Port: port}, nil
 }
 
 // Configuration for a network
 type NetworkConfig struct {
-	// Nodes that are accepting external connections for this network
+	// Nodes that are accepting external connections for this network.
+	// A nil address means the node has to be found through peer exchange
 	Nodes []*Address
 
-	// Defining the quorum for the network
-	Members   []string
+	// Defining the quorum for the network.
+	// Members[i] is the public key of the node at Nodes[i]
+	Members   []util.PublicKey
 	Threshold int
+
+	// Which network this is. Peers with a different ID or genesis hash are
+	// refused. Empty means anyone is accepted, as with networks that are
+	// made for tests.
+	ID      string `json:",omitempty"`
+	Genesis string `json:",omitempty"`
 }
 
 // Configuration for a particular server running part of the network
@@ -35,12 +87,172 @@ type ServerConfig struct {
 
 	Port    int
 	KeyPair *util.KeyPair
+
+	// The host to listen on. Empty means 127.0.0.1, so only this machine
+	// can connect. Use 0.0.0.0 to listen on every interface.
+	Bind string
+
+	// Where other machines can reach this server. This is what the server
+	// tells its peers. Nil means peers use whatever host our connections
+	// come from, since our address in the network config may only work
+	// from this machine.
+	Advertise *Address
+
+	// Nodes to ask where the other members of the network are, when this
+	// server doesn't know all of their addresses. One is enough.
+	Bootstrap []*Address
+
+	// Who is allowed to do what. Members of the network can always do
+	// everything. Nil means there are no restrictions.
+	Access *AccessPolicy
+
+	// Limits on how many queries each signer and each IP address can make.
+	// Members of the network have no limits. Nil means no limit.
+	KeyQuota *QuotaConfig
+	IPQuota  *QuotaConfig
+
+	// Limits on how fast each connection and each signer can send us
+	// messages. Unlike the quotas, these apply to members too, since a
+	// broken member can flood us as easily as anyone else. Nil means no
+	// limit.
+	RateLimit *RateLimitConfig
+
+	// When Follow is set, this server is a read replica. Instead of taking
+	// part in consensus, it streams finalized history from the node at
+	// Follow, whose public key is Leader.
+	Follow *Address
+	Leader util.PublicKey
+
+	// When FollowDiffs is set, a read replica following an archive asks for
+	// state diffs instead of chunks, and applies them without processing
+	// the transactions in them.
+	FollowDiffs bool
+
+	// Whether this server keeps and serves all of history
+	Archive bool
+
+	// Where this server saves finalized history, so that it can restart
+	// without losing state. Empty means nothing is saved.
+	// History that is pruned from memory is read back from here.
+	DataFile string
+
+	// When history saved to DataFile is flushed to disk. The zero value,
+	// data.SyncAlways, means a slot isn't finished until it is on disk.
+	DataSync data.SyncPolicy
+
+	// How big DataFile can get, in bytes. When it gets close, everything in it
+	// is replaced with a checkpoint. Archives can't do that, so they only
+	// alert. Zero means there is no limit.
+	MaxDataSize int64
+
+	// Where this server records every message it handles and every timer
+	// tick, so that a consensus bug can be reproduced by replaying them with
+	// a Replayer. Empty means nothing is recorded.
+	Journal string
+
+	// Where this server saves its recent metrics, so an operator can still
+	// see them after a restart. Empty means they are only kept in memory.
+	MetricsFile string
+
+	// How many slots of finalized history this server keeps in memory.
+	// Zero means HistoryRetention.
+	HistoryRetention int
+
+	// The quorum slice this server uses. Nil means it uses the quorum
+	// defined by the network.
+	QuorumSlice *consensus.QuorumSlice
+
+	// What this server publishes about itself in the validator registry.
+	// Validator is filled in from KeyPair. Nil means it publishes nothing.
+	Metadata *registry.Metadata
+
+	// URLs to call when matching transactions are finalized
+	Webhooks []*WebhookConfig
+
+	// Where to send alerts about critical conditions. Empty means alerts
+	// are not sent anywhere.
+	Alerts []*AlertConfig
+
+	// How long this server can work on one slot before it alerts that the
+	// slot is stuck. Zero means DefaultStuckSlotTimeout.
+	StuckSlotTimeout time.Duration
+
+	// How many ticks of the ballot timer a slot can go with nothing in it
+	// before this server nominates an empty slot, so that slot numbers keep
+	// advancing. Zero means it waits for something to happen.
+	EmptySlotTicks int
 }
 
 func (nc *NetworkConfig) QuorumSlice() consensus.QuorumSlice {
 	return consensus.MakeQuorumSlice(nc.Members, nc.Threshold)
 }
 
+// quorumSlice returns the quorum slice this server should use.
+func (sc *ServerConfig) quorumSlice() consensus.QuorumSlice {
+	if sc.QuorumSlice != nil {
+		return *sc.QuorumSlice
+	}
+	return sc.Network.QuorumSlice()
+}
+
+// LoadQuorumSlice reads a quorum slice from a JSON file, like
+// {"Members": ["A", "B"], "Inner": [{"Members": ["C", "D", "E"], "Threshold": 2}], "Threshold": 2}
+func LoadQuorumSlice(filename string) (*consensus.QuorumSlice, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	qs := &consensus.QuorumSlice{}
+	if err := json.Unmarshal(bytes, qs); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	if err := parseSliceMembers(qs); err != nil {
+		return nil, fmt.Errorf("bad member in %s: %s", filename, err)
+	}
+	return qs, nil
+}
+
+// parseMembers puts members read from a config file through
+// util.ParsePublicKey, so they can be written as strkeys too.
+func parseMembers(members []util.PublicKey) error {
+	for i, member := range members {
+		key, err := util.ParsePublicKey(string(member))
+		if err != nil {
+			return err
+		}
+		members[i] = key
+	}
+	return nil
+}
+
+// parseSliceMembers is parseMembers for every member of a quorum slice,
+// including the inner sets.
+func parseSliceMembers(qs *consensus.QuorumSlice) error {
+	if err := parseMembers(qs.Members); err != nil {
+		return err
+	}
+	for i := range qs.Inner {
+		if err := parseSliceMembers(&qs.Inner[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadKeyPair reads a server's key pair from a file that holds its secret
+// phrase. The file should only be readable by the server's operator.
+func LoadKeyPair(filename string) (*util.KeyPair, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	phrase := strings.TrimSpace(string(bytes))
+	if phrase == "" {
+		return nil, fmt.Errorf("%s has no secret phrase", filename)
+	}
+	return util.NewKeyPairFromSecretPhrase(phrase), nil
+}
+
 // Using a seed prevents multiple networks from accidentally communicating
 // with each other if you don't want them to. If you do want different
 // programs to communicate with each other on a localhost network, just
@@ -53,7 +265,7 @@ func NewLocalhostNetwork(
 
 	network := &NetworkConfig{
 		Nodes:     []*Address{},
-		Members:   []string{},
+		Members:   []util.PublicKey{},
 		Threshold: threshold,
 	}
 	servers := []*ServerConfig{}
@@ -84,21 +296,84 @@ var nextUnitTestPort = MinUnitTestPort
 func NewUnitTestNetwork() (*NetworkConfig, []*ServerConfig) {
 	rand.Seed(int64(time.Now().Nanosecond()))
 	num := 4
-	if nextUnitTestPort+num > MaxUnitTestPort {
-		nextUnitTestPort = MinUnitTestPort
+	return NewLocalhostNetwork(takeUnitTestPorts(num), num, rand.Int())
+}
+
+// takeUnitTestPorts returns the first of num consecutive ports for a unit
+// test. It skips over ports that something else is already listening on.
+func takeUnitTestPorts(num int) int {
+	for {
+		if nextUnitTestPort+num > MaxUnitTestPort {
+			nextUnitTestPort = MinUnitTestPort
+		}
+		first := nextUnitTestPort
+		nextUnitTestPort += num
+		free := true
+		for port := first; port < first+num && free; port++ {
+			ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				free = false
+			} else {
+				ln.Close()
+			}
+		}
+		if free {
+			return first
+		}
 	}
-	n, s := NewLocalhostNetwork(nextUnitTestPort, num, rand.Int())
-	nextUnitTestPort += num
-	return n, s
 }
 
+// NewLocalNetwork returns the default network profile.
 func NewLocalNetwork() (*NetworkConfig, []*ServerConfig) {
-	return NewLocalhostNetwork(9000, 4, 0)
+	return Profiles[DefaultProfile].Network()
+}
+
+// SetAddresses replaces the addresses of the nodes in the network with a
+// list of host:port strings, in the same order as Members.
+func (nc *NetworkConfig) SetAddresses(list []string) error {
+	if len(list) != len(nc.Members) {
+		return fmt.Errorf("expected %d addresses but got %d", len(nc.Members), len(list))
+	}
+	nodes := []*Address{}
+	for i, s := range list {
+		address, err := ParseAddress(s)
+		if err != nil {
+			return err
+		}
+		if nc.Nodes[i] != nil {
+			address.Archive = nc.Nodes[i].Archive
+			address.OutboundOnly = nc.Nodes[i].OutboundOnly
+		}
+		nodes = append(nodes, address)
+	}
+	nc.Nodes = nodes
+	return nil
+}
+
+// checkHello returns an error if a hello comes from a node on a different
+// network, or one whose protocol is too old for us.
+func (nc *NetworkConfig) checkHello(m *HelloMessage) error {
+	if m.Version < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d is too old, we need at least %d",
+			m.Version, MinProtocolVersion)
+	}
+	if nc.ID != "" && m.Network != nc.ID {
+		return fmt.Errorf("expected network %q but got %q", nc.ID, m.Network)
+	}
+	if nc.Genesis != "" && m.Genesis != nc.Genesis {
+		return fmt.Errorf("network %q has a different genesis", m.Network)
+	}
+	return nil
 }
 
 // Just returns a port
 func (nc *NetworkConfig) RandomAddress() *Address {
 	rand.Seed(int64(time.Now().Nanosecond()))
-	index := rand.Intn(len(nc.Nodes))
-	return nc.Nodes[index]
+	known := []*Address{}
+	for _, address := range nc.Nodes {
+		if address != nil {
+			known = append(known, address)
+		}
+	}
+	return known[rand.Intn(len(known))]
 }
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"coinkit/util"
+)
+
+func TestParseAddress(t *testing.T) {
+	a, err := ParseAddress("node1.example.com:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Host != "node1.example.com" || a.Port != 9000 {
+		t.Fatalf("parsed %+v", a)
+	}
+	if a, err := ParseAddress("[::1]:9000"); err != nil || a.String() != "[::1]:9000" {
+		t.Fatalf("ipv6 addresses should round trip, but got %v, %v", a, err)
+	}
+	for _, bad := range []string{"9000", "host:", "host:port", "host:70000"} {
+		if _, err := ParseAddress(bad); err == nil {
+			t.Fatalf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestAddressFromJSON(t *testing.T) {
+	addresses := []*Address{}
+	err := json.Unmarshal([]byte(
+		`["10.0.0.1:9000", {"Host": "10.0.0.2", "Port": 9001, "Archive": true}]`),
+		&addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses[0].String() != "10.0.0.1:9000" {
+		t.Fatalf("got %s", addresses[0])
+	}
+	if addresses[1].String() != "10.0.0.2:9001" || !addresses[1].Archive {
+		t.Fatalf("got %+v", addresses[1])
+	}
+	if err := json.Unmarshal([]byte(`["nope"]`), &addresses); err == nil {
+		t.Fatal("a string without a port should not parse")
+	}
+}
+
+func TestSetAddresses(t *testing.T) {
+	network, _ := NewLocalhostNetwork(9000, 4, 0)
+	network.Nodes[3].OutboundOnly = true
+	if err := network.SetAddresses([]string{"a:1", "b:2"}); err == nil {
+		t.Fatal("there should be an address for every member")
+	}
+	err := network.SetAddresses([]string{"a:1", "b:2", "c:3", "d:4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.Nodes[2].String() != "c:3" {
+		t.Fatalf("got %s", network.Nodes[2])
+	}
+	if !network.Nodes[3].OutboundOnly {
+		t.Fatal("setting the addresses should not change how nodes connect")
+	}
+}
+
+func TestLoadQuorumSlice(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("member")
+	strkey, err := util.PublicKeyToStrkey(kp.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "slice.json")
+	write := func(slice string) {
+		if err := ioutil.WriteFile(filename, []byte(slice), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"Members": [], "Inner": [{"Members": ["` + strkey + `"], "Threshold": 1}], "Threshold": 1}`)
+	qs, err := LoadQuorumSlice(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qs.Inner[0].Members[0] != kp.PublicKey() {
+		t.Fatalf("the strkey should become a base64 key, but got %s", qs.Inner[0].Members[0])
+	}
+
+	write(`{"Members": ["` + string(kp.PublicKey()) + `", "B"], "Threshold": 1}`)
+	if _, err := LoadQuorumSlice(filename); err == nil {
+		t.Fatal("a slice with a malformed member should not load")
+	}
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"coinkit/util"
+)
+
+// How many dead letters a server keeps. Older ones are dropped.
+const MaxDeadLetters = 100
+
+// Dead letter lines longer than this are truncated
+const maxDeadLetterLine = 1000
+
+// A DeadLetter is a message that we received but could not decode.
+// We keep them around so that protocol incompatibilities can be debugged.
+type DeadLetter struct {
+	// The address that sent the message
+	Peer string
+
+	Time time.Time
+
+	// The message as it came over the wire, possibly truncated
+	Line string
+
+	// Why the message could not be decoded
+	Error string
+}
+
+func (d *DeadLetter) String() string {
+	return fmt.Sprintf("%s from %s at %s: %q",
+		d.Error, d.Peer, d.Time.Format(time.RFC3339), d.Line)
+}
+
+// deadLetterQueue is a ring buffer of the most recent dead letters.
+// deadLetterQueue is threadsafe.
+type deadLetterQueue struct {
+	mutex   sync.Mutex
+	letters []*DeadLetter
+
+	// Where the next letter goes in letters, once it is full
+	next int
+
+	// How many dead letters we have ever seen
+	total int
+}
+
+func newDeadLetterQueue() *deadLetterQueue {
+	return &deadLetterQueue{
+		letters: []*DeadLetter{},
+	}
+}
+
+func (q *deadLetterQueue) add(peer string, e *util.DecodeError) {
+	line := e.Line
+	if len(line) > maxDeadLetterLine {
+		// A substring would keep the whole line in memory
+		line = strings.Clone(line[:maxDeadLetterLine])
+	}
+	letter := &DeadLetter{
+		Peer:  peer,
+		Time:  time.Now(),
+		Line:  line,
+		Error: e.Err.Error(),
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.total++
+	if len(q.letters) < MaxDeadLetters {
+		q.letters = append(q.letters, letter)
+		return
+	}
+	q.letters[q.next] = letter
+	q.next = (q.next + 1) % MaxDeadLetters
+}
+
+// list returns the dead letters we have, oldest first, and how many we have
+// ever seen.
+func (q *deadLetterQueue) list() ([]*DeadLetter, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	answer := []*DeadLetter{}
+	answer = append(answer, q.letters[q.next:]...)
+	answer = append(answer, q.letters[:q.next]...)
+	return answer, q.total
+}
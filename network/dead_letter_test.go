@@ -0,0 +1,40 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"coinkit/util"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	q := newDeadLetterQueue()
+	for i := 0; i < MaxDeadLetters+5; i++ {
+		q.add("peer", &util.DecodeError{
+			Line: fmt.Sprintf("garbage %d", i),
+			Err:  errors.New("bad"),
+		})
+	}
+	letters, total := q.list()
+	if total != MaxDeadLetters+5 || len(letters) != MaxDeadLetters {
+		t.Fatalf("got %d letters out of %d", len(letters), total)
+	}
+	if letters[0].Line != "garbage 5" {
+		t.Fatalf("the oldest letters should be dropped first, but got %s",
+			letters[0].Line)
+	}
+	if letters[MaxDeadLetters-1].Line != fmt.Sprintf("garbage %d", MaxDeadLetters+4) {
+		t.Fatalf("the newest letter should be last")
+	}
+
+	q.add("peer", &util.DecodeError{
+		Line: strings.Repeat("x", 2*maxDeadLetterLine),
+		Err:  errors.New("too long"),
+	})
+	letters, _ = q.list()
+	if len(letters[MaxDeadLetters-1].Line) != maxDeadLetterLine {
+		t.Fatalf("long lines should be truncated")
+	}
+}
@@ -0,0 +1,70 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"coinkit/util"
+)
+
+// When the data file gets to this fraction of its maximum size, we compact it
+const CompactionThreshold = 0.8
+
+// unsafeCheckDisk compacts the data file when it gets close to its maximum
+// size, and alerts when that isn't enough to keep it under.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeCheckDisk() {
+	if s.db == nil || s.maxDataSize == 0 {
+		return
+	}
+	if time.Since(s.lastDiskCheck) < s.DiskCheckInterval {
+		return
+	}
+	s.lastDiskCheck = time.Now()
+
+	size, err := s.db.Size()
+	if err != nil {
+		log.Printf("could not check the size of %s: %s", s.db.Path(), err)
+		return
+	}
+	threshold := int64(float64(s.maxDataSize) * CompactionThreshold)
+	if size >= threshold && !s.node.archive {
+		size = s.unsafeCompact(size)
+	}
+
+	if s.alerts == nil {
+		return
+	}
+	if size >= threshold {
+		s.alerts.set(AlertDiskFull, true, fmt.Sprintf("%s is %d bytes, the limit is %d",
+			s.db.Path(), size, s.maxDataSize))
+	} else {
+		s.alerts.set(AlertDiskFull, false, fmt.Sprintf("%s is %d bytes",
+			s.db.Path(), size))
+	}
+}
+
+// unsafeCompact replaces the data file with a checkpoint of the last slot we
+// finished. History from before the checkpoint can no longer be read back.
+// It returns the size of the data file afterwards.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeCompact(size int64) int64 {
+	cp := s.node.Checkpoint()
+	if cp == nil {
+		return size
+	}
+	if err := s.db.Replace([]util.Message{cp}); err != nil {
+		log.Printf("could not compact %s: %s", s.db.Path(), err)
+		return size
+	}
+	s.node.storeFirst = cp.I
+	after, err := s.db.Size()
+	if err != nil {
+		log.Printf("could not check the size of %s: %s", s.db.Path(), err)
+		return size
+	}
+	s.Logf("compacted %s up to slot %d, reclaiming %d bytes",
+		s.db.Path(), cp.I, size-after)
+	return after
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"path/filepath"
+	"testing"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/data"
+	"coinkit/util"
+)
+
+func TestDataFileCompaction(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 1000)
+		nodes = append(nodes, node)
+	}
+	path := filepath.Join(t.TempDir(), "history.db")
+	db, err := data.NewDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	nodes[0].store = db
+
+	rounds := 10
+	for round := 1; round <= rounds; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+		for i := 0; i < 10 && nodes[0].Slot() == round; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+		if err := db.Append(nodes[0].History(round)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &fakeAlertSink{alerts: make(chan *Alert, 10)}
+	s := &Server{
+		keyPair:     util.NewKeyPairFromSecretPhrase(string(names[0])),
+		node:        nodes[0],
+		db:          db,
+		maxDataSize: size,
+		alerts:      newAlerter(names[0], []AlertSink{sink}),
+	}
+	s.unsafeCheckDisk()
+	after, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= size/2 {
+		t.Fatalf("compacting only got the data file from %d to %d bytes", size, after)
+	}
+	if a := s.alerts.update(AlertDiskFull, false, ""); a != nil {
+		t.Fatal("compacting should have kept the disk full alert from being raised")
+	}
+
+	// New history goes after the checkpoint
+	if h := nodes[0].History(rounds); h == nil || h.I != rounds {
+		t.Fatalf("the last slot should still be in memory, but got %+v", h)
+	}
+
+	// Restarting from the compacted file should pick up where we left off
+	restarted := &Server{
+		keyPair: s.keyPair,
+		node:    NewNode(names[0], qs),
+		db:      db,
+	}
+	restarted.restore()
+	if restarted.node.Slot() != rounds+1 {
+		t.Fatalf("restarted on slot %d", restarted.node.Slot())
+	}
+	if restarted.node.queue.MaxBalance() != nodes[0].queue.MaxBalance() {
+		t.Fatal("restarting from the checkpoint lost account data")
+	}
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// How many client accounts a fixture starts with money in, and how much
+const FixtureClients = 4
+const FixtureBalance = 1000
+
+// A Fixture is a set of validators, a quorum, and a genesis for tests and
+// simulations. Everything in it is derived from the seed, so a cluster that
+// misbehaves can be rebuilt exactly from the seed alone.
+type Fixture struct {
+	Seed int64
+
+	// The validators, in the same order as the quorum slice members
+	Validators []*util.KeyPair
+
+	// A 2k+1 out of 3k+1 quorum of the validators
+	QuorumSlice consensus.QuorumSlice
+
+	// Client accounts that start out with FixtureBalance each
+	Clients []*util.KeyPair
+
+	// The starting balance of every account that has money. Tests can change
+	// it before making nodes or servers
+	Genesis map[util.PublicKey]uint64
+}
+
+// NewFixture makes a fixture with the given number of validators.
+func NewFixture(seed int64, validators int) *Fixture {
+	f := &Fixture{
+		Seed:    seed,
+		Genesis: make(map[util.PublicKey]uint64),
+	}
+	names := []util.PublicKey{}
+	for i := 0; i < validators; i++ {
+		kp := util.NewKeyPairFromSecretPhrase(fmt.Sprintf("fixture %d validator %d", seed, i))
+		f.Validators = append(f.Validators, kp)
+		names = append(names, kp.PublicKey())
+	}
+	threshold := int(math.Ceil(2.0/3.0*float64(validators-1))) + 1
+	f.QuorumSlice = consensus.MakeQuorumSlice(names, threshold)
+	for i := 0; i < FixtureClients; i++ {
+		f.AddClient()
+	}
+	return f
+}
+
+// AddClient adds another client account that starts out with
+// FixtureBalance, derived from the seed like the others, and returns it.
+// Tests that need more than FixtureClients clients should add them before
+// making nodes or servers.
+func (f *Fixture) AddClient() *util.KeyPair {
+	kp := util.NewKeyPairFromSecretPhrase(
+		fmt.Sprintf("fixture %d client %d", f.Seed, len(f.Clients)))
+	f.Clients = append(f.Clients, kp)
+	f.Genesis[kp.PublicKey()] = FixtureBalance
+	return kp
+}
+
+// GenesisHash is the hash of the genesis balances.
+func (f *Fixture) GenesisHash() string {
+	lines := []string{}
+	for owner, balance := range f.Genesis {
+		lines = append(lines, fmt.Sprintf("%s %d", owner, balance))
+	}
+	sort.Strings(lines)
+	return consensus.HashString(strings.Join(lines, "\n"))
+}
+
+// Nodes makes a node for each validator, starting from the genesis.
+func (f *Fixture) Nodes() []*Node {
+	nodes := []*Node{}
+	for _, kp := range f.Validators {
+		node := NewNode(kp.PublicKey(), f.QuorumSlice)
+		node.SetSigner(kp)
+		for owner, balance := range f.Genesis {
+			node.queue.SetBalance(owner, balance)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Network returns the configuration for running the validators as servers
+// on localhost, listening on consecutive ports starting at firstPort.
+func (f *Fixture) Network(firstPort int) (*NetworkConfig, []*ServerConfig) {
+	network := &NetworkConfig{
+		Nodes:     []*Address{},
+		Members:   f.QuorumSlice.Members,
+		Threshold: f.QuorumSlice.Threshold,
+		ID:        fmt.Sprintf("fixture-%d", f.Seed),
+		Genesis:   f.GenesisHash(),
+	}
+	servers := []*ServerConfig{}
+	for i, kp := range f.Validators {
+		network.Nodes = append(network.Nodes, &Address{
+			Host: "127.0.0.1",
+			Port: firstPort + i,
+		})
+		servers = append(servers, &ServerConfig{
+			Network: network,
+			Port:    firstPort + i,
+			KeyPair: kp,
+		})
+	}
+	return network, servers
+}
+
+// Servers makes a server for each validator, starting from the genesis, on
+// ports that are free for unit tests. They aren't serving yet.
+func (f *Fixture) Servers() []*Server {
+	_, configs := f.Network(takeUnitTestPorts(len(f.Validators)))
+	servers := []*Server{}
+	for _, config := range configs {
+		s := NewServer(config)
+		for owner, balance := range f.Genesis {
+			s.SetBalance(owner, balance)
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"coinkit/currency"
+)
+
+func TestFixtureIsDeterministic(t *testing.T) {
+	f1 := NewFixture(7, 4)
+	f2 := NewFixture(7, 4)
+	other := NewFixture(8, 4)
+	if f1.QuorumSlice.Threshold != 3 || len(f1.QuorumSlice.Members) != 4 {
+		t.Fatalf("bad quorum slice: %+v", f1.QuorumSlice)
+	}
+	for i := range f1.Validators {
+		if f1.Validators[i].PublicKey() != f2.Validators[i].PublicKey() {
+			t.Fatal("the same seed should make the same validators")
+		}
+		if f1.Validators[i].PublicKey() == other.Validators[i].PublicKey() {
+			t.Fatal("different seeds should make different validators")
+		}
+	}
+	if f1.GenesisHash() != f2.GenesisHash() || f1.GenesisHash() == other.GenesisHash() {
+		t.Fatal("the genesis hash should only depend on the seed")
+	}
+}
+
+func TestFixtureNodes(t *testing.T) {
+	f := NewFixture(1, 4)
+	nodes := f.Nodes()
+	from := f.Clients[0]
+	tr := &currency.Transaction{
+		From:     from.PublicKey(),
+		Sequence: 1,
+		To:       f.Clients[1].PublicKey(),
+		Amount:   10,
+		Fee:      0,
+	}
+	nodes[0].Handle(from.PublicKey(), currency.NewTransactionMessage(tr.SignWith(from)))
+	for i := 0; i < 20 && nodes[0].Slot() == 1; i++ {
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+		tickNodes(nodes)
+	}
+	if nodes[0].Slot() != 2 {
+		t.Fatal("the fixture nodes did not finalize the payment")
+	}
+	if maxAccountBalance(nodes) != FixtureBalance+10 {
+		t.Fatalf("unexpected balance %d", maxAccountBalance(nodes))
+	}
+}
+
+func TestFixtureServers(t *testing.T) {
+	f := NewFixture(2, 4)
+	servers := f.Servers()
+	for _, s := range servers {
+		s.ServeInBackground()
+	}
+	defer stopServers(servers)
+
+	client := NewClient(&Address{Host: "127.0.0.1", Port: servers[0].port})
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	kp := f.Clients[0]
+	account, err := client.GetAccount(ctx, kp.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account == nil || account.Balance != FixtureBalance {
+		t.Fatalf("bad genesis account: %+v", account)
+	}
+}
@@ -0,0 +1,180 @@
+package network
+
+import (
+	"log"
+	"time"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/registry"
+	"coinkit/util"
+)
+
+// NewFollowerNode creates a node that keeps its own copy of the account data
+// by applying the history finalized by a leader, rather than taking part in
+// consensus itself. This lets it serve queries without adding load to the
+// validators.
+func NewFollowerNode(publicKey util.PublicKey, leader util.PublicKey) *Node {
+	queue := currency.NewTransactionQueue(publicKey)
+	r := registry.NewRegistry(publicKey)
+
+	return &Node{
+		publicKey:  publicKey,
+		queue:      queue,
+		registry:   r,
+		values:     newValueStore(queue, r),
+		future:     make(map[int]map[string]*bufferedMessage),
+		leader:     leader,
+		followed:   make(map[int]*consensus.ExternalizeMessage),
+		retention:  HistoryRetention,
+		storeFirst: 1,
+	}
+}
+
+// handleAsFollower is the follower version of Handle.
+func (node *Node) handleAsFollower(sender util.PublicKey, message util.Message) util.Message {
+	switch m := message.(type) {
+
+	// The leader's history gets our status back, so that followForever
+	// knows which slot we need next
+	case *HistoryMessage:
+		if sender != node.leader {
+			// We only trust our leader's history
+			return nil
+		}
+		node.follow(m)
+		return node.Status()
+
+	case *HistoryRangeMessage:
+		if sender != node.leader {
+			return nil
+		}
+		for _, h := range m.History {
+			node.follow(h)
+		}
+		return node.Status()
+
+	case *HistoryRequestMessage:
+		return node.handleHistoryRequest(sender, m)
+
+	case *util.InfoMessage:
+		if m.Status {
+			return node.Status()
+		}
+		if m.Registry {
+			return node.registry.RegistryMessage()
+		}
+		if m.Account != "" {
+			return node.queue.HandleInfoMessage(m)
+		}
+		if h := node.History(m.I); h != nil {
+			return h
+		}
+		return nil
+
+	case *currency.TransactionMessage, *currency.ImportMessage:
+		return &util.ErrorMessage{
+			Error: "this node is a read replica and does not accept transactions",
+		}
+
+	case *PauseMessage:
+		return &util.ErrorMessage{
+			Error: "this node is a read replica and does not take part in consensus",
+		}
+
+	case *registry.RegistryMessage:
+		return &util.ErrorMessage{
+			Error: "this node is a read replica and does not accept metadata",
+		}
+
+	default:
+		return nil
+	}
+}
+
+// follow applies the leader's history for our current slot.
+func (node *Node) follow(m *HistoryMessage) {
+	if m == nil || m.E == nil || m.I != node.Slot() || m.E.I != m.I {
+		return
+	}
+	node.handleHistoryData(m)
+	if m.D != nil {
+		node.queue.HandleStateDiffMessage(m.D)
+	}
+	if !node.values.CanFinalize(m.E.X) {
+		log.Printf("history for slot %d is missing its chunk", m.I)
+		return
+	}
+	node.values.Finalize(m.E.X)
+	node.followed[m.I] = m.E
+	node.prune()
+}
+
+// followForever streams finalized history from the leader and hands it to
+// the processing goroutine. Archive leaders are asked for whole ranges of
+// history at once, other leaders for one slot at a time. It should be run in
+// its own goroutine.
+func (s *Server) followForever() {
+	client := NewClient(s.follow)
+	defer client.Close()
+
+	// The next slot we are asking for. Only this goroutine uses it, so that
+	// we don't have to touch the node. The node tells us where it is after
+	// each batch of history, since it may not have been able to apply it
+	slot := 1
+	for {
+		var request util.Message = &util.InfoMessage{I: slot}
+		if s.follow.Archive {
+			request = &HistoryRequestMessage{
+				First: slot,
+				Last:  slot + MaxHistoryRange - 1,
+				Diffs: s.followDiffs,
+			}
+		}
+		sm, err := client.SendMessage(s.ctx, util.NewSignedMessage(s.keyPair, request))
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil || sm == nil {
+			log.Printf("could not get history for slot %d: %v", slot, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		switch m := sm.Message().(type) {
+		case *HistoryMessage:
+		case *HistoryRangeMessage:
+			if len(m.History) > 0 {
+				break
+			}
+			// We are caught up
+			time.Sleep(time.Second)
+			continue
+		default:
+			// Either the leader is having trouble or we are caught up
+			log.Printf("expected history for slot %d but got %s", slot, m)
+			time.Sleep(time.Second)
+			continue
+		}
+		response := make(chan *util.SignedMessage, 1)
+		select {
+		case s.requests <- &Request{Message: sm, Response: response}:
+		case <-s.ctx.Done():
+			return
+		}
+		select {
+		case r := <-response:
+			if r == nil {
+				break
+			}
+			if status, ok := r.Message().(*StatusMessage); ok {
+				if status.I == slot {
+					log.Printf("could not apply the history for slot %d", slot)
+					time.Sleep(time.Second)
+				}
+				slot = status.I
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/registry"
+	"coinkit/util"
+)
+
+// Run "go test coinkit/network -run Golden -update" to regenerate the golden
+// file after an intentional change to the wire format.
+var updateGolden = flag.Bool("update", false, "rewrite the golden message file")
+
+const goldenFile = "testdata/messages.golden"
+
+// The encodings used by the previous protocol version. Nodes must keep
+// decoding these, so that a cluster can be upgraded one node at a time.
+// This file should never be regenerated.
+const previousGoldenFile = "testdata/messages.v0.golden"
+
+// Message types that are only registered by tests
+var testOnlyMessageTypes = map[string]bool{
+	"Fake": true,
+}
+
+// goldenMessages returns a sample of every message type, with every field
+// filled in. Keys and signatures are literal strings rather than generated,
+// so that the encodings don't depend on the crypto implementation.
+func goldenMessages() []util.Message {
+	qs := consensus.MakeQuorumSlice([]util.PublicKey{"nodeA", "nodeB"}, 2)
+	qs.Inner = []consensus.QuorumSlice{
+		consensus.MakeQuorumSlice([]util.PublicKey{"nodeC", "nodeD", "nodeE"}, 2),
+	}
+	t1 := &currency.SignedTransaction{
+		Transaction: &currency.Transaction{
+			From:     "bob",
+			Sequence: 7,
+			To:       "carol",
+			Amount:   100,
+			Fee:      3,
+			Memo:     42,
+		},
+		Signature: "sig1",
+	}
+	t2 := &currency.SignedTransaction{
+		Transaction: &currency.Transaction{
+			From:     "carol",
+			Sequence: 2,
+			To:       "dave",
+			Amount:   5,
+			Delegate: "hotkey",
+			Grant: &currency.Capability{
+				Key:          "otherkey",
+				MaxAmount:    50,
+				Destinations: []util.PublicKey{"erin"},
+			},
+			Limit: &currency.SpendingLimit{
+				Amount: 500,
+				Slots:  100,
+			},
+		},
+		Signature: "sig2",
+	}
+	chunk := &currency.LedgerChunk{
+		Transactions: []*currency.SignedTransaction{t1, t2},
+		State: map[util.PublicKey]*currency.Account{
+			"bob":   &currency.Account{Sequence: 7, Balance: 897},
+			"carol": &currency.Account{Sequence: 2, Balance: 195},
+			"dave":  &currency.Account{Sequence: 0, Balance: 5},
+		},
+	}
+	tm := &currency.TransactionMessage{
+		Transactions: []*currency.SignedTransaction{t1, t2},
+		Chunks: map[consensus.SlotValue]*currency.LedgerChunk{
+			"chunkhash": chunk,
+		},
+	}
+	em := &consensus.ExternalizeMessage{
+		I:  9,
+		X:  "chunkhash",
+		Cn: 1,
+		Hn: 2,
+		D:  qs,
+	}
+	dm := &currency.StateDiffMessage{
+		I:          9,
+		Chunk:      "chunkhash",
+		Signatures: []string{"sig1", "sig2"},
+		State:      chunk.State,
+		Delegations: map[string]*currency.DelegationState{
+			"carol:hotkey": &currency.DelegationState{
+				Capability: &currency.Capability{Key: "hotkey", MaxAmount: 50},
+				Window:     0,
+				Spent:      5,
+			},
+		},
+		Spending: map[util.PublicKey]*currency.SpendingState{
+			"carol": &currency.SpendingState{
+				Limit:  &currency.SpendingLimit{Amount: 500, Slots: 100},
+				Window: 0,
+				Spent:  5,
+			},
+		},
+		Before: "beforehash",
+		After:  "afterhash",
+	}
+	sm := &registry.SignedMetadata{
+		Metadata: &registry.Metadata{
+			Validator:   "nodeA",
+			Sequence:    2,
+			Name:        "Node A",
+			Contact:     "ops@example.com",
+			Website:     "https://example.com",
+			Fingerprint: "0123 4567 89AB CDEF",
+		},
+		Signature: "sigA",
+	}
+	rm := &registry.RegistryMessage{
+		Entries: []*registry.SignedMetadata{},
+		Batches: map[consensus.SlotValue][]*registry.SignedMetadata{
+			"batchhash": []*registry.SignedMetadata{sm},
+		},
+	}
+	hm := &HistoryMessage{
+		I: 9,
+		T: tm,
+		E: em,
+		D: dm,
+		M: rm,
+	}
+
+	return []util.Message{
+		&util.ErrorMessage{
+			Error:      "too many requests",
+			Transient:  true,
+			RetryAfter: 3 * time.Second,
+		},
+		&util.InfoMessage{
+			I:        9,
+			Account:  "bob",
+			At:       8,
+			Sequence: 7,
+			Registry: true,
+			Status:   true,
+		},
+		&consensus.QuorumSliceMessage{
+			I: 4,
+			D: qs,
+		},
+		&consensus.NominationMessage{
+			I:   9,
+			Nom: []consensus.SlotValue{"x", "y"},
+			Acc: []consensus.SlotValue{"x"},
+			C:   3,
+			D:   qs,
+		},
+		&consensus.PrepareMessage{
+			I:   9,
+			Bn:  3,
+			Bx:  "y",
+			Pn:  2,
+			Px:  "y",
+			Ppn: 1,
+			Ppx: "x",
+			Cn:  1,
+			Hn:  2,
+			D:   qs,
+		},
+		&consensus.ConfirmMessage{
+			I:  9,
+			X:  "y",
+			Pn: 3,
+			Cn: 1,
+			Hn: 3,
+			D:  qs,
+		},
+		em,
+		tm,
+		&currency.ImportMessage{
+			Transactions: []*currency.SignedTransaction{t1, t2},
+			Backlog:      12,
+		},
+		&currency.AccountMessage{
+			I: 9,
+			State: map[util.PublicKey]*currency.Account{
+				"bob":    &currency.Account{Sequence: 7, Balance: 897},
+				"nobody": nil,
+			},
+			Included: 6,
+		},
+		&ChunkRequestMessage{
+			I: 9,
+			X: "chunkhash",
+		},
+		&currency.FetchMessage{
+			Chunks: []consensus.SlotValue{"chunkhash", "otherhash"},
+		},
+		dm,
+		hm,
+		&PauseMessage{Resume: true},
+		&PingMessage{Time: 1500000000000000000, Echo: 1499999999990000000},
+		&BatchMessage{
+			Messages: []util.Message{
+				&PauseMessage{Resume: true},
+				&PingMessage{Time: 1500000000000000000},
+			},
+		},
+		&MetricsMessage{
+			Samples: []*MetricsSample{
+				&MetricsSample{
+					Time:     time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC),
+					I:        10,
+					SlotTime: 1500 * time.Millisecond,
+					TPS:      2.5,
+					Peers:    3,
+				},
+			},
+			DeadLetters: []*DeadLetter{
+				&DeadLetter{
+					Peer:  "10.0.0.3:9002",
+					Time:  time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC),
+					Line:  "garbage",
+					Error: "could not find 4 parts",
+				},
+			},
+			Undecodable: 4,
+			Peers: []*PeerState{
+				&PeerState{
+					PublicKey: "nodeA",
+					Connected: true,
+					Since:     time.Date(2017, 7, 14, 2, 0, 0, 0, time.UTC),
+					Failures:  1,
+					Version:   2,
+					Slot:      9,
+					Dropped:   3,
+					Bans:      1,
+				},
+			},
+		},
+		&PeerExchangeMessage{
+			Peers: map[util.PublicKey]*Address{
+				"nodeA": &Address{Host: "10.0.0.1", Port: 9000},
+				"nodeB": &Address{Host: "10.0.0.2", Port: 9001, Archive: true},
+			},
+		},
+		&StatusMessage{
+			I: 10,
+			Metrics: &consensus.Metrics{
+				Slot:             10,
+				Phase:            consensus.Prepare,
+				BallotNumber:     2,
+				BallotBumps:      1,
+				MessagesReceived: 40,
+				TimeInSlot:       1500 * time.Millisecond,
+			},
+			Slots: []*consensus.SlotStats{
+				&consensus.SlotStats{
+					Slot:               9,
+					NominationDuration: 200 * time.Millisecond,
+					BallotDuration:     800 * time.Millisecond,
+					BallotBumps:        1,
+					MessagesProcessed:  36,
+				},
+			},
+			Queue: 12,
+		},
+		&HelloMessage{
+			Version:     1,
+			Network:     "coinkit-devnet",
+			Genesis:     "genesishash",
+			CurrentSlot: 9,
+		},
+		&HistoryRequestMessage{
+			First:    3,
+			Last:     9,
+			Snapshot: true,
+			Diffs:    true,
+		},
+		&HistoryRangeMessage{
+			History: []*HistoryMessage{hm},
+		},
+		&consensus.DigestMessage{
+			I:    10,
+			Prev: "prevhash",
+			Hash: "digesthash",
+			Signatures: map[util.PublicKey]string{
+				"nodeA": "sigA",
+				"nodeB": "sigB",
+			},
+		},
+		rm,
+		&CheckpointMessage{
+			I:        9,
+			E:        em,
+			Hash:     "chainhash",
+			Registry: []*registry.SignedMetadata{sm},
+			State: &currency.LedgerState{
+				Slot:      10,
+				Last:      "chunkhash",
+				Finalized: 2,
+				Accounts: map[util.PublicKey]*currency.Account{
+					"bob":   &currency.Account{Sequence: 7, Balance: 897},
+					"carol": &currency.Account{Sequence: 2, Balance: 195},
+				},
+				Delegations: map[string]*currency.DelegationState{
+					"carol:hotkey": &currency.DelegationState{
+						Capability: &currency.Capability{Key: "hotkey", MaxAmount: 50},
+						Window:     0,
+						Spent:      5,
+					},
+				},
+				Spending: map[util.PublicKey]*currency.SpendingState{
+					"carol": &currency.SpendingState{
+						Limit:  &currency.SpendingLimit{Amount: 500, Slots: 100},
+						Window: 0,
+						Spent:  5,
+					},
+				},
+			},
+		},
+		&BlockHeaderMessage{
+			I:     9,
+			Prev:  "prevhash",
+			Value: "valuehash",
+			State: "statehash",
+			Cert:  "certhash",
+		},
+	}
+}
+
+// readGolden returns the golden encodings in a file, keyed by message type.
+func readGolden(t *testing.T, filename string) map[string]string {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	answer := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			t.Fatalf("bad golden line: %s", line)
+		}
+		answer[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return answer
+}
+
+func TestGoldenMessages(t *testing.T) {
+	messages := goldenMessages()
+
+	if *updateGolden {
+		lines := []string{}
+		for _, m := range messages {
+			lines = append(lines, fmt.Sprintf("%s %s", m.MessageType(), util.EncodeMessage(m)))
+		}
+		content := strings.Join(lines, "\n") + "\n"
+		if err := ioutil.WriteFile(goldenFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	golden := readGolden(t, goldenFile)
+	for name := range util.MessageTypeMap {
+		if _, ok := golden[name]; !ok && !testOnlyMessageTypes[name] {
+			t.Errorf("message type %s has no golden encoding", name)
+		}
+	}
+
+	for _, m := range messages {
+		name := m.MessageType()
+		if util.EncodeMessage(m) != golden[name] {
+			t.Errorf("the encoding of message type %s changed:\nwant %s\ngot  %s",
+				name, golden[name], util.EncodeMessage(m))
+		}
+	}
+}
+
+func TestGoldenMessagesReencode(t *testing.T) {
+	for name, encoded := range readGolden(t, goldenFile) {
+		m, err := util.DecodeMessage(encoded)
+		if err != nil {
+			t.Errorf("could not decode golden message type %s: %s", name, err)
+			continue
+		}
+		if m.MessageType() != name {
+			t.Errorf("golden line %s decoded to message type %s", name, m.MessageType())
+		}
+		if reencoded := util.EncodeMessage(m); reencoded != encoded {
+			t.Errorf("re-encoding message type %s is not stable:\nwant %s\ngot  %s",
+				name, encoded, reencoded)
+		}
+	}
+}
+
+func TestPreviousVersionMessages(t *testing.T) {
+	previous := readGolden(t, previousGoldenFile)
+	if len(previous) == 0 {
+		t.Fatal("no previous version messages")
+	}
+	for name, encoded := range previous {
+		m, err := util.DecodeMessage(encoded)
+		if err != nil {
+			t.Errorf("could not decode previous version of message type %s: %s",
+				name, err)
+			continue
+		}
+		if m.MessageType() != name {
+			t.Errorf("previous version line %s decoded to message type %s",
+				name, m.MessageType())
+		}
+
+		// Passing the message along to a current node should not change it
+		m2 := util.EncodeThenDecode(m)
+		if !reflect.DeepEqual(m, m2) {
+			t.Errorf("message type %s changed in transit: %s -> %s", name, m, m2)
+		}
+	}
+
+	// A node that is still on the previous version sends these on lines.
+	// The golden keys are placeholders, so real ones are swapped in to sign
+	// with, which leaves the encodings in the previous format
+	keys := map[string]*util.KeyPair{}
+	for _, name := range []string{"nodeA", "nodeB", "nodeC", "bob", "carol"} {
+		keys[name] = util.NewKeyPairFromSecretPhrase(name)
+	}
+	client := util.NewKeyPairFromSecretPhrase("client")
+	signers := []struct {
+		name   string
+		signer *util.KeyPair
+	}{
+		{"I", client}, {"N", keys["nodeB"]}, {"P", keys["nodeC"]},
+		{"C", keys["nodeB"]}, {"T", client}, {"A", client}, {"H", keys["nodeC"]},
+	}
+	in := &bytes.Buffer{}
+	for _, s := range signers {
+		encoded := previous[s.name]
+		for name, kp := range keys {
+			encoded = strings.Replace(encoded, `"`+name+`"`, `"`+string(kp.PublicKey())+`"`, -1)
+		}
+		fmt.Fprintf(in, "e:%s:%s:%s\n", s.signer.PublicKey(), s.signer.Sign(encoded), encoded)
+	}
+
+	// The node is nodeA, on the slot the messages are for, with the account
+	// that the messages say bob has
+	qs := consensus.MakeQuorumSlice([]util.PublicKey{
+		keys["nodeA"].PublicKey(), keys["nodeB"].PublicKey(), keys["nodeC"].PublicKey(),
+	}, 2)
+	node := NewNode(keys["nodeA"].PublicKey(), qs)
+	err := node.RestoreCheckpoint(&CheckpointMessage{
+		I: 8,
+		E: &consensus.ExternalizeMessage{I: 8, X: consensus.EmptyValue, Cn: 1, Hn: 1, D: qs},
+		State: &currency.LedgerState{
+			Slot: 9,
+			Accounts: map[util.PublicKey]*currency.Account{
+				keys["bob"].PublicKey(): &currency.Account{Sequence: 7, Balance: 897},
+			},
+		},
+	})
+	if err != nil || node.Slot() != 9 {
+		t.Fatalf("could not get the node to slot 9: %v", err)
+	}
+
+	wire := util.NewWire(struct {
+		io.Reader
+		io.Writer
+	}{in, ioutil.Discard})
+	responses := map[string]util.Message{}
+	for _, s := range signers {
+		sm, err := wire.Read()
+		if err != nil {
+			t.Fatalf("could not read the previous version of message type %s: %s",
+				s.name, err)
+		}
+		if sm.Signer() != s.signer.PublicKey() || sm.Message().MessageType() != s.name {
+			t.Fatalf("read %s from %s in place of message type %s",
+				sm.Message(), util.Shorten(string(sm.Signer())), s.name)
+		}
+		responses[s.name] = node.Handle(sm.Signer(), sm.Message())
+	}
+	if !wire.Lines() {
+		t.Fatal("the wire should have noticed the previous version framing")
+	}
+
+	am, ok := responses["I"].(*currency.AccountMessage)
+	if !ok || am.State[keys["bob"].PublicKey()] == nil ||
+		am.State[keys["bob"].PublicKey()].Balance != 897 {
+		t.Fatalf("bad response to a previous version info message: %v", responses["I"])
+	}
+	if e, ok := responses["T"].(*util.ErrorMessage); !ok || !strings.Contains(e.Error, "signature") {
+		// The golden signatures are placeholders too, but the transaction
+		// should get as far as checking its signature
+		t.Fatalf("bad response to a previous version transaction: %v", responses["T"])
+	}
+	snap := node.chain.Snapshot().Block
+	n := snap.Nomination.N[keys["nodeB"].PublicKey()]
+	if n == nil || len(n.Nom) != 2 || n.C != 3 {
+		t.Fatalf("the previous version nomination was not counted: %+v", n)
+	}
+	for name, expected := range map[string]string{"nodeB": "C", "nodeC": "E"} {
+		encoded, ok := snap.Ballot.M[keys[name].PublicKey()]
+		if !ok {
+			t.Fatalf("no ballot message from %s", name)
+		}
+		m, err := util.DecodeMessage(encoded)
+		if err != nil || m.MessageType() != expected {
+			t.Fatalf("the latest ballot message from %s should be %s but it is %s",
+				name, expected, encoded)
+		}
+	}
+
+	// Signatures cover the json encoding of a transaction, so old transactions
+	// must encode exactly as they used to, or they would stop verifying.
+	m, err := util.DecodeMessage(previous["T"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range m.(*currency.TransactionMessage).Transactions {
+		bytes, err := json.Marshal(st.Transaction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := `{"From":"bob","Sequence":7,"To":"carol","Amount":100,"Fee":3}`
+		if string(bytes) != expected {
+			t.Fatalf("a previous version transaction now encodes as %s", bytes)
+		}
+	}
+}
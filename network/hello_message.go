@@ -0,0 +1,61 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// The version of the protocol peers speak on a link. It goes up whenever a
+// change means that nodes running the old code can't understand the new.
+// Version 2 put messages in frames instead of lines, and added the counter to
+// nomination messages.
+const ProtocolVersion = 2
+
+// The first protocol version that puts messages in frames. Older nodes put
+// each message on a line of its own, so a link starts out with lines, and
+// switches to frames once both ends have said hello with at least this
+// version.
+const FrameProtocolVersion = 2
+
+// The oldest protocol version we still link up with, so that a network can be
+// upgraded one node at a time. Nominations from version 1 nodes don't have a
+// counter, so one is filled in when they are decoded.
+const MinProtocolVersion = 1
+
+// A HelloMessage is the first message a node sends on a connection to a
+// peer. It asks the peer to use this connection for messages in both
+// directions, so that each pair of peers only needs one connection.
+// It also says which network the node is on and which protocol it speaks,
+// so that nodes that can't work together don't link up.
+// A peer that accepts the link answers with a hello of its own, so both
+// ends know they have the right node. The node's public key is the signer.
+
+type HelloMessage struct {
+	Version int    `json:",omitempty"`
+	Network string `json:",omitempty"`
+	Genesis string `json:",omitempty"`
+
+	// The slot the node is working on
+	CurrentSlot int `json:",omitempty"`
+}
+
+func (m *HelloMessage) Slot() int {
+	return 0
+}
+
+func (m *HelloMessage) MessageType() string {
+	return "L"
+}
+
+func (m *HelloMessage) String() string {
+	if m.Network == "" {
+		return fmt.Sprintf("hello v%d slot=%d", m.Version, m.CurrentSlot)
+	}
+	return fmt.Sprintf("hello v%d network=%s genesis=%s slot=%d", m.Version, m.Network,
+		util.Shorten(m.Genesis), m.CurrentSlot)
+}
+
+func init() {
+	util.RegisterMessageType(&HelloMessage{})
+}
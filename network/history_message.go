@@ -5,6 +5,7 @@ import (
 
 	"coinkit/consensus"
 	"coinkit/currency"
+	"coinkit/registry"
 	"coinkit/util"
 )
 
@@ -15,6 +16,13 @@ type HistoryMessage struct {
 	I int
 	T *currency.TransactionMessage
 	E *consensus.ExternalizeMessage
+
+	// How the slot changed the ledger. It may be sent instead of T, when the
+	// receiver only needs the resulting state
+	D *currency.StateDiffMessage `json:",omitempty"`
+
+	// The registry batch finalized in the slot, if there was one
+	M *registry.RegistryMessage `json:",omitempty"`
 }
 
 func (m *HistoryMessage) Slot() int {
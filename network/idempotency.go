@@ -0,0 +1,98 @@
+package network
+
+import (
+	"errors"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+// Clients can attach an idempotency key to a TransactionMessage. When a
+// client retries a submission with the same key, because it never heard back
+// the first time, the node sends back the response it gave the first time
+// instead of handling the transactions again. Keys belong to whoever signed
+// the message, so clients can't see each other's responses.
+// Each node only remembers the keys that were sent to it, and not across
+// restarts, so a retry should go to the same node soon after.
+
+// How many idempotency keys a node remembers. Older ones are forgotten.
+const MaxIdempotencyKeys = 10000
+
+// Keys longer than this are rejected, so that remembering them stays cheap
+const MaxIdempotencyKeyLength = 100
+
+var (
+	ErrIdempotencyKeyTooLong = errors.New("idempotency key is too long")
+	ErrIdempotencyKeyReused  = errors.New("idempotency key was already used for a different request")
+)
+
+type idempotentResult struct {
+	// The signer and the key, which is what the result is indexed by
+	id string
+
+	// The hash of the request, so that a different request with the same
+	// key isn't mistaken for a retry
+	hash string
+
+	response util.Message
+}
+
+// idempotencyCache is a ring buffer of the most recent results.
+// idempotencyCache is not threadsafe.
+type idempotencyCache struct {
+	results map[string]*idempotentResult
+	order   []*idempotentResult
+
+	// Where the next result goes in order, once it is full
+	next int
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		results: make(map[string]*idempotentResult),
+		order:   []*idempotentResult{},
+	}
+}
+
+func idempotencyID(sender util.PublicKey, key string) string {
+	return string(sender) + " " + key
+}
+
+func idempotencyHash(m *currency.TransactionMessage) string {
+	return consensus.HashString(util.EncodeMessage(m))
+}
+
+// lookup returns the response to an earlier request with the same key, if
+// there was one. It returns an error if the earlier request was different.
+func (c *idempotencyCache) lookup(
+	sender util.PublicKey, m *currency.TransactionMessage) (util.Message, bool, error) {
+	if len(m.IdempotencyKey) > MaxIdempotencyKeyLength {
+		return nil, false, ErrIdempotencyKeyTooLong
+	}
+	result, ok := c.results[idempotencyID(sender, m.IdempotencyKey)]
+	if !ok {
+		return nil, false, nil
+	}
+	if result.hash != idempotencyHash(m) {
+		return nil, false, ErrIdempotencyKeyReused
+	}
+	return result.response, true, nil
+}
+
+func (c *idempotencyCache) add(
+	sender util.PublicKey, m *currency.TransactionMessage, response util.Message) {
+	result := &idempotentResult{
+		id:       idempotencyID(sender, m.IdempotencyKey),
+		hash:     idempotencyHash(m),
+		response: response,
+	}
+	c.results[result.id] = result
+	if len(c.order) < MaxIdempotencyKeys {
+		c.order = append(c.order, result)
+		return
+	}
+	delete(c.results, c.order[c.next].id)
+	c.order[c.next] = result
+	c.next = (c.next + 1) % MaxIdempotencyKeys
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"strings"
+	"testing"
+
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+func TestNodeIdempotencyKeys(t *testing.T) {
+	f := NewFixture(3, 4)
+	nodes := f.Nodes()
+	alice := f.Clients[0]
+	bob := f.Clients[1]
+	send := func(kp *util.KeyPair, sequence uint32, amount uint64, key string) util.Message {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: sequence,
+			To:       f.Clients[2].PublicKey(),
+			Amount:   amount,
+		}
+		tm := currency.NewTransactionMessage(tr.SignWith(kp))
+		tm.IdempotencyKey = key
+		return nodes[0].Handle(kp.PublicKey(), util.EncodeThenDecode(tm))
+	}
+
+	if m := send(alice, 1, 1, "a"); m != nil {
+		t.Fatalf("the first send failed: %s", m)
+	}
+	for i := 0; i < 20 && nodes[0].Slot() == 1; i++ {
+		tickNodes(nodes)
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+	}
+	if nodes[0].Slot() == 1 {
+		t.Fatal("the transaction did not clear")
+	}
+
+	// A retry without the key finds the transaction was already handled
+	if m := send(alice, 1, 1, ""); m == nil {
+		t.Fatal("sending the same transaction again should fail")
+	}
+
+	// A retry with the key gets the original response
+	if m := send(alice, 1, 1, "a"); m != nil {
+		t.Fatalf("the retry should succeed like the original, but got %s", m)
+	}
+
+	// Different requests can't reuse the key
+	m := send(alice, 2, 1, "a")
+	if e, ok := m.(*util.ErrorMessage); !ok || e.Error != ErrIdempotencyKeyReused.Error() {
+		t.Fatalf("expected a reused key error but got %v", m)
+	}
+
+	// Keys belong to whoever sent them
+	if m := send(bob, 1, 1, "a"); m != nil {
+		t.Fatalf("bob's key should not clash with alice's, but got %s", m)
+	}
+
+	// Transient errors aren't remembered, so a retry tries again
+	m = send(alice, 2, FixtureBalance, "b")
+	if e, ok := m.(*util.ErrorMessage); !ok || !e.Transient {
+		t.Fatalf("expected a transient error but got %v", m)
+	}
+	nodes[0].queue.SetBalance(alice.PublicKey(), 2*FixtureBalance)
+	if m := send(alice, 2, FixtureBalance, "b"); m != nil {
+		t.Fatalf("the retry should have been handled again, but got %s", m)
+	}
+
+	m = send(alice, 3, 1, strings.Repeat("x", MaxIdempotencyKeyLength+1))
+	if e, ok := m.(*util.ErrorMessage); !ok || e.Error != ErrIdempotencyKeyTooLong.Error() {
+		t.Fatalf("expected a long key error but got %v", m)
+	}
+}
+
+func TestIdempotencyCacheForgetsOldKeys(t *testing.T) {
+	c := newIdempotencyCache()
+	m := &currency.TransactionMessage{}
+	for i := 0; i <= MaxIdempotencyKeys; i++ {
+		m.IdempotencyKey = string(rune('a'+i%26)) + strings.Repeat("z", i/26)
+		c.add("alice", m, nil)
+	}
+	if len(c.results) != MaxIdempotencyKeys {
+		t.Fatalf("the cache has %d keys", len(c.results))
+	}
+	m.IdempotencyKey = "a"
+	if _, ok, _ := c.lookup("alice", m); ok {
+		t.Fatal("the oldest key should be forgotten")
+	}
+}
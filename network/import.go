@@ -0,0 +1,92 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+// How many transactions Client.Import sends in each ImportMessage
+const ImportBatchSize = 1000
+
+// How long an importer waits when a node's import backlog is full
+const ImportRetryInterval = time.Second
+
+// Import streams transactions to the node for bulk import, signing each
+// batch with kp, which needs AdminScope on the node. It keeps going until ts
+// is closed, waiting whenever the node's backlog is full. The transactions
+// should already be valid, since the node drops any that never will be.
+// It returns how many transactions it sent and the node's backlog after the
+// last batch.
+func (c *Client) Import(ctx context.Context, kp *util.KeyPair,
+	ts <-chan *currency.SignedTransaction) (int, int, error) {
+	sent := 0
+	backlog := 0
+	batch := []*currency.SignedTransaction{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var err error
+		backlog, err = c.importBatch(ctx, kp, batch)
+		if err != nil {
+			return err
+		}
+		sent += len(batch)
+		batch = []*currency.SignedTransaction{}
+		return nil
+	}
+	for {
+		select {
+		case t, ok := <-ts:
+			if !ok {
+				err := flush()
+				return sent, backlog, err
+			}
+			batch = append(batch, t)
+			if len(batch) < ImportBatchSize {
+				continue
+			}
+		case <-ctx.Done():
+			return sent, backlog, ctx.Err()
+		}
+		if err := flush(); err != nil {
+			return sent, backlog, err
+		}
+	}
+}
+
+// importBatch sends one batch, retrying as long as the backlog is full, and
+// returns the backlog afterwards.
+func (c *Client) importBatch(ctx context.Context, kp *util.KeyPair,
+	batch []*currency.SignedTransaction) (int, error) {
+	sm := util.NewSignedMessage(kp, &currency.ImportMessage{Transactions: batch})
+	for {
+		response, err := c.SendMessage(ctx, sm)
+		if err != nil {
+			return 0, err
+		}
+		if response == nil {
+			return 0, ErrNoResponse
+		}
+		switch m := response.Message().(type) {
+		case *currency.ImportMessage:
+			return m.Backlog, nil
+		case *util.ErrorMessage:
+			if m.RetryAfter == 0 {
+				return 0, errors.New(m.Error)
+			}
+			select {
+			case <-time.After(m.RetryAfter):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		default:
+			return 0, fmt.Errorf("expected an import backlog but got %s", m)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"context"
+	"testing"
+
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+func TestImport(t *testing.T) {
+	admin := util.NewKeyPairFromSecretPhrase("admin")
+	_, configs := NewUnitTestNetwork()
+	servers := []*Server{}
+	for _, config := range configs {
+		config.Access = &AccessPolicy{
+			Keys:    map[util.PublicKey]Scope{admin.PublicKey(): AdminScope},
+			Default: AllScopes,
+		}
+		s := NewServer(config)
+		s.InitMint()
+		s.ServeInBackground()
+		servers = append(servers, s)
+	}
+	defer stopServers(servers)
+	client := NewClient(servers[0].LocalhostAddress())
+	defer client.Close()
+	ctx := context.Background()
+
+	// The mint funds two accounts, which each pay carol
+	mint := util.NewKeyPairFromSecretPhrase("mint")
+	alice := util.NewKeyPairFromSecretPhrase("alice")
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+	carol := util.NewKeyPairFromSecretPhrase("carol")
+	send := func(from *util.KeyPair, sequence uint32, to *util.KeyPair, amount uint64) *currency.SignedTransaction {
+		return (&currency.Transaction{
+			From:     from.PublicKey(),
+			Sequence: sequence,
+			To:       to.PublicKey(),
+			Amount:   amount,
+		}).SignWith(from)
+	}
+	signed := []*currency.SignedTransaction{
+		send(alice, 1, carol, 10),
+		send(bob, 1, carol, 20),
+		send(mint, 1, alice, 100),
+		send(mint, 2, bob, 100),
+	}
+
+	ts := make(chan *currency.SignedTransaction, len(signed))
+	for _, st := range signed {
+		ts <- st
+	}
+	close(ts)
+	if _, _, err := client.Import(ctx, util.NewKeyPair(), ts); err == nil {
+		t.Fatal("only the admin should be able to import")
+	}
+
+	ts = make(chan *currency.SignedTransaction, len(signed))
+	for _, st := range signed {
+		ts <- st
+	}
+	close(ts)
+	sent, _, err := client.Import(ctx, admin, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != len(signed) {
+		t.Fatalf("expected to send %d but sent %d", len(signed), sent)
+	}
+	for _, kp := range []*util.KeyPair{alice, bob} {
+		if _, err := client.WaitToClear(ctx, kp.PublicKey(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	account, err := client.GetAccount(ctx, carol.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 30 {
+		t.Fatalf("carol should have 30 but has %d", account.Balance)
+	}
+}
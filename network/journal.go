@@ -0,0 +1,279 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"coinkit/consensus"
+	"coinkit/registry"
+	"coinkit/util"
+)
+
+// A journal records everything that changes a server's node, in order, so
+// that a consensus bug seen on a live server can be reproduced by replaying
+// the journal into a fresh node. The node only changes when messages
+// arrive, when the timer ticks, and when it is set up or reconfigured, so
+// those are the entries.
+
+// A JournalEntry is one line of a journal. Exactly one of the fields after
+// Time is set.
+type JournalEntry struct {
+	// When this happened on the server. Replays don't wait between entries,
+	// so this is only there for whoever is debugging
+	Time time.Time
+
+	// The first entry says how to make the node
+	Start *JournalStart `json:",omitempty"`
+
+	// A starting balance
+	Balance *JournalBalance `json:",omitempty"`
+
+	// A message restored from the data file, in its encoded form
+	Restore string `json:",omitempty"`
+
+	// A signed message we received, in its serialized form
+	Message string `json:",omitempty"`
+
+	// Whether the timer ticked
+	Tick bool `json:",omitempty"`
+
+	// A change to our quorum slice
+	QuorumSlice *consensus.QuorumSlice `json:",omitempty"`
+}
+
+// A JournalStart has what we need to make a node like the one recorded.
+type JournalStart struct {
+	Node        util.PublicKey
+	QuorumSlice consensus.QuorumSlice
+	Leader      util.PublicKey `json:",omitempty"`
+	Archive     bool           `json:",omitempty"`
+
+	EmptySlotTicks int `json:",omitempty"`
+
+	// What the node published about itself in the validator registry
+	Metadata *registry.SignedMetadata `json:",omitempty"`
+}
+
+type JournalBalance struct {
+	Owner  util.PublicKey
+	Amount uint64
+}
+
+// A Journal appends entries to a file. Each entry is flushed as soon as it is
+// written, so a journal is complete up to the moment a server crashes.
+// Entries written after Close are dropped, and a nil Journal records
+// nothing.
+// Journal is threadsafe.
+type Journal struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	closed bool
+}
+
+// NewJournal starts a journal at path, replacing anything already there.
+func NewJournal(path string) (*Journal, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (j *Journal) write(entry *JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+	entry.Time = time.Now()
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.writer.Write(bytes)
+	j.writer.WriteByte('\n')
+	return j.writer.Flush()
+}
+
+func (j *Journal) recordStart(start *JournalStart) error {
+	return j.write(&JournalEntry{Start: start})
+}
+
+func (j *Journal) recordBalance(owner util.PublicKey, amount uint64) error {
+	return j.write(&JournalEntry{Balance: &JournalBalance{Owner: owner, Amount: amount}})
+}
+
+func (j *Journal) recordRestore(m util.Message) error {
+	return j.write(&JournalEntry{Restore: util.EncodeMessage(m)})
+}
+
+func (j *Journal) recordMessage(sm *util.SignedMessage) error {
+	return j.write(&JournalEntry{Message: sm.Serialize()})
+}
+
+func (j *Journal) recordTick() error {
+	return j.write(&JournalEntry{Tick: true})
+}
+
+func (j *Journal) recordQuorumSlice(qs consensus.QuorumSlice) error {
+	return j.write(&JournalEntry{QuorumSlice: &qs})
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	j.writer.Flush()
+	return j.file.Close()
+}
+
+// ReadJournal reads all the entries in the journal at path.
+func ReadJournal(path string) ([]*JournalEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := []*JournalEntry{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, fmt.Errorf("bad journal entry %d: %s", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// A Replayer feeds journal entries into a fresh node, the same way the
+// server that recorded them did, so that the node ends up in the same state.
+// Stepping through a replay one entry at a time shows exactly where it goes
+// wrong.
+type Replayer struct {
+	Node *Node
+
+	entries []*JournalEntry
+	next    int
+}
+
+// NewReplayer makes the node described by the first journal entry.
+func NewReplayer(entries []*JournalEntry) (*Replayer, error) {
+	if len(entries) == 0 || entries[0].Start == nil {
+		return nil, fmt.Errorf("the journal does not start with a node")
+	}
+	start := entries[0].Start
+	var node *Node
+	if start.Leader != "" {
+		node = NewFollowerNode(start.Node, start.Leader)
+	} else {
+		node = NewNode(start.Node, start.QuorumSlice)
+	}
+	node.archive = start.Archive
+	node.SetEmptySlotTicks(start.EmptySlotTicks)
+	if start.Metadata != nil {
+		if _, err := node.registry.Add(start.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return &Replayer{
+		Node:    node,
+		entries: entries,
+		next:    1,
+	}, nil
+}
+
+// Done returns whether every entry has been replayed.
+func (r *Replayer) Done() bool {
+	return r.next >= len(r.entries)
+}
+
+// Step replays the next entry and returns it.
+func (r *Replayer) Step() (*JournalEntry, error) {
+	if r.Done() {
+		return nil, fmt.Errorf("the replay is done")
+	}
+	entry := r.entries[r.next]
+	r.next++
+	node := r.Node
+	switch {
+	case entry.Balance != nil:
+		node.queue.SetBalance(entry.Balance.Owner, entry.Balance.Amount)
+
+	case entry.Restore != "":
+		m, err := util.DecodeMessage(entry.Restore)
+		if err != nil {
+			return nil, err
+		}
+		switch m := m.(type) {
+		case *CheckpointMessage:
+			err = node.RestoreCheckpoint(m)
+		case *HistoryMessage:
+			err = node.Restore(m)
+		default:
+			err = fmt.Errorf("unexpected restored message: %s", m)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	case entry.Message != "":
+		sm, err := util.NewSignedMessageFromSerialized(entry.Message)
+		if err != nil {
+			return nil, err
+		}
+		node.Handle(sm.Signer(), sm.Message())
+		node.OutgoingMessages()
+		node.Resync()
+
+	case entry.Tick:
+		if node.HandleTimerTick() {
+			node.OutgoingMessages()
+		}
+
+	case entry.QuorumSlice != nil:
+		if err := node.SetQuorumSlice(*entry.QuorumSlice); err != nil {
+			return nil, err
+		}
+		node.OutgoingMessages()
+
+	default:
+		return nil, fmt.Errorf("empty journal entry %d", r.next-1)
+	}
+	return entry, nil
+}
+
+// Run replays all the remaining entries.
+func (r *Replayer) Run() error {
+	for !r.Done() {
+		if _, err := r.Step(); err != nil {
+			return fmt.Errorf("journal entry %d: %s", r.next-1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"coinkit/currency"
+	"coinkit/data"
+	"coinkit/util"
+)
+
+func TestReplayMatchesServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+	datafile := filepath.Join(dir, "data")
+
+	_, configs := NewUnitTestNetwork()
+	configs[0].Journal = journal
+	configs[0].DataFile = datafile
+	servers := []*Server{}
+	for _, config := range configs {
+		s := NewServer(config)
+		s.InitMint()
+		s.ServeInBackground()
+		servers = append(servers, s)
+	}
+	mint := util.NewKeyPairFromSecretPhrase("mint")
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+	client := NewClient(servers[0].LocalhostAddress())
+	sendMoney(client, mint, bob, 100)
+	sendMoney(client, mint, bob, 100)
+	client.Close()
+	stopServers(servers)
+
+	entries, err := ReadJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReplayer(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything the server saved, the replay should have finalized the
+	// same way
+	db, err := data.NewDatabase(datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	saved := 0
+	err = db.ForEach(func(m util.Message) error {
+		h := m.(*HistoryMessage)
+		replayed := r.Node.History(h.I)
+		if replayed == nil || util.EncodeMessage(replayed) != util.EncodeMessage(h) {
+			t.Fatalf("slot %d was %s but replayed as %s", h.I, h, replayed)
+		}
+		saved++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved < 2 {
+		t.Fatalf("expected at least two slots but the server saved %d", saved)
+	}
+	am := r.Node.queue.HandleInfoMessage(
+		&util.InfoMessage{Account: bob.PublicKey()}).(*currency.AccountMessage)
+	if am.State[bob.PublicKey()].Balance != 200 {
+		t.Fatalf("bob should have 200 after the replay but has %d",
+			am.State[bob.PublicKey()].Balance)
+	}
+}
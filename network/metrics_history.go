@@ -0,0 +1,183 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A server samples a few key metrics every MetricsInterval and keeps
+// the most recent ones, so that an operator can see how a node has been
+// doing lately without running a monitoring stack. When the server has a
+// metrics file, the samples are saved there, so they survive a restart.
+
+// How many samples a server keeps. At the default of one a minute, that is
+// a day
+const MetricsHistorySize = 24 * 60
+
+// A MetricsSample is how a server was doing over one sample interval.
+type MetricsSample struct {
+	// When the sample was taken
+	Time time.Time
+
+	// The slot the node was working on
+	I int
+
+	// How long the slots that finished during the interval took on average.
+	// Zero if none finished, or for read replicas
+	SlotTime time.Duration `json:",omitempty"`
+
+	// How many transactions per second were finalized during the interval
+	TPS float64
+
+	// How many peers we had links to
+	Peers int
+}
+
+func (s *MetricsSample) String() string {
+	return fmt.Sprintf("%s slot %d, %.1fs per slot, %.1f tps, %d peers",
+		s.Time.Format(time.RFC3339), s.I, s.SlotTime.Seconds(), s.TPS, s.Peers)
+}
+
+// metricsHistory is a ring buffer of the most recent samples.
+// metricsHistory is threadsafe.
+type metricsHistory struct {
+	mutex   sync.Mutex
+	samples []*MetricsSample
+
+	// Where the next sample goes in samples, once it is full
+	next int
+
+	// Where samples are saved. Empty means they aren't
+	path string
+}
+
+// newMetricsHistory loads the samples saved at path, if there are any.
+func newMetricsHistory(path string) (*metricsHistory, error) {
+	h := &metricsHistory{
+		samples: []*MetricsSample{},
+		path:    path,
+	}
+	if path == "" {
+		return h, nil
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	samples := []*MetricsSample{}
+	if err := json.Unmarshal(bytes, &samples); err != nil {
+		return nil, fmt.Errorf("bad metrics file %s: %w", path, err)
+	}
+	for _, sample := range samples {
+		h.add(sample)
+	}
+	return h, nil
+}
+
+func (h *metricsHistory) add(sample *MetricsSample) {
+	if len(h.samples) < MetricsHistorySize {
+		h.samples = append(h.samples, sample)
+		return
+	}
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % MetricsHistorySize
+}
+
+// list returns the samples, oldest first.
+func (h *metricsHistory) list() []*MetricsSample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	answer := append([]*MetricsSample{}, h.samples[h.next:]...)
+	return append(answer, h.samples[:h.next]...)
+}
+
+// record adds a sample and saves the history.
+func (h *metricsHistory) record(sample *MetricsSample) error {
+	h.mutex.Lock()
+	h.add(sample)
+	h.mutex.Unlock()
+	if h.path == "" {
+		return nil
+	}
+	bytes, err := json.Marshal(h.list())
+	if err != nil {
+		return err
+	}
+
+	// Write a new file and swap it in, so a crash can't leave half of one
+	temp := h.path + ".tmp"
+	if err := ioutil.WriteFile(temp, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, h.path)
+}
+
+// unsafeSampleMetrics records a sample when one is due.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeSampleMetrics() {
+	now := time.Now()
+	if now.Sub(s.lastSample) < s.MetricsInterval {
+		return
+	}
+	elapsed := now.Sub(s.lastSample)
+	s.lastSample = now
+
+	sample := &MetricsSample{
+		Time:  now,
+		I:     s.node.Slot(),
+		TPS:   float64(s.finalized) / elapsed.Seconds(),
+		Peers: s.linkCount(),
+	}
+	s.finalized = 0
+
+	total := time.Duration(0)
+	count := 0
+	for _, stats := range s.node.Status().Slots {
+		if stats.Slot >= s.lastSampleSlot {
+			total += stats.Duration()
+			count++
+		}
+	}
+	if count > 0 {
+		sample.SlotTime = total / time.Duration(count)
+	}
+	s.lastSampleSlot = sample.I
+
+	if err := s.metricsHistory.record(sample); err != nil {
+		log.Printf("could not save metrics: %s", err)
+	}
+}
+
+// unsafeCountFinalized counts the transactions in slots from first up to but
+// not including last, for the metrics.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeCountFinalized(first int, last int) {
+	for slot := first; slot < last; slot++ {
+		h := s.node.History(slot)
+		if h == nil || h.T == nil {
+			continue
+		}
+		for _, chunk := range h.T.Chunks {
+			s.finalized += len(chunk.Transactions)
+		}
+	}
+}
+
+func (s *Server) linkCount() int {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	return len(s.links)
+}
+
+// MetricsHistory returns the recent metrics samples, oldest first.
+func (s *Server) MetricsHistory() []*MetricsSample {
+	return s.metricsHistory.list()
+}
@@ -0,0 +1,88 @@
+package network
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"coinkit/util"
+)
+
+func TestMetricsHistoryKeepsRecentSamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	h, err := newMetricsHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= MetricsHistorySize+5; i++ {
+		if err := h.record(&MetricsSample{I: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(samples []*MetricsSample) {
+		if len(samples) != MetricsHistorySize {
+			t.Fatalf("expected %d samples but got %d", MetricsHistorySize, len(samples))
+		}
+		if samples[0].I != 6 || samples[len(samples)-1].I != MetricsHistorySize+5 {
+			t.Fatalf("expected the newest samples in order but got %s to %s",
+				samples[0], samples[len(samples)-1])
+		}
+	}
+	check(h.list())
+
+	reloaded, err := newMetricsHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(reloaded.list())
+}
+
+func TestServerMetrics(t *testing.T) {
+	admin := util.NewKeyPairFromSecretPhrase("admin")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	_, configs := NewUnitTestNetwork()
+	configs[0].MetricsFile = path
+	servers := []*Server{}
+	for _, config := range configs {
+		config.Access = &AccessPolicy{
+			Keys:    map[util.PublicKey]Scope{admin.PublicKey(): AdminScope},
+			Default: AllScopes,
+		}
+		s := NewServer(config)
+		s.InitMint()
+		s.BallotTimerInterval = 10 * time.Millisecond
+		s.MetricsInterval = 20 * time.Millisecond
+		s.ServeInBackground()
+		servers = append(servers, s)
+	}
+	defer stopServers(servers)
+	client := NewClient(servers[0].LocalhostAddress())
+	defer client.Close()
+	ctx := context.Background()
+
+	if _, err := client.GetMetrics(ctx, util.NewKeyPair()); err == nil {
+		t.Fatal("only the admin should be able to see the metrics")
+	}
+
+	for i := 0; ; i++ {
+		samples, err := client.GetMetrics(ctx, admin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) > 0 && samples[len(samples)-1].Peers == len(servers)-1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("the metrics never showed every peer: %v", samples)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The samples are still there after a restart
+	servers[0].Stop()
+	restarted := NewServer(configs[0])
+	if len(restarted.MetricsHistory()) == 0 {
+		t.Fatal("the metrics were not saved")
+	}
+}
@@ -0,0 +1,40 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// A MetricsMessage asks a server for its recent metrics, or responds with
+// them. Only admins can ask, by sending one without any samples.
+type MetricsMessage struct {
+	// The samples, oldest first
+	Samples []*MetricsSample `json:",omitempty"`
+
+	// The most recent messages the server could not decode, oldest first
+	DeadLetters []*DeadLetter `json:",omitempty"`
+
+	// How many messages the server has ever failed to decode
+	Undecodable int `json:",omitempty"`
+
+	// The state of the server's links to its peers
+	Peers []*PeerState `json:",omitempty"`
+}
+
+func (m *MetricsMessage) Slot() int {
+	return 0
+}
+
+func (m *MetricsMessage) MessageType() string {
+	return "Y"
+}
+
+func (m *MetricsMessage) String() string {
+	return fmt.Sprintf("metrics with %d samples and %d dead letters",
+		len(m.Samples), len(m.DeadLetters))
+}
+
+func init() {
+	util.RegisterMessageType(&MetricsMessage{})
+}
@@ -1,65 +1,309 @@
 package network
 
 import (
+	"fmt"
 	"log"
+	"sort"
 
 	"coinkit/consensus"
 	"coinkit/currency"
+	"coinkit/data"
+	"coinkit/registry"
 	"coinkit/util"
 )
 
+// Consensus messages for slots up to this far ahead of the node are buffered
+// until the node gets to their slot. Messages further ahead are dropped.
+const FutureSlotWindow = 5
+
+// Consensus messages for slots more than this far behind the node are dropped.
+const PastSlotWindow = 100
+
+// By default, nodes keep this many slots of finalized history in memory, so
+// that they can help peers catch up. Archive nodes keep all of it, unless
+// they have a history store to read it back from.
+const HistoryRetention = PastSlotWindow
+
+// History that peers send us for slots up to this far ahead is kept until we
+// get to its slot. History further ahead is dropped.
+const CatchupWindow = MaxHistoryRange
+
+// A consensus message that arrived before we were ready for its slot
+type bufferedMessage struct {
+	sender  util.PublicKey
+	message util.Message
+}
+
 // Node is the logical container for everything one node in the network handles.
 // Node is not threadsafe.
 type Node struct {
-	publicKey string
+	publicKey util.PublicKey
 	chain     *consensus.Chain
 	queue     *currency.TransactionQueue
+	registry  *registry.Registry
+
+	// The apps that share the chain. The queue is the "currency" app and
+	// the registry is the "registry" app
+	values *consensus.CompositeValueStore
+
+	// Consensus messages for future slots, indexed by slot.
+	// For each slot, we only keep the latest message of each type from
+	// each sender.
+	future map[int]map[string]*bufferedMessage
+
+	// When leader is set, this node is a follower. It does not take part in
+	// consensus, and just applies the history that leader has finalized.
+	leader util.PublicKey
+
+	// The externalize messages a follower has applied, indexed by slot
+	followed map[int]*consensus.ExternalizeMessage
+
+	// Archive nodes keep all history, and serve it to anyone who asks
+	archive bool
+
+	// How many slots of finalized history we keep in memory
+	retention int
+
+	// Where finalized history is saved, so that history pruned from memory
+	// can still be read back. Nil if it isn't saved
+	store *data.Database
+
+	// The slot whose history is first in the store. After the store is
+	// compacted, it starts with a checkpoint for this slot instead
+	storeFirst int
+
+	// History that peers sent us for future slots, indexed by slot and then
+	// by sender. It still goes through consensus once we get to its slot,
+	// so no single peer can make us finalize anything.
+	catchup map[int]map[util.PublicKey]*HistoryMessage
+
+	// The highest slot each peer in our quorum slice has sent a consensus
+	// message for, until we catch up to it. When enough of them are beyond
+	// the future slot window, we ask our peers for history.
+	peerSlots map[util.PublicKey]int
+
+	// The responses to recent client requests that had idempotency keys
+	idempotency *idempotencyCache
+
+	// The headers of recently finalized slots, indexed by slot
+	headers map[int]*BlockHeaderMessage
+
+	// The hash of the last header we made, and its slot. The next header
+	// refers to it, even once the header itself is pruned
+	lastHeader     string
+	lastHeaderSlot int
+}
+
+// The names of the apps in slot values
+const (
+	CurrencyApp = "currency"
+	RegistryApp = "registry"
+)
+
+func newValueStore(queue *currency.TransactionQueue,
+	r *registry.Registry) *consensus.CompositeValueStore {
+	values := consensus.NewCompositeValueStore()
+	values.Add(CurrencyApp, queue)
+	values.Add(RegistryApp, r)
+	return values
 }
 
-func NewNode(publicKey string, qs consensus.QuorumSlice) *Node {
+func NewNode(publicKey util.PublicKey, qs consensus.QuorumSlice) *Node {
 	queue := currency.NewTransactionQueue(publicKey)
+	r := registry.NewRegistry(publicKey)
+	r.SetMembers(qs.AllMembers())
+	values := newValueStore(queue, r)
 
 	return &Node{
-		publicKey: publicKey,
-		chain:     consensus.NewEmptyChain(publicKey, qs, queue),
-		queue:     queue,
+		publicKey:   publicKey,
+		chain:       consensus.NewEmptyChain(publicKey, qs, values, consensus.RealClock{}),
+		queue:       queue,
+		registry:    r,
+		values:      values,
+		future:      make(map[int]map[string]*bufferedMessage),
+		catchup:     make(map[int]map[util.PublicKey]*HistoryMessage),
+		peerSlots:   make(map[util.PublicKey]int),
+		retention:   HistoryRetention,
+		storeFirst:  1,
+		idempotency: newIdempotencyCache(),
+		headers:     make(map[int]*BlockHeaderMessage),
 	}
 }
 
 // Slot() returns the slot this node is currently working on
 func (node *Node) Slot() int {
+	if node.leader != "" {
+		return node.queue.Slot()
+	}
 	return node.chain.Slot()
 }
 
 // Handle handles an incoming message.
 // It may return a message to be sent back to the original sender, or it may
 // just return nil if it has no particular response.
-func (node *Node) Handle(sender string, message util.Message) util.Message {
+func (node *Node) Handle(sender util.PublicKey, message util.Message) util.Message {
 	if sender == node.publicKey {
 		return nil
 	}
+	if batch, ok := message.(*BatchMessage); ok {
+		// The messages in a batch are handled one at a time, and their
+		// responses go back together
+		responses := []util.Message{}
+		for _, m := range batch.Messages {
+			if response := node.Handle(sender, m); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		return batchOf(responses)
+	}
+	if node.leader != "" {
+		return node.handleAsFollower(sender, message)
+	}
 	switch m := message.(type) {
 
 	case *HistoryMessage:
-		node.Handle(sender, m.T)
+		if m.E == nil || m.E.I != m.I {
+			return nil
+		}
+		if m.I > node.Slot() && node.isPeer(sender) {
+			node.saveCatchup(sender, m)
+			return nil
+		}
+		// Empty and registry-only slots have no transactions
+		if m.T != nil {
+			node.Handle(sender, m.T)
+		}
+		if m.M != nil {
+			node.Handle(sender, m.M)
+		}
 		node.Handle(sender, m.E)
 		return nil
 
+	case *HistoryRangeMessage:
+		for _, h := range m.History {
+			if h == nil {
+				continue
+			}
+			node.Handle(sender, h)
+		}
+		return nil
+
+	case *HistoryRequestMessage:
+		return node.handleHistoryRequest(sender, m)
+
 	case *currency.AccountMessage:
 		return nil
 
 	case *util.InfoMessage:
+		if m.Status {
+			return node.Status()
+		}
+		if m.Registry {
+			return node.registry.RegistryMessage()
+		}
 		if m.Account != "" {
 			return node.queue.HandleInfoMessage(m)
 		}
-		if m.I != 0 {
-			return node.chain.Handle(sender, m)
+		if h := node.History(m.I); h != nil {
+			return h
+		}
+		return nil
+
+	case *registry.RegistryMessage:
+		updated, err := node.registry.HandleRegistryMessage(m)
+		if updated {
+			slot := node.Slot()
+			node.chain.ValueStoreUpdated()
+			if node.Slot() != slot {
+				node.advanced()
+			}
+		}
+		if err != nil && !node.isPeer(sender) {
+			return &util.ErrorMessage{
+				Error: err.Error(),
+			}
 		}
 		return nil
 
 	case *currency.TransactionMessage:
-		if node.queue.HandleTransactionMessage(m) {
+		if m == nil {
+			return nil
+		}
+		if m.IdempotencyKey == "" || node.isPeer(sender) {
+			return node.handleTransactionMessage(sender, m)
+		}
+		response, ok, err := node.idempotency.lookup(sender, m)
+		if err != nil {
+			return &util.ErrorMessage{Error: err.Error()}
+		}
+		if ok {
+			return response
+		}
+		response = node.handleTransactionMessage(sender, m)
+		if e, ok := response.(*util.ErrorMessage); !ok || !e.Transient {
+			// Transient errors are worth retrying for real
+			node.idempotency.add(sender, m, response)
+		}
+		return response
+
+	case *PauseMessage:
+		if m.Resume {
+			node.chain.Resume()
+		} else {
+			node.chain.Pause()
+		}
+		return node.Status()
+
+	case *currency.ImportMessage:
+		updated, err := node.queue.Import(m.Transactions)
+		if updated {
+			slot := node.Slot()
 			node.chain.ValueStoreUpdated()
+			if node.Slot() != slot {
+				node.advanced()
+			}
+		}
+		if err == currency.ErrImportBacklogFull {
+			return &util.ErrorMessage{
+				Error:      err.Error(),
+				Transient:  true,
+				RetryAfter: ImportRetryInterval,
+			}
+		}
+		if err != nil {
+			return &util.ErrorMessage{Error: err.Error()}
+		}
+		return &currency.ImportMessage{Backlog: node.queue.ImportBacklog()}
+
+	case *util.ErrorMessage:
+		log.Printf("%s sent an error: %s", util.Shorten(string(sender)), m)
+		return nil
+
+	case *ChunkRequestMessage:
+		return node.handleChunkRequest(m)
+
+	case *currency.FetchMessage:
+		response := node.queue.HandleFetchMessage(m)
+		if response == nil {
+			return nil
+		}
+		return response
+
+	case *consensus.QuorumSliceMessage:
+		// These are about future slots, so they skip the slot window
+		return node.chain.Handle(sender, m)
+
+	case *consensus.DigestMessage:
+		// These are about past slots, so they skip the slot window too
+		return node.chain.Handle(sender, m)
+
+	case *BlockHeaderMessage:
+		if m.Value != "" {
+			// Peers broadcast these for observers. We make our own
+			return nil
+		}
+		if h := node.Header(m.I); h != nil {
+			return h
 		}
 		return nil
 
@@ -78,42 +322,610 @@ func (node *Node) Handle(sender string, message util.Message) util.Message {
 	}
 }
 
+// SetSigner makes the node sign its consensus digests with kp.
+func (node *Node) SetSigner(kp *util.KeyPair) {
+	if node.chain != nil {
+		node.chain.SetSigner(kp)
+	}
+}
+
+// handleTransactionMessage adds transactions to the queue.
+func (node *Node) handleTransactionMessage(
+	sender util.PublicKey, m *currency.TransactionMessage) util.Message {
+	updated, err := node.queue.HandleTransactionMessage(m)
+	if updated {
+		slot := node.Slot()
+		node.chain.ValueStoreUpdated()
+		if node.Slot() != slot {
+			node.advanced()
+		}
+	}
+	if err != nil && !node.isPeer(sender) {
+		// Let clients know why their transaction was rejected.
+		// Peers share transactions we may have already processed, so
+		// they get no response.
+		return &util.ErrorMessage{
+			Error:     err.Error(),
+			Transient: currency.IsTransient(err),
+		}
+	}
+	return nil
+}
+
+// SetEmptySlotTicks makes the node externalize an empty slot when it goes
+// this many timer ticks without any transactions or registry changes.
+// Read replicas follow whatever their leader does.
+func (node *Node) SetEmptySlotTicks(ticks int) {
+	if node.chain != nil {
+		node.chain.SetEmptySlotTicks(ticks)
+	}
+}
+
+// SetQuorumSlice changes the quorum slice this node uses, starting with the
+// next slot.
+func (node *Node) SetQuorumSlice(qs consensus.QuorumSlice) error {
+	if node.leader != "" {
+		return fmt.Errorf("read replicas don't have a quorum slice")
+	}
+	if err := node.chain.SetQuorumSlice(qs); err != nil {
+		return err
+	}
+	node.registry.SetMembers(qs.AllMembers())
+	return nil
+}
+
+// HandleTimerTick drives the nomination and ballot timers. It should be called
+// at regular intervals and returns whether our outgoing messages changed.
+// A tick can finish a slot that was waiting to be finalized.
+func (node *Node) HandleTimerTick() bool {
+	slot := node.Slot()
+	changed := node.chain.HandleTimerTick()
+	if node.Slot() != slot {
+		node.advanced()
+	}
+	return changed
+}
+
+// Resync returns whether a peer got back in touch after being cut off from
+// us, so that all of our outgoing messages should be sent again.
+func (node *Node) Resync() bool {
+	if node.chain == nil {
+		return false
+	}
+	return node.chain.Resync()
+}
+
+// Diverged returns an error if our account state has diverged from the rest
+// of the network, in which case the node should stop.
+func (node *Node) Diverged() error {
+	return node.queue.Diverged()
+}
+
+// Peer priorities, from most to least important
+const (
+	// Peers in our quorum slice
+	SlicePriority = iota
+
+	// Peers in the quorum slices of peers in our quorum slice
+	TransitivePriority
+
+	// Everyone else
+	OtherPriority
+)
+
+// PeerPriorities returns how important each peer is for us to stay in touch
+// with. Peers that are not in the map have OtherPriority.
+func (node *Node) PeerPriorities() map[util.PublicKey]int {
+	answer := make(map[util.PublicKey]int)
+	if node.chain == nil {
+		return answer
+	}
+	slot := node.Slot()
+	members := node.chain.D.AllMembers()
+	for _, member := range members {
+		answer[member] = SlicePriority
+	}
+	for _, member := range members {
+		qs := node.chain.QuorumSliceOf(member, slot)
+		if qs == nil {
+			continue
+		}
+		for _, m := range qs.AllMembers() {
+			if _, ok := answer[m]; !ok {
+				answer[m] = TransitivePriority
+			}
+		}
+	}
+	delete(answer, node.publicKey)
+	return answer
+}
+
+// QuorumReachable returns whether we could satisfy our quorum slice while
+// only hearing from these peers.
+func (node *Node) QuorumReachable(peers []util.PublicKey) bool {
+	if node.chain == nil {
+		return true
+	}
+	return node.chain.D.SatisfiedWith(append(peers, node.publicKey))
+}
+
+// isPeer returns whether the sender is a member of our quorum slice.
+func (node *Node) isPeer(sender util.PublicKey) bool {
+	for _, member := range node.chain.D.AllMembers() {
+		if member == sender {
+			return true
+		}
+	}
+	return false
+}
+
 // A helper to handle the messages
-func (node *Node) handleChainMessage(sender string, message util.Message) util.Message {
+func (node *Node) handleChainMessage(sender util.PublicKey, message util.Message) util.Message {
+	slot := message.Slot()
+	current := node.Slot()
+	if slot > current && slot > node.peerSlots[sender] && node.isPeer(sender) {
+		node.peerSlots[sender] = slot
+	}
+	if slot < current-PastSlotWindow || slot > current+FutureSlotWindow {
+		return nil
+	}
+	if slot > current {
+		// Anyone can make up keys, so only our peers get buffer space
+		if node.isPeer(sender) {
+			node.buffer(sender, message)
+		}
+		return nil
+	}
+
 	response := node.chain.Handle(sender, message)
+	if node.Slot() != current {
+		node.advanced()
+	}
+	return node.historyMessage(response)
+}
 
+// handleChunkRequest responds with the history for a slot that a peer is
+// stuck on, if we finalized the same value for it.
+func (node *Node) handleChunkRequest(m *ChunkRequestMessage) util.Message {
+	h := node.History(m.I)
+	if h == nil || h.E.X != m.X {
+		return nil
+	}
+	return h
+}
+
+// historyMessage augments externalize messages into history messages, so
+// that the recipient gets the chunk data too. Other messages pass through.
+func (node *Node) historyMessage(response util.Message) util.Message {
 	externalize, ok := response.(*consensus.ExternalizeMessage)
 	if !ok {
 		return response
 	}
-
-	// Augment externalize messages into history messages
 	t := node.queue.OldChunkMessage(externalize.I)
 	return &HistoryMessage{
 		T: t,
 		E: externalize,
 		I: externalize.I,
+		M: node.registry.OldBatchMessage(externalize.I),
+	}
+}
+
+// advanced should be called whenever the node moves on to a new slot.
+func (node *Node) advanced() {
+	node.makeHeader()
+	node.handleBuffered()
+	node.prune()
+	for peer, slot := range node.peerSlots {
+		if slot <= node.Slot() {
+			delete(node.peerSlots, peer)
+		}
+	}
+}
+
+// highestSlot returns the highest slot that enough of our peers have gotten
+// to that at least one of them is honest, assuming our quorum slice can't
+// be blocked by faulty nodes alone. A single peer can't make it go up.
+func (node *Node) highestSlot() int {
+	answer := node.Slot()
+	for _, slot := range node.peerSlots {
+		if slot <= answer {
+			continue
+		}
+		peers := []util.PublicKey{}
+		for peer, s := range node.peerSlots {
+			if s >= slot {
+				peers = append(peers, peer)
+			}
+		}
+		if node.chain.D.BlockedBy(peers) {
+			answer = slot
+		}
+	}
+	return answer
+}
+
+// prune forgets history that is too old to keep in memory.
+// Archives without a history store keep everything. Archives with one only
+// prune consensus blocks, and keep the chunks for historical account queries.
+func (node *Node) prune() {
+	if node.archive && node.store == nil {
+		return
+	}
+	before := node.Slot() - node.retention
+	if before <= 1 {
+		return
+	}
+	if node.chain != nil {
+		node.chain.Prune(before)
+	}
+	for slot, _ := range node.headers {
+		if slot < before {
+			delete(node.headers, slot)
+		}
+	}
+	if node.archive {
+		return
+	}
+	node.queue.Prune(before)
+	node.registry.Prune(before)
+	for slot, _ := range node.followed {
+		if slot < before {
+			delete(node.followed, slot)
+		}
+	}
+}
+
+// makeHeader makes the header for the slot we just finalized. It has to be
+// called before we handle anything for the next slot, while the accounts
+// are as the finalized slot left them.
+func (node *Node) makeHeader() {
+	slot := node.Slot() - 1
+	e := node.externalized(slot)
+	if e == nil {
+		return
+	}
+	h := &BlockHeaderMessage{
+		I:     slot,
+		Value: consensus.HashString(string(e.X)),
+		State: node.queue.StateHash(),
+		Cert:  consensus.HashString(util.EncodeMessage(e)),
+	}
+	if node.lastHeaderSlot == slot-1 {
+		h.Prev = node.lastHeader
+	}
+	node.headers[slot] = h
+	node.lastHeader = h.Hash()
+	node.lastHeaderSlot = slot
+}
+
+// Header returns our header for a finalized slot, or for the last one if
+// slot is zero. It returns nil if we don't have it.
+func (node *Node) Header(slot int) *BlockHeaderMessage {
+	if slot == 0 {
+		slot = node.Slot() - 1
+	}
+	return node.headers[slot]
+}
+
+// externalized returns the externalize message for a finished slot, or nil
+// if we don't have it.
+func (node *Node) externalized(slot int) *consensus.ExternalizeMessage {
+	if node.leader != "" {
+		return node.followed[slot]
+	}
+	return node.chain.Externalized(slot)
+}
+
+// handleHistoryRequest serves ranges of history and snapshots. Archives
+// serve anyone. Other nodes only serve the history they still have to peers
+// that are catching up.
+func (node *Node) handleHistoryRequest(sender util.PublicKey, m *HistoryRequestMessage) util.Message {
+	if !node.archive && (m.Snapshot || node.leader != "" || !node.isPeer(sender)) {
+		return &util.ErrorMessage{
+			Error: "this node is not an archive",
+		}
+	}
+	if m.Snapshot {
+		return node.queue.SnapshotMessage()
+	}
+	if m.First < 1 || m.Last < m.First {
+		return &util.ErrorMessage{
+			Error: fmt.Sprintf("bad history range: %d-%d", m.First, m.Last),
+		}
+	}
+	last := m.Last
+	if last >= m.First+MaxHistoryRange {
+		last = m.First + MaxHistoryRange - 1
+	}
+	answer := &HistoryRangeMessage{
+		History: []*HistoryMessage{},
+	}
+	for slot := m.First; slot <= last; slot++ {
+		h := node.History(slot)
+		if h == nil {
+			break
+		}
+		if m.Diffs {
+			if d := node.queue.StateDiffMessage(slot); d != nil {
+				h = &HistoryMessage{
+					I: h.I,
+					E: h.E,
+					D: d,
+					M: h.M,
+				}
+			}
+		}
+		answer.History = append(answer.History, h)
+	}
+	return answer
+}
+
+// History returns the history for a finished slot, or nil if we don't have it.
+// History that was pruned from memory is read back from the history store.
+func (node *Node) History(slot int) *HistoryMessage {
+	e := node.externalized(slot)
+	if e == nil {
+		return node.storedHistory(slot)
+	}
+	h := &HistoryMessage{
+		T: node.queue.OldChunkMessage(slot),
+		E: e,
+		I: slot,
+		M: node.registry.OldBatchMessage(slot),
+	}
+	if h.T == nil {
+		// A replica that follows diffs never gets the chunk, so the diff
+		// is what it saves and replays
+		h.D = node.queue.StateDiffMessage(slot)
+	}
+	return h
+}
+
+// storedHistory reads the history for a slot from the history store, or
+// returns nil if it isn't there.
+func (node *Node) storedHistory(slot int) *HistoryMessage {
+	if node.store == nil || slot < node.storeFirst || slot >= node.Slot() {
+		return nil
+	}
+
+	// The store has the history for every slot, in order, starting at
+	// storeFirst
+	m, err := node.store.Read(slot - node.storeFirst)
+	if err != nil {
+		log.Printf("could not read history for slot %d: %s", slot, err)
+		return nil
+	}
+	h, ok := m.(*HistoryMessage)
+	if !ok || h.I != slot {
+		return nil
+	}
+	return h
+}
+
+// handleHistoryData gives the apps the data they need to finalize the slot
+// in some history.
+func (node *Node) handleHistoryData(h *HistoryMessage) {
+	node.queue.HandleTransactionMessage(h.T)
+	node.registry.HandleRegistryMessage(h.M)
+}
+
+// Restore applies history that this node saved before it restarted.
+// It must be called with the history for the current slot.
+func (node *Node) Restore(h *HistoryMessage) error {
+	if h.E == nil || h.I != node.Slot() {
+		return fmt.Errorf("cannot restore history for slot %d on slot %d", h.I, node.Slot())
+	}
+	node.handleHistoryData(h)
+	if node.leader != "" {
+		node.follow(h)
+		if node.Slot() != h.I+1 {
+			return fmt.Errorf("could not restore history for slot %d", h.I)
+		}
+		return nil
+	}
+	if err := node.chain.Restore(h.E); err != nil {
+		return err
+	}
+	node.advanced()
+	return nil
+}
+
+// Checkpoint returns the state of the node as of the last slot it finished,
+// or nil if it hasn't finished any.
+func (node *Node) Checkpoint() *CheckpointMessage {
+	slot := node.Slot() - 1
+	e := node.externalized(slot)
+	if e == nil {
+		return nil
+	}
+	cp := &CheckpointMessage{
+		I:        slot,
+		E:        e,
+		State:    node.queue.LedgerState(),
+		Registry: node.registry.Entries(),
+	}
+	if node.chain != nil {
+		cp.Hash = node.chain.Hash()
+		cp.Digest = node.chain.LatestDigest()
+	}
+	if node.lastHeaderSlot == slot {
+		cp.Header = node.lastHeader
+	}
+	return cp
+}
+
+// RestoreCheckpoint starts a node that has not finished any slots from a
+// checkpoint it saved before it restarted. The store should start with the
+// checkpoint.
+func (node *Node) RestoreCheckpoint(m *CheckpointMessage) error {
+	if m.E == nil || m.State == nil || m.E.I != m.I || m.State.Slot != m.I+1 {
+		return fmt.Errorf("bad checkpoint: %s", m)
+	}
+	if err := node.queue.RestoreLedgerState(m.State); err != nil {
+		return err
+	}
+	node.registry.Restore(m.State.Slot, m.Registry)
+	if node.leader != "" {
+		node.followed[m.I] = m.E
+	} else if err := node.chain.RestoreCheckpoint(m.E, m.Hash, m.Digest); err != nil {
+		return err
+	}
+	if m.Header != "" {
+		node.lastHeader = m.Header
+		node.lastHeaderSlot = m.I
+	}
+	node.storeFirst = m.I
+	return nil
+}
+
+// buffer saves a message for a future slot, replacing any older message of
+// the same type from the same sender.
+func (node *Node) buffer(sender util.PublicKey, message util.Message) {
+	slot := message.Slot()
+	if node.future[slot] == nil {
+		node.future[slot] = make(map[string]*bufferedMessage)
+	}
+	node.future[slot][string(sender)+":"+message.MessageType()] = &bufferedMessage{
+		sender:  sender,
+		message: message,
+	}
+}
+
+// saveCatchup keeps history from a peer until we get to its slot.
+func (node *Node) saveCatchup(sender util.PublicKey, h *HistoryMessage) {
+	if h.E == nil || h.E.I != h.I || h.I > node.Slot()+CatchupWindow {
+		return
+	}
+	if node.catchup[h.I] == nil {
+		node.catchup[h.I] = make(map[util.PublicKey]*HistoryMessage)
+	}
+	node.catchup[h.I][sender] = h
+}
+
+// handleBuffered handles the buffered messages and catchup history for the
+// current slot, and discards what is buffered for slots that are already in
+// the past.
+// If that finishes the current slot, it moves on to the next one.
+func (node *Node) handleBuffered() {
+	for {
+		slot := node.Slot()
+		for s, _ := range node.future {
+			if s < slot {
+				delete(node.future, s)
+			}
+		}
+		for s, _ := range node.catchup {
+			if s < slot {
+				delete(node.catchup, s)
+			}
+		}
+		buffered, ok := node.future[slot]
+		history, hok := node.catchup[slot]
+		if !ok && !hok {
+			return
+		}
+		delete(node.future, slot)
+		delete(node.catchup, slot)
+
+		keys := []string{}
+		for key, _ := range buffered {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b := buffered[key]
+			node.chain.Handle(b.sender, b.message)
+		}
+
+		senders := []util.PublicKey{}
+		for sender, _ := range history {
+			senders = append(senders, sender)
+		}
+		util.SortPublicKeys(senders)
+		for _, sender := range senders {
+			h := history[sender]
+			node.handleHistoryData(h)
+			node.chain.Handle(sender, h.E)
+		}
+
+		if node.Slot() == slot {
+			return
+		}
 	}
 }
 
 func (node *Node) OutgoingMessages() []util.Message {
 	answer := []util.Message{}
+	if node.leader != "" {
+		// Followers don't have anything to say
+		return answer
+	}
 	sharing := node.queue.SharingMessage()
 	if sharing != nil {
 		answer = append(answer, sharing)
 	}
+	if m := node.registry.SharingMessage(); m != nil {
+		answer = append(answer, m)
+	}
+	fetch := node.queue.FetchMessage()
+	if fetch != nil {
+		answer = append(answer, fetch)
+	}
+	if e := node.chain.Stalled(); e != nil {
+		// Peers that have moved on won't share this slot's data any more,
+		// so we have to ask for it
+		answer = append(answer, &ChunkRequestMessage{I: e.I, X: e.X})
+	}
 	for _, m := range node.chain.OutgoingMessages() {
 		answer = append(answer, m)
 	}
+	if h := node.Header(0); h != nil {
+		// Observers on the other end of our links follow these
+		answer = append(answer, h)
+	}
+	if node.highestSlot() > node.Slot()+FutureSlotWindow {
+		// We are too far behind to catch up from the live messages
+		answer = append(answer, &HistoryRequestMessage{
+			First: node.Slot(),
+			Last:  node.Slot() + MaxHistoryRange - 1,
+		})
+	}
 	return answer
 }
 
+// Metrics reports how consensus is going, or nil for a follower, since it
+// doesn't take part.
+func (node *Node) Metrics() *consensus.Metrics {
+	if node.leader != "" {
+		return nil
+	}
+	return node.chain.Metrics()
+}
+
+// Status reports how the node is doing, for operators.
+func (node *Node) Status() *StatusMessage {
+	m := &StatusMessage{I: node.Slot(), Queue: node.queue.Size()}
+	if node.leader == "" {
+		m.Metrics = node.chain.Metrics()
+		m.Slots = node.chain.Stats()
+		m.Paused = node.chain.Paused()
+	}
+	return m
+}
+
 func (node *Node) Stats() {
-	node.chain.Stats()
+	if node.leader == "" {
+		log.Printf("%d blocks externalized", node.chain.Slot()-1)
+		if stats := node.chain.Stats(); len(stats) > 0 {
+			log.Printf("last %s", stats[len(stats)-1])
+		}
+	}
 	node.queue.Stats()
 }
 
 func (node *Node) Log() {
-	node.chain.Log()
+	if node.leader == "" {
+		node.chain.Log()
+	}
 	node.queue.Log()
 }
@@ -1,16 +1,23 @@
 package network
 
 import (
-	"fmt"
 	"log"
 	"math/rand"
+	"path/filepath"
 	"testing"
 
 	"coinkit/consensus"
 	"coinkit/currency"
+	"coinkit/data"
+	"coinkit/registry"
 	"coinkit/util"
 )
 
+func init() {
+	// Crash on ballot bugs rather than quarantining messages
+	consensus.StrictBallots = true
+}
+
 func sendNodeToNodeMessages(source *Node, target *Node, t *testing.T) {
 	messages := source.OutgoingMessages()
 	for _, message := range messages {
@@ -25,6 +32,19 @@ func sendNodeToNodeMessages(source *Node, target *Node, t *testing.T) {
 	}
 }
 
+// tickNodes advances the consensus timers on every node, so that nomination
+// can move past leaders that are not participating.
+func tickNodes(nodes []*Node) {
+	for _, node := range nodes {
+		node.HandleTimerTick()
+	}
+}
+
+// testKey returns the public key for the test account with this name.
+func testKey(name string) util.PublicKey {
+	return util.NewKeyPairFromSecretPhrase(name).PublicKey()
+}
+
 func maxAccountBalance(nodes []*Node) uint64 {
 	answer := uint64(0)
 	for _, node := range nodes {
@@ -51,7 +71,7 @@ func TestNodeCatchup(t *testing.T) {
 		tr := &currency.Transaction{
 			From:     kp.PublicKey(),
 			Sequence: uint32(round),
-			To:       "bob",
+			To:       testKey("bob"),
 			Amount:   1,
 			Fee:      0,
 		}
@@ -59,6 +79,7 @@ func TestNodeCatchup(t *testing.T) {
 		m := currency.NewTransactionMessage(ts...)
 		nodes[0].Handle(kp.PublicKey(), m)
 		for i := 0; i < 10; i++ {
+			tickNodes(nodes[:3])
 			sendNodeToNodeMessages(nodes[0], nodes[1], t)
 			sendNodeToNodeMessages(nodes[0], nodes[2], t)
 			sendNodeToNodeMessages(nodes[1], nodes[2], t)
@@ -87,15 +108,103 @@ func TestNodeCatchup(t *testing.T) {
 	}
 }
 
+func TestNodeCatchupFarBehind(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(4)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 100)
+		nodes = append(nodes, node)
+	}
+
+	// The first three nodes get well beyond the future slot window
+	rounds := 3 * FutureSlotWindow
+	for round := 1; round <= rounds; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+		for i := 0; i < 10 && nodes[2].Slot() == round; i++ {
+			tickNodes(nodes[:3])
+			for _, source := range nodes[:3] {
+				for _, target := range nodes[:3] {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+		if nodes[2].Slot() != round+1 {
+			t.Fatalf("round %d did not finish", round)
+		}
+	}
+
+	// The last node should catch up in a few exchanges, by asking for history
+	for i := 0; i < 3; i++ {
+		for _, peer := range nodes[:3] {
+			sendNodeToNodeMessages(peer, nodes[3], t)
+			sendNodeToNodeMessages(nodes[3], peer, t)
+		}
+	}
+	if nodes[3].Slot() != rounds+1 {
+		t.Fatalf("catchup only got to slot %d", nodes[3].Slot())
+	}
+	if nodes[3].queue.MaxBalance() != nodes[0].queue.MaxBalance() {
+		t.Fatal("the caught up node has the wrong balances")
+	}
+}
+
+func requestsHistory(node *Node) bool {
+	for _, m := range node.OutgoingMessages() {
+		if _, ok := m.(*HistoryRequestMessage); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNodeNeedsPeersToAgreeItIsBehind(t *testing.T) {
+	qs, names := consensus.MakeTestQuorumSlice(4)
+	node := NewNode(names[0], qs)
+
+	// One peer is not enough to make us think we are far behind
+	far := &consensus.NominationMessage{I: 1000, D: qs}
+	node.Handle(names[1], far)
+	node.Handle("outsider", far)
+	if requestsHistory(node) {
+		t.Fatal("a single peer should not make us ask for history")
+	}
+
+	// Two out of three peers could block us, so one of them is honest
+	near := &consensus.NominationMessage{I: 10 + FutureSlotWindow, D: qs}
+	node.Handle(names[2], near)
+	if !requestsHistory(node) {
+		t.Fatal("expected a history request once two peers are ahead")
+	}
+	if node.highestSlot() != near.I {
+		t.Fatalf("expected the highest slot to be %d, got %d", near.I, node.highestSlot())
+	}
+}
+
 func nodeFuzzTest(seed int64, t *testing.T) {
 	initialMoney := uint64(4)
 
-	numClients := 5
-	clients := []*util.KeyPair{}
-	for i := 0; i < numClients; i++ {
-		kp := util.NewKeyPairFromSecretPhrase(fmt.Sprintf("client%d", i))
-		clients = append(clients, kp)
+	// 4 nodes running on 3-out-of-4, with 5 clients that each start out
+	// with initialMoney
+	f := NewFixture(seed, 4)
+	for len(f.Clients) < 5 {
+		f.AddClient()
 	}
+	clients := f.Clients
+	for _, client := range clients {
+		f.Genesis[client.PublicKey()] = initialMoney
+	}
+	nodes := f.Nodes()
 
 	clientMessages := []*currency.TransactionMessage{}
 	for i, client := range clients {
@@ -120,17 +229,6 @@ func nodeFuzzTest(seed int64, t *testing.T) {
 		clientMessages = append(clientMessages, m)
 	}
 
-	// 4 nodes running on 3-out-of-4
-	qs, names := consensus.MakeTestQuorumSlice(4)
-	nodes := []*Node{}
-	for _, name := range names {
-		node := NewNode(name, qs)
-		for _, client := range clients {
-			node.queue.SetBalance(client.PublicKey(), initialMoney)
-		}
-		nodes = append(nodes, node)
-	}
-
 	rand.Seed(seed ^ 789789)
 	log.Printf("fuzz testing nodes with seed %d", seed)
 	for i := 0; i <= 10000; i++ {
@@ -169,3 +267,997 @@ func TestNodeFullCluster(t *testing.T) {
 		nodeFuzzTest(i, t)
 	}
 }
+
+func TestNodeSlotWindow(t *testing.T) {
+	qs, names := consensus.MakeTestQuorumSlice(4)
+	node := NewNode(names[0], qs)
+
+	near := &consensus.NominationMessage{I: 1 + FutureSlotWindow, D: qs}
+	node.Handle(names[1], near)
+	node.Handle(names[1], near)
+	node.Handle(names[2], near)
+	if len(node.future) != 1 || len(node.future[near.I]) != 2 {
+		t.Fatalf("expected one buffered message per sender, got %+v", node.future)
+	}
+
+	far := &consensus.NominationMessage{I: 2 + FutureSlotWindow, D: qs}
+	node.Handle(names[1], far)
+	if len(node.future) != 1 {
+		t.Fatal("messages too far in the future should be dropped")
+	}
+
+	node.Handle("stranger", near)
+	if len(node.future[near.I]) != 2 {
+		t.Fatal("messages from outside our quorum slice should not be buffered")
+	}
+}
+
+func TestNodeReplaysBufferedMessages(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(4)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 100)
+		nodes = append(nodes, node)
+	}
+
+	// Get the first three nodes to slot 2
+	tr := &currency.Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       testKey("bob"),
+		Amount:   1,
+		Fee:      0,
+	}
+	nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+	for i := 0; i < 10; i++ {
+		tickNodes(nodes[:3])
+		for j := 0; j <= 2; j++ {
+			for k := 0; k <= 2; k++ {
+				if j != k {
+					sendNodeToNodeMessages(nodes[j], nodes[k], t)
+				}
+			}
+		}
+	}
+
+	// The last node hears about slot 2 before it finishes slot 1
+	for j := 0; j <= 2; j++ {
+		if nodes[j].Slot() != 2 {
+			t.Fatalf("nodes[%d] did not finish slot 1", j)
+		}
+		sendNodeToNodeMessages(nodes[j], nodes[3], t)
+	}
+	if len(nodes[3].future[2]) == 0 {
+		t.Fatalf("nodes[3] should have buffered messages for slot 2")
+	}
+	for j := 0; j <= 2; j++ {
+		sendNodeToNodeMessages(nodes[3], nodes[j], t)
+	}
+	if nodes[3].Slot() != 2 {
+		t.Fatalf("nodes[3] did not catch up")
+	}
+	if len(nodes[3].future) != 0 {
+		t.Fatalf("buffered messages should be handled once we reach their slot")
+	}
+}
+
+func TestNodeRejectsClientTransaction(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(4)
+	node := NewNode(names[0], qs)
+	node.queue.SetBalance(kp.PublicKey(), 10)
+
+	tr := &currency.Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       testKey("bob"),
+		Amount:   100,
+		Fee:      0,
+	}
+	m := currency.NewTransactionMessage(tr.SignWith(kp))
+	response, ok := node.Handle(kp.PublicKey(), m).(*util.ErrorMessage)
+	if !ok || !response.Transient {
+		t.Fatalf("expected a transient error but got %+v", response)
+	}
+	if node.Handle(names[1], m) != nil {
+		t.Fatal("peers should not get error responses")
+	}
+}
+
+func TestNodeDropsFinalizedTransactions(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 10)
+		nodes = append(nodes, node)
+	}
+	tr := &currency.Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       testKey("bob"),
+		Amount:   1,
+		Fee:      0,
+	}
+	m := currency.NewTransactionMessage(tr.SignWith(kp))
+	nodes[0].Handle(kp.PublicKey(), m)
+	for i := 0; i < 10 && nodes[0].Slot() == 1; i++ {
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+	}
+	if nodes[0].Slot() != 2 {
+		t.Fatal("the transaction was not finalized")
+	}
+
+	// A slow peer sharing it again should not get it back into the queue
+	m = util.EncodeThenDecode(m).(*currency.TransactionMessage)
+	if nodes[0].Handle(names[1], m) != nil || nodes[0].queue.Size() != 0 {
+		t.Fatal("a finalized transaction from a peer should be dropped")
+	}
+
+	// A client resubmitting it finds out why it was dropped
+	response, ok := nodes[0].Handle(kp.PublicKey(), m).(*util.ErrorMessage)
+	if !ok || response.Transient || response.Error != currency.ErrAlreadyFinalized.Error() {
+		t.Fatalf("expected a permanent error but got %+v", response)
+	}
+}
+
+func TestNodeRegistry(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("validator")
+
+	// Only members can publish metadata, so the validator is node 0. It
+	// ignores messages from itself, so a client passes the metadata along
+	_, names := consensus.MakeTestQuorumSlice(3)
+	names[0] = kp.PublicKey()
+	qs := consensus.MakeQuorumSlice(names, 3)
+	nodes := []*Node{}
+	for _, name := range names {
+		nodes = append(nodes, NewNode(name, qs))
+	}
+	metadata := &registry.Metadata{
+		Validator: kp.PublicKey(),
+		Sequence:  1,
+		Name:      "the validator",
+		Contact:   "ops@example.com",
+	}
+	m := &registry.RegistryMessage{
+		Entries: []*registry.SignedMetadata{metadata.SignWith(kp)},
+	}
+	outsider := util.NewKeyPairFromSecretPhrase("outsider")
+	unknown := &registry.Metadata{
+		Validator: outsider.PublicKey(),
+		Sequence:  1,
+		Name:      "not a validator",
+	}
+	response, ok := nodes[0].Handle("client", &registry.RegistryMessage{
+		Entries: []*registry.SignedMetadata{unknown.SignWith(outsider)},
+	}).(*util.ErrorMessage)
+	if !ok || response.Error != registry.ErrNotMember.Error() {
+		t.Fatalf("expected a not member error but got %+v", response)
+	}
+	if nodes[0].Handle("client", m) != nil {
+		t.Fatal("valid metadata should be accepted quietly")
+	}
+	for i := 0; i < 10 && nodes[2].Slot() == 1; i++ {
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+	}
+	if nodes[2].Slot() != 2 {
+		t.Fatal("the metadata was not finalized")
+	}
+
+	// Every node can answer for the registry
+	for _, node := range nodes {
+		response, ok := node.Handle("client", &util.InfoMessage{Registry: true}).(*registry.RegistryMessage)
+		if !ok || len(response.Entries) != 1 || response.Entries[0].Name != "the validator" {
+			t.Fatalf("bad registry response: %+v", response)
+		}
+	}
+
+	// Publishing the same metadata again is an error
+	response, ok = nodes[0].Handle("client", m).(*util.ErrorMessage)
+	if !ok || response.Error != registry.ErrOldSequence.Error() {
+		t.Fatalf("expected an old sequence error but got %+v", response)
+	}
+
+	// Metadata comes along with history, so a restarted node learns it too
+	restarted := NewNode(names[0], qs)
+	if err := restarted.Restore(nodes[1].History(1)); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.registry.Get(kp.PublicKey()) == nil {
+		t.Fatal("the restarted node should know the metadata")
+	}
+}
+
+func TestNodeStatus(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 10)
+		nodes = append(nodes, node)
+	}
+	for round := 1; round <= 2; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+		for i := 0; i < 10 && nodes[0].Slot() == round; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+		if nodes[0].Slot() != round+1 {
+			t.Fatalf("round %d did not finish", round)
+		}
+	}
+
+	status, ok := nodes[0].Handle("operator", &util.InfoMessage{Status: true}).(*StatusMessage)
+	if !ok || status.I != 3 || status.Metrics == nil || status.Metrics.Slot != 3 {
+		t.Fatalf("bad status: %+v", status)
+	}
+	if len(status.Slots) != 2 || status.Slots[0].Slot != 1 || status.Slots[1].Slot != 2 {
+		t.Fatalf("expected stats for both finished slots but got %d", len(status.Slots))
+	}
+	if status.Queue != 0 {
+		t.Fatalf("the queue should be empty but it has %d", status.Queue)
+	}
+
+	// A transaction that hasn't gone through yet shows up in the queue
+	tr := &currency.Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 3,
+		To:       testKey("bob"),
+		Amount:   1,
+		Fee:      0,
+	}
+	nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+	status = nodes[0].Handle("operator", &util.InfoMessage{Status: true}).(*StatusMessage)
+	if status.Queue != 1 {
+		t.Fatalf("expected one queued transaction but got %d", status.Queue)
+	}
+}
+
+func TestNodeBlockHeaders(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 10)
+		nodes = append(nodes, node)
+	}
+	if nodes[0].Handle("observer", &BlockHeaderMessage{}) != nil {
+		t.Fatal("there should be no header before the first slot is finalized")
+	}
+	for round := 1; round <= 2; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+		for i := 0; i < 10 && nodes[0].Slot() == round; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+		if nodes[0].Slot() != round+1 {
+			t.Fatalf("round %d did not finish", round)
+		}
+	}
+
+	latest, ok := nodes[0].Handle("observer", &BlockHeaderMessage{}).(*BlockHeaderMessage)
+	if !ok || latest.I != 2 || latest.Cert == "" {
+		t.Fatalf("bad latest header: %+v", latest)
+	}
+	first, ok := nodes[0].Handle("observer", &BlockHeaderMessage{I: 1}).(*BlockHeaderMessage)
+	if !ok || first.Prev != "" || latest.Prev != first.Hash() {
+		t.Fatalf("the headers should chain together: %+v %+v", first, latest)
+	}
+	if latest.State != nodes[0].queue.StateHash() || latest.State == first.State {
+		t.Fatal("the header should commit to the accounts after its slot")
+	}
+	for _, node := range nodes[1:] {
+		if node.Header(2).Hash() != latest.Hash() {
+			t.Fatalf("%s disagrees about the header", node.publicKey)
+		}
+	}
+}
+
+// stallNode runs slot 1 on four nodes, withholding its data from the last
+// one, so that it externalizes the slot but can't finalize it.
+func stallNode(t *testing.T) (nodes []*Node, stuck *Node) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(4)
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 10)
+		nodes = append(nodes, node)
+	}
+	tr := &currency.Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 1,
+		To:       testKey("bob"),
+		Amount:   1,
+		Fee:      0,
+	}
+	nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+
+	// Node 3 hears the consensus messages, but never gets the chunk
+	stuck = nodes[3]
+	withheld := func(m util.Message) bool {
+		switch m.(type) {
+		case *currency.TransactionMessage, *currency.FetchMessage,
+			*ChunkRequestMessage, *HistoryMessage:
+			return true
+		}
+		return false
+	}
+	for i := 0; i < 20 && stuck.chain.Stalled() == nil; i++ {
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source == target {
+					continue
+				}
+				cut := source == stuck || target == stuck
+				for _, message := range source.OutgoingMessages() {
+					if cut && withheld(message) {
+						continue
+					}
+					response := target.Handle(source.publicKey, util.EncodeThenDecode(message))
+					if response != nil && !(cut && withheld(response)) {
+						source.Handle(target.publicKey, util.EncodeThenDecode(response))
+					}
+				}
+			}
+		}
+		tickNodes(nodes)
+	}
+	if stuck.chain.Stalled() == nil || stuck.Slot() != 1 {
+		t.Fatal("node 3 should have externalized slot 1 without the chunk")
+	}
+	if nodes[0].Slot() != 2 {
+		t.Fatal("the other nodes should have finished slot 1")
+	}
+	return nodes, stuck
+}
+
+func TestNodeRecoversMissingChunk(t *testing.T) {
+	nodes, stuck := stallNode(t)
+
+	// Asking a peer that moved on for the slot gets node 3 unstuck
+	var request *ChunkRequestMessage
+	for _, message := range stuck.OutgoingMessages() {
+		if m, ok := message.(*ChunkRequestMessage); ok {
+			request = m
+		}
+	}
+	if request == nil || request.I != 1 {
+		t.Fatalf("expected a chunk request for slot 1 but got %+v", request)
+	}
+	response := nodes[0].Handle(stuck.publicKey, util.EncodeThenDecode(request))
+	if response == nil {
+		t.Fatal("node 0 should have the data for slot 1")
+	}
+	stuck.Handle(nodes[0].publicKey, util.EncodeThenDecode(response))
+	if stuck.Slot() != 2 || stuck.chain.Stalled() != nil {
+		t.Fatalf("node 3 is still on slot %d", stuck.Slot())
+	}
+	if maxAccountBalance([]*Node{stuck}) != 9 {
+		t.Fatal("node 3 did not apply the chunk")
+	}
+
+	// Peers don't answer for a different value
+	request.X = "bogus"
+	if nodes[0].Handle(stuck.publicKey, request) != nil {
+		t.Fatal("a request for the wrong value should get no response")
+	}
+}
+
+func TestNodeFinishesSlotOnTick(t *testing.T) {
+	nodes, stuck := stallNode(t)
+
+	// The chunk shows up without the chain hearing about it, so only the
+	// next tick can finish the slot
+	h := nodes[0].History(1)
+	stuck.queue.HandleTransactionMessage(h.T)
+	stuck.HandleTimerTick()
+	if stuck.Slot() != 2 {
+		t.Fatalf("node 3 is still on slot %d", stuck.Slot())
+	}
+	if stuck.Header(1) == nil {
+		t.Fatal("finishing a slot on a tick should still make its header")
+	}
+}
+
+func TestFollowerNode(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 100)
+		nodes = append(nodes, node)
+	}
+	follower := NewFollowerNode("follower", names[0])
+	follower.queue.SetBalance(kp.PublicKey(), 100)
+
+	for round := 1; round <= 3; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		m := currency.NewTransactionMessage(tr.SignWith(kp))
+		nodes[0].Handle(kp.PublicKey(), m)
+		for i := 0; i < 10; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+	}
+
+	// The follower shouldn't accept transactions
+	tr := &currency.Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 4,
+		To:       testKey("bob"),
+		Amount:   1,
+		Fee:      0,
+	}
+	m := currency.NewTransactionMessage(tr.SignWith(kp))
+	if _, ok := follower.Handle(kp.PublicKey(), m).(*util.ErrorMessage); !ok {
+		t.Fatal("expected the follower to reject a transaction")
+	}
+
+	// History from anyone but the leader should be ignored
+	info := util.EncodeThenDecode(&util.InfoMessage{I: 1})
+	history := util.EncodeThenDecode(nodes[1].Handle("follower", info))
+	follower.Handle(names[1], history)
+	if follower.Slot() != 1 {
+		t.Fatal("follower accepted history from a non-leader")
+	}
+
+	// Stream history from the leader, one slot at a time
+	for slot := 1; slot <= 3; slot++ {
+		info := util.EncodeThenDecode(&util.InfoMessage{I: slot})
+		history, ok := nodes[0].Handle("follower", info).(*HistoryMessage)
+		if !ok {
+			t.Fatalf("expected history for slot %d", slot)
+		}
+		status, ok := follower.Handle(names[0], util.EncodeThenDecode(history)).(*StatusMessage)
+		if follower.Slot() != slot+1 || !ok || status.I != slot+1 {
+			t.Fatalf("follower did not apply slot %d", slot)
+		}
+
+		// History it can't apply leaves it where it is, and it says so
+		status, ok = follower.Handle(names[0], util.EncodeThenDecode(history)).(*StatusMessage)
+		if !ok || status.I != slot+1 {
+			t.Fatalf("the follower should still need slot %d", slot+1)
+		}
+	}
+
+	bob := testKey("bob")
+	query := &util.InfoMessage{Account: bob}
+	expected := nodes[0].Handle("follower", query).(*currency.AccountMessage)
+	actual := follower.Handle("someone", query).(*currency.AccountMessage)
+	if actual.State[bob].Balance != 3 || expected.State[bob].Balance != actual.State[bob].Balance {
+		t.Fatalf("follower has the wrong balance for bob: %+v", actual.State[bob])
+	}
+	if len(follower.OutgoingMessages()) != 0 {
+		t.Fatal("followers should not send messages")
+	}
+}
+
+func TestArchiveNode(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 1000)
+		nodes = append(nodes, node)
+	}
+	nodes[0].archive = true
+
+	rounds := HistoryRetention + 5
+	for round := 1; round <= rounds; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		m := currency.NewTransactionMessage(tr.SignWith(kp))
+		nodes[0].Handle(kp.PublicKey(), m)
+		for i := 0; i < 10 && nodes[2].Slot() == round; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+		if nodes[2].Slot() != round+1 {
+			t.Fatalf("round %d did not finish", round)
+		}
+	}
+
+	// Only the archive should still have the early history
+	info := &util.InfoMessage{I: 1}
+	if nodes[1].Handle("someone", info) != nil {
+		t.Fatal("a regular node should have pruned slot 1")
+	}
+	if _, ok := nodes[0].Handle("someone", info).(*HistoryMessage); !ok {
+		t.Fatal("the archive should still have slot 1")
+	}
+
+	request := &HistoryRequestMessage{First: 1, Last: 1000}
+	if _, ok := nodes[1].Handle("someone", request).(*util.ErrorMessage); !ok {
+		t.Fatal("a regular node should not serve history ranges")
+	}
+	response := util.EncodeThenDecode(nodes[0].Handle("someone", request))
+	hrange, ok := response.(*HistoryRangeMessage)
+	if !ok || len(hrange.History) != MaxHistoryRange {
+		t.Fatalf("expected %d slots of history but got %s", MaxHistoryRange, response)
+	}
+
+	// A fresh node can catch up from the archive's history, either by
+	// processing chunks or by applying state diffs
+	followers := []*Node{}
+	for _, diffs := range []bool{false, true} {
+		follower := NewFollowerNode("follower", names[0])
+		follower.queue.SetBalance(kp.PublicKey(), 1000)
+
+		// Keep everything, so that we can replay it below
+		follower.retention = rounds
+		for follower.Slot() <= rounds {
+			request := &HistoryRequestMessage{
+				First: follower.Slot(),
+				Last:  follower.Slot() + MaxHistoryRange - 1,
+				Diffs: diffs,
+			}
+			slot := follower.Slot()
+			response := util.EncodeThenDecode(nodes[0].Handle("follower", request))
+			for _, h := range response.(*HistoryRangeMessage).History {
+				if diffs != (h.D != nil && h.T == nil) {
+					t.Fatalf("unexpected history for diffs=%t: %s", diffs, h)
+				}
+			}
+			follower.Handle(names[0], response)
+			if follower.Slot() == slot {
+				t.Fatalf("follower got stuck at slot %d", slot)
+			}
+		}
+		followers = append(followers, follower)
+	}
+
+	snapshot, ok := nodes[0].Handle("someone", &HistoryRequestMessage{
+		Snapshot: true,
+	}).(*currency.AccountMessage)
+	if !ok || snapshot.State[testKey("bob")].Balance != uint64(rounds) {
+		t.Fatalf("bad snapshot: %+v", snapshot)
+	}
+
+	// The history a follower of diffs saves is enough to restore it
+	restored := NewFollowerNode("follower", names[0])
+	restored.queue.SetBalance(kp.PublicKey(), 1000)
+	for slot := 1; slot <= rounds; slot++ {
+		h := util.EncodeThenDecode(followers[1].History(slot)).(*HistoryMessage)
+		if err := restored.Restore(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	followers = append(followers, restored)
+
+	for _, follower := range followers {
+		if follower.queue.MaxBalance() != nodes[0].queue.MaxBalance() {
+			t.Fatal("the follower did not catch up")
+		}
+		info := follower.queue.HandleInfoMessage(
+			&util.InfoMessage{Account: testKey("bob")}).(*currency.AccountMessage)
+		account := info.State[testKey("bob")]
+		if account == nil || account.Balance != uint64(rounds) {
+			t.Fatalf("the follower has the wrong balance for bob: %+v", account)
+		}
+	}
+}
+
+func TestHistoryStore(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 1000)
+		node.retention = 5
+		nodes = append(nodes, node)
+	}
+	db, err := data.NewDatabase(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	nodes[0].store = db
+
+	rounds := 20
+	for round := 1; round <= rounds; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+		for i := 0; i < 10 && nodes[0].Slot() == round; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+		if nodes[0].Slot() != round+1 {
+			t.Fatalf("round %d did not finish", round)
+		}
+
+		// Save the history like the server does
+		if err := db.Append(nodes[0].History(round)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if nodes[0].chain.Externalized(1) != nil {
+		t.Fatal("slot 1 should have been pruned from memory")
+	}
+	h := nodes[0].History(1)
+	if h == nil || h.I != 1 || h.E == nil || h.T == nil {
+		t.Fatalf("slot 1 should be read back from the store, but got %+v", h)
+	}
+	if nodes[1].History(1) != nil {
+		t.Fatal("a node without a store should not have slot 1")
+	}
+}
+
+func TestPeerPriorities(t *testing.T) {
+	qs := consensus.MakeQuorumSlice([]util.PublicKey{"a", "b", "c"}, 2)
+	node := NewNode("a", qs)
+	node.Handle("b", &consensus.QuorumSliceMessage{
+		I: 1,
+		D: consensus.MakeQuorumSlice([]util.PublicKey{"b", "c", "d"}, 2),
+	})
+	priorities := node.PeerPriorities()
+	if priorities["b"] != SlicePriority || priorities["c"] != SlicePriority {
+		t.Fatalf("slice members should have the highest priority: %+v", priorities)
+	}
+	if priorities["d"] != TransitivePriority {
+		t.Fatalf("d is in b's slice: %+v", priorities)
+	}
+	if _, ok := priorities["a"]; ok {
+		t.Fatal("we are not our own peer")
+	}
+}
+
+func TestNodeEmptySlots(t *testing.T) {
+	f := NewFixture(7, 4)
+	nodes := f.Nodes()
+	for _, node := range nodes {
+		node.SetEmptySlotTicks(2)
+	}
+	exchange := func() {
+		tickNodes(nodes)
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+	}
+	for i := 0; i < 100 && nodes[0].Slot() <= 3; i++ {
+		exchange()
+	}
+	if nodes[0].Slot() <= 3 {
+		t.Fatalf("empty slots did not advance, still on slot %d", nodes[0].Slot())
+	}
+	if x := nodes[0].chain.Externalized(1).X; x != consensus.EmptyValue {
+		t.Fatalf("slot 1 should be empty but it is %s", x)
+	}
+
+	// Transactions still go through in between empty slots
+	client := f.Clients[0]
+	tr := &currency.Transaction{
+		From:     client.PublicKey(),
+		Sequence: 1,
+		To:       f.Clients[1].PublicKey(),
+		Amount:   1,
+		Fee:      0,
+	}
+	nodes[0].Handle(client.PublicKey(), currency.NewTransactionMessage(tr.SignWith(client)))
+	for i := 0; i < 100 && nodes[3].queue.MaxBalance() == FixtureBalance; i++ {
+		exchange()
+	}
+	if nodes[3].queue.MaxBalance() != FixtureBalance+1 {
+		t.Fatal("the transaction did not clear")
+	}
+	if nodes[0].queue.Slot() != nodes[0].Slot() {
+		t.Fatal("the queue lost track of the slot during empty slots")
+	}
+}
+
+func TestNodeCatchesUpOnEmptySlots(t *testing.T) {
+	f := NewFixture(7, 4)
+	nodes := f.Nodes()
+	for _, node := range nodes {
+		node.SetEmptySlotTicks(2)
+	}
+
+	// The last node is held back at slot 1 while the others move on
+	for i := 0; i < 100 && nodes[0].Slot() <= 3; i++ {
+		tickNodes(nodes[:3])
+		for _, source := range nodes[:3] {
+			for _, target := range nodes[:3] {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+	}
+	if nodes[0].Slot() <= 3 || nodes[3].Slot() != 1 {
+		t.Fatalf("expected node 3 to be behind, but nodes are on %d and %d",
+			nodes[0].Slot(), nodes[3].Slot())
+	}
+
+	// The history for an empty slot has no transactions
+	h := nodes[0].History(1)
+	if h == nil || h.T != nil {
+		t.Fatalf("expected history with no transactions for slot 1, got %+v", h)
+	}
+	for i := 0; i < 3 && nodes[3].Slot() < nodes[0].Slot(); i++ {
+		for _, peer := range nodes[:3] {
+			sendNodeToNodeMessages(peer, nodes[3], t)
+			sendNodeToNodeMessages(nodes[3], peer, t)
+		}
+	}
+	if nodes[3].Slot() != nodes[0].Slot() {
+		t.Fatalf("node 3 only caught up to slot %d of %d", nodes[3].Slot(), nodes[0].Slot())
+	}
+}
+
+func TestNodeIgnoresMalformedHistory(t *testing.T) {
+	f := NewFixture(3, 4)
+	node := f.Nodes()[0]
+	m := &HistoryRangeMessage{History: []*HistoryMessage{
+		nil,
+		&HistoryMessage{I: 1},
+		&HistoryMessage{I: 1, E: &consensus.ExternalizeMessage{I: 2}},
+	}}
+	if response := node.Handle("stranger", util.EncodeThenDecode(m)); response != nil {
+		t.Fatalf("expected no response but got %s", response)
+	}
+	if node.Handle("stranger", &HistoryMessage{I: 1}) != nil || node.Slot() != 1 {
+		t.Fatal("malformed history should be ignored")
+	}
+}
+
+func TestNodePause(t *testing.T) {
+	f := NewFixture(5, 4)
+	nodes := f.Nodes()
+	admin := util.NewKeyPairFromSecretPhrase("admin").PublicKey()
+	status, ok := nodes[0].Handle(admin, &PauseMessage{}).(*StatusMessage)
+	if !ok || !status.Paused {
+		t.Fatalf("expected a paused status but got %v", status)
+	}
+
+	// The rest of the network keeps going, and the paused node follows it
+	client := f.Clients[0]
+	tr := &currency.Transaction{
+		From:     client.PublicKey(),
+		Sequence: 1,
+		To:       f.Clients[1].PublicKey(),
+		Amount:   1,
+	}
+	nodes[1].Handle(client.PublicKey(), currency.NewTransactionMessage(tr.SignWith(client)))
+	for i := 0; i < 50 && nodes[0].queue.MaxBalance() == FixtureBalance; i++ {
+		tickNodes(nodes)
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+	}
+	if nodes[0].queue.MaxBalance() != FixtureBalance+1 {
+		t.Fatal("the paused node did not keep up")
+	}
+
+	status, ok = nodes[0].Handle(admin, &PauseMessage{Resume: true}).(*StatusMessage)
+	if !ok || status.Paused {
+		t.Fatalf("expected a running status but got %v", status)
+	}
+}
+
+func TestNodeRestore(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 100)
+		nodes = append(nodes, node)
+	}
+	for round := 1; round <= 3; round++ {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(round),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+		for i := 0; i < 10; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+	}
+
+	// Restart node 0 from its own history
+	restarted := NewNode(names[0], qs)
+	restarted.queue.SetBalance(kp.PublicKey(), 100)
+	for slot := 1; slot < nodes[0].Slot(); slot++ {
+		h := util.EncodeThenDecode(nodes[0].History(slot)).(*HistoryMessage)
+		if err := restarted.Restore(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if restarted.Slot() != 4 || restarted.queue.MaxBalance() != nodes[0].queue.MaxBalance() {
+		t.Fatalf("restore failed")
+	}
+	if restarted.Restore(nodes[0].History(1)) == nil {
+		t.Fatal("restoring an old slot should fail")
+	}
+
+	// The restarted node should be able to keep going with the others
+	nodes[0] = restarted
+	tr := &currency.Transaction{
+		From:     kp.PublicKey(),
+		Sequence: 4,
+		To:       testKey("bob"),
+		Amount:   1,
+		Fee:      0,
+	}
+	nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+	for i := 0; i < 10; i++ {
+		for _, source := range nodes {
+			for _, target := range nodes {
+				if source != target {
+					sendNodeToNodeMessages(source, target, t)
+				}
+			}
+		}
+	}
+	if restarted.Slot() != 5 {
+		t.Fatalf("the restarted node got stuck on slot %d", restarted.Slot())
+	}
+	if restarted.chain.Hash() == "" || restarted.chain.Hash() != nodes[1].chain.Hash() {
+		t.Fatal("the restarted node lost track of the hash chain")
+	}
+	h := restarted.Header(4)
+	if h == nil || h.Prev == "" || h.Hash() != nodes[1].Header(4).Hash() {
+		t.Fatalf("the restarted node lost track of the headers: %+v", h)
+	}
+}
+
+func TestNodeRestoreCheckpoint(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	qs, names := consensus.MakeTestQuorumSlice(3)
+	nodes := []*Node{}
+	for _, name := range names {
+		node := NewNode(name, qs)
+		node.queue.SetBalance(kp.PublicKey(), 100)
+		nodes = append(nodes, node)
+	}
+	pay := func(sequence int) {
+		tr := &currency.Transaction{
+			From:     kp.PublicKey(),
+			Sequence: uint32(sequence),
+			To:       testKey("bob"),
+			Amount:   1,
+			Fee:      0,
+		}
+		nodes[0].Handle(kp.PublicKey(), currency.NewTransactionMessage(tr.SignWith(kp)))
+		for i := 0; i < 10; i++ {
+			for _, source := range nodes {
+				for _, target := range nodes {
+					if source != target {
+						sendNodeToNodeMessages(source, target, t)
+					}
+				}
+			}
+		}
+	}
+	for round := 1; round <= 3; round++ {
+		pay(round)
+	}
+
+	// Restart node 0 from a checkpoint instead of its whole history
+	cp := util.EncodeThenDecode(nodes[0].Checkpoint()).(*CheckpointMessage)
+	if cp.I != 3 {
+		t.Fatalf("expected a checkpoint for slot 3 but got %s", cp)
+	}
+	restarted := NewNode(names[0], qs)
+	if err := restarted.RestoreCheckpoint(cp); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Slot() != 4 {
+		t.Fatalf("restarted on slot %d", restarted.Slot())
+	}
+	account := restarted.queue.HandleInfoMessage(
+		&util.InfoMessage{Account: kp.PublicKey()}).(*currency.AccountMessage).
+		State[kp.PublicKey()]
+	if account == nil || account.Balance != 97 || account.Sequence != 3 {
+		t.Fatalf("bad account after restoring: %+v", account)
+	}
+	if restarted.RestoreCheckpoint(cp) == nil {
+		t.Fatal("restoring a checkpoint twice should fail")
+	}
+	if e := restarted.externalized(3); e == nil || e.X != cp.E.X {
+		t.Fatal("the restarted node should still know how slot 3 went")
+	}
+
+	// The restarted node should be able to keep going with the others
+	nodes[0] = restarted
+	pay(4)
+	if restarted.Slot() != 5 {
+		t.Fatalf("the restarted node got stuck on slot %d", restarted.Slot())
+	}
+	if restarted.chain.Hash() == "" || restarted.chain.Hash() != nodes[1].chain.Hash() {
+		t.Fatal("the restarted node lost track of the hash chain")
+	}
+}
@@ -0,0 +1,33 @@
+package network
+
+import (
+	"coinkit/util"
+)
+
+// A PauseMessage asks a node to stop taking part in consensus, or to start
+// again, for a maintenance window. Only admins can send one. The node
+// responds with a StatusMessage.
+
+type PauseMessage struct {
+	// Whether to resume instead of pausing
+	Resume bool `json:",omitempty"`
+}
+
+func (m *PauseMessage) Slot() int {
+	return 0
+}
+
+func (m *PauseMessage) MessageType() string {
+	return "V"
+}
+
+func (m *PauseMessage) String() string {
+	if m.Resume {
+		return "resume"
+	}
+	return "pause"
+}
+
+func init() {
+	util.RegisterMessageType(&PauseMessage{})
+}
@@ -0,0 +1,36 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// Nodes find each other by gossiping a PeerExchangeMessage with the
+// addresses they know. Peers send one on their link every so often, and a
+// new node sends one to its bootstrap addresses, which answer with their own.
+// The sender's own entry can leave out the host, when the sender doesn't
+// know how it is reached. The receiver then uses the host the connection
+// comes from.
+
+type PeerExchangeMessage struct {
+	// The best address we know for each node, by public key, including
+	// our own
+	Peers map[util.PublicKey]*Address
+}
+
+func (m *PeerExchangeMessage) Slot() int {
+	return 0
+}
+
+func (m *PeerExchangeMessage) MessageType() string {
+	return "O"
+}
+
+func (m *PeerExchangeMessage) String() string {
+	return fmt.Sprintf("peerexchange with %d peers", len(m.Peers))
+}
+
+func init() {
+	util.RegisterMessageType(&PeerExchangeMessage{})
+}
@@ -0,0 +1,467 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"coinkit/util"
+)
+
+// How many frames can be waiting to go out on a link. If a peer falls further
+// behind than this, we drop frames, and rely on rebroadcasts.
+const linkBufferSize = 100
+
+// A peerLink is the one connection between us and a peer. Unlike a client
+// connection, both sides send messages on it whenever they like, and there
+// are no "ok" responses. A response to a message is just sent as another
+// message.
+// Only one node of each pair dials, so that each pair of peers only has one
+// connection.
+type peerLink struct {
+	// The peer on the other end
+	publicKey util.PublicKey
+
+	conn     net.Conn
+	outgoing chan string
+
+	// Whether the peer only speaks the line framing from before protocol
+	// version 2. Set before the link starts running
+	lines bool
+
+	// The quorum slices we have sent the peer, by hash. Protected by
+	// sliceMutex
+	sentSlices map[string]string
+	sliceMutex sync.Mutex
+
+	// The quorum slices the peer has sent us, by hash. Only the goroutine
+	// reading from the link uses it
+	slices map[string]string
+
+	// When we sent the pings that the peer hasn't answered yet, in unix
+	// nanoseconds. Protected by pingMutex
+	pings     []int64
+	pingMutex sync.Mutex
+
+	closeOnce sync.Once
+	closed    chan bool
+}
+
+func newPeerLink(publicKey util.PublicKey, conn net.Conn) *peerLink {
+	return &peerLink{
+		publicKey:  publicKey,
+		conn:       conn,
+		outgoing:   make(chan string, linkBufferSize),
+		sentSlices: make(map[string]string),
+		slices:     make(map[string]string),
+		closed:     make(chan bool),
+	}
+}
+
+// send queues a frame to be sent, without blocking.
+// If more than limit frames are already queued, the frame is dropped.
+func (link *peerLink) send(frame string, limit int) {
+	if len(link.outgoing) >= limit {
+		return
+	}
+	select {
+	case link.outgoing <- frame:
+	default:
+	}
+}
+
+// sentPing remembers a ping we sent, so that we only believe answers to it.
+// Only the last few are kept, since older ones were probably dropped.
+func (link *peerLink) sentPing(t int64) {
+	link.pingMutex.Lock()
+	defer link.pingMutex.Unlock()
+	link.pings = append(link.pings, t)
+	if len(link.pings) > clockSamples {
+		link.pings = link.pings[1:]
+	}
+}
+
+// answeredPing returns whether t is when we sent a ping that the peer hasn't
+// answered yet, and forgets that ping.
+func (link *peerLink) answeredPing(t int64) bool {
+	link.pingMutex.Lock()
+	defer link.pingMutex.Unlock()
+	for i, sent := range link.pings {
+		if sent == t {
+			link.pings = append(link.pings[:i], link.pings[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// linkLimit returns how many frames can be queued for a peer before we start
+// dropping them. Less important peers get dropped sooner, so that when we
+// are falling behind, our quorum slice still hears from us.
+// The caller must hold linkMutex.
+func (s *Server) linkLimit(publicKey util.PublicKey) int {
+	priority, ok := s.priorities[publicKey]
+	if !ok {
+		priority = OtherPriority
+	}
+	return linkBufferSize >> uint(priority)
+}
+
+// maxBackoff returns the longest we wait before redialing a peer.
+// We try harder to stay connected to more important peers.
+func (s *Server) maxBackoff(publicKey util.PublicKey) time.Duration {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	priority, ok := s.priorities[publicKey]
+	if !ok {
+		priority = OtherPriority
+	}
+	switch priority {
+	case SlicePriority:
+		return 5 * time.Second
+	case TransitivePriority:
+		return 15 * time.Second
+	default:
+		return 30 * time.Second
+	}
+}
+
+func (link *peerLink) close() {
+	link.closeOnce.Do(func() {
+		close(link.closed)
+		link.conn.Close()
+	})
+}
+
+// writeForever sends queued frames until the link is closed.
+func (link *peerLink) writeForever() {
+	for {
+		select {
+		case <-link.closed:
+			return
+		case frame := <-link.outgoing:
+			if _, err := io.WriteString(link.conn, link.encode(frame)); err != nil {
+				link.close()
+				return
+			}
+		}
+	}
+}
+
+// encode turns a frame into what we actually send on the link. Peers that
+// speak the line framing get a line, or nothing for frames that have no
+// line, and the rest get a compact frame.
+func (link *peerLink) encode(frame string) string {
+	if link.lines {
+		line, _ := util.FrameToLine(frame)
+		return line
+	}
+	return link.compact(frame)
+}
+
+// shouldDial returns whether we are the one who dials this peer.
+// Each pair of peers only needs one link, so we decide who dials.
+// Outbound-only nodes can't be dialed, so they always dial. Otherwise, the
+// node with the lower public key dials. Until we know where a peer is, we
+// can't dial it, so it has to dial us.
+func (s *Server) shouldDial(publicKey util.PublicKey) bool {
+	if s.follow != nil {
+		// Read replicas don't talk to anyone but their leader
+		return false
+	}
+	address := s.book.best(publicKey)
+	if address == nil {
+		return false
+	}
+	switch {
+	case s.outboundOnly && address.OutboundOnly:
+		return false
+	case s.outboundOnly || address.OutboundOnly:
+		return s.outboundOnly
+	default:
+		return s.keyPair.PublicKey() < publicKey
+	}
+}
+
+// runLink uses a link until it breaks. reader must be the only reader of
+// the link's connection, and hello is the hello the peer sent.
+func (s *Server) runLink(link *peerLink, reader *bufio.Reader, hello *HelloMessage) {
+	s.linkMutex.Lock()
+	if old, ok := s.links[link.publicKey]; ok {
+		// The peer reconnected, so the old link is no good
+		old.close()
+	}
+	s.links[link.publicKey] = link
+
+	// Let the peer know where we are
+	go link.writeForever()
+	go s.pingForever(link)
+	go s.exchangeForever(link)
+	limit := s.linkLimit(link.publicKey)
+	for _, frame := range s.lastBroadcast {
+		link.send(frame, limit)
+	}
+	s.linkMutex.Unlock()
+	s.peerUp(link.publicKey, hello)
+
+	defer func() {
+		link.close()
+		s.linkMutex.Lock()
+		current := s.links[link.publicKey] == link
+		if current {
+			delete(s.links, link.publicKey)
+		}
+		s.linkMutex.Unlock()
+		if current {
+			// If the peer already reconnected, it's still up
+			s.peerDown(link.publicKey)
+		}
+	}()
+
+	host := remoteHost(link.conn)
+	for {
+		var sm *util.SignedMessage
+		var err error
+		if link.lines {
+			sm, err = util.ReadSignedLine(reader)
+		} else {
+			sm, err = link.readMessage(reader)
+		}
+		if err != nil {
+			var decodeError *util.DecodeError
+			if errors.As(err, &decodeError) {
+				s.deadLetters.add(link.conn.RemoteAddr().String(), decodeError)
+				log.Printf("bad message on link: %v", err)
+			} else if s.ctx.Err() == nil && err != io.EOF {
+				log.Printf("link error: %v", err)
+			}
+			return
+		}
+		if sm == nil {
+			continue
+		}
+		if sm.Signer() != link.publicKey {
+			log.Printf("got a message signed by %s on the link to %s",
+				util.Shorten(string(sm.Signer())), util.Shorten(string(link.publicKey)))
+			return
+		}
+		switch verdict, _ := s.checkRate(host, sm); verdict {
+		case rateDropped:
+			continue
+		case rateBanned, rateStillBanned:
+			return
+		}
+		if !s.access.Allows(sm.Signer(), sm.Message()) {
+			// Being linked doesn't let a peer do more than it could on
+			// a plain connection
+			log.Printf("%s is not allowed to send %s on its link",
+				util.Shorten(string(sm.Signer())), sm.Message().MessageType())
+			continue
+		}
+		if ping, ok := sm.Message().(*PingMessage); ok {
+			// Pings are about the link, so the node never sees them
+			s.handlePing(link, ping)
+			continue
+		}
+		if m, ok := sm.Message().(*PeerExchangeMessage); ok {
+			s.handlePeerExchange(link.publicKey, hostOf(link.conn.RemoteAddr()), m)
+			continue
+		}
+		response, ok := s.handleMessage(sm)
+		if !ok {
+			return
+		}
+		if response != nil {
+			s.linkMutex.Lock()
+			limit := s.linkLimit(link.publicKey)
+			s.linkMutex.Unlock()
+			link.send(util.SignedMessageToFrame(response), limit)
+		}
+	}
+}
+
+// backoff returns how long to wait before redialing a peer, after failing
+// to dial it failCount times in a row. The wait doubles with each failure,
+// up to max.
+func backoff(failCount int, max time.Duration) time.Duration {
+	if failCount == 0 {
+		return 0
+	}
+	if failCount > 30 {
+		// Any more and the shift overflows
+		failCount = 30
+	}
+	wait := time.Second << uint(failCount-1)
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+var errNoAddress = errors.New("no address for peer")
+
+// dialForever keeps a link to a peer open, redialing when it breaks. Each
+// time, it dials the best address in our book.
+// It should be run in its own goroutine.
+func (s *Server) dialForever(publicKey util.PublicKey) {
+	failCount := 0
+	for s.ctx.Err() == nil {
+		address := s.book.best(publicKey)
+		err := errNoAddress
+		if address != nil {
+			err = s.dial(publicKey, address)
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failCount++
+			s.peerDialFailed(publicKey)
+			if address != nil {
+				s.book.failure(publicKey, address)
+			}
+		} else {
+			failCount = 0
+			s.book.success(publicKey, address)
+		}
+		wait := backoff(failCount, s.maxBackoff(publicKey))
+		if banned := s.keyLimiter.bannedFor(string(publicKey), time.Now()); banned > wait {
+			// The peer would just get dropped again
+			wait = banned
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+var errNoHello = errors.New("peer did not accept our hello")
+
+// dial connects to a peer and uses the link until it breaks.
+func (s *Server) dial(publicKey util.PublicKey, address *Address) error {
+	conn, err := net.Dial("tcp", address.String())
+	if err != nil {
+		return err
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// The hello is a regular request, so we wait for the peer's hello before
+	// we start streaming. Nodes before protocol version 2 only read lines,
+	// so the hellos go on lines, and we only switch to frames if the peer
+	// says it speaks them
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	wire := util.NewWire(conn)
+	wire.UseLines()
+	wire.Write(util.NewSignedMessage(s.keyPair, s.hello()))
+	response, err := wire.Read()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if response == nil {
+		// Only nodes from before the handshake answer with an ok
+		conn.Close()
+		return fmt.Errorf("%w: got an ok", errNoHello)
+	}
+	hello, ok := response.Message().(*HelloMessage)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("%w: %s", errNoHello, response.Message())
+	}
+	if response.Signer() != publicKey {
+		conn.Close()
+		return fmt.Errorf("dialed %s but %s answered", util.Shorten(string(publicKey)),
+			util.Shorten(string(response.Signer())))
+	}
+	if err := s.network.checkHello(hello); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	link := newPeerLink(publicKey, conn)
+	link.lines = hello.Version < FrameProtocolVersion
+	s.runLink(link, wire.Reader(), hello)
+	return nil
+}
+
+// hello returns the hello we send when a link starts.
+func (s *Server) hello() *HelloMessage {
+	slot := 0
+	if m := s.Metrics(); m != nil {
+		slot = m.Slot
+	}
+	return &HelloMessage{
+		Version:     ProtocolVersion,
+		Network:     s.network.ID,
+		Genesis:     s.network.Genesis,
+		CurrentSlot: slot,
+	}
+}
+
+// acceptLink turns an incoming connection that started with a hello into a
+// link, and uses it until it breaks. Hellos from anyone who isn't a peer
+// that is supposed to dial us get an error instead. wire is what the hello
+// was read from, since it may have buffered what the peer sent next.
+// We answer in the framing the hello came in. If that was lines, the link
+// only switches to frames when the peer's hello says it speaks them.
+func (s *Server) acceptLink(conn net.Conn, wire *util.Wire, sm *util.SignedMessage) {
+	signer := sm.Signer()
+	if !s.isMember(signer) || signer == s.keyPair.PublicKey() || s.shouldDial(signer) {
+		wire.Write(util.NewSignedMessage(s.keyPair,
+			&util.ErrorMessage{Error: "unexpected hello"}))
+		return
+	}
+	hello := sm.Message().(*HelloMessage)
+	if err := s.network.checkHello(hello); err != nil {
+		log.Printf("refusing a link from %s: %s", util.Shorten(string(signer)), err)
+		wire.Write(util.NewSignedMessage(s.keyPair,
+			&util.ErrorMessage{Error: err.Error()}))
+		return
+	}
+	wire.Write(util.NewSignedMessage(s.keyPair, s.hello()))
+	link := newPeerLink(signer, conn)
+	link.lines = wire.Lines() && hello.Version < FrameProtocolVersion
+	s.runLink(link, wire.Reader(), hello)
+}
+
+// broadcastFrames sends frames to every peer we have a link to.
+// current is the full set of frames we would send to a new peer.
+func (s *Server) broadcastFrames(frames []string, current []string) {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	s.lastBroadcast = current
+
+	// Send to the most important peers first
+	links := []*peerLink{}
+	for _, link := range s.links {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return s.linkLimit(links[i].publicKey) > s.linkLimit(links[j].publicKey)
+	})
+
+	for _, frame := range frames {
+		for _, link := range links {
+			link.send(frame, s.linkLimit(link.publicKey))
+		}
+		s.broadcasted += 1
+	}
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"coinkit/util"
+)
+
+// A PeerState is whether we have a link to a peer, and since when.
+type PeerState struct {
+	PublicKey util.PublicKey
+
+	Connected bool
+
+	// When the link came up or went down. Zero if we have never had a link
+	// to this peer
+	Since time.Time
+
+	// How many times in a row we have failed to dial the peer. Always zero
+	// for peers that dial us
+	Failures int
+
+	// The protocol version the peer speaks, and the slot it was working on,
+	// as of the last time a link came up. Zero if we have never had a link
+	Version int
+	Slot    int
+
+	// How many of the peer's messages we dropped for going over the rate
+	// limits, and how many times we banned it for flooding us
+	Dropped int
+	Bans    int
+}
+
+func (p *PeerState) String() string {
+	state := "down"
+	if p.Connected {
+		state = "up"
+	}
+	if p.Since.IsZero() {
+		return fmt.Sprintf("%s never connected, %d failures",
+			util.Shorten(string(p.PublicKey)), p.Failures)
+	}
+	answer := fmt.Sprintf("%s %s for %s, %d failures", util.Shorten(string(p.PublicKey)), state,
+		time.Since(p.Since).Round(time.Second), p.Failures)
+	if p.Dropped > 0 || p.Bans > 0 {
+		answer += fmt.Sprintf(", %d dropped, %d bans", p.Dropped, p.Bans)
+	}
+	return answer
+}
+
+// OnPeerStateChange registers a function that is called whenever a link to
+// a peer comes up or goes down, a dial fails, or the peer goes over its rate
+// limits. It is called on the
+// goroutine that runs the link, so it should not block.
+// It should be called before the server starts serving.
+func (s *Server) OnPeerStateChange(f func(*PeerState)) {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	s.peerCallbacks = append(s.peerCallbacks, f)
+}
+
+// PeerStates returns the state of every peer we have tried to link to, or
+// that has linked to us, sorted by public key.
+func (s *Server) PeerStates() []*PeerState {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	answer := []*PeerState{}
+	for _, state := range s.peerStates {
+		copy := *state
+		answer = append(answer, &copy)
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		return answer[i].PublicKey < answer[j].PublicKey
+	})
+	return answer
+}
+
+// updatePeerState changes what we know about a peer, and lets the callbacks
+// know.
+func (s *Server) updatePeerState(publicKey util.PublicKey, update func(*PeerState)) {
+	s.linkMutex.Lock()
+	state, ok := s.peerStates[publicKey]
+	if !ok {
+		state = &PeerState{PublicKey: publicKey}
+		s.peerStates[publicKey] = state
+	}
+	update(state)
+	copy := *state
+	callbacks := s.peerCallbacks
+	s.linkMutex.Unlock()
+
+	for _, f := range callbacks {
+		f(&copy)
+	}
+}
+
+// peerUp records that a link to a peer came up, after the peer sent hello.
+func (s *Server) peerUp(publicKey util.PublicKey, hello *HelloMessage) {
+	s.updatePeerState(publicKey, func(state *PeerState) {
+		if !state.Connected && !state.Since.IsZero() {
+			log.Printf("link to %s is back after %s", util.Shorten(string(publicKey)),
+				time.Since(state.Since).Round(time.Second))
+		}
+		state.Connected = true
+		state.Since = time.Now()
+		state.Failures = 0
+		state.Version = hello.Version
+		state.Slot = hello.CurrentSlot
+	})
+}
+
+// peerDown records that a link to a peer went down.
+func (s *Server) peerDown(publicKey util.PublicKey) {
+	s.updatePeerState(publicKey, func(state *PeerState) {
+		state.Connected = false
+		state.Since = time.Now()
+	})
+}
+
+// peerDialFailed records that we could not dial a peer.
+func (s *Server) peerDialFailed(publicKey util.PublicKey) {
+	s.updatePeerState(publicKey, func(state *PeerState) {
+		state.Failures++
+	})
+}
+
+// peerRateLimited records that a message from a peer went over the rate
+// limits.
+func (s *Server) peerRateLimited(publicKey util.PublicKey, verdict rateVerdict) {
+	s.updatePeerState(publicKey, func(state *PeerState) {
+		state.Dropped++
+		if verdict == rateBanned {
+			state.Bans++
+		}
+	})
+}
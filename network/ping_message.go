@@ -0,0 +1,36 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/util"
+)
+
+// Peers send each other a PingMessage every so often on their link, to
+// measure how far apart their clocks are. The answer to a ping is another
+// ping, with Echo set to the Time of the ping it answers.
+// Times are Unix nanoseconds on the sender's clock.
+
+type PingMessage struct {
+	Time int64
+	Echo int64 `json:",omitempty"`
+}
+
+func (m *PingMessage) Slot() int {
+	return 0
+}
+
+func (m *PingMessage) MessageType() string {
+	return "W"
+}
+
+func (m *PingMessage) String() string {
+	if m.Echo != 0 {
+		return fmt.Sprintf("ping time=%d echo=%d", m.Time, m.Echo)
+	}
+	return fmt.Sprintf("ping time=%d", m.Time)
+}
+
+func init() {
+	util.RegisterMessageType(&PingMessage{})
+}
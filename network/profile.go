@@ -0,0 +1,153 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"coinkit/consensus"
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+// A Profile is a named network that a server or client can join. Each
+// profile has its own keys, ports, and data directory, so that one build can
+// run against any of them without mixing up their peers or their history.
+type Profile struct {
+	Name string
+
+	// Peers check each other's network ID and genesis hash before they link
+	// up, so that nodes from different networks refuse to talk
+	ID string
+
+	// The servers in the network listen on consecutive ports starting here
+	Port int
+
+	// Whether the servers run on this machine, with key pairs derived from
+	// Seed. Anyone can derive those keys, so this is only for development.
+	// Other networks load their members and addresses with LoadNetwork, and
+	// each operator keeps their own key
+	Local bool
+	Seed  int
+
+	// Where servers keep their data files, relative to the home directory
+	DataDir string
+}
+
+// The profiles that are built in. Devnet is the default, and it is the same
+// network that NewLocalNetwork always made.
+var Profiles = map[string]*Profile{
+	"mainnet": &Profile{
+		Name:    "mainnet",
+		ID:      "coinkit-mainnet",
+		Port:    9200,
+		DataDir: ".coinkit/mainnet",
+	},
+	"testnet": &Profile{
+		Name:    "testnet",
+		ID:      "coinkit-testnet",
+		Port:    9100,
+		DataDir: ".coinkit/testnet",
+	},
+	"devnet": &Profile{
+		Name:    "devnet",
+		ID:      "coinkit-devnet",
+		Port:    9000,
+		Local:   true,
+		Seed:    0,
+		DataDir: ".coinkit/devnet",
+	},
+}
+
+const DefaultProfile = "devnet"
+
+// LookupProfile returns the profile with the given name.
+func LookupProfile(name string) (*Profile, error) {
+	p, ok := Profiles[name]
+	if !ok {
+		names := []string{}
+		for name := range Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown network %q, expected one of %s",
+			name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// Genesis is the hash of the state the network starts with, when all money
+// is in the mint account.
+func (p *Profile) Genesis() string {
+	mint := util.NewKeyPairFromSecretPhrase("mint")
+	return consensus.HashString(fmt.Sprintf("%s\n%s\n%d",
+		p.ID, mint.PublicKey(), currency.TotalMoney))
+}
+
+// Network returns the configuration for a local network and for each of its
+// servers. Other networks have nothing built in, so it returns nils for them.
+func (p *Profile) Network() (*NetworkConfig, []*ServerConfig) {
+	if !p.Local {
+		return nil, nil
+	}
+	network, servers := NewLocalhostNetwork(p.Port, 4, p.Seed)
+	network.ID = p.ID
+	network.Genesis = p.Genesis()
+	return network, servers
+}
+
+// LoadNetwork returns the configuration for the network. It is read from
+// filename, like
+// {"Nodes": ["10.0.0.1:9200", "10.0.0.2:9200"], "Members": ["A", "B"], "Threshold": 2}
+// A local network can leave filename empty to use the built-in one.
+func (p *Profile) LoadNetwork(filename string) (*NetworkConfig, error) {
+	if filename == "" {
+		if !p.Local {
+			return nil, fmt.Errorf("%s needs a network config file", p.Name)
+		}
+		network, _ := p.Network()
+		return network, nil
+	}
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	network := &NetworkConfig{}
+	if err := json.Unmarshal(bytes, network); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	if len(network.Members) == 0 || len(network.Nodes) != len(network.Members) {
+		return nil, fmt.Errorf("%s should have one address for each member", filename)
+	}
+	if network.Threshold < 1 || network.Threshold > len(network.Members) {
+		return nil, fmt.Errorf("bad threshold in %s: %d", filename, network.Threshold)
+	}
+	if err := parseMembers(network.Members); err != nil {
+		return nil, fmt.Errorf("bad member in %s: %s", filename, err)
+	}
+	network.ID = p.ID
+	network.Genesis = p.Genesis()
+	return network, nil
+}
+
+// DataPath returns where a data file with the given name goes for this
+// profile, creating the data directory if it doesn't exist yet. Absolute
+// paths are left alone.
+func (p *Profile) DataPath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, p.DataDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,123 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"coinkit/util"
+)
+
+func TestProfilesAreDistinct(t *testing.T) {
+	ids := make(map[string]bool)
+	ports := make(map[int]bool)
+	genesis := make(map[string]bool)
+	members := make(map[util.PublicKey]bool)
+	for name, p := range Profiles {
+		if p.Name != name {
+			t.Fatalf("profile %s is named %s", name, p.Name)
+		}
+		if ids[p.ID] || ports[p.Port] || genesis[p.Genesis()] {
+			t.Fatalf("profile %s overlaps with another profile", name)
+		}
+		ids[p.ID] = true
+		ports[p.Port] = true
+		genesis[p.Genesis()] = true
+		network, _ := p.Network()
+		if network == nil {
+			continue
+		}
+		for _, member := range network.Members {
+			if members[member] {
+				t.Fatalf("profile %s shares a member with another profile", name)
+			}
+			members[member] = true
+		}
+	}
+	if _, err := LookupProfile("nonesuch"); err == nil {
+		t.Fatal("expected an error for an unknown profile")
+	}
+}
+
+// writeTestnetConfig writes a config for a testnet whose members are the
+// devnet members, and returns its filename.
+func writeTestnetConfig(t *testing.T) string {
+	devnet, _ := Profiles["devnet"].Network()
+	bytes, err := json.Marshal(&NetworkConfig{
+		Nodes:     devnet.Nodes,
+		Members:   devnet.Members,
+		Threshold: devnet.Threshold,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "testnet.json")
+	if err := ioutil.WriteFile(filename, bytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadNetwork(t *testing.T) {
+	testnet := Profiles["testnet"]
+	if network, servers := testnet.Network(); network != nil || servers != nil {
+		t.Fatal("testnet keys should not be built in")
+	}
+	if _, err := testnet.LoadNetwork(""); err == nil {
+		t.Fatal("testnet should need a config file")
+	}
+	network, err := testnet.LoadNetwork(writeTestnetConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.ID != testnet.ID || network.Genesis != testnet.Genesis() || len(network.Members) != 4 {
+		t.Fatalf("bad testnet config: %+v", network)
+	}
+	if _, err := Profiles["devnet"].LoadNetwork(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckHello(t *testing.T) {
+	devnet, _ := Profiles["devnet"].Network()
+	testnet, err := Profiles["testnet"].LoadNetwork(writeTestnetConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &HelloMessage{
+		Version: ProtocolVersion,
+		Network: testnet.ID,
+		Genesis: testnet.Genesis,
+	}
+	if err := testnet.checkHello(hello); err != nil {
+		t.Fatal(err)
+	}
+	if devnet.checkHello(hello) == nil {
+		t.Fatal("devnet should refuse a hello from testnet")
+	}
+	if devnet.checkHello(&HelloMessage{
+		Version: ProtocolVersion,
+		Network: devnet.ID,
+		Genesis: "other",
+	}) == nil {
+		t.Fatal("devnet should refuse a hello with a different genesis")
+	}
+	if testnet.checkHello(&HelloMessage{Network: testnet.ID, Genesis: testnet.Genesis}) == nil {
+		t.Fatal("testnet should refuse a hello from before the protocol had versions")
+	}
+	if testnet.checkHello(&HelloMessage{
+		Version: 1,
+		Network: testnet.ID,
+		Genesis: testnet.Genesis,
+	}) != nil {
+		t.Fatal("testnet should accept a hello from the previous protocol version")
+	}
+
+	// Test networks don't have an ID, so they accept anyone with a new
+	// enough protocol
+	unit, _ := NewUnitTestNetwork()
+	if err := unit.checkHello(hello); err != nil {
+		t.Fatal(err)
+	}
+}
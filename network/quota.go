@@ -0,0 +1,134 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A QuotaConfig limits how many expensive queries a client can make.
+// Each client can make Burst queries at once, and then gets another query
+// every Interval.
+type QuotaConfig struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// Validate returns an error if the quota could never let a query through.
+func (c *QuotaConfig) Validate() error {
+	if c.Burst < 1 {
+		return fmt.Errorf("quota burst must be at least 1, not %d", c.Burst)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("quota interval must be positive, not %s", c.Interval)
+	}
+	return nil
+}
+
+// ParseQuota parses a quota written as burst/interval, like 20/1s.
+func ParseQuota(s string) (*QuotaConfig, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected a quota like 20/1s but got %q", s)
+	}
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad burst in quota %q", s)
+	}
+	interval, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad interval in quota %q", s)
+	}
+	config := &QuotaConfig{Burst: burst, Interval: interval}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// If we are tracking more clients than this, we forget about the ones that
+// are not using any of their quota.
+const maxQuotaClients = 10000
+
+type quotaBucket struct {
+	tokens int
+
+	// When tokens was last refilled
+	refilled time.Time
+}
+
+// quotaTracker tracks how much quota each client has left.
+// quotaTracker is threadsafe.
+type quotaTracker struct {
+	config  *QuotaConfig
+	mutex   sync.Mutex
+	buckets map[string]*quotaBucket
+}
+
+// newQuotaTracker returns nil if there is no quota config, and an error if
+// the config is invalid.
+func newQuotaTracker(config *QuotaConfig) (*quotaTracker, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &quotaTracker{
+		config:  config,
+		buckets: make(map[string]*quotaBucket),
+	}, nil
+}
+
+// refill adds any tokens that the bucket has earned since it was last refilled.
+func (t *quotaTracker) refill(b *quotaBucket, now time.Time) {
+	earned := int(now.Sub(b.refilled) / t.config.Interval)
+	if earned <= 0 {
+		return
+	}
+	b.tokens += earned
+	b.refilled = b.refilled.Add(time.Duration(earned) * t.config.Interval)
+	if b.tokens >= t.config.Burst {
+		b.tokens = t.config.Burst
+		b.refilled = now
+	}
+}
+
+// take uses up one query for this client.
+// If the client is out of quota, it returns false along with how long the
+// client should wait before trying again.
+// A nil quotaTracker allows everything.
+func (t *quotaTracker) take(client string, now time.Time) (bool, time.Duration) {
+	if t == nil {
+		return true, 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	b, ok := t.buckets[client]
+	if !ok {
+		if len(t.buckets) >= maxQuotaClients {
+			t.forgetIdle(now)
+		}
+		b = &quotaBucket{tokens: t.config.Burst, refilled: now}
+		t.buckets[client] = b
+	}
+	t.refill(b, now)
+	if b.tokens == 0 {
+		return false, b.refilled.Add(t.config.Interval).Sub(now)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// forgetIdle drops the clients whose quota is full anyway.
+func (t *quotaTracker) forgetIdle(now time.Time) {
+	for client, b := range t.buckets {
+		t.refill(b, now)
+		if b.tokens == t.config.Burst {
+			delete(t.buckets, client)
+		}
+	}
+}
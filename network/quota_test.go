@@ -0,0 +1,58 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	var unlimited *quotaTracker
+	if ok, _ := unlimited.take("bob", time.Now()); !ok {
+		t.Fatal("a nil tracker should allow everything")
+	}
+
+	tracker, err := newQuotaTracker(&QuotaConfig{Burst: 2, Interval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := tracker.take("bob", start); !ok {
+			t.Fatal("bob should be able to make a burst of queries")
+		}
+	}
+	ok, wait := tracker.take("bob", start.Add(100*time.Millisecond))
+	if ok {
+		t.Fatal("bob should be out of quota")
+	}
+	if wait != 900*time.Millisecond {
+		t.Fatalf("bob should wait 900ms but was told %s", wait)
+	}
+	if ok, _ := tracker.take("alice", start); !ok {
+		t.Fatal("alice has her own quota")
+	}
+	if ok, _ := tracker.take("bob", start.Add(time.Second)); !ok {
+		t.Fatal("bob should get more quota after a second")
+	}
+	if ok, _ := tracker.take("bob", start.Add(time.Second)); ok {
+		t.Fatal("bob should only get one more query after a second")
+	}
+	if ok, _ := tracker.take("bob", start.Add(time.Hour)); !ok {
+		t.Fatal("bob's quota should refill")
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	config, err := ParseQuota("20/1s")
+	if err != nil || config.Burst != 20 || config.Interval != time.Second {
+		t.Fatalf("bad quota: %+v, %v", config, err)
+	}
+	for _, s := range []string{"20", "20/0s", "0/1s", "x/1s", "20/x"} {
+		if _, err := ParseQuota(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+	if _, err := newQuotaTracker(&QuotaConfig{Burst: 1}); err == nil {
+		t.Fatal("a quota with no interval should be refused")
+	}
+}
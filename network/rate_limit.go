@@ -0,0 +1,205 @@
+package network
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A RateLimitConfig limits how fast a single signer or IP address can send
+// us messages, so that one misbehaving peer can't flood the node.
+// A message that goes over the limit is dropped. A sender that keeps going
+// over the limit is banned for a while, which drops its connections.
+type RateLimitConfig struct {
+	// How many messages and how many bytes a sender can keep sending each
+	// second. Zero means no limit
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+
+	// How long a sender can go at full speed before it hits the limits.
+	// Zero means one second
+	Burst time.Duration
+
+	// How many messages a sender can have dropped before it gets banned.
+	// The count starts over once the sender slows down enough that its
+	// limits refill. Zero means senders are never banned
+	Strikes int
+
+	// How long a ban lasts
+	BanDuration time.Duration
+}
+
+// If we are tracking more senders than this, we forget about the ones that
+// are well under their limits.
+const maxRateLimitSenders = 10000
+
+// A rateVerdict is what to do with a message. Later verdicts are harsher.
+type rateVerdict int
+
+const (
+	rateAllowed rateVerdict = iota
+	rateDropped
+
+	// The sender just got banned
+	rateBanned
+
+	// The sender was already banned
+	rateStillBanned
+)
+
+type rateBucket struct {
+	// How many messages and bytes the sender can send right now. bytes can
+	// go negative, so that one big message is allowed as long as the sender
+	// then waits for it to be paid off
+	messages float64
+	bytes    float64
+
+	// When messages and bytes were last refilled
+	refilled time.Time
+
+	// How many messages were dropped since the bucket was last full
+	strikes int
+
+	// The sender is banned until then
+	bannedUntil time.Time
+}
+
+// capacity returns how many messages and bytes a full bucket holds. It always
+// holds at least one message, or slow limits would never allow anything.
+func (c *RateLimitConfig) capacity() (float64, float64) {
+	burst := 1.0
+	if c.Burst > 0 {
+		burst = c.Burst.Seconds()
+	}
+	return math.Max(c.MessagesPerSecond*burst, 1), c.BytesPerSecond * burst
+}
+
+func (c *RateLimitConfig) newBucket(now time.Time) *rateBucket {
+	messages, bytes := c.capacity()
+	return &rateBucket{
+		messages: messages,
+		bytes:    bytes,
+		refilled: now,
+	}
+}
+
+// refill adds whatever the bucket has earned since it was last refilled.
+// It returns whether the bucket is now full.
+func (c *RateLimitConfig) refill(b *rateBucket, now time.Time) bool {
+	messages, bytes := c.capacity()
+	elapsed := now.Sub(b.refilled).Seconds()
+	if elapsed > 0 {
+		b.refilled = now
+		b.messages = math.Min(b.messages+elapsed*c.MessagesPerSecond, messages)
+		b.bytes = math.Min(b.bytes+elapsed*c.BytesPerSecond, bytes)
+	}
+	full := b.messages == messages && b.bytes == bytes
+	if full {
+		b.strikes = 0
+	}
+	return full
+}
+
+// check uses up one message of size bytes from the bucket.
+// If the message is not allowed, it also returns how long the sender should
+// wait before sending another.
+func (c *RateLimitConfig) check(b *rateBucket, size int, now time.Time) (rateVerdict, time.Duration) {
+	if now.Before(b.bannedUntil) {
+		return rateStillBanned, b.bannedUntil.Sub(now)
+	}
+	c.refill(b, now)
+	messagesOK := c.MessagesPerSecond == 0 || b.messages >= 1
+	bytesOK := c.BytesPerSecond == 0 || b.bytes > 0
+	if messagesOK && bytesOK {
+		// A limit of zero is no limit, so there is nothing to use up
+		if c.MessagesPerSecond > 0 {
+			b.messages--
+		}
+		if c.BytesPerSecond > 0 {
+			b.bytes -= float64(size)
+		}
+		return rateAllowed, 0
+	}
+
+	b.strikes++
+	if c.Strikes > 0 && b.strikes >= c.Strikes {
+		b.strikes = 0
+		b.bannedUntil = now.Add(c.BanDuration)
+		return rateBanned, c.BanDuration
+	}
+	var wait float64
+	if !messagesOK {
+		wait = (1 - b.messages) / c.MessagesPerSecond
+	}
+	if !bytesOK {
+		wait = math.Max(wait, -b.bytes/c.BytesPerSecond)
+	}
+	return rateDropped, time.Duration(wait * float64(time.Second))
+}
+
+// rateLimiter tracks how fast each sender has been sending us messages.
+// rateLimiter is threadsafe.
+type rateLimiter struct {
+	config  *RateLimitConfig
+	mutex   sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// newRateLimiter returns nil if there is no rate limit config.
+func newRateLimiter(config *RateLimitConfig) *rateLimiter {
+	if config == nil {
+		return nil
+	}
+	return &rateLimiter{
+		config:  config,
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// check counts a message of size bytes from this sender, and returns
+// whether it is allowed.
+// If it is not, it also returns how long the sender should wait, or how
+// long the sender is banned for.
+// A nil rateLimiter allows everything.
+func (r *rateLimiter) check(sender string, size int, now time.Time) (rateVerdict, time.Duration) {
+	if r == nil {
+		return rateAllowed, 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, ok := r.buckets[sender]
+	if !ok {
+		if len(r.buckets) >= maxRateLimitSenders {
+			r.forgetIdle(now)
+		}
+		b = r.config.newBucket(now)
+		r.buckets[sender] = b
+	}
+	return r.config.check(b, size, now)
+}
+
+// bannedFor returns how much longer this sender is banned for, or zero if
+// it isn't banned.
+func (r *rateLimiter) bannedFor(sender string, now time.Time) time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	b, ok := r.buckets[sender]
+	if !ok || !now.Before(b.bannedUntil) {
+		return 0
+	}
+	return b.bannedUntil.Sub(now)
+}
+
+// forgetIdle drops the senders that are not banned and whose limits are
+// full anyway.
+func (r *rateLimiter) forgetIdle(now time.Time) {
+	for sender, b := range r.buckets {
+		if r.config.refill(b, now) && !now.Before(b.bannedUntil) {
+			delete(r.buckets, sender)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var unlimited *rateLimiter
+	if verdict, _ := unlimited.check("bob", 1000, time.Now()); verdict != rateAllowed {
+		t.Fatal("a nil limiter should allow everything")
+	}
+
+	limiter := newRateLimiter(&RateLimitConfig{
+		MessagesPerSecond: 2,
+		Strikes:           3,
+		BanDuration:       time.Minute,
+	})
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if verdict, _ := limiter.check("bob", 10, start); verdict != rateAllowed {
+			t.Fatal("bob should be able to send a burst of messages")
+		}
+	}
+	verdict, wait := limiter.check("bob", 10, start.Add(100*time.Millisecond))
+	if verdict != rateDropped {
+		t.Fatal("bob should be over the limit")
+	}
+	if wait != 400*time.Millisecond {
+		t.Fatalf("bob should wait 400ms but was told %s", wait)
+	}
+	if verdict, _ := limiter.check("alice", 10, start); verdict != rateAllowed {
+		t.Fatal("alice has her own limit")
+	}
+
+	// Once his limit refills, bob can send another burst, but keeping it up
+	// gets him banned
+	now := start.Add(2 * time.Second)
+	for i := 0; i < 2; i++ {
+		if verdict, _ := limiter.check("bob", 10, now); verdict != rateAllowed {
+			t.Fatal("bob should be able to send again later")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if verdict, _ := limiter.check("bob", 10, now); verdict != rateDropped {
+			t.Fatal("bob should be over the limit again")
+		}
+	}
+	verdict, wait = limiter.check("bob", 10, now)
+	if verdict != rateBanned || wait != time.Minute {
+		t.Fatalf("bob should be banned for a minute but got %d, %s", verdict, wait)
+	}
+	if verdict, _ := limiter.check("bob", 10, now.Add(time.Second)); verdict != rateStillBanned {
+		t.Fatal("bob should still be banned")
+	}
+	if limiter.bannedFor("bob", now.Add(time.Second)) != 59*time.Second {
+		t.Fatal("bob should know how long the ban has left")
+	}
+	if verdict, _ := limiter.check("bob", 10, now.Add(time.Hour)); verdict != rateAllowed {
+		t.Fatal("bob's ban should run out")
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	limiter := newRateLimiter(&RateLimitConfig{BytesPerSecond: 100})
+	start := time.Now()
+	if verdict, _ := limiter.check("10.0.0.1", 1000, start); verdict != rateAllowed {
+		t.Fatal("one big message should be allowed")
+	}
+	verdict, wait := limiter.check("10.0.0.1", 1, start)
+	if verdict != rateDropped {
+		t.Fatal("the big message should use up the limit")
+	}
+	if wait != 9*time.Second {
+		t.Fatalf("expected to wait 9s but was told %s", wait)
+	}
+	if verdict, _ := limiter.check("10.0.0.1", 1, start.Add(10*time.Second)); verdict != rateAllowed {
+		t.Fatal("the big message should be paid off after 10s")
+	}
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"time"
 
 	"coinkit/util"
@@ -12,18 +13,41 @@ import (
 type Request struct {
 	Message *util.SignedMessage
 
-	// If Message is nil, it has been pre-encoded into MessageString.
-	Line string
+	// If Message is nil, it has been pre-encoded into Frame.
+	Frame string
 
 	Response chan *util.SignedMessage
 
 	Timeout time.Duration
+
+	// When Context is done, the request is abandoned.
+	// If it is nil, the request is never abandoned.
+	Context context.Context
+}
+
+// Done returns a channel that is closed when the request is abandoned.
+func (r *Request) Done() <-chan struct{} {
+	if r.Context == nil {
+		return nil
+	}
+	return r.Context.Done()
+}
+
+// Deadline returns when we should give up on a response to this request.
+func (r *Request) Deadline() time.Time {
+	deadline := time.Now().Add(r.Timeout)
+	if r.Context != nil {
+		if d, ok := r.Context.Deadline(); ok && d.Before(deadline) {
+			return d
+		}
+	}
+	return deadline
 }
 
-func (r *Request) GetLine() string {
-	if r.Message != nil && len(r.Line) == 0 {
-		// We need to calculate the message string
-		r.Line = util.SignedMessageToLine(r.Message)
+func (r *Request) GetFrame() string {
+	if r.Message != nil && len(r.Frame) == 0 {
+		// We need to calculate the frame
+		r.Frame = util.SignedMessageToFrame(r.Message)
 	}
-	return r.Line
+	return r.Frame
 }
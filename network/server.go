@@ -1,41 +1,164 @@
 package network
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"coinkit/consensus"
 	"coinkit/currency"
+	"coinkit/data"
+	"coinkit/registry"
 	"coinkit/util"
 )
 
 type Server struct {
 	port    int
 	keyPair *util.KeyPair
-	peers   []*Client
 	node    *Node
 
-	// Whenever there is a new batch of outgoing messages, it is serialized
-	// into a list of lines and sent to the outgoing channel
+	// The host we listen on
+	bind string
+
+	// Where we tell peers to find us. Nil if we let them work it out from
+	// our connections
+	advertise *Address
+
+	// Who is allowed to send us what
+	access *AccessPolicy
+
+	// How many queries each signer and each IP address have left
+	keyQuota *quotaTracker
+	ipQuota  *quotaTracker
+
+	// How fast each signer and each IP address can send us messages
+	keyLimiter *rateLimiter
+	ipLimiter  *rateLimiter
+
+	// The network we are on, so that we only link up with its nodes
+	network *NetworkConfig
+
+	// The public keys of the other nodes in the network, and of anyone
+	// else in our quorum slice. The map is replaced, never changed, when
+	// our quorum slice changes. Protected by memberMutex
+	members     map[util.PublicKey]bool
+	memberMutex sync.Mutex
+
+	// Where we think the other members of the network are
+	book *addressBook
+
+	// Nodes we ask where everyone is when we start up
+	bootstrap []*Address
+
+	// The peers we are dialing. Protected by linkMutex
+	dialing map[util.PublicKey]bool
+
+	// Outbound-only servers don't listen for connections at all
+	outboundOnly bool
+
+	// Whether we keep all of history
+	archive bool
+
+	// Our links to peers, by public key. Protected by linkMutex
+	links     map[util.PublicKey]*peerLink
+	linkMutex sync.Mutex
+
+	// The frames a new peer should get. Protected by linkMutex
+	lastBroadcast []string
+
+	// Whether each peer is connected, and who wants to know when that
+	// changes. Protected by linkMutex
+	peerStates    map[util.PublicKey]*PeerState
+	peerCallbacks []func(*PeerState)
+
+	// The latest consensus metrics from the node. Protected by metricsMutex
+	metrics      *consensus.Metrics
+	metricsMutex sync.Mutex
+
+	// How important each peer is, from the node. Protected by linkMutex
+	priorities map[util.PublicKey]int
+
+	// The node we stream history from, if we are a read replica
+	follow *Address
+
+	// Whether we ask the node we follow for state diffs
+	followDiffs bool
+
+	// Messages we could not decode
+	deadLetters *deadLetterQueue
+
+	// Where we save finalized history. Nil if we don't save it
+	db *data.Database
+
+	// How big db can get, in bytes. Zero means there is no limit
+	maxDataSize int64
+
+	// Where we record everything that changes our node. Nil if we don't
+	journal *Journal
+
+	// When we last checked how big db is
+	lastDiskCheck time.Time
+
+	// Who we call when transactions are finalized. Nil if nobody
+	webhooks *webhookSender
+
+	// Where we send alerts. Nil if nowhere
+	alerts *alerter
+
+	// How long we can work on one slot before alerting that it is stuck
+	stuckSlotTimeout time.Duration
+
+	// How far our clock is from our peers' clocks
+	clocks *clockTracker
+
+	// Whether our clock was too far off the last time we checked
+	clockOff bool
+
+	// The recent metrics samples
+	metricsHistory *metricsHistory
+
+	// When we last sampled the metrics, and the slot we were on then
+	lastSample     time.Time
+	lastSampleSlot int
+
+	// How many transactions were finalized since the last sample
+	finalized int
+
+	// Whenever there is a new set of outgoing messages, they are encoded
+	// and sent to the outgoing channel
 	outgoing chan []string
 
+	// Gets a value when a peer gets back in touch after a partition, so
+	// that all of our outgoing frames should be sent again right away
+	resync chan bool
+
 	// Messages we are going to handle. These do not require a response
 	messages chan *util.SignedMessage
 
 	// Requests we are going to handle. These require a response
 	requests chan *Request
 
+	// Changes to our quorum slice, which have to be made on the
+	// message-processing thread since they touch the node
+	sliceChanges chan *sliceChange
+
 	listener net.Listener
 
 	// We close the currentBlock channel whenever the current block is complete
 	currentBlock chan bool
 
-	// We set shutdown to true and close the quit channel
+	// We set shutdown to true and cancel the context
 	// when the server is shutting down
 	shutdown bool
-	quit     chan bool
+	ctx      context.Context
+	cancel   context.CancelFunc
 
 	// A counter of how many messages we have broadcasted
 	broadcasted int
@@ -44,32 +167,216 @@ type Server struct {
 
 	// How often we send out a rebroadcast, resending our redundant data
 	RebroadcastInterval time.Duration
+
+	// How often we rebroadcast once nothing has changed since the last
+	// rebroadcast. Peers that are keeping up don't need to hear the same
+	// thing every second
+	KeepaliveInterval time.Duration
+
+	// How long one tick of the nomination and ballot timers lasts
+	BallotTimerInterval time.Duration
+
+	// How often we check how big the data file is
+	DiskCheckInterval time.Duration
+
+	// How often we sample the metrics
+	MetricsInterval time.Duration
+
+	// How often we share the addresses we know with each peer
+	PeerExchangeInterval time.Duration
 }
 
 func NewServer(config *ServerConfig) *Server {
-	peers := []*Client{}
-	for _, address := range config.Network.Nodes {
-		peers = append(peers, NewClient(address))
+	qs := config.quorumSlice()
+	if config.Follow == nil {
+		if err := qs.Validate(config.KeyPair.PublicKey()); err != nil {
+			log.Fatalf("bad quorum slice: %s", err)
+		}
+	}
+
+	members := memberSet(config.Network, qs)
+
+	// Network members need to be able to do everything
+	var access *AccessPolicy
+	if config.Access != nil {
+		access = &AccessPolicy{
+			Keys:    make(map[util.PublicKey]Scope),
+			Default: config.Access.Default,
+		}
+		for key, scope := range config.Access.Keys {
+			access.Keys[key] = scope
+		}
+		for _, member := range config.Network.Members {
+			access.Keys[member] = AllScopes
+		}
 	}
-	qs := config.Network.QuorumSlice()
 
 	// At the start, all money is in the "mint" account
-	node := NewNode(config.KeyPair.PublicKey(), qs)
+	var node *Node
+	var signed *registry.SignedMetadata
+	if config.Follow != nil {
+		// Read replicas don't talk to anyone but their leader
+		node = NewFollowerNode(config.KeyPair.PublicKey(), config.Leader)
+	} else {
+		node = NewNode(config.KeyPair.PublicKey(), qs)
+		node.SetSigner(config.KeyPair)
+		node.SetEmptySlotTicks(config.EmptySlotTicks)
+		if config.Metadata != nil {
+			metadata := *config.Metadata
+			metadata.Validator = config.KeyPair.PublicKey()
+			signed = metadata.SignWith(config.KeyPair)
+			if _, err := node.registry.Add(signed); err != nil {
+				log.Fatalf("bad metadata: %s", err)
+			}
+		}
+	}
+
+	metrics, err := newMetricsHistory(config.MetricsFile)
+	if err != nil {
+		log.Fatalf("could not load metrics: %s", err)
+	}
+
+	var journal *Journal
+	if config.Journal != "" {
+		var err error
+		journal, err = NewJournal(config.Journal)
+		if err != nil {
+			log.Fatalf("could not open %s: %s", config.Journal, err)
+		}
+		err = journal.recordStart(&JournalStart{
+			Node:        config.KeyPair.PublicKey(),
+			QuorumSlice: qs,
+			Leader:      config.Leader,
+			Archive:     config.Archive,
+			Metadata:    signed,
+
+			EmptySlotTicks: config.EmptySlotTicks,
+		})
+		if err != nil {
+			log.Fatalf("could not write to %s: %s", config.Journal, err)
+		}
+	}
+
+	// The addresses in the config are where we start. Members without one
+	// get found through peer exchange
+	outboundOnly := false
+	book := newAddressBook(config.KeyPair.PublicKey(), members)
+	for i, address := range config.Network.Nodes {
+		if address == nil {
+			continue
+		}
+		if config.Network.Members[i] == config.KeyPair.PublicKey() {
+			outboundOnly = address.OutboundOnly
+			continue
+		}
+		book.add(config.Network.Members[i], address, configScore)
+	}
+	for i, address := range config.Network.Nodes {
+		if outboundOnly && address != nil && address.OutboundOnly {
+			log.Printf("no way to connect to %s, since we are both outbound-only",
+				util.Shorten(string(config.Network.Members[i])))
+		}
+	}
+	node.archive = config.Archive
+
+	var db *data.Database
+	if config.DataFile != "" {
+		var err error
+		db, err = data.NewDatabase(config.DataFile)
+		if err != nil {
+			log.Fatalf("could not open %s: %s", config.DataFile, err)
+		}
+		db.SetSyncPolicy(config.DataSync)
+		node.store = db
+	}
+	if config.HistoryRetention > 0 {
+		node.retention = config.HistoryRetention
+	}
+	var webhooks *webhookSender
+	if len(config.Webhooks) > 0 {
+		webhooks = newWebhookSender(config.Webhooks)
+	}
+	var alerts *alerter
+	if len(config.Alerts) > 0 {
+		sinks := []AlertSink{}
+		for _, ac := range config.Alerts {
+			sink, err := NewAlertSink(ac)
+			if err != nil {
+				log.Fatalf("bad alert config: %s", err)
+			}
+			sinks = append(sinks, sink)
+		}
+		alerts = newAlerter(config.KeyPair.PublicKey(), sinks)
+	}
+	keyQuota, err := newQuotaTracker(config.KeyQuota)
+	if err != nil {
+		log.Fatalf("bad key quota: %s", err)
+	}
+	ipQuota, err := newQuotaTracker(config.IPQuota)
+	if err != nil {
+		log.Fatalf("bad IP quota: %s", err)
+	}
+	stuckSlotTimeout := config.StuckSlotTimeout
+	if stuckSlotTimeout == 0 {
+		stuckSlotTimeout = DefaultStuckSlotTimeout
+	}
+	bind := config.Bind
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Server{
 		port:                config.Port,
 		keyPair:             config.KeyPair,
-		peers:               peers,
+		bind:                bind,
+		advertise:           config.Advertise,
+		book:                book,
+		bootstrap:           config.Bootstrap,
+		dialing:             make(map[util.PublicKey]bool),
+		outboundOnly:        outboundOnly,
+		archive:             config.Archive,
+		links:               make(map[util.PublicKey]*peerLink),
+		peerStates:          make(map[util.PublicKey]*PeerState),
+		priorities:          node.PeerPriorities(),
 		node:                node,
+		access:              access,
+		keyQuota:            keyQuota,
+		ipQuota:             ipQuota,
+		keyLimiter:          newRateLimiter(config.RateLimit),
+		ipLimiter:           newRateLimiter(config.RateLimit),
+		network:             config.Network,
+		members:             members,
+		follow:              config.Follow,
+		followDiffs:         config.FollowDiffs,
+		deadLetters:         newDeadLetterQueue(),
+		db:                  db,
+		journal:             journal,
+		maxDataSize:         config.MaxDataSize,
+		webhooks:            webhooks,
+		alerts:              alerts,
+		stuckSlotTimeout:    stuckSlotTimeout,
+		clocks:              newClockTracker(),
+		metricsHistory:      metrics,
+		lastSample:          time.Now(),
 		outgoing:            make(chan []string, 10),
+		resync:              make(chan bool, 1),
 		messages:            make(chan *util.SignedMessage),
 		requests:            make(chan *Request),
+		sliceChanges:        make(chan *sliceChange),
 		listener:            nil,
 		shutdown:            false,
-		quit:                make(chan bool),
+		ctx:                 ctx,
+		cancel:              cancel,
 		currentBlock:        make(chan bool),
 		broadcasted:         0,
 		RebroadcastInterval: time.Second,
+		KeepaliveInterval:   10 * time.Second,
+		BallotTimerInterval: time.Second,
+		DiskCheckInterval:   time.Minute,
+		MetricsInterval:     time.Minute,
+
+		PeerExchangeInterval: 30 * time.Second,
 	}
 }
 
@@ -82,18 +389,34 @@ func (s *Server) InitMint() {
 	s.SetBalance(mint.PublicKey(), currency.TotalMoney)
 }
 
-func (s *Server) SetBalance(user string, amount uint64) {
+func (s *Server) SetBalance(user util.PublicKey, amount uint64) {
+	s.checkJournal(s.journal.recordBalance(user, amount))
 	s.node.queue.SetBalance(user, amount)
 }
 
+// checkJournal exits if we could not write to the journal, since a journal
+// with missing entries can't be replayed.
+func (s *Server) checkJournal(err error) {
+	if err != nil {
+		log.Fatalf("could not write to the journal: %s", err)
+	}
+}
+
 // Handles an incoming connection.
-// This is likely to include many messages, all separated by endlines.
+// This is likely to include many messages, each in its own frame, or on its
+// own line if it comes from a node before protocol version 2.
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	wire := util.NewWire(conn)
+	host := remoteHost(conn)
 	for {
-		sm, err := util.ReadSignedMessage(conn)
+		sm, err := wire.Read()
 		if err != nil {
+			var decodeError *util.DecodeError
+			if errors.As(err, &decodeError) {
+				s.deadLetters.add(conn.RemoteAddr().String(), decodeError)
+			}
 			if !s.shutdown && err != io.EOF {
 				log.Printf("connection error: %v", err)
 			}
@@ -103,13 +426,129 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
+		switch verdict, wait := s.checkRate(host, sm); verdict {
+		case rateDropped:
+			wire.Write(util.NewSignedMessage(s.keyPair,
+				&util.ErrorMessage{
+					Error:      "rate limit exceeded",
+					Transient:  true,
+					RetryAfter: wait,
+				}))
+			continue
+		case rateBanned, rateStillBanned:
+			return
+		}
+
+		if !s.access.Allows(sm.Signer(), sm.Message()) {
+			wire.Write(util.NewSignedMessage(s.keyPair,
+				&util.ErrorMessage{Error: "not authorized"}))
+			continue
+		}
+
+		if _, ok := sm.Message().(*HelloMessage); ok {
+			// This connection either becomes a link or gets dropped
+			s.acceptLink(conn, wire, sm)
+			return
+		}
+
+		if m, ok := sm.Message().(*PeerExchangeMessage); ok {
+			// The address book belongs to the server, not the node
+			s.handlePeerExchange(sm.Signer(), hostOf(conn.RemoteAddr()), m)
+			wire.Write(util.NewSignedMessage(s.keyPair,
+				s.peerExchangeMessage()))
+			continue
+		}
+
+		if _, ok := sm.Message().(*MetricsMessage); ok {
+			// The metrics belong to the server, not the node
+			letters, dead := s.deadLetters.list()
+			wire.Write(util.NewSignedMessage(s.keyPair, &MetricsMessage{
+				Samples:     s.MetricsHistory(),
+				DeadLetters: letters,
+				Undecodable: dead,
+				Peers:       s.PeerStates(),
+			}))
+			continue
+		}
+
+		if wait := s.checkQuota(conn, sm); wait > 0 {
+			wire.Write(util.NewSignedMessage(s.keyPair,
+				&util.ErrorMessage{
+					Error:      "quota exceeded",
+					Transient:  true,
+					RetryAfter: wait,
+				}))
+			continue
+		}
+
 		m, ok := s.handleMessage(sm)
 		if !ok {
 			return
 		}
 
-		util.WriteSignedMessage(conn, m)
+		wire.Write(m)
+	}
+}
+
+// checkQuota uses up quota for expensive queries. It returns how long the
+// sender should wait, or zero if the query can go ahead.
+func (s *Server) checkQuota(conn net.Conn, sm *util.SignedMessage) time.Duration {
+	switch sm.Message().(type) {
+	case *util.InfoMessage, *HistoryRequestMessage:
+	default:
+		return 0
+	}
+	if s.isMember(sm.Signer()) {
+		return 0
+	}
+	now := time.Now()
+	ok, wait := s.keyQuota.take(string(sm.Signer()), now)
+	if !ok {
+		return wait
+	}
+	ok, wait = s.ipQuota.take(remoteHost(conn), now)
+	if !ok {
+		return wait
+	}
+	return 0
+}
+
+// remoteHost returns the host a connection comes from. The limits for each
+// IP address are kept by it.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
 	}
+	return host
+}
+
+// checkRate counts a message against the rate limits for its signer and,
+// unless the signer is a member, for the host it came from. Anyone can make
+// up new keys and reconnect, so a ban on the host is what keeps a stranger
+// out. Members are only limited by key, since several of them may share a
+// host. If the message is not allowed, it also returns how long the sender
+// should wait.
+func (s *Server) checkRate(host string, sm *util.SignedMessage) (rateVerdict, time.Duration) {
+	now := time.Now()
+	size := len(sm.Serialize())
+	verdict, wait := s.keyLimiter.check(string(sm.Signer()), size, now)
+	if verdict == rateBanned {
+		log.Printf("banning %s for %s for flooding us", util.Shorten(string(sm.Signer())), wait)
+	}
+	if !s.isMember(sm.Signer()) {
+		ipVerdict, ipWait := s.ipLimiter.check(host, size, now)
+		if ipVerdict == rateBanned {
+			log.Printf("banning %s for %s for flooding us", host, ipWait)
+		}
+		if ipVerdict > verdict {
+			verdict, wait = ipVerdict, ipWait
+		}
+	}
+	if verdict != rateAllowed && s.isMember(sm.Signer()) {
+		s.peerRateLimited(sm.Signer(), verdict)
+	}
+	return verdict, wait
 }
 
 // handleMessage will try many times for an InfoMessage, but only once for other
@@ -126,26 +565,57 @@ func (s *Server) handleMessage(sm *util.SignedMessage) (*util.SignedMessage, boo
 }
 
 // handleMessageOnce is like handleMessage but explicitly only tries once.
+// If the processing goroutine is too busy to take the message, the sender
+// gets a transient error and can try again later.
 func (s *Server) handleMessageOnce(sm *util.SignedMessage) (*util.SignedMessage, bool) {
-	response := make(chan *util.SignedMessage)
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	// The processing goroutine should never block on responding, even if
+	// we have already given up
+	response := make(chan *util.SignedMessage, 1)
 	request := &Request{
 		Message:  sm,
 		Response: response,
+		Context:  ctx,
 	}
 
-	// Send our request to the processing goroutine, wait for the response,
-	// and return it down the connection
-	s.requests <- request
-	timer := time.NewTimer(time.Second)
+	// Send our request to the processing goroutine. Anyone can keep it busy,
+	// so waiting too long for our turn is not a reason to crash
+	enqueue, cancelEnqueue := context.WithTimeout(ctx, time.Second)
+	defer cancelEnqueue()
+	select {
+	case s.requests <- request:
+	case <-enqueue.Done():
+		if s.ctx.Err() != nil {
+			return nil, false
+		}
+		return util.NewSignedMessage(s.keyPair, &util.ErrorMessage{
+			Error:      "server busy",
+			Transient:  true,
+			RetryAfter: time.Second,
+		}), true
+	}
+
+	// Wait for the response, and return it down the connection
+	wait, cancelWait := context.WithTimeout(ctx, time.Second)
+	defer cancelWait()
 	select {
 	case m := <-response:
 		return m, true
-	case <-s.quit:
-		return nil, false
-	case <-timer.C:
+	case <-wait.Done():
+		return nil, s.checkOverloaded(wait)
+	}
+}
+
+// checkOverloaded is called when a request context is done before the
+// processing goroutine responded to a request it took. If the server is not
+// shutting down, that means the processing goroutine is overloaded.
+func (s *Server) checkOverloaded(ctx context.Context) bool {
+	if ctx.Err() == context.DeadlineExceeded && s.ctx.Err() == nil {
 		log.Fatalf("the processing goroutine got overloaded")
-		return nil, false
 	}
+	return false
 }
 
 // retryHandleMessage is like handleMessageOnce, but it expects a non-nil response.
@@ -163,7 +633,7 @@ func (s *Server) retryHandleMessage(sm *util.SignedMessage) (*util.SignedMessage
 		select {
 		case <-s.currentBlock:
 			// There's another block, so let the loop retry
-		case <-s.quit:
+		case <-s.ctx.Done():
 			return nil, false
 		}
 	}
@@ -173,14 +643,14 @@ func (s *Server) retryHandleMessage(sm *util.SignedMessage) (*util.SignedMessage
 // Returns [], false if there is none
 // Does not wait
 func (s *Server) getOutgoing() ([]string, bool) {
-	lines := []string{}
+	encoded := []string{}
 	ok := false
 	for {
 		select {
-		case lines = <-s.outgoing:
+		case encoded = <-s.outgoing:
 			ok = true
 		default:
-			return lines, ok
+			return encoded, ok
 		}
 	}
 }
@@ -190,35 +660,51 @@ func (s *Server) getOutgoing() ([]string, bool) {
 // Since it deals with the node directly, it should only be called from the
 // message-processing thread.
 func (s *Server) unsafeUpdateOutgoing() {
-	// First encode the outgoing messages into lines
+	// First encode the outgoing messages. The node may change them after
+	// this, so they can't leave this thread as they are
 	out := s.node.OutgoingMessages()
 
-	lines := []string{}
+	encoded := []string{}
 	for _, m := range out {
-		sm := util.NewSignedMessage(s.keyPair, m)
-		lines = append(lines, util.SignedMessageToLine(sm))
+		encoded = append(encoded, util.EncodeMessage(m))
 	}
 
+	// Our quorum slice or our peers' might have changed
+	priorities := s.node.PeerPriorities()
+	s.linkMutex.Lock()
+	s.priorities = priorities
+	s.linkMutex.Unlock()
+
+	metrics := s.node.Metrics()
+	s.metricsMutex.Lock()
+	s.metrics = metrics
+	s.metricsMutex.Unlock()
+
 	// Clear the outgoing queue
 	s.getOutgoing()
 
-	// Send our lines to the now-probably-empty queue
-	s.outgoing <- lines
+	// Send our messages to the now-probably-empty queue
+	s.outgoing <- encoded
 }
 
 // unsafeProcessMessage handles a message by interacting with the node directly.
 // It should be only be called from the message-processing thread.
 func (s *Server) unsafeProcessMessage(m *util.SignedMessage) *util.SignedMessage {
+	s.checkJournal(s.journal.recordMessage(m))
 	prevSlot := s.node.Slot()
 	message := s.node.Handle(m.Signer(), m.Message())
 	postSlot := s.node.Slot()
 	s.unsafeUpdateOutgoing()
-
-	if postSlot != prevSlot {
-		close(s.currentBlock)
-		s.currentBlock = make(chan bool)
+	if s.node.Resync() {
+		select {
+		case s.resync <- true:
+		default:
+			// There's already a resync on the way
+		}
 	}
 
+	s.unsafeFinished(prevSlot, postSlot)
+
 	// Return the appropriate message
 	if message == nil {
 		return nil
@@ -227,15 +713,160 @@ func (s *Server) unsafeProcessMessage(m *util.SignedMessage) *util.SignedMessage
 	return sm
 }
 
+// unsafeFinished does everything that has to happen once the node finishes
+// the slots from first up to but not including last, however it got there.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeFinished(first int, last int) {
+	if first == last {
+		return
+	}
+	if err := s.unsafeCheckDivergence(); err != nil {
+		log.Fatalf("stopping because we diverged from the network: %s", err)
+	}
+	s.unsafeSave(first, last)
+	s.unsafeNotify(first, last)
+	s.unsafeCountFinalized(first, last)
+	close(s.currentBlock)
+	s.currentBlock = make(chan bool)
+}
+
+// unsafeCheckDivergence returns an error if the node has diverged from the
+// network, after making sure an alert for it goes out.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeCheckDivergence() error {
+	err := s.node.Diverged()
+	if err != nil && s.alerts != nil {
+		s.alerts.raiseNow(AlertDivergence, err.Error(), 10*time.Second)
+	}
+	return err
+}
+
+// unsafeSave saves the history for slots from first up to but not including
+// last to the database, in one batch.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeSave(first int, last int) {
+	if s.db == nil || first >= last {
+		return
+	}
+	batch := []util.Message{}
+	for slot := first; slot < last; slot++ {
+		h := s.node.History(slot)
+		if h == nil {
+			log.Fatalf("we finished slot %d but have no history for it", slot)
+		}
+		batch = append(batch, h)
+	}
+	if err := s.db.Append(batch...); err != nil {
+		if err == data.ErrClosed && s.ctx.Err() != nil {
+			// We are shutting down
+			return
+		}
+		if s.alerts != nil && errors.Is(err, syscall.ENOSPC) {
+			s.alerts.raiseNow(AlertDiskFull,
+				fmt.Sprintf("could not save slots %d-%d to %s", first, last-1, s.db.Path()),
+				10*time.Second)
+		}
+		log.Fatalf("could not save history for slots %d-%d: %s", first, last-1, err)
+	}
+}
+
+// unsafeNotify calls the webhooks for the transactions in slots from first up
+// to but not including last.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeNotify(first int, last int) {
+	if s.webhooks == nil {
+		return
+	}
+	for slot := first; slot < last; slot++ {
+		h := s.node.History(slot)
+		if h == nil || h.T == nil {
+			continue
+		}
+		for _, chunk := range h.T.Chunks {
+			s.webhooks.notify(slot, chunk)
+		}
+	}
+}
+
+// restore rebuilds the node's state from the database.
+// It must be called before the message-processing thread starts.
+func (s *Server) restore() {
+	if s.db == nil {
+		return
+	}
+	err := s.db.ForEach(func(m util.Message) error {
+		s.checkJournal(s.journal.recordRestore(m))
+		switch m := m.(type) {
+		case *CheckpointMessage:
+			return s.node.RestoreCheckpoint(m)
+		case *HistoryMessage:
+			return s.node.Restore(m)
+		}
+		return fmt.Errorf("unexpected message in database: %s", m)
+	})
+	if err != nil {
+		log.Fatalf("could not restore from %s: %s", s.db.Path(), err)
+	}
+	if s.node.Slot() > 1 {
+		s.Logf("restored history up to slot %d", s.node.Slot()-1)
+	}
+}
+
+// unsafeCheckAlerts raises or resolves the alerts for conditions we check
+// on every tick.
+// It should only be called from the message-processing thread.
+func (s *Server) unsafeCheckAlerts() {
+	if s.alerts == nil {
+		return
+	}
+	m := s.node.Metrics()
+	if m == nil {
+		// Followers don't take part in consensus, so they can't get stuck
+		return
+	}
+	if m.TimeInSlot > s.stuckSlotTimeout {
+		s.alerts.set(AlertStuckSlot, true, fmt.Sprintf("slot %d has taken %.0fs",
+			m.Slot, m.TimeInSlot.Seconds()))
+	} else {
+		s.alerts.set(AlertStuckSlot, false, fmt.Sprintf("working on slot %d", m.Slot))
+	}
+
+	// Give peers a chance to connect before worrying about them
+	if time.Since(s.start) < s.stuckSlotTimeout {
+		return
+	}
+	connected := []util.PublicKey{}
+	s.linkMutex.Lock()
+	for key := range s.links {
+		connected = append(connected, key)
+	}
+	s.linkMutex.Unlock()
+	if s.node.QuorumReachable(connected) {
+		s.alerts.set(AlertQuorumAtRisk, false,
+			fmt.Sprintf("connected to %d peers", len(connected)))
+	} else {
+		s.alerts.set(AlertQuorumAtRisk, true,
+			fmt.Sprintf("only connected to %d peers, not enough for our quorum slice",
+				len(connected)))
+	}
+}
+
 // processMessagesForever should be run in its own goroutine. This is the only
 // thread that is allowed to access the node, because node is not threadsafe.
 // The 'unsafe' methods should only be called from within here.
 func (s *Server) processMessagesForever() {
+	ticker := time.NewTicker(s.BallotTimerInterval)
+	defer ticker.Stop()
+
 	for {
 
 		select {
 
 		case request := <-s.requests:
+			if request.Context != nil && request.Context.Err() != nil {
+				// The requester already gave up on this one
+				continue
+			}
 			if request.Message != nil {
 				response := s.unsafeProcessMessage(request.Message)
 				if request.Response != nil {
@@ -248,12 +879,96 @@ func (s *Server) processMessagesForever() {
 				s.unsafeProcessMessage(message)
 			}
 
-		case <-s.quit:
-			break
+		case change := <-s.sliceChanges:
+			err := s.node.SetQuorumSlice(change.qs)
+			if err == nil {
+				s.checkJournal(s.journal.recordQuorumSlice(change.qs))
+				s.setMembers(change.qs)
+				s.unsafeUpdateOutgoing()
+			}
+			change.err <- err
+
+		case <-ticker.C:
+			s.checkJournal(s.journal.recordTick())
+			prevSlot := s.node.Slot()
+			if s.node.HandleTimerTick() {
+				s.unsafeUpdateOutgoing()
+			}
+			s.unsafeFinished(prevSlot, s.node.Slot())
+			s.unsafeCheckAlerts()
+			s.unsafeCheckClock()
+			s.unsafeCheckDisk()
+			s.unsafeSampleMetrics()
+
+		case <-s.ctx.Done():
+			return
 		}
 	}
 }
 
+// memberSet returns the nodes that are members of the network, along with
+// anyone in our quorum slice.
+func memberSet(network *NetworkConfig, qs consensus.QuorumSlice) map[util.PublicKey]bool {
+	members := make(map[util.PublicKey]bool)
+	for _, member := range network.Members {
+		members[member] = true
+	}
+	for _, member := range qs.AllMembers() {
+		members[member] = true
+	}
+	return members
+}
+
+// isMember returns whether a node is a member of the network.
+func (s *Server) isMember(publicKey util.PublicKey) bool {
+	s.memberMutex.Lock()
+	defer s.memberMutex.Unlock()
+	return s.members[publicKey]
+}
+
+// setMembers updates who counts as a member after our quorum slice changes
+// to qs, and starts dialing the new members that we know how to reach.
+func (s *Server) setMembers(qs consensus.QuorumSlice) {
+	members := memberSet(s.network, qs)
+	s.memberMutex.Lock()
+	old := s.members
+	s.members = members
+	s.memberMutex.Unlock()
+	s.book.setMembers(members)
+	for member := range members {
+		if !old[member] {
+			s.maybeDial(member)
+		}
+	}
+}
+
+// A sliceChange asks the message-processing thread to change our quorum
+// slice. The error from making the change is sent back on err.
+type sliceChange struct {
+	qs  consensus.QuorumSlice
+	err chan error
+}
+
+// SetQuorumSlice changes the quorum slice of a running server, starting
+// with the next slot. The change is announced to our peers right away.
+func (s *Server) SetQuorumSlice(qs consensus.QuorumSlice) error {
+	change := &sliceChange{
+		qs:  qs,
+		err: make(chan error, 1),
+	}
+	select {
+	case s.sliceChanges <- change:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	select {
+	case err := <-change.err:
+		return err
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
 func (s *Server) listen() {
 	for {
 		conn, err := s.listener.Accept()
@@ -271,9 +986,10 @@ func (s *Server) listen() {
 // Must be called before listen()
 // Will retry up to 5 seconds
 func (s *Server) acquirePort() {
-	s.Logf("listening on port %d", s.port)
+	address := net.JoinHostPort(s.bind, strconv.Itoa(s.port))
+	s.Logf("listening on %s", address)
 	for i := 0; i < 100; i++ {
-		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", s.port))
+		ln, err := net.Listen("tcp", address)
 		if err == nil {
 			s.listener = ln
 			s.start = time.Now()
@@ -281,20 +997,7 @@ func (s *Server) acquirePort() {
 		}
 		time.Sleep(time.Millisecond * time.Duration(50))
 	}
-	log.Fatalf("could not acquire port %d", s.port)
-}
-
-func (s *Server) broadcastLines(lines []string) {
-	for _, line := range lines {
-		for _, peer := range s.peers {
-			peer.Send(&Request{
-				Line:     line,
-				Response: s.messages,
-				Timeout:  5 * time.Second,
-			})
-		}
-		s.broadcasted += 1
-	}
+	log.Fatalf("could not listen on %s", address)
 }
 
 func scontains(list []string, s string) bool {
@@ -310,45 +1013,83 @@ func scontains(list []string, s string) bool {
 // should be run as a goroutine. This handles both redundancy rebroadcasts and
 // the regular broadcasts of new messages.
 func (s *Server) broadcastIntermittently() {
-	lastLines := []string{}
+	lastMessages := []string{}
+	lastFrames := []string{}
+
+	// Whether anything changed since the last rebroadcast. If not, the next
+	// one is just a keepalive and can wait longer
+	changedSince := false
 
 	for {
-		timer := time.NewTimer(s.RebroadcastInterval)
+		interval := s.RebroadcastInterval
+		if !changedSince {
+			interval = s.KeepaliveInterval
+		}
+		timer := time.NewTimer(interval)
 		select {
 
-		case <-s.quit:
-			break
+		case <-s.ctx.Done():
+			return
 
-		case lines := <-s.outgoing:
+		case messages := <-s.outgoing:
 
-			// See if there are even newer lines
-			newerLines, ok := s.getOutgoing()
+			// See if there are even newer messages
+			newerMessages, ok := s.getOutgoing()
 			if ok {
-				lines = newerLines
+				messages = newerMessages
 			}
 
 			// When we receive a new outgoing, we only need to send out the
-			// lines that have changed since last time.
-			changedLines := []string{}
-			for _, line := range lines {
-				if !scontains(lastLines, line) {
-					changedLines = append(changedLines, line)
+			// messages that have changed since last time.
+			changed := []string{}
+			for _, m := range messages {
+				if !scontains(lastMessages, m) {
+					changed = append(changed, m)
 				}
 			}
+			if len(changed) == 0 && len(messages) == len(lastMessages) {
+				// Nothing to send, and nothing to sign again
+				continue
+			}
 
-			lastLines = lines
-			s.broadcastLines(changedLines)
+			changedSince = true
+			lastMessages = messages
+			lastFrames = s.batchFrames(messages)
+			s.broadcastFrames(s.batchFrames(changed), lastFrames)
+
+		case <-s.resync:
+			// Someone was cut off from us, so they might have missed
+			// messages that haven't changed since. Send everything.
+			newerMessages, ok := s.getOutgoing()
+			if ok {
+				changedSince = true
+				lastMessages = newerMessages
+				lastFrames = s.batchFrames(newerMessages)
+			}
+			s.Logf("resyncing after a partition")
+			s.broadcastFrames(lastFrames, lastFrames)
 
 		case <-timer.C:
 			// It's time for a rebroadcast. Send out duplicate messages.
 			// This is a backstop against miscellaneous problems. If the
 			// network is functioning perfectly, this isn't necessary.
 			s.Logf("performing a backup rebroadcast")
-			s.broadcastLines(lastLines)
+			s.broadcastFrames(lastFrames, lastFrames)
+			changedSince = false
 		}
 	}
 }
 
+// batchFrames signs encoded messages as one batch, so that they share a
+// signature and a frame. No messages means no frames at all.
+func (s *Server) batchFrames(encoded []string) []string {
+	if len(encoded) == 0 {
+		return []string{}
+	}
+	sm := util.NewSignedMessage(s.keyPair, newEncodedBatch(encoded))
+	return []string{util.SignedMessageToFrame(sm)}
+}
+
 func (s *Server) LocalhostAddress() *Address {
 	return &Address{
 		Host: "127.0.0.1",
@@ -360,20 +1101,47 @@ func (s *Server) LocalhostAddress() *Address {
 // Stop() might not work when you run the server this way, because stopping
 // during startup does not work well
 func (s *Server) ServeForever() {
-	s.acquirePort()
+	s.serveInBackground()
+	s.broadcastIntermittently()
+}
+
+// serveInBackground starts up everything but the broadcasting.
+func (s *Server) serveInBackground() {
+	s.restore()
+
+	if s.outboundOnly {
+		s.Logf("running without a listener")
+		s.start = time.Now()
+	} else {
+		s.acquirePort()
+	}
 
 	go s.processMessagesForever()
-	go s.listen()
-	s.broadcastIntermittently()
+	if !s.outboundOnly {
+		go s.listen()
+	}
+	if s.follow != nil {
+		go s.followForever()
+	}
+	if s.webhooks != nil {
+		go s.webhooks.deliverForever(s.ctx)
+	}
+	if s.alerts != nil {
+		go s.alerts.deliverForever(s.ctx)
+	}
+	for _, key := range s.book.keys() {
+		s.maybeDial(key)
+	}
+	if len(s.bootstrap) > 0 && s.follow == nil {
+		go s.bootstrapForever()
+	}
 }
 
 // ServeInBackground spawns goroutines to run the server.
 // It returns once it has successfully bound to its port.
 // Stop() should work if it is called after ServeInBackground returns.
 func (s *Server) ServeInBackground() {
-	s.acquirePort()
-	go s.processMessagesForever()
-	go s.listen()
+	s.serveInBackground()
 	go s.broadcastIntermittently()
 }
 
@@ -381,19 +1149,53 @@ func (s *Server) Stats() {
 	s.Logf("server stats:")
 	s.Logf("%.1fs uptime", time.Now().Sub(s.start).Seconds())
 	s.Logf("%d messages broadcasted", s.broadcasted)
+	_, dead := s.deadLetters.list()
+	s.Logf("%d messages could not be decoded", dead)
+	if m := s.Metrics(); m != nil {
+		s.Logf("consensus on %s", m)
+		for _, r := range m.Participation {
+			s.Logf("%s", r)
+		}
+	}
 	s.node.Stats()
 }
 
+// Metrics returns how consensus was going as of the last message the server
+// processed, or nil if it doesn't take part in consensus.
+func (s *Server) Metrics() *consensus.Metrics {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+	if s.metrics == nil {
+		return nil
+	}
+	m := *s.metrics
+	return &m
+}
+
+// DeadLetters returns the most recent messages that could not be decoded,
+// oldest first.
+func (s *Server) DeadLetters() []*DeadLetter {
+	letters, _ := s.deadLetters.list()
+	return letters
+}
+
 func (s *Server) Stop() {
 	s.shutdown = true
-	close(s.quit)
+	s.cancel()
 
 	if s.listener != nil {
 		s.Logf("releasing port %d", s.port)
 		s.listener.Close()
 	}
 
-	for _, peer := range s.peers {
-		peer.Close()
+	s.linkMutex.Lock()
+	for _, link := range s.links {
+		link.close()
+	}
+	s.linkMutex.Unlock()
+
+	if s.db != nil {
+		s.db.Close()
 	}
+	s.journal.Close()
 }
@@ -1,12 +1,17 @@
 package network
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"testing"
 	"time"
 
+	"coinkit/consensus"
 	"coinkit/currency"
 	"coinkit/util"
 )
@@ -62,7 +67,11 @@ func TestStartStop(t *testing.T) {
 // sendMoney waits until the transaction clears
 // it fatals if from doesn't have the money
 func sendMoney(client *Client, from *util.KeyPair, to *util.KeyPair, amount uint64) {
-	account := client.GetAccount(from.PublicKey())
+	ctx := context.Background()
+	account, err := client.GetAccount(ctx, from.PublicKey())
+	if err != nil {
+		log.Fatal(err)
+	}
 	if account == nil || account.Balance < amount {
 		log.Fatalf("%s did not have enough money", from.PublicKey())
 	}
@@ -77,8 +86,12 @@ func sendMoney(client *Client, from *util.KeyPair, to *util.KeyPair, amount uint
 	st := transaction.SignWith(from)
 	tm := currency.NewTransactionMessage(st)
 	sm := util.NewSignedMessage(from, tm)
-	client.SendMessage(sm)
-	client.WaitToClear(from.PublicKey(), seq)
+	if _, err := client.SendMessage(ctx, sm); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := client.WaitToClear(ctx, from.PublicKey(), seq); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func TestSendMoney(t *testing.T) {
@@ -185,7 +198,7 @@ func sendString(address *Address, s string) error {
 	c := NewClient(address)
 	c.connect()
 	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-	fmt.Fprintf(c.conn, s)
+	io.WriteString(c.conn, s)
 	_, err := util.ReadSignedMessage(c.conn)
 	return err
 }
@@ -199,25 +212,585 @@ func TestServerOkayWithMalformedMessage(t *testing.T) {
 		t.Errorf("Didn't get disconnected after a total garbage message")
 	}
 
-	if sendString(s.LocalhostAddress(), "a:b:c:d\n") != io.EOF {
+	tooBig := util.EncodeFrame(util.FrameMessage, "")[:2] + "\xff\xff\xff\xff"
+	if sendString(s.LocalhostAddress(), tooBig) != io.EOF {
+		t.Errorf("Didn't get disconnected after an oversized frame")
+	}
+
+	semiGarbage := util.EncodeFrame(util.FrameMessage, "a:b:c:d")
+	if sendString(s.LocalhostAddress(), semiGarbage) != io.EOF {
 		t.Errorf("Didn't get disconnected after a semi-garbage message")
 	}
 
 	goodMessage := "{ \"T\": \"N\", \"M\": { \"I\": 1 } }"
 	kp := util.NewKeyPair()
-	line := fmt.Sprintf("e:%s:%s:%s\n",
-		kp.PublicKey(), "notRealSignature", goodMessage)
+	frame := util.EncodeFrame(util.FrameMessage, fmt.Sprintf("e:%s:%s:%s",
+		kp.PublicKey(), "notRealSignature", goodMessage))
 
-	if sendString(s.LocalhostAddress(), line) != io.EOF {
+	if sendString(s.LocalhostAddress(), frame) != io.EOF {
 		t.Errorf("Didn't get disconnected after a bad-signature message")
 	}
 
-	line = fmt.Sprintf("e:%s:%s:%s\n",
-		kp.PublicKey(), kp.Sign(goodMessage), goodMessage)
+	frame = util.EncodeFrame(util.FrameMessage, fmt.Sprintf("e:%s:%s:%s",
+		kp.PublicKey(), kp.Sign(goodMessage), goodMessage))
 
-	if sendString(s.LocalhostAddress(), line) != nil {
+	if sendString(s.LocalhostAddress(), frame) != nil {
 		t.Errorf("The server should still process a good message")
 	}
 
 	go s.Stop()
 }
+
+func TestAdminsGetServerMetrics(t *testing.T) {
+	admin := util.NewKeyPairFromSecretPhrase("admin")
+	s, peer := serveWithAdmin(admin.PublicKey())
+	defer s.Stop()
+
+	semiGarbage := util.EncodeFrame(util.FrameMessage, "a:b:c:d")
+	if sendString(s.LocalhostAddress(), semiGarbage) != io.EOF {
+		t.Fatal("expected to get disconnected")
+	}
+
+	c := NewClient(s.LocalhostAddress())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := c.GetDeadLetters(ctx, util.NewKeyPairFromSecretPhrase("nobody")); err == nil {
+		t.Fatal("only admins should get the dead letters")
+	}
+	letters, total, err := c.GetDeadLetters(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(letters) != 1 || letters[0].Line != "a:b:c:d" {
+		t.Fatalf("expected the garbage message but got %d: %v", total, letters)
+	}
+
+	// Linked peers show up in the peer table
+	joinAsPeer(t, s, peer)
+	m, err := c.GetServerMetrics(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Peers) != 1 || m.Peers[0].PublicKey != peer.PublicKey() || !m.Peers[0].Connected {
+		t.Fatalf("expected a link to the peer but got %v", m.Peers)
+	}
+}
+
+func TestServerBansFlooders(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	configs[1].RateLimit = &RateLimitConfig{
+		MessagesPerSecond: 0.1,
+		Strikes:           2,
+		BanDuration:       time.Minute,
+	}
+	s := NewServer(configs[1])
+	s.ServeInBackground()
+	defer s.Stop()
+
+	// Even a member of the network gets cut off when it floods us
+	flooder := configs[0].KeyPair
+	c := NewClient(s.LocalhostAddress())
+	c.connect()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	send := func() (*util.SignedMessage, error) {
+		util.WriteSignedMessage(c.conn, util.NewSignedMessage(flooder, &MetricsMessage{}))
+		return util.ReadSignedMessage(c.conn)
+	}
+	if response, err := send(); err != nil || response == nil {
+		t.Fatalf("the first message should be fine, but got %v", err)
+	}
+	response, err := send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := response.Message().(*util.ErrorMessage); !ok || !m.Transient {
+		t.Fatalf("expected a rate limit error but got %s", response.Message())
+	}
+	if _, err := send(); err != io.EOF {
+		t.Fatalf("expected to get banned but got %v", err)
+	}
+	if s.keyLimiter.bannedFor(string(flooder.PublicKey()), time.Now()) == 0 {
+		t.Fatal("the ban should be on the signer, not just the connection")
+	}
+
+	for _, state := range s.PeerStates() {
+		if state.PublicKey == flooder.PublicKey() {
+			if state.Dropped != 2 || state.Bans != 1 {
+				t.Fatalf("expected 2 dropped and 1 ban but got %s", state)
+			}
+			return
+		}
+	}
+	t.Fatal("the flooder should show up in the peer states")
+}
+
+func TestServerBansFloodingHosts(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	configs[1].RateLimit = &RateLimitConfig{
+		MessagesPerSecond: 0.1,
+		Strikes:           2,
+		BanDuration:       time.Minute,
+	}
+	s := NewServer(configs[1])
+	s.ServeInBackground()
+	defer s.Stop()
+
+	// A stranger can use a new key for every message, so the ban has to
+	// stick to where it connects from
+	c := NewClient(s.LocalhostAddress())
+	c.connect()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	send := func() (*util.SignedMessage, error) {
+		util.WriteSignedMessage(c.conn, util.NewSignedMessage(util.NewKeyPair(),
+			&util.InfoMessage{Account: configs[0].KeyPair.PublicKey()}))
+		return util.ReadSignedMessage(c.conn)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := send(); err != io.EOF {
+		t.Fatalf("expected to get banned but got %v", err)
+	}
+	c.Close()
+
+	c = NewClient(s.LocalhostAddress())
+	defer c.Close()
+	c.connect()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := send(); err != io.EOF {
+		t.Fatalf("reconnecting should not get around the ban, but got %v", err)
+	}
+}
+
+// serveWithAdmin starts the server for the member of the unit test network
+// with the highest key, so that it waits for the other members to dial it.
+// admin is the only key that can do admin actions on it. It returns the
+// server and the key pair of another member.
+func serveWithAdmin(admin util.PublicKey) (*Server, *util.KeyPair) {
+	_, configs := NewUnitTestNetwork()
+	server, peer := configs[0], configs[1]
+	for _, config := range configs {
+		if config.KeyPair.PublicKey() > server.KeyPair.PublicKey() {
+			server, peer = config, server
+		}
+	}
+	server.Access = &AccessPolicy{
+		Keys: map[util.PublicKey]Scope{admin: AllScopes | AdminScope},
+	}
+	s := NewServer(server)
+	s.ServeInBackground()
+	return s, peer.KeyPair
+}
+
+// joinAsPeer links up with s the way another member's server would. It
+// returns a function that sends a message on the link and returns the
+// responses to it.
+func joinAsPeer(t *testing.T, s *Server, kp *util.KeyPair) func(util.Message) []util.Message {
+	conn, err := net.Dial("tcp", s.LocalhostAddress().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	util.WriteSignedMessage(conn, util.NewSignedMessage(kp, s.hello()))
+	reader := bufio.NewReader(conn)
+	response, err := util.ReadSignedMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response.Message().(*HelloMessage); !ok {
+		t.Fatalf("expected a hello but got %s", response.Message())
+	}
+	link := newPeerLink(s.keyPair.PublicKey(), conn)
+
+	pings := int64(0)
+	return func(m util.Message) []util.Message {
+		// A ping after the message tells us when it has been handled,
+		// since the link handles messages in order
+		pings++
+		util.WriteSignedMessage(conn, util.NewSignedMessage(kp, m))
+		util.WriteSignedMessage(conn, util.NewSignedMessage(kp, &PingMessage{Time: pings}))
+		responses := []util.Message{}
+		for {
+			sm, err := link.readMessage(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sm == nil {
+				continue
+			}
+			switch m := sm.Message().(type) {
+			case *PingMessage:
+				if m.Echo == pings {
+					return responses
+				}
+			case *util.ErrorMessage, *StatusMessage, *currency.ImportMessage:
+				responses = append(responses, m)
+			}
+		}
+	}
+}
+
+// helloOnLine starts a link with s the way a dialing peer does, with its
+// hello on a line, and says it speaks the given protocol version.
+func helloOnLine(t *testing.T, s *Server, kp *util.KeyPair, version int) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", s.LocalhostAddress().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	hello := s.hello()
+	hello.Version = version
+	io.WriteString(conn, util.SignedMessageToLine(util.NewSignedMessage(kp, hello)))
+	reader := bufio.NewReader(conn)
+	response, err := util.ReadSignedLine(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response.Message().(*HelloMessage); !ok {
+		t.Fatalf("expected a hello but got %s", response.Message())
+	}
+	return conn, reader
+}
+
+func TestLinkWithLineFraming(t *testing.T) {
+	s, peer := serveWithAdmin(util.NewKeyPairFromSecretPhrase("admin").PublicKey())
+	defer s.Stop()
+
+	// A node from before frames keeps using lines
+	conn, reader := helloOnLine(t, s, peer, 1)
+	defer conn.Close()
+	ping := util.NewSignedMessage(peer, &PingMessage{Time: 7})
+	io.WriteString(conn, util.SignedMessageToLine(ping))
+	for {
+		sm, err := util.ReadSignedLine(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := sm.Message().(*PingMessage); ok && m.Echo == 7 {
+			break
+		}
+	}
+
+	// A node that speaks frames switches to them after the hellos
+	conn2, reader2 := helloOnLine(t, s, peer, ProtocolVersion)
+	defer conn2.Close()
+	util.WriteSignedMessage(conn2, ping)
+	link := newPeerLink(s.keyPair.PublicKey(), conn2)
+	for {
+		sm, err := link.readMessage(reader2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sm == nil {
+			continue
+		}
+		if m, ok := sm.Message().(*PingMessage); ok && m.Echo == 7 {
+			break
+		}
+	}
+}
+
+func TestLinksCheckAccess(t *testing.T) {
+	admin := util.NewKeyPairFromSecretPhrase("admin")
+	s, peer := serveWithAdmin(admin.PublicKey())
+	defer s.Stop()
+	send := joinAsPeer(t, s, peer)
+
+	// Being a member doesn't make a peer an admin
+	if responses := send(&currency.ImportMessage{}); len(responses) != 0 {
+		t.Fatalf("an import from a peer should be dropped, but got %v", responses)
+	}
+}
+
+func TestPeersCannotPause(t *testing.T) {
+	admin := util.NewKeyPairFromSecretPhrase("admin")
+	s, peer := serveWithAdmin(admin.PublicKey())
+	defer s.Stop()
+	send := joinAsPeer(t, s, peer)
+
+	if responses := send(&PauseMessage{}); len(responses) != 0 {
+		t.Fatalf("a pause from a peer should be dropped, but got %v", responses)
+	}
+	client := NewClient(s.LocalhostAddress())
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	response, err := client.SendMessage(ctx,
+		util.NewSignedMessage(admin, &util.InfoMessage{Status: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, ok := response.Message().(*StatusMessage)
+	if !ok || status.Paused {
+		t.Fatalf("the node should still be running, but got %s", response.Message())
+	}
+}
+
+func TestSendMessageRespectsContext(t *testing.T) {
+	// Nothing is listening on this port
+	client := NewClient(&Address{Host: "127.0.0.1", Port: MaxUnitTestPort + 1})
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sm := util.NewSignedMessage(util.NewKeyPair(), &util.InfoMessage{I: 1})
+	_, err := client.SendMessage(ctx, sm)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error but got %v", err)
+	}
+}
+
+func TestBusyServerTurnsRequestsAway(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	s := NewServer(configs[0])
+	defer s.Stop()
+	kp := util.NewKeyPairFromSecretPhrase("client")
+	sm := util.NewSignedMessage(kp, &util.InfoMessage{Account: kp.PublicKey()})
+
+	// Nothing is processing requests yet, so every one of them waits its
+	// turn until it gives up
+	responses := make(chan *util.SignedMessage)
+	for i := 0; i < 5; i++ {
+		go func() {
+			response, _ := s.handleMessage(sm)
+			responses <- response
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		response := <-responses
+		if response == nil {
+			t.Fatal("expected an error")
+		}
+		e, ok := response.Message().(*util.ErrorMessage)
+		if !ok || !e.Transient {
+			t.Fatalf("expected a transient error but got %s", response.Message())
+		}
+	}
+
+	// The server is still around to handle requests once it gets to them
+	s.ServeInBackground()
+	response, ok := s.handleMessage(sm)
+	if !ok || response == nil {
+		t.Fatal("expected a response")
+	}
+	if _, ok := response.Message().(*currency.AccountMessage); !ok {
+		t.Fatalf("expected an account message but got %s", response.Message())
+	}
+}
+
+func countLinks(s *Server) int {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	return len(s.links)
+}
+
+func countDials(s *Server) int {
+	s.linkMutex.Lock()
+	defer s.linkMutex.Unlock()
+	return len(s.dialing)
+}
+
+func TestOneLinkPerPeerPair(t *testing.T) {
+	servers := makeServers()
+	defer stopServers(servers)
+
+	dials := 0
+	for _, s := range servers {
+		dials += countDials(s)
+	}
+	if dials != len(servers)*(len(servers)-1)/2 {
+		t.Fatalf("expected one dial per pair of servers but got %d", dials)
+	}
+
+	for i := 0; i < 100; i++ {
+		linked := true
+		for _, s := range servers {
+			if countLinks(s) != len(servers)-1 {
+				linked = false
+			}
+		}
+		if linked {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("servers did not link up with every peer")
+}
+
+func TestBackoffDoubles(t *testing.T) {
+	max := 30 * time.Second
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second,
+		8 * time.Second, 16 * time.Second, max, max}
+	for failCount, wait := range expected {
+		if got := backoff(failCount, max); got != wait {
+			t.Fatalf("after %d failures, expected to wait %s but got %s",
+				failCount, wait, got)
+		}
+	}
+	if backoff(1000, max) != max {
+		t.Fatal("the backoff should never pass the max")
+	}
+}
+
+func TestRebroadcastSlowsDownWhenNothingChanges(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	s := NewServer(configs[0])
+	defer s.Stop()
+	s.RebroadcastInterval = 20 * time.Millisecond
+	s.KeepaliveInterval = time.Hour
+	go s.broadcastIntermittently()
+
+	broadcasted := func() int {
+		s.linkMutex.Lock()
+		defer s.linkMutex.Unlock()
+		return s.broadcasted
+	}
+
+	// The same messages again are nothing new
+	messages := []string{
+		util.EncodeMessage(&PingMessage{}),
+		util.EncodeMessage(&consensus.QuorumSliceMessage{I: 1, D: s.network.QuorumSlice()}),
+	}
+	s.outgoing <- messages
+	s.outgoing <- messages
+	time.Sleep(200 * time.Millisecond)
+
+	// One batch for the change and one rebroadcast, then only keepalives
+	if got := broadcasted(); got != 2 {
+		t.Fatalf("expected 2 broadcasts but got %d", got)
+	}
+}
+
+func TestPeerStates(t *testing.T) {
+	_, configs := NewUnitTestNetwork()
+	servers := []*Server{}
+	changes := make(chan *PeerState, 100)
+	for i, config := range configs {
+		s := NewServer(config)
+		if i == 0 {
+			s.OnPeerStateChange(func(state *PeerState) {
+				changes <- state
+			})
+		}
+		s.ServeInBackground()
+		servers = append(servers, s)
+	}
+	defer stopServers(servers)
+
+	connected := func(s *Server) int {
+		count := 0
+		for _, state := range s.PeerStates() {
+			if state.Connected {
+				count++
+			}
+		}
+		return count
+	}
+	for i := 0; connected(servers[0]) < len(servers)-1; i++ {
+		if i == 100 {
+			t.Fatalf("only connected to %d peers", connected(servers[0]))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, state := range servers[0].PeerStates() {
+		if state.Version != ProtocolVersion {
+			t.Fatalf("expected every peer to say hello with version %d but got %s",
+				ProtocolVersion, state)
+		}
+	}
+
+	gone := servers[3].keyPair.PublicKey()
+	servers[3].Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case state := <-changes:
+			if state.PublicKey == gone && !state.Connected {
+				if connected(servers[0]) != len(servers)-2 {
+					t.Fatalf("expected %d connected peers after one went down",
+						len(servers)-2)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("never heard that the link went down")
+		}
+	}
+}
+
+func TestOutboundOnlyServer(t *testing.T) {
+	network, configs := NewUnitTestNetwork()
+
+	// Pick the server with the highest key, which would usually get dialed
+	// by everyone else
+	outbound := 0
+	for i, member := range network.Members {
+		if member > network.Members[outbound] {
+			outbound = i
+		}
+	}
+	network.Nodes[outbound].OutboundOnly = true
+
+	servers := []*Server{}
+	for _, config := range configs {
+		server := NewServer(config)
+		server.ServeInBackground()
+		servers = append(servers, server)
+	}
+	defer stopServers(servers)
+
+	if servers[outbound].listener != nil {
+		t.Fatal("an outbound-only server should not listen")
+	}
+	if countDials(servers[outbound]) != len(servers)-1 {
+		t.Fatal("an outbound-only server should dial every peer")
+	}
+
+	for i := 0; i < 100; i++ {
+		if countLinks(servers[outbound]) == len(servers)-1 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("the outbound-only server did not link up with every peer")
+}
+
+func TestServerChangesQuorumSlice(t *testing.T) {
+	servers := makeServers()
+	defer stopServers(servers)
+	members := servers[0].network.Members
+
+	// Leaving out the last server still overlaps with the old slice
+	qs := consensus.MakeQuorumSlice(members[:3], 3)
+	if err := servers[0].SetQuorumSlice(qs); err != nil {
+		t.Fatal(err)
+	}
+	mint := util.NewKeyPairFromSecretPhrase("mint")
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+	sendMoney(NewClient(servers[0].LocalhostAddress()), mint, bob, 100)
+
+	disjoint := consensus.MakeQuorumSlice([]util.PublicKey{members[0], "stranger"}, 2)
+	err := servers[0].SetQuorumSlice(disjoint)
+	if !errors.Is(err, consensus.ErrNoIntersection) {
+		t.Fatalf("expected no intersection but got %v", err)
+	}
+	if servers[0].isMember("stranger") {
+		t.Fatal("a rejected slice should not add members")
+	}
+
+	// Someone new in our slice counts as a member from then on
+	newcomer := util.NewKeyPairFromSecretPhrase("newcomer").PublicKey()
+	address := &Address{Host: "127.0.0.1", Port: 1}
+	if servers[0].book.add(newcomer, address, gossipScore) {
+		t.Fatal("only members should go in the address book")
+	}
+	grown := consensus.MakeQuorumSlice(append([]util.PublicKey{newcomer}, members[:3]...), 3)
+	if err := servers[0].SetQuorumSlice(grown); err != nil {
+		t.Fatal(err)
+	}
+	if !servers[0].isMember(newcomer) || !servers[0].book.add(newcomer, address, gossipScore) {
+		t.Fatal("the newcomer should be a member now")
+	}
+}
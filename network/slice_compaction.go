@@ -0,0 +1,191 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// Every consensus message carries its sender's whole quorum slice, which is
+// the same from one message to the next. So on a link, we send each slice
+// once in a slice frame, and after that we cut it out of messages and send
+// its hash instead.
+// The signature covers the whole message, so the other end puts the slice
+// back exactly where it was before it checks the signature. If it doesn't
+// know the hash, it drops the message and asks for the slice, and the
+// message comes back with the next rebroadcast.
+
+// How many slices each end of a link remembers. When either end fills up,
+// it forgets them all and starts over.
+const maxLinkSlices = 100
+
+var errBadCompactFrame = errors.New("bad compact frame")
+
+// The key every quorum slice goes under, once a message is encoded
+const sliceKey = `"D":`
+
+// cutSlice finds the quorum slice in a serialized message. It returns the
+// hash of the slice, the slice itself, and the payload of a compact frame
+// for the message. A batch can hold the same slice many times, so every
+// copy of it is cut out. If there is no slice worth cutting out, ok is false.
+func cutSlice(serialized string) (hash string, slice string, compact string, ok bool) {
+	// A quote inside a JSON string is always escaped, so this can only
+	// match a real key. If a batch holds different slices, only copies of
+	// the first one get cut, since a frame can only refer to one.
+	start := strings.Index(serialized, sliceKey+"{")
+	if start < 0 {
+		return "", "", "", false
+	}
+	start += len(sliceKey)
+	var raw json.RawMessage
+	if err := json.NewDecoder(strings.NewReader(serialized[start:])).Decode(&raw); err != nil {
+		return "", "", "", false
+	}
+	end := start + len(raw)
+	slice = serialized[start:end]
+	if slice != string(raw) {
+		return "", "", "", false
+	}
+	hash = consensus.HashString(slice)
+	if len(slice) <= len(hash) {
+		return "", "", "", false
+	}
+
+	// The offsets are where each copy goes back in what is left
+	offsets := []string{}
+	rest := serialized[:start]
+	for {
+		offsets = append(offsets, strconv.Itoa(len(rest)))
+		next := strings.Index(serialized[end:], sliceKey+slice)
+		if next < 0 {
+			break
+		}
+		rest += serialized[end : end+next+len(sliceKey)]
+		end += next + len(sliceKey) + len(slice)
+	}
+	rest += serialized[end:]
+	compact = fmt.Sprintf("%s:%s:%s", hash, strings.Join(offsets, ","), rest)
+	return hash, slice, compact, true
+}
+
+// pasteSlice reverses cutSlice. It takes the payload of a compact frame and
+// returns the hash of the slice it needs, and a function that puts the
+// slice back.
+func pasteSlice(payload string) (string, func(slice string) string, error) {
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) != 3 {
+		return "", nil, errBadCompactFrame
+	}
+	hash, rest := parts[0], parts[2]
+	offsets := []int{}
+	for _, s := range strings.Split(parts[1], ",") {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset > len(rest) ||
+			(len(offsets) == 0 && offset < 0) ||
+			(len(offsets) > 0 && offset < offsets[len(offsets)-1]) {
+			return "", nil, errBadCompactFrame
+		}
+		offsets = append(offsets, offset)
+	}
+	return hash, func(slice string) string {
+		var b strings.Builder
+		previous := 0
+		for _, offset := range offsets {
+			b.WriteString(rest[previous:offset])
+			b.WriteString(slice)
+			previous = offset
+		}
+		b.WriteString(rest[previous:])
+		return b.String()
+	}, nil
+}
+
+// compact turns a frame into what we actually send on the link. A message
+// frame loses its quorum slice, and if the peer hasn't seen the slice yet,
+// it goes first in a slice frame of its own.
+// It is only called by the goroutine writing to the link.
+func (link *peerLink) compact(frame string) string {
+	frameType, payload, err := util.ReadFrame(strings.NewReader(frame))
+	if err != nil || frameType != util.FrameMessage {
+		return frame
+	}
+	hash, slice, compact, ok := cutSlice(payload)
+	if !ok {
+		return frame
+	}
+	answer := util.EncodeFrame(util.FrameCompact, compact)
+
+	link.sliceMutex.Lock()
+	defer link.sliceMutex.Unlock()
+	if _, ok := link.sentSlices[hash]; !ok {
+		if len(link.sentSlices) >= maxLinkSlices {
+			link.sentSlices = make(map[string]string)
+		}
+		link.sentSlices[hash] = slice
+		answer = util.EncodeFrame(util.FrameSlice, slice) + answer
+	}
+	return answer
+}
+
+// resendSlice sends a slice the peer asked for again. If we have
+// forgotten it, we will send it anyway before we use it next.
+func (link *peerLink) resendSlice(hash string) {
+	link.sliceMutex.Lock()
+	slice, ok := link.sentSlices[hash]
+	link.sliceMutex.Unlock()
+	if ok {
+		link.send(util.EncodeFrame(util.FrameSlice, slice), linkBufferSize)
+	}
+}
+
+// readMessage reads from the link until it gets a message, handling the
+// frames that only matter to the link along the way. Like
+// util.ReadSignedMessage, it returns a nil message for an ok frame.
+// It is only called by the goroutine reading from the link.
+func (link *peerLink) readMessage(r io.Reader) (*util.SignedMessage, error) {
+	for {
+		frameType, payload, err := util.ReadFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		switch frameType {
+		case util.FrameOK:
+			return nil, nil
+
+		case util.FrameSlice:
+			if len(link.slices) >= maxLinkSlices {
+				link.slices = make(map[string]string)
+			}
+			link.slices[consensus.HashString(payload)] = payload
+			continue
+
+		case util.FrameSliceRequest:
+			link.resendSlice(payload)
+			continue
+
+		case util.FrameCompact:
+			hash, paste, err := pasteSlice(payload)
+			if err != nil {
+				return nil, &util.DecodeError{Line: payload, Err: err}
+			}
+			slice, ok := link.slices[hash]
+			if !ok {
+				link.send(util.EncodeFrame(util.FrameSliceRequest, hash), linkBufferSize)
+				continue
+			}
+			payload = paste(slice)
+		}
+
+		sm, err := util.NewSignedMessageFromSerialized(payload)
+		if err != nil {
+			return nil, &util.DecodeError{Line: payload, Err: err}
+		}
+		return sm, nil
+	}
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+func TestLinkCompaction(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("foo")
+	members := []util.PublicKey{}
+	for i := 0; i < 10; i++ {
+		members = append(members,
+			util.NewKeyPairFromSecretPhrase(fmt.Sprintf("node%d", i)).PublicKey())
+	}
+	sm := util.NewSignedMessage(kp, &consensus.QuorumSliceMessage{
+		I: 3,
+		D: consensus.MakeQuorumSlice(members, 7),
+	})
+	frame := util.SignedMessageToFrame(sm)
+
+	sender := newPeerLink(kp.PublicKey(), nil)
+	receiver := newPeerLink(kp.PublicKey(), nil)
+	first := sender.compact(frame)
+	second := sender.compact(frame)
+	if len(second) >= len(frame) {
+		t.Fatalf("the slice should be cut out of %q", second)
+	}
+	if len(first) <= len(frame) {
+		t.Fatal("the first frame should carry the slice")
+	}
+	for _, data := range []string{first, second} {
+		sm2, err := receiver.readMessage(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sm2.Serialize() != sm.Serialize() {
+			t.Fatalf("expected %s but got %s", sm.Serialize(), sm2.Serialize())
+		}
+	}
+
+	// A peer that doesn't know the slice drops the message and asks for it
+	forgetful := newPeerLink(kp.PublicKey(), nil)
+	if _, err := forgetful.readMessage(strings.NewReader(second)); err != io.EOF {
+		t.Fatalf("expected the message to be dropped but got %v", err)
+	}
+	request := <-forgetful.outgoing
+	if _, err := sender.readMessage(strings.NewReader(request)); err != io.EOF {
+		t.Fatalf("expected the request to be handled but got %v", err)
+	}
+	resent := <-sender.outgoing
+	sm2, err := forgetful.readMessage(strings.NewReader(resent + second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm2.Serialize() != sm.Serialize() {
+		t.Fatalf("expected %s but got %s", sm.Serialize(), sm2.Serialize())
+	}
+
+	// Messages without a slice go out as they are
+	ping := util.SignedMessageToFrame(util.NewSignedMessage(kp, &PingMessage{}))
+	if sender.compact(ping) != ping {
+		t.Fatal("a ping has nothing to compact")
+	}
+}
+
+func TestBadCompactFrames(t *testing.T) {
+	link := newPeerLink("", nil)
+	for _, payload := range []string{
+		"nocolons", "hash:-1:rest", "hash:99:rest", "hash:3,1:rest", "hash:1,x:rest",
+	} {
+		frame := util.EncodeFrame(util.FrameCompact, payload)
+		if _, err := link.readMessage(strings.NewReader(frame)); err == nil {
+			t.Fatalf("expected an error for %q", payload)
+		}
+	}
+	if _, err := util.ReadSignedMessage(strings.NewReader(
+		util.EncodeFrame(util.FrameSlice, "{}"))); err == nil {
+		t.Fatal("slice frames only belong on links")
+	}
+}
+
+func TestBatchCompaction(t *testing.T) {
+	kp := util.NewKeyPairFromSecretPhrase("foo")
+	members := []util.PublicKey{}
+	for i := 0; i < 10; i++ {
+		members = append(members,
+			util.NewKeyPairFromSecretPhrase(fmt.Sprintf("node%d", i)).PublicKey())
+	}
+	qs := consensus.MakeQuorumSlice(members, 7)
+	other := consensus.MakeQuorumSlice(members[:5], 3)
+	sm := util.NewSignedMessage(kp, &BatchMessage{Messages: []util.Message{
+		&consensus.QuorumSliceMessage{I: 3, D: qs},
+		&consensus.QuorumSliceMessage{I: 4, D: other},
+		&consensus.QuorumSliceMessage{I: 5, D: qs},
+	}})
+	frame := util.SignedMessageToFrame(sm)
+
+	_, slice, compact, ok := cutSlice(sm.Serialize())
+	if !ok {
+		t.Fatal("expected to cut the slice out of the batch")
+	}
+	if strings.Contains(compact, slice) {
+		t.Fatal("every copy of the slice should be cut out")
+	}
+
+	sender := newPeerLink(kp.PublicKey(), nil)
+	receiver := newPeerLink(kp.PublicKey(), nil)
+	sm2, err := receiver.readMessage(strings.NewReader(sender.compact(frame)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm2.Serialize() != sm.Serialize() {
+		t.Fatalf("expected %s but got %s", sm.Serialize(), sm2.Serialize())
+	}
+	batch := sm2.Message().(*BatchMessage)
+	if len(batch.Messages) != 3 || batch.Messages[1].(*consensus.QuorumSliceMessage).D.Threshold != 3 {
+		t.Fatalf("the batch did not survive: %s", batch)
+	}
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"fmt"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A StatusMessage tells an operator how a node is doing. Nodes send one in
+// response to an InfoMessage that sets Status.
+
+type StatusMessage struct {
+	// The slot the node is working on
+	I int
+
+	// How consensus is going on the current slot. Nil for read replicas,
+	// since they don't take part
+	Metrics *consensus.Metrics `json:",omitempty"`
+
+	// How long the recent slots took, oldest first
+	Slots []*consensus.SlotStats `json:",omitempty"`
+
+	// Whether the node was paused. It still votes until it finishes the
+	// slot it was on when it was paused
+	Paused bool `json:",omitempty"`
+
+	// How many transactions are waiting in the queue
+	Queue int `json:",omitempty"`
+}
+
+func (m *StatusMessage) Slot() int {
+	return 0
+}
+
+func (m *StatusMessage) MessageType() string {
+	return "U"
+}
+
+func (m *StatusMessage) String() string {
+	if m.Paused {
+		return fmt.Sprintf("status i=%d slots=%d paused", m.I, len(m.Slots))
+	}
+	return fmt.Sprintf("status i=%d slots=%d", m.I, len(m.Slots))
+}
+
+func init() {
+	util.RegisterMessageType(&StatusMessage{})
+}
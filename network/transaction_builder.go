@@ -0,0 +1,182 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+// These errors mean a transaction could never be accepted by the network, so
+// the builder refuses it before signing.
+var (
+	ErrNoDestination = errors.New("transaction has no destination")
+	ErrZeroAmount    = errors.New("transaction sends no money")
+	ErrSendToSelf    = errors.New("transaction sends money to its own sender")
+	ErrTooMuchMoney  = errors.New("transaction moves more money than exists")
+)
+
+// A TransactionBuilder makes a signed transaction step by step, like
+//
+//	st, err := client.NewTransaction(kp).To(bob).Amount(100).Memo(7).Submit(ctx)
+//
+// The first error from any step is kept and returned from Build or Submit,
+// so the steps can be chained without checking each one.
+type TransactionBuilder struct {
+	client  *Client
+	keyPair *util.KeyPair
+	t       *currency.Transaction
+
+	// When the sequence isn't set, Build fetches the next one for the sender
+	sequenceSet bool
+
+	// With an idempotency key, the transaction is only built once, so that
+	// submitting again is a retry of the same request
+	key   string
+	built *currency.SignedTransaction
+
+	err error
+}
+
+// NewTransaction starts building a transaction sent and signed by kp.
+func (c *Client) NewTransaction(kp *util.KeyPair) *TransactionBuilder {
+	return &TransactionBuilder{
+		client:  c,
+		keyPair: kp,
+		t: &currency.Transaction{
+			From: kp.PublicKey(),
+		},
+	}
+}
+
+// To sets who receives the money. It can be a base64 public key or a strkey.
+func (b *TransactionBuilder) To(recipient string) *TransactionBuilder {
+	publicKey, err := util.ParsePublicKey(recipient)
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	b.t.To = publicKey
+	return b
+}
+
+// Amount sets how much money to send.
+func (b *TransactionBuilder) Amount(amount uint64) *TransactionBuilder {
+	b.t.Amount = amount
+	return b
+}
+
+// Fee sets how much the sender pays on top of the amount.
+func (b *TransactionBuilder) Fee(fee uint64) *TransactionBuilder {
+	b.t.Fee = fee
+	return b
+}
+
+// Memo sets the ID that the recipient uses to tell deposits apart.
+func (b *TransactionBuilder) Memo(memo uint64) *TransactionBuilder {
+	b.t.Memo = memo
+	return b
+}
+
+// Sequence sets the sequence number, instead of fetching the next one from
+// the network. This is useful for preparing several transactions at once.
+// Build then checks the transaction as if the ones before it had already
+// cleared, so it only fails on the sequence if that was already used.
+func (b *TransactionBuilder) Sequence(sequence uint32) *TransactionBuilder {
+	b.t.Sequence = sequence
+	b.sequenceSet = true
+	return b
+}
+
+// IdempotencyKey sets a key that makes Submit safe to retry. If the first
+// submission got to the node but its response didn't make it back, a retry
+// gets the original response, instead of an error about the transaction
+// having been sent already. The key should be unique for each transaction
+// the sender makes, and retries should go to the same node.
+func (b *TransactionBuilder) IdempotencyKey(key string) *TransactionBuilder {
+	b.key = key
+	return b
+}
+
+// check finds the problems with the transaction that don't depend on any
+// account.
+func (b *TransactionBuilder) check() error {
+	t := b.t
+	switch {
+	case t.To == "":
+		return ErrNoDestination
+	case t.Amount == 0:
+		return ErrZeroAmount
+	case t.To == t.From:
+		return ErrSendToSelf
+	case t.Amount > currency.TotalMoney || t.Fee > currency.TotalMoney-t.Amount:
+		return ErrTooMuchMoney
+	}
+	return nil
+}
+
+// Build checks the transaction against the sender's account and signs it.
+// It checks the same things a node does when the transaction arrives, so a
+// transaction that builds should only be rejected if the account changes
+// before it gets there.
+func (b *TransactionBuilder) Build(ctx context.Context) (*currency.SignedTransaction, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	account, err := b.client.GetAccount(ctx, b.t.From)
+	if err != nil {
+		return nil, fmt.Errorf("could not get account data: %s", err)
+	}
+	if !b.sequenceSet && account != nil {
+		b.t.Sequence = account.Sequence + 1
+	}
+	accounts := currency.NewAccountMap()
+	if account != nil {
+		if b.sequenceSet && b.t.Sequence > account.Sequence+1 {
+			// The transactions before this one may not even be sent yet
+			copy := *account
+			copy.Sequence = b.t.Sequence - 1
+			account = &copy
+		}
+		accounts.Set(b.t.From, account)
+	}
+	if err := accounts.Validate(b.t); err != nil {
+		return nil, err
+	}
+	t := *b.t
+	return t.SignWith(b.keyPair), nil
+}
+
+// Submit builds the transaction and sends it to the network. It does not
+// wait for the transaction to clear; use WaitToClear for that.
+// With an idempotency key, calling Submit again sends the same transaction
+// as the first call.
+func (b *TransactionBuilder) Submit(ctx context.Context) (*currency.SignedTransaction, error) {
+	st := b.built
+	if st == nil {
+		var err error
+		st, err = b.Build(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if b.key != "" {
+			b.built = st
+		}
+	}
+	tm := currency.NewTransactionMessage(st)
+	tm.IdempotencyKey = b.key
+	response, err := b.client.SendMessage(ctx, util.NewSignedMessage(b.keyPair, tm))
+	if err != nil {
+		return nil, err
+	}
+	if response != nil {
+		if e, ok := response.Message().(*util.ErrorMessage); ok {
+			return nil, errors.New(e.Error)
+		}
+	}
+	return st, nil
+}
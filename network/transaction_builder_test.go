@@ -0,0 +1,117 @@
+package network
+
+import (
+	"context"
+	"testing"
+
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+func TestTransactionBuilderValidates(t *testing.T) {
+	servers := makeServers()
+	defer stopServers(servers)
+	client := NewClient(servers[0].LocalhostAddress())
+	defer client.Close()
+	ctx := context.Background()
+	mint := util.NewKeyPairFromSecretPhrase("mint")
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+
+	cases := []struct {
+		b   *TransactionBuilder
+		err error
+	}{
+		{client.NewTransaction(mint).Amount(1), ErrNoDestination},
+		{client.NewTransaction(mint).To(string(bob.PublicKey())), ErrZeroAmount},
+		{client.NewTransaction(mint).To(string(mint.PublicKey())).Amount(1), ErrSendToSelf},
+		{client.NewTransaction(mint).To(string(bob.PublicKey())).Amount(currency.TotalMoney).Fee(1),
+			ErrTooMuchMoney},
+		{client.NewTransaction(bob).To(string(mint.PublicKey())).Amount(1), currency.ErrNoAccount},
+		{client.NewTransaction(mint).To(string(bob.PublicKey())).Amount(1).Sequence(0),
+			currency.ErrOldSequence},
+	}
+	for _, c := range cases {
+		if _, err := c.b.Build(ctx); err != c.err {
+			t.Fatalf("expected %v but got %v", c.err, err)
+		}
+	}
+	if _, err := client.NewTransaction(mint).To("bob").Amount(1).Build(ctx); err == nil {
+		t.Fatal("a bad destination should not build")
+	}
+
+	// A later transaction can be prepared before the ones ahead of it
+	st, err := client.NewTransaction(mint).To(string(bob.PublicKey())).Amount(1).Sequence(5).Build(ctx)
+	if err != nil || st.Sequence != 5 {
+		t.Fatalf("expected to build sequence 5 but got %v, %v", st, err)
+	}
+}
+
+func TestTransactionBuilderSubmits(t *testing.T) {
+	servers := makeServers()
+	defer stopServers(servers)
+	client := NewClient(servers[0].LocalhostAddress())
+	defer client.Close()
+	ctx := context.Background()
+	mint := util.NewKeyPairFromSecretPhrase("mint")
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+
+	strkey, err := util.PublicKeyToStrkey(bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 2; i++ {
+		st, err := client.NewTransaction(mint).To(strkey).Amount(100).Memo(7).Submit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Sequence != i || st.To != bob.PublicKey() || st.Memo != 7 || !st.Verify() {
+			t.Fatalf("bad transaction: %s", st)
+		}
+		if _, err := client.WaitToClear(ctx, mint.PublicKey(), st.Sequence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	account, err := client.GetAccount(ctx, bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 200 {
+		t.Fatalf("bob should have 200 but has %d", account.Balance)
+	}
+}
+
+func TestTransactionBuilderRetriesWithKey(t *testing.T) {
+	servers := makeServers()
+	defer stopServers(servers)
+	client := NewClient(servers[0].LocalhostAddress())
+	defer client.Close()
+	ctx := context.Background()
+	mint := util.NewKeyPairFromSecretPhrase("mint")
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+
+	b := client.NewTransaction(mint).To(string(bob.PublicKey())).Amount(100).IdempotencyKey("pay bob")
+	st, err := b.Submit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WaitToClear(ctx, mint.PublicKey(), st.Sequence); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrying after the transaction cleared sends the same transaction,
+	// and gets the same response
+	retry, err := b.Submit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.Sequence != st.Sequence {
+		t.Fatalf("the retry was a different transaction: %s", retry)
+	}
+	account, err := client.GetAccount(ctx, bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 100 {
+		t.Fatalf("bob should have 100 but has %d", account.Balance)
+	}
+}
@@ -0,0 +1,187 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+// The header that carries the hex HMAC-SHA256 of a webhook body, keyed with
+// the webhook's secret
+const WebhookSignatureHeader = "X-Coinkit-Signature"
+
+// How many webhook calls can wait to be delivered. When a receiver falls this
+// far behind, newer calls are dropped.
+const webhookQueueSize = 1000
+
+// How many times we try to deliver a webhook call before giving up
+const webhookAttempts = 5
+
+// A WebhookConfig registers a URL that gets called when transactions that
+// match its filters are finalized.
+type WebhookConfig struct {
+	URL string
+
+	// Used to sign each call, so that the receiver knows it came from us
+	Secret string
+
+	// When Account is set, only transactions to or from it match
+	Account util.PublicKey
+
+	// Only transactions moving at least this much match
+	MinAmount uint64
+
+	// When Memo is set, only transactions with this memo ID match
+	Memo uint64
+}
+
+func (w *WebhookConfig) matches(t *currency.Transaction) bool {
+	if w.Account != "" && t.From != w.Account && t.To != w.Account {
+		return false
+	}
+	if w.Memo != 0 && t.Memo != w.Memo {
+		return false
+	}
+	return t.Amount >= w.MinAmount
+}
+
+// A WebhookCall is the body of a webhook call. It lists the matching
+// transactions finalized in one slot.
+type WebhookCall struct {
+	Slot         int
+	Transactions []*currency.Transaction
+}
+
+// SignWebhook returns the signature for a webhook body.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookDelivery struct {
+	hook *WebhookConfig
+	body []byte
+}
+
+// webhookSender delivers webhook calls in the background, so that slow
+// receivers don't hold up message processing.
+type webhookSender struct {
+	hooks  []*WebhookConfig
+	queue  chan *webhookDelivery
+	client *http.Client
+}
+
+func newWebhookSender(hooks []*WebhookConfig) *webhookSender {
+	return &webhookSender{
+		hooks:  hooks,
+		queue:  make(chan *webhookDelivery, webhookQueueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// notify queues calls for every webhook with transactions that match in
+// this chunk. The chunk may be nil.
+func (w *webhookSender) notify(slot int, chunk *currency.LedgerChunk) {
+	if chunk == nil {
+		return
+	}
+	for _, hook := range w.hooks {
+		call := &WebhookCall{
+			Slot:         slot,
+			Transactions: []*currency.Transaction{},
+		}
+		for _, t := range chunk.Transactions {
+			if hook.matches(t.Transaction) {
+				call.Transactions = append(call.Transactions, t.Transaction)
+			}
+		}
+		if len(call.Transactions) == 0 {
+			continue
+		}
+		body, err := json.Marshal(call)
+		if err != nil {
+			panic(err)
+		}
+		select {
+		case w.queue <- &webhookDelivery{hook: hook, body: body}:
+		default:
+			log.Printf("webhook queue is full, dropping a call to %s", hook.URL)
+		}
+	}
+}
+
+// deliver makes one webhook call, retrying with a backoff.
+func (w *webhookSender) deliver(ctx context.Context, d *webhookDelivery) error {
+	wait := time.Second
+	var err error
+	for i := 0; i < webhookAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(wait):
+				wait *= 2
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err = w.post(ctx, d)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (w *webhookSender) post(ctx context.Context, d *webhookDelivery) error {
+	return postJSON(ctx, w.client, d.hook.URL, d.body, func(r *http.Request) {
+		r.Header.Set(WebhookSignatureHeader, SignWebhook(d.hook.Secret, d.body))
+	})
+}
+
+// postJSON posts a JSON body, letting the caller add headers first.
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte,
+	prepare func(*http.Request)) error {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	if prepare != nil {
+		prepare(request)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("got status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// deliverForever sends queued webhook calls, in order. It should be run in
+// its own goroutine.
+func (w *webhookSender) deliverForever(ctx context.Context) {
+	for {
+		select {
+		case d := <-w.queue:
+			if err := w.deliver(ctx, d); err != nil && ctx.Err() == nil {
+				log.Printf("could not call webhook %s: %s", d.hook.URL, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
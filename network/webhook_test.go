@@ -0,0 +1,64 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"coinkit/currency"
+	"coinkit/util"
+)
+
+func TestWebhooks(t *testing.T) {
+	calls := make(chan *WebhookCall, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get(WebhookSignatureHeader) != SignWebhook("secret", body) {
+				t.Errorf("bad signature")
+			}
+			call := &WebhookCall{}
+			if err := json.Unmarshal(body, call); err != nil {
+				t.Errorf("bad body: %s", err)
+			}
+			calls <- call
+		}))
+	defer receiver.Close()
+
+	bob := util.NewKeyPairFromSecretPhrase("bob")
+	sender := newWebhookSender([]*WebhookConfig{&WebhookConfig{
+		URL:       receiver.URL,
+		Secret:    "secret",
+		Account:   "carol",
+		MinAmount: 10,
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sender.deliverForever(ctx)
+
+	chunk := &currency.LedgerChunk{}
+	for i, amount := range []uint64{5, 20} {
+		tr := &currency.Transaction{
+			From:     bob.PublicKey(),
+			Sequence: uint32(i + 1),
+			To:       "carol",
+			Amount:   amount,
+		}
+		chunk.Transactions = append(chunk.Transactions, tr.SignWith(bob))
+	}
+	sender.notify(7, chunk)
+
+	select {
+	case call := <-calls:
+		if call.Slot != 7 || len(call.Transactions) != 1 ||
+			call.Transactions[0].Amount != 20 {
+			t.Fatalf("bad call: %+v", call)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was never called")
+	}
+}
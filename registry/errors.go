@@ -0,0 +1,17 @@
+package registry
+
+import (
+	"errors"
+)
+
+var (
+	ErrNilMetadata    = errors.New("missing metadata")
+	ErrBadSignature   = errors.New("signature failed verification")
+	ErrOldSequence    = errors.New("sequence number was already used")
+	ErrFieldTooLong   = errors.New("metadata field is too long")
+	ErrNoValidator    = errors.New("metadata has no validator")
+	ErrBadValidator   = errors.New("metadata validator is not a valid public key")
+	ErrBatchTooLarge  = errors.New("batch has too many entries")
+	ErrBatchDuplicate = errors.New("batch has more than one entry for a validator")
+	ErrNotMember      = errors.New("validator is not a member of the network")
+)
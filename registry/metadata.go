@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"coinkit/util"
+)
+
+// The longest a metadata field can be, in bytes
+const MaxFieldLength = 200
+
+// Metadata is what a validator publishes about itself, so that explorers and
+// quorum tooling can show who runs each node.
+type Metadata struct {
+	// The public key of the validator this describes. It must sign the
+	// metadata
+	Validator util.PublicKey
+
+	// Each update needs a higher sequence number than the last one, so that
+	// old metadata can't be replayed
+	Sequence uint32
+
+	Name    string
+	Contact string `json:",omitempty"`
+	Website string `json:",omitempty"`
+
+	// The fingerprint of a key the operators use outside the network, such
+	// as a PGP key, so that people can check who they are talking to
+	Fingerprint string `json:",omitempty"`
+}
+
+func (m *Metadata) String() string {
+	return fmt.Sprintf("metadata for %s, seq %d: %q", util.Shorten(string(m.Validator)),
+		m.Sequence, m.Name)
+}
+
+// Validate returns an error if the metadata could never be published,
+// regardless of what has been published before.
+func (m *Metadata) Validate() error {
+	if m.Validator == "" {
+		return ErrNoValidator
+	}
+	if m.Validator.Validate() != nil {
+		return ErrBadValidator
+	}
+	for _, field := range []string{m.Name, m.Contact, m.Website, m.Fingerprint} {
+		if len(field) > MaxFieldLength {
+			return ErrFieldTooLong
+		}
+	}
+	return nil
+}
+
+// SignWith signs the metadata. Only the validator it describes can sign it.
+func (m *Metadata) SignWith(kp *util.KeyPair) *SignedMetadata {
+	if kp.PublicKey() != m.Validator {
+		panic("you can only sign your own metadata")
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		panic("failed to sign metadata because json encoding failed")
+	}
+	return &SignedMetadata{
+		Metadata:  m,
+		Signature: kp.Sign(string(bytes)),
+	}
+}
+
+type SignedMetadata struct {
+	*Metadata
+
+	// The validator's signature of the metadata
+	Signature string
+}
+
+func (s *SignedMetadata) Verify() bool {
+	if s.Metadata == nil {
+		return false
+	}
+	bytes, err := json.Marshal(s.Metadata)
+	if err != nil {
+		return false
+	}
+	return util.Verify(s.Validator, string(bytes), s.Signature)
+}
+
+// check returns an error if the signed metadata could never be published.
+func (s *SignedMetadata) check() error {
+	if s == nil || s.Metadata == nil {
+		return ErrNilMetadata
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if !s.Verify() {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package registry
+
+import (
+	"encoding/base64"
+	"sort"
+
+	"golang.org/x/crypto/sha3"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// The most entries that can be finalized in one slot
+const MaxBatchSize = 100
+
+// A Registry keeps the metadata that validators have published on the chain.
+// It is an app that shares the chain with the currency, through a
+// CompositeValueStore. Each slot value is the hash of a batch of metadata.
+// Registry is not threadsafe.
+type Registry struct {
+	// Just for logging
+	publicKey util.PublicKey
+
+	// Metadata that has not been finalized yet, keyed by validator
+	// Only members get in, so there is at most one entry per member
+	pending map[util.PublicKey]*SignedMetadata
+
+	// The validators we accept metadata from. Anyone can sign metadata, so
+	// without this a flood of made-up validators could crowd out real ones
+	members map[util.PublicKey]bool
+
+	// The batches that are being considered for the current slot
+	// They are indexed by hash
+	batches map[consensus.SlotValue][]*SignedMetadata
+
+	// Batches that already got finalized, so that they can be sent along
+	// with history
+	// They are indexed by slot
+	old map[int][]*SignedMetadata
+
+	// The finalized metadata, keyed by validator
+	entries map[util.PublicKey]*SignedMetadata
+
+	// The key of the last batch to get finalized
+	last consensus.SlotValue
+
+	// The current slot we are working on
+	slot int
+}
+
+func NewRegistry(publicKey util.PublicKey) *Registry {
+	return &Registry{
+		publicKey: publicKey,
+		pending:   make(map[util.PublicKey]*SignedMetadata),
+		members:   make(map[util.PublicKey]bool),
+		batches:   make(map[consensus.SlotValue][]*SignedMetadata),
+		old:       make(map[int][]*SignedMetadata),
+		entries:   make(map[util.PublicKey]*SignedMetadata),
+		last:      consensus.SlotValue(""),
+		slot:      1,
+	}
+}
+
+func (r *Registry) Logf(format string, a ...interface{}) {
+	util.Logf("RG", r.publicKey, format, a...)
+}
+
+// SetMembers sets the validators that we accept metadata from, and drops
+// pending metadata from anyone else.
+func (r *Registry) SetMembers(members []util.PublicKey) {
+	r.members = make(map[util.PublicKey]bool)
+	for _, member := range members {
+		r.members[member] = true
+	}
+	for validator := range r.pending {
+		if !r.members[validator] {
+			delete(r.pending, validator)
+		}
+	}
+}
+
+// Add adds metadata to the pending metadata. It returns whether it is new.
+// Only metadata for members is accepted.
+func (r *Registry) Add(s *SignedMetadata) (bool, error) {
+	if err := r.validate(s); err != nil {
+		return false, err
+	}
+	if !r.members[s.Validator] {
+		return false, ErrNotMember
+	}
+	if p, ok := r.pending[s.Validator]; ok && p.Sequence >= s.Sequence {
+		return false, nil
+	}
+	r.pending[s.Validator] = s
+	return true, nil
+}
+
+// validate returns an error if the metadata can't be finalized on top of
+// what is already finalized.
+func (r *Registry) validate(s *SignedMetadata) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if e, ok := r.entries[s.Validator]; ok && e.Sequence >= s.Sequence {
+		return ErrOldSequence
+	}
+	return nil
+}
+
+// HandleRegistryMessage adds the entries and batches in a message. It
+// returns whether we learned anything, and the first reason an entry was
+// rejected.
+func (r *Registry) HandleRegistryMessage(m *RegistryMessage) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	updated := false
+	var rejected error
+	for _, s := range m.Entries {
+		added, err := r.Add(s)
+		if err != nil && rejected == nil {
+			rejected = err
+		}
+		updated = updated || added
+	}
+	for key, batch := range m.Batches {
+		if _, ok := r.batches[key]; ok {
+			continue
+		}
+		if batchHash(batch) != key {
+			continue
+		}
+		if err := r.validateBatch(batch); err != nil {
+			r.Logf("rejected batch %s: %s", util.Shorten(string(key)), err)
+			continue
+		}
+		r.batches[key] = batch
+		updated = true
+	}
+	return updated, rejected
+}
+
+// validateBatch returns an error if a batch can't be finalized on top of
+// what is already finalized.
+func (r *Registry) validateBatch(batch []*SignedMetadata) error {
+	if len(batch) > MaxBatchSize {
+		return ErrBatchTooLarge
+	}
+	seen := make(map[util.PublicKey]bool)
+	for _, s := range batch {
+		if err := r.validate(s); err != nil {
+			return err
+		}
+		if seen[s.Validator] {
+			return ErrBatchDuplicate
+		}
+		seen[s.Validator] = true
+	}
+	return nil
+}
+
+// batchHash is the hash of a batch. Signatures are enough to stand in for
+// the whole metadata, since they can't be reused for different metadata.
+func batchHash(batch []*SignedMetadata) consensus.SlotValue {
+	h := sha3.New512()
+	for _, s := range batch {
+		h.Write([]byte(s.Signature))
+	}
+	return consensus.SlotValue(base64.RawStdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// newBatch makes a batch out of the latest metadata for each validator, and
+// keeps it with the batches for this slot.
+func (r *Registry) newBatch(list []*SignedMetadata) (consensus.SlotValue, []*SignedMetadata) {
+	latest := make(map[util.PublicKey]*SignedMetadata)
+	for _, s := range list {
+		if r.validate(s) != nil {
+			continue
+		}
+		if l, ok := latest[s.Validator]; !ok || l.Sequence < s.Sequence {
+			latest[s.Validator] = s
+		}
+	}
+	batch := []*SignedMetadata{}
+	for _, s := range latest {
+		batch = append(batch, s)
+	}
+	if len(batch) == 0 {
+		return consensus.SlotValue(""), nil
+	}
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].Validator < batch[j].Validator
+	})
+	if len(batch) > MaxBatchSize {
+		batch = batch[:MaxBatchSize]
+	}
+	key := batchHash(batch)
+	r.batches[key] = batch
+	return key, batch
+}
+
+// SharingMessage returns a message with everything we have that other
+// nodes might need for the current slot, or nil if there is nothing.
+func (r *Registry) SharingMessage() *RegistryMessage {
+	if len(r.pending) == 0 && len(r.batches) == 0 {
+		return nil
+	}
+	return &RegistryMessage{
+		Entries: sortedEntries(r.pending),
+		Batches: r.batches,
+	}
+}
+
+// RegistryMessage returns a message with all of the finalized metadata.
+func (r *Registry) RegistryMessage() *RegistryMessage {
+	return &RegistryMessage{
+		Entries: r.Entries(),
+	}
+}
+
+// OldBatchMessage returns a message with the batch finalized in a slot, or
+// nil if there was none.
+func (r *Registry) OldBatchMessage(slot int) *RegistryMessage {
+	batch, ok := r.old[slot]
+	if !ok {
+		return nil
+	}
+	return &RegistryMessage{
+		Entries: []*SignedMetadata{},
+		Batches: map[consensus.SlotValue][]*SignedMetadata{
+			batchHash(batch): batch,
+		},
+	}
+}
+
+// Entries returns the finalized metadata, sorted by validator.
+func (r *Registry) Entries() []*SignedMetadata {
+	return sortedEntries(r.entries)
+}
+
+// Get returns the finalized metadata for a validator, or nil if it has not
+// published any.
+func (r *Registry) Get(validator util.PublicKey) *Metadata {
+	s, ok := r.entries[validator]
+	if !ok {
+		return nil
+	}
+	return s.Metadata
+}
+
+func sortedEntries(m map[util.PublicKey]*SignedMetadata) []*SignedMetadata {
+	answer := []*SignedMetadata{}
+	for _, s := range m {
+		answer = append(answer, s)
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		return answer[i].Validator < answer[j].Validator
+	})
+	return answer
+}
+
+// Restore replaces the finalized metadata of a registry that has not
+// finalized anything yet, for a node restarting from a checkpoint. The
+// registry picks up at slot.
+func (r *Registry) Restore(slot int, entries []*SignedMetadata) {
+	r.entries = make(map[util.PublicKey]*SignedMetadata)
+	for _, s := range entries {
+		r.entries[s.Validator] = s
+	}
+	r.slot = slot
+}
+
+// Prune forgets the finalized batches for all slots before the provided one.
+func (r *Registry) Prune(before int) {
+	for slot := range r.old {
+		if slot < before {
+			delete(r.old, slot)
+		}
+	}
+}
+
+// Combine merges batches into one with the latest metadata for each
+// validator.
+func (r *Registry) Combine(list []consensus.SlotValue) consensus.SlotValue {
+	entries := []*SignedMetadata{}
+	for _, v := range list {
+		batch, ok := r.batches[v]
+		if !ok {
+			r.Logf("cannot combine unknown batch %s", util.Shorten(string(v)))
+			continue
+		}
+		entries = append(entries, batch...)
+	}
+	key, batch := r.newBatch(entries)
+	if batch == nil {
+		// Every node agrees on the lowest value in the list, so fall back
+		// to that
+		answer := consensus.SlotValue("")
+		for i, v := range list {
+			if i == 0 || v < answer {
+				answer = v
+			}
+		}
+		return answer
+	}
+	return key
+}
+
+// CanFinalize returns whether we know about this batch.
+func (r *Registry) CanFinalize(v consensus.SlotValue) bool {
+	_, ok := r.batches[v]
+	return ok
+}
+
+func (r *Registry) Finalize(v consensus.SlotValue) {
+	batch, ok := r.batches[v]
+	if !ok {
+		panic("We are finalizing a batch but we don't know its data.")
+	}
+	for _, s := range batch {
+		r.entries[s.Validator] = s
+		if p, ok := r.pending[s.Validator]; ok && p.Sequence <= s.Sequence {
+			delete(r.pending, s.Validator)
+		}
+	}
+	r.old[r.slot] = batch
+	r.last = v
+	r.advance()
+}
+
+func (r *Registry) Skip() {
+	r.advance()
+}
+
+// advance moves the registry on to the next slot.
+func (r *Registry) advance() {
+	r.batches = make(map[consensus.SlotValue][]*SignedMetadata)
+	r.slot++
+}
+
+func (r *Registry) Last() consensus.SlotValue {
+	return r.last
+}
+
+// Slot returns the slot that we are working on.
+func (r *Registry) Slot() int {
+	return r.slot
+}
+
+// SuggestValue returns a batch of the pending metadata, keyed by its hash.
+func (r *Registry) SuggestValue() (consensus.SlotValue, bool) {
+	key, batch := r.newBatch(sortedEntries(r.pending))
+	if batch == nil {
+		return consensus.SlotValue(""), false
+	}
+	return key, true
+}
+
+// ValidateValue returns whether we know about this batch, it can still
+// be finalized, and it only has metadata for members.
+func (r *Registry) ValidateValue(v consensus.SlotValue) bool {
+	batch, ok := r.batches[v]
+	if !ok {
+		return false
+	}
+	if r.validateBatch(batch) != nil {
+		return false
+	}
+	for _, s := range batch {
+		if !r.members[s.Validator] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+// A RegistryMessage carries validator metadata. Validators send one to
+// publish their own metadata, nodes use them to share the metadata that is
+// waiting to be finalized, and they answer requests for the registry.
+
+type RegistryMessage struct {
+	// Signed metadata, at most one entry per validator
+	Entries []*SignedMetadata
+
+	// Batches of metadata that might get finalized, keyed by their hash
+	Batches map[consensus.SlotValue][]*SignedMetadata `json:",omitempty"`
+}
+
+func (m *RegistryMessage) Slot() int {
+	return 0
+}
+
+func (m *RegistryMessage) MessageType() string {
+	return "M"
+}
+
+func (m *RegistryMessage) String() string {
+	names := []string{}
+	for name := range m.Batches {
+		names = append(names, util.Shorten(string(name)))
+	}
+	return fmt.Sprintf("registry entries=%d batches=(%s)",
+		len(m.Entries), strings.Join(names, ","))
+}
+
+func init() {
+	util.RegisterMessageType(&RegistryMessage{})
+}
@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+
+	"coinkit/consensus"
+	"coinkit/util"
+)
+
+func makeTestMetadata(n int, sequence uint32) *SignedMetadata {
+	kp := util.NewKeyPairFromSecretPhrase(fmt.Sprintf("validator %d", n))
+	m := &Metadata{
+		Validator: kp.PublicKey(),
+		Sequence:  sequence,
+		Name:      fmt.Sprintf("validator %d", n),
+		Website:   "https://example.com",
+	}
+	return m.SignWith(kp)
+}
+
+// testMembers are the validators that makeTestMetadata makes for 1 and 2
+func testMembers() []util.PublicKey {
+	return []util.PublicKey{
+		makeTestMetadata(1, 1).Validator,
+		makeTestMetadata(2, 1).Validator,
+	}
+}
+
+func TestPublishingMetadata(t *testing.T) {
+	r1 := NewRegistry("r1")
+	r2 := NewRegistry("r2")
+	r1.SetMembers(testMembers())
+	r2.SetMembers(testMembers())
+	s := makeTestMetadata(1, 1)
+	if _, ok := r1.SuggestValue(); ok {
+		t.Fatal("there should be nothing to suggest yet")
+	}
+	if added, err := r1.Add(s); !added || err != nil {
+		t.Fatalf("could not add metadata: %v", err)
+	}
+	key, ok := r1.SuggestValue()
+	if !ok {
+		t.Fatal("expected a suggestion")
+	}
+
+	// r2 learns about the batch from r1
+	if r2.ValidateValue(key) {
+		t.Fatal("r2 should not know the batch yet")
+	}
+	sharing := util.EncodeThenDecode(r1.SharingMessage()).(*RegistryMessage)
+	if updated, _ := r2.HandleRegistryMessage(sharing); !updated {
+		t.Fatal("r2 should learn something from r1")
+	}
+	if !r2.ValidateValue(key) || !r2.CanFinalize(key) {
+		t.Fatal("r2 should know the batch now")
+	}
+	for _, r := range []*Registry{r1, r2} {
+		r.Finalize(key)
+		if m := r.Get(s.Validator); m == nil || m.Name != "validator 1" {
+			t.Fatalf("bad metadata after finalizing: %+v", m)
+		}
+	}
+	if r1.SharingMessage() != nil {
+		t.Fatal("r1 should have nothing left to share")
+	}
+
+	// Replaying old metadata doesn't work
+	if _, err := r1.Add(s); err != ErrOldSequence {
+		t.Fatalf("expected an old sequence error but got %v", err)
+	}
+	forged := makeTestMetadata(1, 2)
+	forged.Name = "someone else"
+	if _, err := r1.Add(forged); err != ErrBadSignature {
+		t.Fatalf("expected a bad signature error but got %v", err)
+	}
+
+	// The batch comes along with history
+	old := r1.OldBatchMessage(1)
+	if old == nil || len(old.Batches) != 1 || old.Batches[key] == nil {
+		t.Fatalf("bad old batch message: %s", old)
+	}
+}
+
+func TestOnlyMembersPublish(t *testing.T) {
+	r1 := NewRegistry("r1")
+	r2 := NewRegistry("r2")
+	r1.SetMembers(testMembers())
+	r2.SetMembers(testMembers())
+	if _, err := r1.Add(makeTestMetadata(3, 1)); err != ErrNotMember {
+		t.Fatalf("expected a not member error but got %v", err)
+	}
+	if r1.SharingMessage() != nil {
+		t.Fatal("r1 should not share metadata for non-members")
+	}
+
+	// r2 won't vote for a batch with a non-member in it
+	key, _ := r1.newBatch([]*SignedMetadata{makeTestMetadata(1, 1), makeTestMetadata(3, 1)})
+	r2.HandleRegistryMessage(util.EncodeThenDecode(r1.SharingMessage()).(*RegistryMessage))
+	if !r2.CanFinalize(key) || r2.ValidateValue(key) {
+		t.Fatal("r2 should know the batch but not vote for it")
+	}
+
+	// Dropping a member drops its pending metadata
+	if added, err := r1.Add(makeTestMetadata(2, 1)); !added || err != nil {
+		t.Fatalf("could not add metadata: %v", err)
+	}
+	r1.SetMembers(testMembers()[:1])
+	if len(r1.pending) != 0 {
+		t.Fatal("metadata for a removed member should be dropped")
+	}
+}
+
+func TestCombineBatches(t *testing.T) {
+	r := NewRegistry("r")
+	batches := []consensus.SlotValue{}
+	for _, s := range []*SignedMetadata{
+		makeTestMetadata(1, 1),
+		makeTestMetadata(1, 2),
+		makeTestMetadata(2, 1),
+	} {
+		key, _ := r.newBatch([]*SignedMetadata{s})
+		batches = append(batches, key)
+	}
+	combined := r.Combine(batches)
+	batch := r.batches[combined]
+	if len(batch) != 2 {
+		t.Fatalf("expected one entry per validator but got %d", len(batch))
+	}
+	for _, s := range batch {
+		if s.Name == "validator 1" && s.Sequence != 2 {
+			t.Fatal("the combined batch should have the latest metadata")
+		}
+	}
+	if r.Combine([]consensus.SlotValue{batches[0], "unknown"}) != batches[0] {
+		t.Fatal("unknown batches should be left out")
+	}
+}
@@ -1,6 +1,7 @@
 #!/bin/bash
 
 LOGS="$HOME/logs"
+NETWORK="${NETWORK:-devnet}"
 
 if [ ! -d "$LOGS" ]; then
     echo "please create a logs directory in ~/logs"
@@ -25,7 +26,7 @@ fi
 
 for i in `seq 0 3`;
 do
-    nohup cserver $i &> $LOGS/cserver$i.log &
+    nohup cserver --network $NETWORK $i &> $LOGS/cserver$i.log &
 done 
 
 sleep 0.1
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// An ErrorMessage is sent in response to a message that could not be handled,
+// to tell the sender why. Like InfoMessage, the node-to-node protocol does not
+// need these, so they are typically just sent to endpoint clients.
+type ErrorMessage struct {
+	// A human-readable description of what went wrong
+	Error string
+
+	// Whether the same message might succeed if it is sent again later
+	Transient bool
+
+	// When nonzero, how long the sender should wait before trying again
+	RetryAfter time.Duration
+}
+
+func (m *ErrorMessage) Slot() int {
+	return 0
+}
+
+func (m *ErrorMessage) MessageType() string {
+	return "X"
+}
+
+func (m *ErrorMessage) String() string {
+	if m.RetryAfter > 0 {
+		return fmt.Sprintf("error (retry after %s): %s", m.RetryAfter, m.Error)
+	}
+	if m.Transient {
+		return fmt.Sprintf("error (transient): %s", m.Error)
+	}
+	return fmt.Sprintf("error: %s", m.Error)
+}
+
+func init() {
+	RegisterMessageType(&ErrorMessage{})
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Messages go over the wire in frames. A frame is a six-byte header followed
+// by a payload. The header is the version of the framing, the frame type, and
+// the length of the payload as a four-byte big-endian integer. Since the
+// length comes first, a payload can hold any bytes, newlines included.
+
+// The framing version we speak. Frames with any other version are rejected,
+// so a future change to the header can't be misread as a message.
+const FrameVersion byte = 1
+
+const frameHeaderSize = 6
+
+// Frames with a longer payload than this are rejected without reading the
+// payload.
+const MaxFrameSize = 16 << 20
+
+// Frame types
+const (
+	// An empty response. Its payload is always empty
+	FrameOK byte = 1
+
+	// A serialized signed message
+	FrameMessage byte = 2
+
+	// The rest of these only go over links between peers. See peerLink in
+	// the network package for how they are used.
+
+	// A quorum slice that later compact frames refer to by its hash
+	FrameSlice byte = 3
+
+	// A serialized signed message with its quorum slice cut out
+	FrameCompact byte = 4
+
+	// Asks for the quorum slice with the hash in the payload to be sent
+	// again
+	FrameSliceRequest byte = 5
+)
+
+var (
+	ErrUnknownFrameVersion = errors.New("unrecognized frame version")
+	ErrUnknownFrameType    = errors.New("unrecognized frame type")
+	ErrFrameTooLarge       = errors.New("frame is too large")
+	ErrUnexpectedFrameType = errors.New("frame type is not allowed here")
+)
+
+// EncodeFrame returns a frame holding payload, ready to go on the wire.
+func EncodeFrame(frameType byte, payload string) string {
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = FrameVersion
+	buf[1] = frameType
+	binary.BigEndian.PutUint32(buf[2:frameHeaderSize], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	return string(buf)
+}
+
+// ReadFrame reads one frame, and returns its type and payload. A header we
+// can't make sense of is a DecodeError, after which the rest of the stream
+// can't be trusted.
+// It never reads past the end of the frame, so it can be used straight on a
+// connection, although a buffered reader is faster.
+// The caller is responsible for setting any deadlines.
+func ReadFrame(r io.Reader) (byte, string, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", err
+	}
+	if header[0] != FrameVersion {
+		return 0, "", &DecodeError{Line: string(header[:]), Err: ErrUnknownFrameVersion}
+	}
+	frameType := header[1]
+	if frameType < FrameOK || frameType > FrameSliceRequest {
+		return 0, "", &DecodeError{Line: string(header[:]), Err: ErrUnknownFrameType}
+	}
+	size := binary.BigEndian.Uint32(header[2:])
+	if size > MaxFrameSize {
+		return 0, "", &DecodeError{Line: string(header[:]), Err: ErrFrameTooLarge}
+	}
+	// Anyone can send a header, so the payload only gets as much memory as
+	// has actually arrived, rather than what the header claims
+	var payload strings.Builder
+	if _, err := io.CopyN(&payload, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, "", err
+	}
+	return frameType, payload.String(), nil
+}
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	payloads := []string{"", "hello", "one\ntwo\n\n", strings.Repeat("x", 100000)}
+	buf := &bytes.Buffer{}
+	for _, payload := range payloads {
+		buf.WriteString(EncodeFrame(FrameMessage, payload))
+	}
+	for _, payload := range payloads {
+		frameType, got, err := ReadFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frameType != FrameMessage || got != payload {
+			t.Fatalf("expected %q but got %q", payload, got)
+		}
+	}
+	if _, _, err := ReadFrame(buf); err != io.EOF {
+		t.Fatalf("expected EOF but got %v", err)
+	}
+}
+
+func TestFrameHeaderDoesNotReserveMemory(t *testing.T) {
+	// A header that claims the largest payload, with none to follow
+	header := EncodeFrame(FrameMessage, "")[:2] + "\x00\xff\xff\xff"
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err := ReadFrame(strings.NewReader(header + "hello"))
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF but got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("reading a short frame allocated %d bytes", allocated)
+	}
+}
+
+func TestSignedMessagesOverFrames(t *testing.T) {
+	kp := NewKeyPairFromSecretPhrase("foo")
+	sm := NewSignedMessage(kp, &ErrorMessage{Error: "a message\nwith newlines\n"})
+	buf := &bytes.Buffer{}
+	WriteSignedMessage(buf, sm)
+	WriteSignedMessage(buf, nil)
+	WriteSignedMessage(buf, sm)
+
+	for i := 0; i < 3; i++ {
+		sm2, err := ReadSignedMessage(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			if sm2 != nil {
+				t.Fatalf("expected an ok but got %s", sm2.Message())
+			}
+			continue
+		}
+		if sm2.Serialize() != sm.Serialize() {
+			t.Fatalf("expected %s but got %s", sm.Serialize(), sm2.Serialize())
+		}
+	}
+}
+
+func TestBadFrames(t *testing.T) {
+	good := EncodeFrame(FrameMessage, "hello")
+	cases := map[string]error{
+		"Garbage!\n\n\n":              ErrUnknownFrameVersion,
+		good[:1] + "\x09" + good[2:]:  ErrUnknownFrameType,
+		good[:2] + "\xff\xff\xff\xff": ErrFrameTooLarge,
+		good[:len(good)-1]:            io.ErrUnexpectedEOF,
+		good[:3]:                      io.ErrUnexpectedEOF,
+	}
+	for data, expected := range cases {
+		_, _, err := ReadFrame(strings.NewReader(data))
+		if !errors.Is(err, expected) {
+			t.Fatalf("reading %q, expected %v but got %v", data, expected, err)
+		}
+	}
+
+	// A bad header is a decode error, so it can be looked at later
+	_, err := ReadSignedMessage(strings.NewReader("Garbage!"))
+	var decodeError *DecodeError
+	if !errors.As(err, &decodeError) || decodeError.Line != "Garbag" {
+		t.Fatalf("expected a decode error but got %v", err)
+	}
+}
+
+func TestWireFollowsFraming(t *testing.T) {
+	kp := NewKeyPairFromSecretPhrase("foo")
+	sm := NewSignedMessage(kp, &ErrorMessage{Error: "hi"})
+	for _, lines := range []bool{true, false} {
+		in := &bytes.Buffer{}
+		if lines {
+			in.WriteString(SignedMessageToLine(sm) + SignedMessageToLine(nil))
+		} else {
+			WriteSignedMessage(in, sm)
+			WriteSignedMessage(in, nil)
+		}
+		out := &bytes.Buffer{}
+		wire := NewWire(struct {
+			io.Reader
+			io.Writer
+		}{in, out})
+		sm2, err := wire.Read()
+		if err != nil || sm2 == nil || sm2.Signer() != kp.PublicKey() {
+			t.Fatalf("bad message %v: %v", sm2, err)
+		}
+		if wire.Lines() != lines {
+			t.Fatalf("lines should be %v", lines)
+		}
+		if sm2, err := wire.Read(); sm2 != nil || err != nil {
+			t.Fatalf("expected an ok but got %v, %v", sm2, err)
+		}
+		wire.Write(nil)
+		if lines && out.String() != OK+"\n" {
+			t.Fatalf("a wire reading lines should write them, but wrote %q", out.String())
+		}
+		if !lines && out.String() != SignedMessageToFrame(nil) {
+			t.Fatalf("a wire reading frames should write them, but wrote %q", out.String())
+		}
+	}
+
+	if _, _, err := ReadLine(bufio.NewReader(strings.NewReader("no newline"))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF but got %v", err)
+	}
+}
@@ -15,7 +15,25 @@ type InfoMessage struct {
 
 	// When Account is nonempty, the info message is requesting an AccountMessage
 	// for this particular user.
-	Account string
+	Account PublicKey
+
+	// When At is nonzero along with Account, the info message is requesting
+	// the state of the account as of the end of slot At, rather than its
+	// current state.
+	At int
+
+	// When Sequence is nonzero along with Account, the info message is also
+	// asking which slot finalized the account's transaction with that
+	// sequence number, so that the client can tell how deep it is.
+	Sequence uint32 `json:",omitempty"`
+
+	// When Registry is set, the info message is requesting a RegistryMessage
+	// with the metadata every validator has published.
+	Registry bool `json:",omitempty"`
+
+	// When Status is set, the info message is requesting a StatusMessage
+	// with how the node is doing, for operators.
+	Status bool `json:",omitempty"`
 }
 
 func (m *InfoMessage) Slot() int {
@@ -32,7 +50,19 @@ func (m *InfoMessage) String() string {
 		parts = append(parts, fmt.Sprintf("i=%d", m.I))
 	}
 	if m.Account != "" {
-		parts = append(parts, fmt.Sprintf("account=%s", Shorten(m.Account)))
+		parts = append(parts, fmt.Sprintf("account=%s", Shorten(string(m.Account))))
+	}
+	if m.At != 0 {
+		parts = append(parts, fmt.Sprintf("at=%d", m.At))
+	}
+	if m.Sequence != 0 {
+		parts = append(parts, fmt.Sprintf("sequence=%d", m.Sequence))
+	}
+	if m.Registry {
+		parts = append(parts, "registry")
+	}
+	if m.Status {
+		parts = append(parts, "status")
 	}
 	return strings.Join(parts, " ")
 }
@@ -39,8 +39,8 @@ func NewKeyPairFromSecretPhrase(phrase string) *KeyPair {
 }
 
 // A transportable version of the public key, using base64
-func (kp *KeyPair) PublicKey() string {
-	return base64.RawStdEncoding.EncodeToString(kp.publicKey)
+func (kp *KeyPair) PublicKey() PublicKey {
+	return PublicKey(base64.RawStdEncoding.EncodeToString(kp.publicKey))
 }
 
 // Interprets the message as utf8, then returns the signature as base64.
@@ -53,9 +53,9 @@ func (kp *KeyPair) Sign(message string) string {
 }
 
 // The external versions: message is handled as utf8, the keys and sigs are base64.
-func Verify(publicKey string, message string, signature string) bool {
-	pub, err := base64.RawStdEncoding.DecodeString(publicKey)
-	if err != nil || len(pub) != ed25519.PublicKeySize {
+func Verify(publicKey PublicKey, message string, signature string) bool {
+	pub, err := decodePublicKey(publicKey)
+	if err != nil {
 		return false
 	}
 	sig, err := base64.RawStdEncoding.DecodeString(signature)
@@ -0,0 +1,156 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Before protocol version 2, messages went over the wire one per line
+// instead of in frames, with a line of just "ok" for an empty response. A
+// frame always starts with FrameVersion, which no line does, so the first
+// byte a connection gets says which framing the other end speaks.
+
+// The line for an empty response
+const OK = "ok"
+
+// Convert a signed message to one line in the line framing.
+// A nil message becomes an ok line.
+func SignedMessageToLine(sm *SignedMessage) string {
+	if sm == nil {
+		return OK + "\n"
+	}
+	return sm.Serialize() + "\n"
+}
+
+// FrameToLine converts a frame to the line framing. Only ok and message
+// frames have a line, so for any other frame it returns false.
+func FrameToLine(frame string) (string, bool) {
+	frameType, payload, err := ReadFrame(strings.NewReader(frame))
+	if err != nil {
+		return "", false
+	}
+	switch frameType {
+	case FrameOK:
+		return OK + "\n", true
+	case FrameMessage:
+		return payload + "\n", true
+	default:
+		return "", false
+	}
+}
+
+// UsesLines returns whether the next thing r has for us is a line rather
+// than a frame. It waits for at least one byte to arrive.
+func UsesLines(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] != FrameVersion, nil
+}
+
+// ReadLine reads one line, and returns it as the frame type and payload that
+// ReadFrame would return for the same message. Like frames, lines longer
+// than MaxFrameSize are rejected.
+func ReadLine(r *bufio.Reader) (byte, string, error) {
+	var b strings.Builder
+	for {
+		chunk, err := r.ReadSlice('\n')
+		b.Write(chunk)
+		if b.Len() > MaxFrameSize+1 {
+			return 0, "", &DecodeError{Line: strings.Clone(b.String()[:100]), Err: ErrFrameTooLarge}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && b.Len() > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, "", err
+		}
+		break
+	}
+	line := strings.TrimSuffix(b.String(), "\n")
+	if line == OK {
+		return FrameOK, "", nil
+	}
+	return FrameMessage, line, nil
+}
+
+// ReadSignedLine is ReadSignedMessage for the line framing.
+func ReadSignedLine(r *bufio.Reader) (*SignedMessage, error) {
+	return signedMessageFrom(ReadLine(r))
+}
+
+// A Wire reads and writes signed messages on a connection, in whichever
+// framing the other end speaks. Unless it is told otherwise, it finds out
+// from the first thing it reads, and writes in the same framing.
+// A Wire is not threadsafe.
+type Wire struct {
+	reader *bufio.Reader
+	writer io.Writer
+
+	// Whether we know the framing yet, and if so, whether it's lines
+	known bool
+	lines bool
+}
+
+func NewWire(conn io.ReadWriter) *Wire {
+	return &Wire{
+		reader: bufio.NewReader(conn),
+		writer: conn,
+	}
+}
+
+// Reader returns the reader the wire reads from, which may have buffered
+// more than the wire has read.
+func (w *Wire) Reader() *bufio.Reader {
+	return w.reader
+}
+
+// Lines returns whether the wire is using the line framing.
+func (w *Wire) Lines() bool {
+	return w.lines
+}
+
+// UseLines makes the wire use the line framing from now on.
+func (w *Wire) UseLines() {
+	w.known = true
+	w.lines = true
+}
+
+// UseFrames makes the wire use frames from now on.
+func (w *Wire) UseFrames() {
+	w.known = true
+	w.lines = false
+}
+
+// Read reads the next signed message. Like ReadSignedMessage, it returns a
+// nil message for an ok.
+// The caller is responsible for setting any deadlines.
+func (w *Wire) Read() (*SignedMessage, error) {
+	if !w.known {
+		lines, err := UsesLines(w.reader)
+		if err != nil {
+			return nil, err
+		}
+		w.known = true
+		w.lines = lines
+	}
+	if w.lines {
+		return ReadSignedLine(w.reader)
+	}
+	return ReadSignedMessage(w.reader)
+}
+
+// Write writes a signed message, or an ok for a nil message. Until the wire
+// knows better, it uses frames.
+func (w *Wire) Write(sm *SignedMessage) {
+	if w.lines {
+		io.WriteString(w.writer, SignedMessageToLine(sm))
+		return
+	}
+	WriteSignedMessage(w.writer, sm)
+}
@@ -13,6 +13,6 @@ func Shorten(name string) string {
 }
 
 // Send logging through here so that it's easier to manage
-func Logf(tag string, publicKey string, format string, a ...interface{}) {
-	log.Printf(tag + " " + Shorten(publicKey) + " " + format, a...)
+func Logf(tag string, publicKey PublicKey, format string, a ...interface{}) {
+	log.Printf(tag + " " + Shorten(string(publicKey)) + " " + format, a...)
 }
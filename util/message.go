@@ -2,6 +2,7 @@ package util
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
@@ -18,6 +19,8 @@ type Message interface {
 	String() string
 }
 
+var ErrUnregisteredMessageType = errors.New("unregistered message type")
+
 // MessageTypeMap maps into struct types whose pointer-types implement Message.
 // For example, *NominationMessage is a Message. So this map contains the
 // NominationMessage type.
@@ -79,7 +82,7 @@ func DecodeMessage(encoded string) (Message, error) {
 
 	messageType, ok := MessageTypeMap[pdm.T]
 	if !ok {
-		return nil, fmt.Errorf("unregistered message type: %s", pdm.T)
+		return nil, fmt.Errorf("%w: %s", ErrUnregisteredMessageType, pdm.T)
 	}
 	m := reflect.New(messageType).Interface().(Message)
 	err = json.Unmarshal(pdm.M, &m)
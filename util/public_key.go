@@ -0,0 +1,23 @@
+package util
+
+import (
+	"sort"
+)
+
+// A PublicKey identifies a node or an account. It is an ed25519 public key
+// in base64, which is also how it goes over the wire.
+// Keys that come from outside, like flags and config files, should go
+// through ParsePublicKey. The signer of a signed message has already been
+// checked by its signature.
+type PublicKey string
+
+// Validate returns an error if this is not a well-formed public key.
+func (k PublicKey) Validate() error {
+	_, err := decodePublicKey(k)
+	return err
+}
+
+// SortPublicKeys sorts keys in increasing order.
+func SortPublicKeys(keys []PublicKey) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+}
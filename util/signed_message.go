@@ -1,19 +1,22 @@
 package util
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
 )
 
-const OK = "ok"
+var (
+	ErrWrongPartCount = errors.New("could not find 4 parts")
+	ErrUnknownVersion = errors.New("unrecognized version")
+	ErrBadSignature   = errors.New("signature failed verification")
+)
 
 type SignedMessage struct {
 	message Message
 	messageString string
-	signer string
+	signer PublicKey
 	signature string
 }
 
@@ -31,7 +34,7 @@ func (sm *SignedMessage) Message() Message {
 	return sm.message
 }
 
-func (sm *SignedMessage) Signer() string {
+func (sm *SignedMessage) Signer() PublicKey {
 	return sm.signer
 }
 
@@ -42,14 +45,14 @@ func (sm *SignedMessage) Serialize() string {
 func NewSignedMessageFromSerialized(serialized string) (*SignedMessage, error) {
 	parts := strings.SplitN(serialized, ":", 4)
 	if len(parts) != 4 {
-		return nil, errors.New("could not find 4 parts")
+		return nil, ErrWrongPartCount
 	}
-	version, signer, signature, ms := parts[0], parts[1], parts[2], parts[3]
+	version, signer, signature, ms := parts[0], PublicKey(parts[1]), parts[2], parts[3]
 	if version != "e" {
-		return nil, errors.New("unrecognized version")
+		return nil, ErrUnknownVersion
 	}
 	if !Verify(signer, ms, signature) {
-		return nil, errors.New("signature failed verification")
+		return nil, ErrBadSignature
 	}
 	m, err := DecodeMessage(ms)
 	if err != nil {
@@ -63,32 +66,56 @@ func NewSignedMessageFromSerialized(serialized string) (*SignedMessage, error) {
 	}, nil
 }
 
-// Convert a signed message to one line in a wire format
-func SignedMessageToLine(sm *SignedMessage) string {
+// Convert a signed message to a frame in the wire format.
+// A nil message becomes an ok frame.
+func SignedMessageToFrame(sm *SignedMessage) string {
 	if sm == nil {
-		return OK + "\n"
+		return EncodeFrame(FrameOK, "")
 	}
-	return sm.Serialize() + "\n"
+	return EncodeFrame(FrameMessage, sm.Serialize())
 }
 
 func WriteSignedMessage(w io.Writer, sm *SignedMessage) {
-	fmt.Fprintf(w, SignedMessageToLine(sm))
+	io.WriteString(w, SignedMessageToFrame(sm))
 }
 
 // ReadSignedMessage can return a nil message even when there is no error.
-// Specifically, a line with just "ok" indicates no message, but also no error.
+// Specifically, an ok frame indicates no message, but also no error.
 // The caller is responsible for setting any deadlines.
 func ReadSignedMessage(r io.Reader) (*SignedMessage, error) {
-	data, err := bufio.NewReader(r).ReadString('\n')
+	return signedMessageFrom(ReadFrame(r))
+}
+
+// signedMessageFrom decodes the signed message in a frame that has been read.
+func signedMessageFrom(frameType byte, payload string, err error) (*SignedMessage, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	// Chop the newline
-	serialized := data[:len(data)-1]
-	if serialized == OK {
+	if frameType == FrameOK {
 		return nil, nil
 	}
-	
-	return NewSignedMessageFromSerialized(serialized)
+	if frameType != FrameMessage {
+		return nil, &DecodeError{Line: payload, Err: ErrUnexpectedFrameType}
+	}
+	sm, err := NewSignedMessageFromSerialized(payload)
+	if err != nil {
+		return nil, &DecodeError{Line: payload, Err: err}
+	}
+	return sm, nil
+}
+
+// A DecodeError is returned when we read a frame that is not a valid signed
+// message, as opposed to failing to read at all.
+type DecodeError struct {
+	// The payload, or just the header if the header was bad
+	Line string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode message: %s", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
 }
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Strkeys are the encoding that Stellar tools use for keys: a version byte,
+// the key, and a CRC16 checksum, all in base32. A public key strkey starts
+// with a G. They are easier to read out loud than base64, and a typo is
+// caught by the checksum.
+
+// The version byte for ed25519 public keys
+const strkeyPublicKeyVersion = byte(6 << 3)
+
+var ErrBadStrkey = errors.New("not a valid public key strkey")
+
+// crc16 is the CRC-16/XMODEM checksum that strkeys use.
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// decodePublicKey decodes a base64 public key, checking its length.
+func decodePublicKey(publicKey PublicKey) ([]byte, error) {
+	pub, err := base64.RawStdEncoding.DecodeString(string(publicKey))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("not a valid base64 public key: %q", publicKey)
+	}
+	return pub, nil
+}
+
+// PublicKeyToStrkey converts a base64 public key to a strkey.
+func PublicKeyToStrkey(publicKey PublicKey) (string, error) {
+	pub, err := decodePublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	data := append([]byte{strkeyPublicKeyVersion}, pub...)
+	crc := crc16(data)
+	data = append(data, byte(crc), byte(crc>>8))
+	return base32.StdEncoding.EncodeToString(data), nil
+}
+
+// PublicKeyFromStrkey converts a strkey to a base64 public key.
+func PublicKeyFromStrkey(strkey string) (PublicKey, error) {
+	data, err := base32.StdEncoding.DecodeString(strkey)
+	if err != nil || len(data) != 1+ed25519.PublicKeySize+2 {
+		return "", ErrBadStrkey
+	}
+	if data[0] != strkeyPublicKeyVersion {
+		return "", ErrBadStrkey
+	}
+	body := data[:len(data)-2]
+	crc := crc16(body)
+	if data[len(data)-2] != byte(crc) || data[len(data)-1] != byte(crc>>8) {
+		return "", fmt.Errorf("%w: bad checksum", ErrBadStrkey)
+	}
+	return PublicKey(base64.RawStdEncoding.EncodeToString(body[1:])), nil
+}
+
+// ParsePublicKey reads a public key in either base64 or strkey form, and
+// returns it in base64, the form that the rest of coinkit uses.
+func ParsePublicKey(s string) (PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if err := PublicKey(s).Validate(); err == nil {
+		return PublicKey(s), nil
+	}
+	if strings.HasPrefix(s, "G") {
+		return PublicKeyFromStrkey(s)
+	}
+	return "", fmt.Errorf("not a base64 or strkey public key: %q", s)
+}
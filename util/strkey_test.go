@@ -0,0 +1,51 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStrkeyKnownValue(t *testing.T) {
+	zero := PublicKey(strings.Repeat("A", 43))
+	strkey, err := PublicKeyToStrkey(zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strkey != "GAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAWHF" {
+		t.Fatalf("bad strkey for the zero key: %s", strkey)
+	}
+}
+
+func TestStrkeyRoundTrip(t *testing.T) {
+	kp := NewKeyPairFromSecretPhrase("monkey")
+	strkey, err := PublicKeyToStrkey(kp.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(strkey, "G") {
+		t.Fatalf("public key strkeys should start with G: %s", strkey)
+	}
+	for _, s := range []string{strkey, string(kp.PublicKey()), " " + strkey + "\n"} {
+		publicKey, err := ParsePublicKey(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publicKey != kp.PublicKey() {
+			t.Fatalf("%q parsed to the wrong key", s)
+		}
+	}
+
+	// A typo should fail the checksum
+	typo := []byte(strkey)
+	if typo[10] == 'A' {
+		typo[10] = 'B'
+	} else {
+		typo[10] = 'A'
+	}
+	if _, err := PublicKeyFromStrkey(string(typo)); err == nil {
+		t.Fatal("a strkey with a typo should not parse")
+	}
+	if _, err := ParsePublicKey("garbagekey"); err == nil {
+		t.Fatal("garbage should not parse")
+	}
+}